@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Obtains and renews certificates from an ACME CA such as Let's Encrypt, if hosts have been configured for
+// it; nil otherwise
+var acmeManager *autocert.Manager
+
+func acmeEnabled(c Config) bool {
+	return len(c.ACME.Host) > 0
+}
+
+func validateAcmeConfig(c Config) error {
+	if !acmeEnabled(c) {
+		return nil
+	}
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		return errors.New("ACME may not be combined with certFile or keyFile")
+	}
+	if c.TLS.ClientCaFile != "" {
+		// Public CAs don't issue certificates that a private client CA would accept for health checks, and
+		// the CA's validation requests carry no client certificate
+		return errors.New("ACME may not be combined with clientCaFile")
+	}
+	if c.ACME.CacheDir == "" {
+		return errors.New("ACME requires cacheDir, so that certificates aren't requested again each time the relay starts")
+	}
+	port := c.Main.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	if c.ACME.HttpPort != 0 && c.ACME.HttpPort == port {
+		return errors.New("ACME httpPort must be different from the relay's port")
+	}
+	return nil
+}
+
+func newAcmeManager(c Config) *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.ACME.Host...),
+		Cache:      autocert.DirCache(c.ACME.CacheDir),
+		Email:      c.ACME.Email,
+	}
+	if c.ACME.DirectoryUrl != "" {
+		manager.Client = &acme.Client{DirectoryURL: c.ACME.DirectoryUrl, UserAgent: "LDRelay/" + Version}
+	}
+	return manager
+}
+
+// Returns the TLS configuration for a listener whose certificates come from the ACME manager. The manager
+// answers TLS-ALPN-01 challenges on the same listener.
+func makeAcmeTLSConfig(manager *autocert.Manager) *tls.Config {
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	return tlsConfig
+}
+
+// Answers HTTP-01 challenges on httpPort, if one is configured, and redirects every other request there to
+// HTTPS. This runs alongside the relay's main listener, and failing to start it only prevents HTTP-01
+// validation, so it is logged rather than treated as fatal.
+func startAcmeHttpListener(c Config, manager *autocert.Manager) {
+	if c.ACME.HttpPort == 0 {
+		return
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(listenHost(c), fmt.Sprint(c.ACME.HttpPort)))
+	if err != nil {
+		Error.Printf("Unable to answer ACME HTTP challenges on port %d: %s", c.ACME.HttpPort, err)
+		return
+	}
+	Info.Printf("Answering ACME HTTP challenges on port %d", c.ACME.HttpPort)
+	go func() {
+		if err := http.Serve(listener, manager.HTTPHandler(nil)); err != nil {
+			Error.Printf("ACME HTTP listener stopped: %s", err)
+		}
+	}()
+}
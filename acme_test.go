@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme"
+)
+
+func TestValidateAcmeConfig(t *testing.T) {
+	makeConfig := func() Config {
+		var c Config
+		c.ACME.Host = []string{"relay.example.com"}
+		c.ACME.CacheDir = "/var/cache/ld-relay"
+		return c
+	}
+
+	assert.NoError(t, validateAcmeConfig(Config{}))
+	assert.NoError(t, validateAcmeConfig(makeConfig()))
+
+	c := makeConfig()
+	c.ACME.HttpPort = 80
+	assert.NoError(t, validateAcmeConfig(c))
+
+	c = makeConfig()
+	c.ACME.HttpPort = defaultPort
+	assert.Error(t, validateAcmeConfig(c))
+
+	c = makeConfig()
+	c.ACME.CacheDir = ""
+	assert.Error(t, validateAcmeConfig(c))
+
+	c = makeConfig()
+	c.TLS.CertFile = "cert.pem"
+	assert.Error(t, validateAcmeConfig(c))
+
+	c = makeConfig()
+	c.TLS.ClientCaFile = "ca.pem"
+	assert.Error(t, validateAcmeConfig(c))
+}
+
+func TestAcmeTLSConfigServesCachedCertificatesForConfiguredHosts(t *testing.T) {
+	cacheDir, _ := ioutil.TempDir("", "acme")
+	defer os.RemoveAll(cacheDir)
+
+	// A certificate obtained earlier, as the manager caches it
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "relay.example.com"},
+		DNSNames:     []string{"relay.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	cached := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(cacheDir, "relay.example.com"), cached, 0600))
+
+	var c Config
+	c.ACME.Host = []string{"relay.example.com"}
+	c.ACME.CacheDir = cacheDir
+	acmeManager = newAcmeManager(c)
+	defer func() { acmeManager = nil }()
+
+	assert.True(t, tlsEnabled(c))
+	tlsConfig, err := makeTLSConfig(c)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, tlsConfig.NextProtos, acme.ALPNProto)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+
+	hello := func(serverName string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:       serverName,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		}
+	}
+	cert, err := tlsConfig.GetCertificate(hello("relay.example.com"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, der, cert.Certificate[0])
+	}
+	_, err = tlsConfig.GetCertificate(hello("other.example.com"))
+	assert.Error(t, err)
+}
+
+func TestHealthcheckUsesAcmeHostName(t *testing.T) {
+	var c Config
+	c.ACME.Host = []string{"relay.example.com", "relay2.example.com"}
+	c.ACME.CacheDir = "/var/cache/ld-relay"
+	uri, client, err := localStatusClient(c)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://localhost:8030/status", uri)
+		assert.Equal(t, "relay.example.com", client.Transport.(*http.Transport).TLSClientConfig.ServerName)
+	}
+}
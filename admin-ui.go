@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const adminUIRecentChanges = 50
+
+// How long an operator can turn on debug logging for from the UI
+var adminUIDebugTtls = []string{"15m", "1h", "4h", "24h"}
+
+type adminUIEnvironment struct {
+	Name          string
+	SdkKey        string
+	Status        string
+	Connections   int
+	ReconnectRate string
+}
+
+type adminUIChange struct {
+	flagChange
+	Environment string
+}
+
+type adminUIPage struct {
+	Version      string
+	Environments []adminUIEnvironment
+	Changes      []adminUIChange
+	LogLevel     string
+	LogLevels    []string
+	DebugTtls    []string
+	Debug        map[string]debugSetting
+	CSRFToken    string
+	Message      string
+}
+
+// Registers a small web UI for operators, served at /internal/ui. Actions are performed by posting forms
+// back to the UI, which must carry a token from the page to guard against cross-site requests.
+func (r *relay) registerAdminUI(router *mux.Router) {
+	tokenBytes := make([]byte, 16)
+	rand.Read(tokenBytes)
+	csrfToken := hex.EncodeToString(tokenBytes)
+
+	router.HandleFunc("/ui", func(w http.ResponseWriter, req *http.Request) {
+		r.renderAdminUI(w, csrfToken, req.URL.Query().Get("message"))
+	}).Methods("GET")
+
+	action := func(perform func(req *http.Request) string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(req.PostFormValue("csrf")), []byte(csrfToken)) != 1 {
+				writeError(w, req, http.StatusForbidden, "Invalid or missing form token")
+				return
+			}
+			message := perform(req)
+			http.Redirect(w, req, adminPathPrefix+"/ui?message="+template.URLQueryEscaper(message), http.StatusSeeOther)
+		}
+	}
+
+	router.HandleFunc("/ui/resync", action(func(req *http.Request) string {
+		name := req.PostFormValue("env")
+		clientCtx := r.findEnvironment(name)
+		if clientCtx == nil {
+			return "Unknown environment " + name
+		}
+		Info.Printf("Resyncing environment %s at operator request", name)
+		clientCtx.resync()
+		return "Resyncing " + name
+	})).Methods("POST")
+
+	router.HandleFunc("/ui/restart", action(func(req *http.Request) string {
+		Warning.Println("Restarting relay at operator request")
+		go func() {
+			// Give the redirect a moment to reach the browser before the process is replaced
+			time.Sleep(500 * time.Millisecond)
+			if err := restartProcess(); err != nil {
+				Error.Printf("Unable to restart relay: %s", err)
+			}
+		}()
+		return "Restarting relay"
+	})).Methods("POST")
+
+	router.HandleFunc("/ui/loglevel", action(func(req *http.Request) string {
+		level := req.PostFormValue("level")
+		ttl, _ := time.ParseDuration(req.PostFormValue("ttl"))
+		if err := setLogLevelWithTtl(level, ttl); err != nil {
+			return err.Error()
+		}
+		if setting, ok := getDebugFeatures()["logLevel"]; ok {
+			return "Log level set to " + level + " until " + setting.Expires.Format("15:04:05")
+		}
+		return "Log level set to " + level
+	})).Methods("POST")
+}
+
+func (r *relay) renderAdminUI(w http.ResponseWriter, csrfToken string, message string) {
+	page := adminUIPage{
+		Version:   Version,
+		LogLevel:  getLogLevel(),
+		LogLevels: logLevels,
+		DebugTtls: adminUIDebugTtls,
+		Debug:     getDebugFeatures(),
+		CSRFToken: csrfToken,
+		Message:   message,
+	}
+
+	for _, clientCtx := range r.allEnvironments() {
+		env := adminUIEnvironment{
+			Name:        clientCtx.name,
+			SdkKey:      obscureKey(clientCtx.sdkKey),
+			Status:      clientCtx.connectionStatus(),
+			Connections: clientCtx.getMetrics().getActiveStreams(),
+		}
+		if stats := clientCtx.getMetrics().getConnectionStats(); stats.Connects > 0 {
+			env.ReconnectRate = fmt.Sprintf("%.0f%%", stats.ReconnectRate*100)
+		}
+		page.Environments = append(page.Environments, env)
+
+		if clientCtx.changes != nil {
+			for _, change := range clientCtx.changes.recent() {
+				page.Changes = append(page.Changes, adminUIChange{flagChange: change, Environment: clientCtx.name})
+			}
+		}
+	}
+	sort.SliceStable(page.Changes, func(i, j int) bool { return page.Changes[i].Time.After(page.Changes[j].Time) })
+	if len(page.Changes) > adminUIRecentChanges {
+		page.Changes = page.Changes[:adminUIRecentChanges]
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	if err := adminUITemplate.Execute(w, page); err != nil {
+		Error.Printf("Error rendering admin UI: %s", err)
+	}
+}
+
+var adminUITemplate = template.Must(template.New("ui").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>LaunchDarkly Relay</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.3em 1em; border-bottom: 1px solid #ddd; }
+.connected { color: #080; }
+.disconnected { color: #b00; }
+.initializing { color: #a60; }
+.message { background: #eef; padding: 0.5em 1em; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>LaunchDarkly Relay {{.Version}}</h1>
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+
+<h2>Environments</h2>
+<table>
+<tr><th>Name</th><th>SDK key</th><th>Status</th><th>Stream connections</th><th>Reconnects (5m)</th><th></th></tr>
+{{range .Environments}}
+<tr>
+<td>{{.Name}}</td>
+<td><code>{{.SdkKey}}</code></td>
+<td class="{{.Status}}">{{.Status}}</td>
+<td>{{.Connections}}</td>
+<td>{{.ReconnectRate}}</td>
+<td><form method="post" action="ui/resync"><input type="hidden" name="csrf" value="{{$.CSRFToken}}"><input type="hidden" name="env" value="{{.Name}}"><button>Resync</button></form></td>
+</tr>
+{{end}}
+</table>
+
+<h2>Recent flag changes</h2>
+{{if .Changes}}
+<table>
+<tr><th>Time</th><th>Environment</th><th>Kind</th><th>Key</th><th>Version</th><th></th></tr>
+{{range .Changes}}
+<tr>
+<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.Environment}}</td>
+<td>{{.Kind}}</td>
+<td>{{.Key}}</td>
+<td>{{if .Version}}{{.Version}}{{end}}</td>
+<td>{{if .Deleted}}deleted{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No changes received yet.</p>
+{{end}}
+
+<h2>Operations</h2>
+{{range $name, $setting := .Debug}}<p>Debug setting {{$name}}={{$setting.Value}} is on until {{$setting.Expires.Format "2006-01-02 15:04:05"}}</p>
+{{end}}<p>
+<form method="post" action="ui/loglevel">
+<input type="hidden" name="csrf" value="{{.CSRFToken}}">
+Log level
+<select name="level">{{range .LogLevels}}<option{{if eq . $.LogLevel}} selected{{end}}>{{.}}</option>{{end}}</select>
+debug logging reverts after
+<select name="ttl">{{range .DebugTtls}}<option>{{.}}</option>{{end}}</select>
+<button>Set</button>
+</form>
+</p>
+<p>
+<form method="post" action="ui/restart" onsubmit="return confirm('Restart the relay?')">
+<input type="hidden" name="csrf" value="{{.CSRFToken}}">
+<button>Restart relay</button>
+</form>
+</p>
+</body>
+</html>
+`))
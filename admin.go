@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	adminPathPrefix      = "/internal"
+	defaultAdminUsername = "admin"
+)
+
+// Registers the operator-facing endpoints under /internal. None of them are available unless an admin
+// password has been configured.
+func (r *relay) registerAdmin(router *mux.Router) {
+	if r.config.Admin.Password == "" {
+		return
+	}
+
+	adminRouter := router.PathPrefix(adminPathPrefix).Subrouter()
+	adminRouter.Use(r.adminAuthMiddleware)
+
+	adminRouter.HandleFunc("/status", r.sdkClientMux.getDetailedStatus).Methods("GET")
+	adminRouter.Handle("/status/stream", streamHandler{r.statusStream.handler()}).Methods("GET")
+	adminRouter.HandleFunc("/connections", r.getConnectionStats).Methods("GET")
+	r.registerEnvAdmin(adminRouter)
+	adminRouter.HandleFunc("/export/{name}", r.exportEnvironment).Methods("GET")
+	adminRouter.HandleFunc("/import/{name}", r.importEnvironment).Methods("POST")
+	adminRouter.HandleFunc("/inspect/{name}", r.inspectEnvironment).Methods("GET")
+	adminRouter.HandleFunc("/overrides", r.getOverrides).Methods("GET")
+	adminRouter.HandleFunc("/overrides/{name}/{flag}", r.putOverride).Methods("PUT")
+	adminRouter.HandleFunc("/overrides/{name}/{flag}", r.deleteOverride).Methods("DELETE")
+	if r.config.Audit.Enabled {
+		adminRouter.HandleFunc("/audit/keys", getAuditKeys).Methods("GET")
+	}
+
+	if r.config.Admin.EnableUI {
+		r.registerAdminUI(adminRouter)
+	}
+}
+
+// Requires HTTP basic authentication with the configured admin credentials
+func (r *relay) adminAuthMiddleware(next http.Handler) http.Handler {
+	expectedUsername := r.config.Admin.Username
+	if expectedUsername == "" {
+		expectedUsername = defaultAdminUsername
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(r.config.Admin.Password)) != 1 {
+			if ok {
+				// Browsers always try once without credentials, so only wrong credentials are worth recording
+				auditFailure(auditAdminAuthFailure, "", "", req)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="ld-relay"`)
+			writeError(w, req, http.StatusUnauthorized, "Admin credentials are required")
+			return
+		}
+		if status, message := checkAdminRequestSource(req); status != 0 {
+			writeError(w, req, status, message)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Browsers send cached Basic credentials with requests that any other site makes, so a request that changes
+// something must show that it didn't come from a page elsewhere: either its body is JSON, which a cross-site
+// form can't send, or the browser says it came from the relay's own pages. Requests without a body, which a
+// form can't make except as GET, are refused only if the browser says they came from another site. The UI's
+// forms are checked against the UI's own token instead. Returns 0 if the request may go ahead.
+func checkAdminRequestSource(req *http.Request) (int, string) {
+	if req.Method == "GET" || req.Method == "HEAD" || strings.HasPrefix(req.URL.Path, adminPathPrefix+"/ui") {
+		return 0, ""
+	}
+	site := requestSite(req)
+	if site == "cross-site" {
+		return http.StatusForbidden, "Admin requests may not be made from other sites"
+	}
+	if site == "same-origin" || (req.ContentLength == 0 && len(req.TransferEncoding) == 0) {
+		return 0, ""
+	}
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" {
+		return http.StatusUnsupportedMediaType, "Admin requests must have a Content-Type of application/json"
+	}
+	return 0, ""
+}
+
+// Returns "same-origin" or "cross-site" if the browser that sent a request says where it came from, using
+// Sec-Fetch-Site or else Origin, and "" if the request doesn't say, as with clients other than browsers
+func requestSite(req *http.Request) string {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return "same-origin"
+	case "same-site", "cross-site":
+		return "cross-site"
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return ""
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host != "" && u.Host == req.Host {
+		return "same-origin"
+	}
+	return "cross-site"
+}
+
+// Reports stream connection, disconnection and reconnection counts for each environment
+func (r *relay) getConnectionStats(w http.ResponseWriter, req *http.Request) {
+	filter, err := tagFilterFromRequest(req)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	stats := make(map[string]connectionStats)
+	for _, clientCtx := range r.allEnvironments() {
+		if filter.matches(clientCtx.tags) {
+			envStats := clientCtx.getMetrics().getConnectionStats()
+			envStats.Tags = clientCtx.tags
+			if clientCtx.replays != nil {
+				replays := clientCtx.replays.stats()
+				envStats.Replays = &replays
+			}
+			stats[clientCtx.name] = envStats
+		}
+	}
+	data, _ := json.Marshal(stats)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Returns every environment's context, sorted by name
+func (r *relay) allEnvironments() []*clientContextImpl {
+	return r.envs.all()
+}
+
+func (r *relay) findEnvironment(name string) *clientContextImpl {
+	return r.envs.named(name)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func makeAdminTestRelay(enableUI bool) *relay {
+	config := Config{Environment: map[string]*EnvConfig{
+		"env1": {SdkKey: "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"},
+	}}
+	config.Admin.Password = "secret"
+	config.Admin.EnableUI = enableUI
+	return makeTestRelay(config)
+}
+
+func TestAdminEndpointsRequireCredentials(t *testing.T) {
+	handler := makeAdminTestRelay(true).getHandler()
+
+	specs := []struct {
+		name           string
+		username       string
+		password       string
+		expectedStatus int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", "admin", "wrong", http.StatusUnauthorized},
+		{"wrong username", "someone", "secret", http.StatusUnauthorized},
+		{"valid credentials", "admin", "secret", http.StatusOK},
+	}
+
+	for _, path := range []string{"/internal/ui", "/internal/status"} {
+		for _, s := range specs {
+			t.Run(path+" "+s.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				r, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+				if s.username != "" {
+					r.SetBasicAuth(s.username, s.password)
+				}
+				handler.ServeHTTP(w, r)
+				assert.Equal(t, s.expectedStatus, w.Result().StatusCode)
+			})
+		}
+	}
+}
+
+func TestAdminUIIsDisabledByDefault(t *testing.T) {
+	handler := makeAdminTestRelay(false).getHandler()
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost/internal/ui", nil)
+	r.SetBasicAuth("admin", "secret")
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestAdminUI(t *testing.T) {
+	defer setLogLevelWithTtl("info", 0)
+	handler := makeAdminTestRelay(true).getHandler()
+
+	getPage := func() string {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost/internal/ui", nil)
+		r.SetBasicAuth("admin", "secret")
+		handler.ServeHTTP(w, r)
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		return string(body)
+	}
+	post := func(path string, form url.Values) *http.Response {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://localhost/internal/ui/"+path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("admin", "secret")
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	page := getPage()
+	assert.Contains(t, page, "env1")
+	assert.Contains(t, page, "sdk-********-****-****-****-*******e42d0")
+	match := regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`).FindStringSubmatch(page)
+	if !assert.NotNil(t, match) {
+		return
+	}
+	csrf := match[1]
+
+	t.Run("actions require the form token", func(t *testing.T) {
+		resp := post("loglevel", url.Values{"level": {"debug"}})
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, "info", getLogLevel())
+	})
+
+	t.Run("set log level", func(t *testing.T) {
+		resp := post("loglevel", url.Values{"level": {"debug"}, "csrf": {csrf}})
+		assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		assert.Equal(t, "debug", getLogLevel())
+	})
+
+	t.Run("resync unknown environment", func(t *testing.T) {
+		resp := post("resync", url.Values{"env": {"nope"}, "csrf": {csrf}})
+		if assert.Equal(t, http.StatusSeeOther, resp.StatusCode) {
+			assert.Contains(t, resp.Header.Get("Location"), "Unknown+environment")
+		}
+	})
+}
+
+func TestResyncsAreSerialized(t *testing.T) {
+	config := Config{Environment: map[string]*EnvConfig{
+		"env1": {SdkKey: "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"},
+	}}
+	var connecting, maxConnecting, connections int32
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		n := atomic.AddInt32(&connecting, 1)
+		defer atomic.AddInt32(&connecting, -1)
+		for {
+			max := atomic.LoadInt32(&maxConnecting)
+			if n <= max || atomic.CompareAndSwapInt32(&maxConnecting, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		config.FeatureStore.Init(nil)
+		atomic.AddInt32(&connections, 1)
+		return FakeLDClient{true}, nil
+	})
+	clientCtx := relay.findEnvironment("env1")
+	defer clientCtx.close()
+
+	for i := 0; i < 3; i++ {
+		clientCtx.resync()
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&connections) < 4 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&connections))
+	// The first connection, made at startup, may overlap with a resync; the resyncs never overlap each other
+	assert.True(t, atomic.LoadInt32(&maxConnecting) <= 2)
+}
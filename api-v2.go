@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const apiV2Prefix = "/api/v2"
+
+const (
+	apiAuthSdkKey    = "sdkKey"
+	apiAuthMobileKey = "mobileKey"
+)
+
+// apiV2Route describes one endpoint of the versioned API. The same definitions are used both to register
+// the routes and to generate the OpenAPI document, so the two can't drift apart.
+type apiV2Route struct {
+	method      string
+	path        string
+	operationId string
+	summary     string
+	auth        []string
+	clientSide  bool
+	requestBody string
+	// The group of endpoints the route belongs to, which may be turned off in the [endpoints] section
+	group string
+	// Optional query parameters, which may each be given more than once, by name and description
+	queryParams map[string]string
+	responses   map[int]apiV2Response
+	handler     http.HandlerFunc
+}
+
+type apiV2Response struct {
+	description string
+	schema      string
+}
+
+var apiV2ErrorResponses = map[int]apiV2Response{
+	http.StatusBadRequest:         {"The user is missing or invalid", "Error"},
+	http.StatusServiceUnavailable: {"The environment has not been initialized", "Error"},
+}
+
+func (r *relay) apiV2Routes() []apiV2Route {
+	evalResponses := map[int]apiV2Response{
+		http.StatusOK: {"Evaluation results for every flag, keyed by flag key", "EvaluationResults"},
+	}
+	for status, resp := range apiV2ErrorResponses {
+		evalResponses[status] = resp
+	}
+	authEvalResponses := map[int]apiV2Response{
+		http.StatusUnauthorized: {"The key is not configured for any environment", "Error"},
+	}
+	for status, resp := range evalResponses {
+		authEvalResponses[status] = resp
+	}
+
+	return []apiV2Route{
+		{
+			method:      "GET",
+			path:        "/status",
+			operationId: "getStatus",
+			summary:     "Returns the connection status of every environment",
+			queryParams: map[string]string{"tag": "Only include environments with this tag, given as key:value or just a key"},
+			responses:   map[int]apiV2Response{http.StatusOK: {"Relay status", "Status"}, http.StatusBadRequest: {"A tag filter is invalid", "Error"}},
+			group:       endpointsStatus,
+			handler:     r.sdkClientMux.getStatus,
+		},
+		{
+			method:      "POST",
+			path:        "/flags/evaluate",
+			operationId: "evaluateFlags",
+			summary:     "Evaluates all flags for a user, using an SDK key or mobile key",
+			auth:        []string{apiAuthSdkKey, apiAuthMobileKey},
+			requestBody: "User",
+			responses:   authEvalResponses,
+			group:       endpointsServerEval,
+			handler:     evaluateAllFeatureFlags,
+		},
+		{
+			method:      "POST",
+			path:        "/environments/{envId}/flags/evaluate",
+			operationId: "evaluateClientSideFlags",
+			summary:     "Evaluates all client-side flags for a user, using a client-side ID",
+			clientSide:  true,
+			requestBody: "User",
+			responses:   evalResponses,
+			group:       endpointsClientSide,
+			handler:     evaluateAllFeatureFlags,
+		},
+	}
+}
+
+// Registers the versioned API. Routes in groups that the policy doesn't serve are left out, along with their
+// descriptions in the OpenAPI document.
+func (r *relay) registerApiV2(router *mux.Router, policy endpointPolicy) {
+	var routes []apiV2Route
+	for _, route := range r.apiV2Routes() {
+		if policy.serves(route.group) {
+			routes = append(routes, route)
+		}
+	}
+	apiRouter := router.PathPrefix(apiV2Prefix).Subrouter()
+
+	spec, _ := json.Marshal(makeOpenApiSpec(routes))
+	apiRouter.HandleFunc("/openapi.json", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}).Methods("GET")
+
+	clientSideMiddlewareStack := chainMiddleware(corsMiddleware, r.clientSideMux.selectClientByUrlParam)
+	evalBodyLimit := limitBodySize(r.config.Main.MaxEvalBodyBytes)
+	for _, route := range routes {
+		var handler http.Handler = route.handler
+		if route.requestBody != "" {
+			handler = evalBodyLimit(handler)
+		}
+		methods := []string{route.method}
+		switch {
+		case route.clientSide:
+			handler = clientSideMiddlewareStack(r.privacy.middleware(handler))
+			methods = append(methods, "OPTIONS")
+		case len(route.auth) > 0:
+			handler = r.selectClientByAnyKey(handler)
+		}
+		apiRouter.Handle(route.path, handler).Methods(methods...)
+	}
+}
+
+// Like ClientMux.selectClientByAuthorizationKey, but accepts either an SDK key or a mobile key
+func (r *relay) selectClientByAnyKey(next http.Handler) http.Handler {
+	sdkHandler := r.sdkClientMux.selectClientByAuthorizationKey(next)
+	mobileHandler := r.mobileClientMux.selectClientByAuthorizationKey(r.privacy.middleware(next))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authKey, _ := fetchAuthToken(req)
+		if r.envs.withMobileKey(authKey) != nil {
+			mobileHandler.ServeHTTP(w, req)
+			return
+		}
+		sdkHandler.ServeHTTP(w, req)
+	})
+}
+
+var apiV2PathParam = regexp.MustCompile(`{([^}]+)}`)
+
+func makeOpenApiSpec(routes []apiV2Route) map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	for _, route := range routes {
+		operation := map[string]interface{}{
+			"operationId": route.operationId,
+			"summary":     route.summary,
+		}
+
+		var params []interface{}
+		for _, match := range apiV2PathParam.FindAllStringSubmatch(route.path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		queryParamNames := make([]string, 0, len(route.queryParams))
+		for name := range route.queryParams {
+			queryParamNames = append(queryParamNames, name)
+		}
+		sort.Strings(queryParamNames)
+		for _, name := range queryParamNames {
+			params = append(params, map[string]interface{}{
+				"name":        name,
+				"in":          "query",
+				"description": route.queryParams[name],
+				"schema":      map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if route.requestBody != "" {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(route.requestBody),
+			}
+		}
+
+		responses := make(map[string]interface{})
+		for status, resp := range route.responses {
+			responses[strconv.Itoa(status)] = map[string]interface{}{
+				"description": resp.description,
+				"content":     jsonContent(resp.schema),
+			}
+		}
+		operation["responses"] = responses
+
+		if len(route.auth) > 0 {
+			var security []interface{}
+			for _, scheme := range route.auth {
+				security = append(security, map[string]interface{}{scheme: []string{}})
+			}
+			operation["security"] = security
+		}
+
+		path := apiV2Prefix + route.path
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(route.method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "LaunchDarkly Relay Proxy",
+			"version": Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				apiAuthSdkKey:    map[string]interface{}{"type": "apiKey", "in": "header", "name": "Authorization"},
+				apiAuthMobileKey: map[string]interface{}{"type": "apiKey", "in": "header", "name": "Authorization"},
+			},
+			"schemas": apiV2Schemas,
+		},
+	}
+}
+
+func jsonContent(schema string) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": map[string]interface{}{"$ref": "#/components/schemas/" + schema},
+		},
+	}
+}
+
+var apiV2Schemas = map[string]interface{}{
+	"User": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"key"},
+		"properties": map[string]interface{}{
+			"key":       map[string]interface{}{"type": "string"},
+			"secondary": map[string]interface{}{"type": "string"},
+			"ip":        map[string]interface{}{"type": "string"},
+			"country":   map[string]interface{}{"type": "string"},
+			"email":     map[string]interface{}{"type": "string"},
+			"firstName": map[string]interface{}{"type": "string"},
+			"lastName":  map[string]interface{}{"type": "string"},
+			"avatar":    map[string]interface{}{"type": "string"},
+			"name":      map[string]interface{}{"type": "string"},
+			"anonymous": map[string]interface{}{"type": "boolean"},
+			"custom":    map[string]interface{}{"type": "object"},
+		},
+	},
+	"EvaluationResult": map[string]interface{}{
+		"type":     "object",
+		"required": []string{"value", "version", "trackEvents"},
+		"properties": map[string]interface{}{
+			"value":                map[string]interface{}{},
+			"variation":            map[string]interface{}{"type": "integer"},
+			"version":              map[string]interface{}{"type": "integer"},
+			"trackEvents":          map[string]interface{}{"type": "boolean"},
+			"debugEventsUntilDate": map[string]interface{}{"type": "integer", "format": "int64"},
+		},
+	},
+	"EvaluationResults": map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"$ref": "#/components/schemas/EvaluationResult"},
+	},
+	"EnvironmentStatus": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"sdkKey":    map[string]interface{}{"type": "string"},
+			"envId":     map[string]interface{}{"type": "string"},
+			"mobileKey": map[string]interface{}{"type": "string"},
+			"status":    map[string]interface{}{"type": "string", "enum": []string{"connected", "degraded", "initializing", "disconnected"}},
+			"state":     map[string]interface{}{"type": "string", "enum": []string{"initializing", "ready", "failed"}},
+			"tags":      map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}},
+		},
+	},
+	"Status": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"status": map[string]interface{}{"type": "string", "enum": []string{"healthy", "degraded"}},
+			"environments": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": map[string]interface{}{"$ref": "#/components/schemas/EnvironmentStatus"},
+			},
+			"relayId": map[string]interface{}{"type": "string"},
+			"parentRelay": map[string]interface{}{
+				"description": "The relay this relay gets its data from, if it is chained to another relay",
+				"type":        "object",
+				"properties": map[string]interface{}{
+					"relayIds": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				},
+			},
+		},
+	},
+	"Error": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"code":      map[string]interface{}{"type": "string"},
+			"message":   map[string]interface{}{"type": "string"},
+			"requestId": map[string]interface{}{"type": "string"},
+		},
+	},
+}
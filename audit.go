@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Events are sent to the webhook in the background; if it falls this far behind, further events are
+	// dropped rather than holding up requests
+	auditQueueSize      = 1000
+	auditWebhookTimeout = 10 * time.Second
+	// The most unrecognized keys whose usage is remembered, so that a client trying random keys can't use up
+	// memory
+	maxAuditedUnknownKeys = 10000
+)
+
+// Kinds of audit event
+const (
+	auditMissingKey        = "missingKey"
+	auditUnknownKey        = "unknownKey"
+	auditUnknownEnvId      = "unknownEnvironmentId"
+	auditCertificateDenied = "certificateDenied"
+	auditAdminAuthFailure  = "adminAuthFailure"
+)
+
+// Records authorization failures and key usage, if auditing is enabled; nil otherwise
+var auditor *auditLog
+
+// auditLog keeps a record of every authorization failure, written to the audit log file and webhook, and
+// counts the requests made with each key, so that operators can spot leaked keys or misconfigured clients
+type auditLog struct {
+	out        io.Writer
+	webhookUrl string
+	client     *http.Client
+	queue      chan auditEvent
+	mu         sync.Mutex
+	keys       map[[sha256.Size]byte]*keyUsage
+	// The hashes of the keys that aren't configured for any environment, most recently seen first, so that
+	// the least recently seen can be forgotten to make room for another
+	unknown *list.List
+}
+
+type auditEvent struct {
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ClientIp    string    `json:"clientIp"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	RequestId   string    `json:"requestId,omitempty"`
+}
+
+// keyUsage describes how one key has been used. Keys are only held in obscured form, and are looked up by
+// their hash.
+type keyUsage struct {
+	Key         string    `json:"key"`
+	KeyType     string    `json:"keyType"`
+	Environment string    `json:"environment,omitempty"`
+	Requests    int64     `json:"requests"`
+	Failures    int64     `json:"failures"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	// The key's place in the list of unknown keys, if it is one
+	unknownElement *list.Element
+}
+
+// Creates an audit log that appends events to logFile, or to the relay's warning log if logFile is empty, and
+// also posts them to webhookUrl if that is set
+func newAuditLog(logFile string, webhookUrl string) (*auditLog, error) {
+	a := &auditLog{
+		webhookUrl: webhookUrl,
+		keys:       make(map[[sha256.Size]byte]*keyUsage),
+		unknown:    list.New(),
+	}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.out = f
+	}
+	if webhookUrl != "" {
+		a.client = &http.Client{Timeout: auditWebhookTimeout}
+		a.queue = make(chan auditEvent, auditQueueSize)
+		go a.runWebhook()
+	}
+	return a, nil
+}
+
+func validateAuditWebhookUrl(webhookUrl string) error {
+	u, err := url.Parse(webhookUrl)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q must be an absolute http or https URL", webhookUrl)
+	}
+	return nil
+}
+
+func (a *auditLog) runWebhook() {
+	for event := range a.queue {
+		data, _ := json.Marshal(event)
+		resp, err := a.client.Post(a.webhookUrl, "application/json", bytes.NewReader(data))
+		if err != nil {
+			Warning.Printf("Unable to send audit event to webhook: %s", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			Warning.Printf("Audit webhook rejected an event with status %d", resp.StatusCode)
+		}
+	}
+}
+
+// Records a failed request. The key, if any, is the credential the client presented.
+func (a *auditLog) failure(kind string, key string, envName string, req *http.Request) {
+	now := time.Now()
+	if key != "" {
+		a.mu.Lock()
+		a.usageLocked(key, envName, now).Failures++
+		a.mu.Unlock()
+	}
+
+	event := auditEvent{
+		Time:        now.UTC(),
+		Kind:        kind,
+		Environment: envName,
+		RemoteAddr:  req.RemoteAddr,
+		ClientIp:    clientIp(req),
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		UserAgent:   req.UserAgent(),
+		RequestId:   requestId(req),
+	}
+	if key != "" {
+		event.Key = obscureKey(key)
+	}
+	data, _ := json.Marshal(event)
+	if a.out != nil {
+		a.out.Write(append(data, '\n'))
+	} else {
+		Warning.Printf("AUDIT: %s", data)
+	}
+	if a.queue != nil {
+		select {
+		case a.queue <- event:
+		default:
+		}
+	}
+}
+
+// Records a request that was authorized with the given key
+func (a *auditLog) use(key string, envName string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.usageLocked(key, envName, time.Now()).Requests++
+}
+
+// Finds or starts the usage record for a key. If there are already too many unknown keys, the one seen least
+// recently is forgotten to make room for a new one. The caller must hold the lock.
+func (a *auditLog) usageLocked(key string, envName string, now time.Time) *keyUsage {
+	hash := sha256.Sum256([]byte(key))
+	usage := a.keys[hash]
+	if usage == nil {
+		usage = &keyUsage{Key: obscureKey(key), KeyType: keyType(key), Environment: envName, FirstSeen: now.UTC()}
+		a.keys[hash] = usage
+		if envName == "" {
+			if a.unknown.Len() >= maxAuditedUnknownKeys {
+				oldest := a.unknown.Back()
+				delete(a.keys, a.unknown.Remove(oldest).([sha256.Size]byte))
+			}
+			usage.unknownElement = a.unknown.PushFront(hash)
+		}
+	} else if usage.unknownElement != nil {
+		if envName != "" {
+			// The key has since been configured for an environment, so it is no longer at risk of being forgotten
+			usage.Environment = envName
+			a.unknown.Remove(usage.unknownElement)
+			usage.unknownElement = nil
+		} else {
+			a.unknown.MoveToFront(usage.unknownElement)
+		}
+	}
+	usage.LastSeen = now.UTC()
+	return usage
+}
+
+// Returns the usage of every key seen, most recently used first
+func (a *auditLog) keyUsage() []keyUsage {
+	a.mu.Lock()
+	result := make([]keyUsage, 0, len(a.keys))
+	for _, usage := range a.keys {
+		result = append(result, *usage)
+	}
+	a.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].LastSeen.After(result[j].LastSeen) })
+	return result
+}
+
+func keyType(key string) string {
+	switch {
+	case strings.HasPrefix(key, "sdk-"):
+		return "sdk"
+	case strings.HasPrefix(key, "mob-"):
+		return "mobile"
+	default:
+		return "clientSide"
+	}
+}
+
+// Records an authorization failure. Does nothing unless auditing is enabled.
+func auditFailure(kind string, key string, envName string, req *http.Request) {
+	if auditor != nil {
+		auditor.failure(kind, key, envName, req)
+	}
+}
+
+// Records a request authorized with a key. Does nothing unless auditing is enabled.
+func auditKeyUse(key string, envName string) {
+	if auditor != nil {
+		auditor.use(key, envName)
+	}
+}
+
+// Lists how each key has been used
+func getAuditKeys(w http.ResponseWriter, req *http.Request) {
+	var usage []keyUsage
+	if auditor != nil {
+		usage = auditor.keyUsage()
+	}
+	data, _ := json.Marshal(usage)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeAuditTestRelay(t *testing.T, logFile string, webhookUrl string) *relay {
+	var err error
+	auditor, err = newAuditLog(logFile, webhookUrl)
+	assert.NoError(t, err)
+
+	config := Config{Environment: map[string]*EnvConfig{
+		"env1": {SdkKey: "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"},
+	}}
+	config.Admin.Password = "secret"
+	config.Audit.Enabled = true
+	relay := makeTestRelay(config)
+	deadline := time.Now().Add(time.Second)
+	for !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return relay
+}
+
+func makeAuditTestRequest(handler http.Handler, authKey string) int {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("REPORT", "http://localhost/sdk/eval/user", nil)
+	req.Header.Set("Authorization", authKey)
+	req.Header.Set("User-Agent", "TestClient/1.0")
+	handler.ServeHTTP(w, req)
+	return w.Result().StatusCode
+}
+
+func TestAuthorizationFailuresAreLogged(t *testing.T) {
+	logFile, _ := ioutil.TempFile("", "ld-relay-audit")
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+	handler := makeAuditTestRelay(t, logFile.Name(), "").getHandler()
+	defer func() { auditor = nil }()
+
+	assert.Equal(t, http.StatusUnauthorized, makeAuditTestRequest(handler, "sdk-11111111-2222-4333-8444-555555555555"))
+	assert.Equal(t, http.StatusUnauthorized, makeAuditTestRequest(handler, "not a key"))
+	makeAuditTestRequest(handler, "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0")
+
+	f, _ := os.Open(logFile.Name())
+	defer f.Close()
+	var events []auditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event auditEvent
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, auditUnknownKey, events[0].Kind)
+		assert.Equal(t, "sdk-********-****-****-****-*******55555", events[0].Key)
+		assert.Equal(t, "/sdk/eval/user", events[0].Path)
+		assert.Equal(t, "TestClient/1.0", events[0].UserAgent)
+		assert.Equal(t, auditMissingKey, events[1].Kind)
+		assert.Empty(t, events[1].Key)
+	}
+}
+
+func TestAuthorizationFailuresAreSentToWebhook(t *testing.T) {
+	received := make(chan auditEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event auditEvent
+		json.NewDecoder(req.Body).Decode(&event)
+		received <- event
+	}))
+	defer webhook.Close()
+	handler := makeAuditTestRelay(t, os.DevNull, webhook.URL).getHandler()
+	defer func() { auditor = nil }()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/internal/audit/keys", nil)
+	req.SetBasicAuth("admin", "wrong")
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	select {
+	case event := <-received:
+		assert.Equal(t, auditAdminAuthFailure, event.Kind)
+		assert.Equal(t, "/internal/audit/keys", event.Path)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for webhook")
+	}
+}
+
+func TestKeyUsageIsReported(t *testing.T) {
+	handler := makeAuditTestRelay(t, os.DevNull, "").getHandler()
+	defer func() { auditor = nil }()
+
+	makeAuditTestRequest(handler, "sdk-11111111-2222-4333-8444-555555555555")
+	makeAuditTestRequest(handler, "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0")
+	makeAuditTestRequest(handler, "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/internal/audit/keys", nil)
+	req.SetBasicAuth("admin", "secret")
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var usage []keyUsage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	if assert.Len(t, usage, 2) {
+		known, unknown := usage[0], usage[1]
+		assert.Equal(t, "sdk-********-****-****-****-*******e42d0", known.Key)
+		assert.Equal(t, "sdk", known.KeyType)
+		assert.Equal(t, "env1", known.Environment)
+		assert.Equal(t, int64(2), known.Requests)
+		assert.Equal(t, int64(0), known.Failures)
+		assert.False(t, known.FirstSeen.After(known.LastSeen))
+
+		assert.Equal(t, "sdk-********-****-****-****-*******55555", unknown.Key)
+		assert.Empty(t, unknown.Environment)
+		assert.Equal(t, int64(0), unknown.Requests)
+		assert.Equal(t, int64(1), unknown.Failures)
+	}
+}
+
+func TestLeastRecentlySeenUnknownKeysAreForgotten(t *testing.T) {
+	a, _ := newAuditLog(os.DevNull, "")
+	unknownKey := func(i int) string {
+		return fmt.Sprintf("sdk-%08d-2222-4333-8444-555555555555", i)
+	}
+	for i := 0; i < maxAuditedUnknownKeys; i++ {
+		a.use(unknownKey(i), "")
+	}
+	a.use(unknownKey(0), "")
+	a.use(unknownKey(maxAuditedUnknownKeys), "")
+
+	assert.Equal(t, maxAuditedUnknownKeys, a.unknown.Len())
+	assert.Len(t, a.keys, maxAuditedUnknownKeys)
+	assert.Contains(t, a.keys, sha256.Sum256([]byte(unknownKey(0))))
+	assert.NotContains(t, a.keys, sha256.Sum256([]byte(unknownKey(1))))
+	assert.Contains(t, a.keys, sha256.Sum256([]byte(unknownKey(maxAuditedUnknownKeys))))
+
+	// A key that has been configured since no longer takes up room for unknown keys
+	a.use(unknownKey(0), "env1")
+	assert.Equal(t, maxAuditedUnknownKeys-1, a.unknown.Len())
+	assert.Equal(t, "env1", a.keys[sha256.Sum256([]byte(unknownKey(0)))].Environment)
+}
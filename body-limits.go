@@ -0,0 +1,92 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultMaxEvalBodyBytes  = 1 << 20
+	defaultMaxEventBodyBytes = 10 << 20
+)
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+// limitedBody wraps a request body so that reading more than a given number of bytes fails with
+// errBodyTooLarge. Gzipped bodies are decompressed, and the limit applies to both the compressed and the
+// decompressed data, so a small payload can't expand to fill the relay's memory.
+type limitedBody struct {
+	body    io.ReadCloser
+	reader  io.Reader
+	gzipped bool
+	limit   int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.reader == nil {
+		// The gzip header is read as soon as the gzip reader is created, so we do that on the first read
+		var reader io.Reader = &limitedReader{reader: b.body, limit: b.limit}
+		if b.gzipped {
+			gzipReader, err := gzip.NewReader(reader)
+			if err != nil {
+				return 0, err
+			}
+			reader = &limitedReader{reader: gzipReader, limit: b.limit}
+		}
+		b.reader = reader
+	}
+	return b.reader.Read(p)
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// limitedReader is like io.LimitReader, but fails with errBodyTooLarge rather than stopping quietly
+type limitedReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.limit > 0 && r.read+int64(len(p)) > r.limit+1 {
+		p = p[:r.limit+1-r.read]
+	}
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.limit > 0 && r.read > r.limit {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// Returns middleware that limits request bodies to maxBytes, decompressing them if they are gzipped. A
+// limit of zero means bodies of any size are accepted.
+func limitBodySize(maxBytes int) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Body != nil {
+				gzipped := req.Header.Get("Content-Encoding") == "gzip"
+				if gzipped {
+					req.Header.Del("Content-Encoding")
+				}
+				req.Body = &limitedBody{body: req.Body, gzipped: gzipped, limit: int64(maxBytes)}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// Responds to a failure to read a request body
+func writeBodyReadError(w http.ResponseWriter, req *http.Request, err error) {
+	if err == errBodyTooLarge {
+		writeError(w, req, http.StatusRequestEntityTooLarge, "Request body is too large")
+		return
+	}
+	writeError(w, req, http.StatusBadRequest, "Unable to read request body: "+err.Error())
+}
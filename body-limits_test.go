@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestLimitBodySize(t *testing.T) {
+	echo := limitBodySize(100)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeBodyReadError(w, req, err)
+			return
+		}
+		w.Write(body)
+	}))
+
+	specs := []struct {
+		name           string
+		body           []byte
+		gzipped        bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"within limit", []byte(strings.Repeat("a", 100)), false, http.StatusOK, strings.Repeat("a", 100)},
+		{"over limit", []byte(strings.Repeat("a", 101)), false, http.StatusRequestEntityTooLarge, ""},
+		{"gzipped", gzipBytes([]byte("hello")), true, http.StatusOK, "hello"},
+		{"gzipped over limit when decompressed", gzipBytes(bytes.Repeat([]byte("a"), 1<<20)), true, http.StatusRequestEntityTooLarge, ""},
+		{"invalid gzip", []byte("not gzip"), true, http.StatusBadRequest, ""},
+	}
+
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "http://localhost/bulk", bytes.NewReader(s.body))
+			if s.gzipped {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			echo.ServeHTTP(w, req)
+			assert.Equal(t, s.expectedStatus, w.Result().StatusCode)
+			if s.expectedBody != "" {
+				assert.Equal(t, s.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRelayRejectsOversizedBodies(t *testing.T) {
+	sdkKey := "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+	config := Config{Environment: map[string]*EnvConfig{"test": {SdkKey: sdkKey}}}
+	config.Main.MaxEvalBodyBytes = 50
+	config.Events.MaxBodyBytes = 50
+	config.Events.SendEvents = true
+	config.Events.FlushIntervalSecs = 1
+	relay := makeTestRelay(config)
+	deadline := time.Now().Add(time.Second)
+	for !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler := relay.getHandler()
+
+	largeUser := `{"key":"` + strings.Repeat("a", 100) + `"}`
+	for _, path := range []string{"/sdk/eval/user", "/bulk"} {
+		t.Run(path, func(t *testing.T) {
+			method := "REPORT"
+			if path == "/bulk" {
+				method = "POST"
+			}
+			req, _ := http.NewRequest(method, "http://localhost"+path, strings.NewReader(largeUser))
+			req.Header.Set("Authorization", sdkKey)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+		})
+	}
+}
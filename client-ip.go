@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The reverse proxies and load balancers whose X-Forwarded-For and X-Real-IP headers are believed, if any
+// are configured; nil otherwise
+var trustedProxies proxyNetworks
+
+type proxyNetworks []*net.IPNet
+
+type deviceEventsContextKey struct{}
+
+// Parses trusted proxies given as CIDR blocks, such as 10.0.0.0/8, or as single addresses
+func parseTrustedProxies(specs []string) (proxyNetworks, error) {
+	var networks proxyNetworks
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR block", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR block", spec)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (p proxyNetworks) contains(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the address of the client that made a request. If the request came through trusted proxies, this
+// is the address before the last of them in X-Forwarded-For, since each proxy appends the address it
+// received the request from and only the entries added by trusted proxies can be believed; failing that, it
+// is X-Real-IP. Otherwise it is the address the request came from.
+func clientIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxies.contains(ip) {
+		return host
+	}
+
+	var forwarded []string
+	for _, header := range req.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(addr))
+		}
+	}
+	if len(forwarded) == 0 {
+		if realIp := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); realIp != nil {
+			return realIp.String()
+		}
+		return host
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := net.ParseIP(forwarded[i])
+		if addr == nil {
+			// Whatever is further left can't be trusted either
+			break
+		}
+		ip = addr
+		if !trustedProxies.contains(addr) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// Marks requests that carry events from client-side and mobile SDKs, which run on end users' devices
+func deviceEvents(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), deviceEventsContextKey{}, true)))
+	})
+}
+
+func isDeviceEventsRequest(req *http.Request) bool {
+	devices, _ := req.Context().Value(deviceEventsContextKey{}).(bool)
+	return devices
+}
+
+// Gives the user in an event the address of the device that sent it, unless the SDK already gave it one.
+// LaunchDarkly would otherwise take the address the events came from, which is the relay's.
+func addUserIp(evt json.RawMessage, ip string) json.RawMessage {
+	decoder := json.NewDecoder(bytes.NewReader(evt))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil || fields == nil {
+		return evt
+	}
+	user, ok := fields["user"].(map[string]interface{})
+	if !ok {
+		return evt
+	}
+	if _, exists := user["ip"]; exists {
+		return evt
+	}
+	user["ip"] = ip
+	withIp, err := json.Marshal(fields)
+	if err != nil {
+		return evt
+	}
+	return withIp
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	assert.NoError(t, err)
+	assert.Len(t, proxies, 3)
+	assert.Equal(t, "192.168.1.1/32", proxies[1].String())
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = parseTrustedProxies([]string{"proxy.example.com"})
+	assert.Error(t, err)
+}
+
+func TestClientIp(t *testing.T) {
+	trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.0/8"})
+	defer func() { trustedProxies = nil }()
+
+	request := func(remoteAddr string, headers map[string][]string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		for name, values := range headers {
+			req.Header[name] = values
+		}
+		return req
+	}
+	specs := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{"direct", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"untrusted proxy", "203.0.113.5:4000", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"spoofed entries", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"several headers", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"1.2.3.4", "198.51.100.1"}}, "198.51.100.1"},
+		{"only trusted proxies", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"invalid entry", "10.0.0.1:4000", map[string][]string{"X-Forwarded-For": {"198.51.100.1, unknown, 10.0.0.2"}}, "10.0.0.2"},
+		{"real ip", "10.0.0.1:4000", map[string][]string{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"no headers", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"ipv6", "[2001:db8::1]:4000", nil, "2001:db8::1"},
+	}
+	for _, s := range specs {
+		assert.Equal(t, s.expected, clientIp(request(s.remoteAddr, s.headers)), s.name)
+	}
+}
+
+func TestClientIpIsAddedToDeviceEvents(t *testing.T) {
+	assert.JSONEq(t, `{"kind":"identify","creationDate":1526000000123,"user":{"key":"me","ip":"198.51.100.1"}}`,
+		string(addUserIp(json.RawMessage(`{"kind":"identify","creationDate":1526000000123,"user":{"key":"me"}}`), "198.51.100.1")))
+	assert.JSONEq(t, `{"kind":"identify","user":{"key":"me","ip":"192.0.2.1"}}`,
+		string(addUserIp(json.RawMessage(`{"kind":"identify","user":{"key":"me","ip":"192.0.2.1"}}`), "198.51.100.1")))
+	assert.JSONEq(t, `{"kind":"feature","userKey":"me"}`,
+		string(addUserIp(json.RawMessage(`{"kind":"feature","userKey":"me"}`), "198.51.100.1")))
+
+	var config Config
+	config.Events.Capacity = defaultEventCapacity
+	config.Events.AddClientIp = true
+	publish := func(h func(http.Handler) http.Handler) string {
+		sink := &fakeEventSink{}
+		handler := newEventRelayHandler("sdk-key", config, nil)
+		handler.sinks = []*eventSinkForwarder{newEventSinkForwarder(sink, "env1", config)}
+		handler.sinksOnly = true
+		req := httptest.NewRequest("POST", "/mobile", strings.NewReader(`[{"kind":"identify","user":{"key":"me"}}]`))
+		req.RemoteAddr = "198.51.100.1:4000"
+		req.Header.Set(eventSchemaHeader, "3")
+		h(handler).ServeHTTP(httptest.NewRecorder(), req)
+		waitForSinkQueue(handler.sinks[0], 1)
+		handler.close()
+		if messages := sink.published(); assert.Len(t, messages, 1) {
+			return string(messages[0].data)
+		}
+		return ""
+	}
+	assert.JSONEq(t, `{"kind":"identify","user":{"key":"me","ip":"198.51.100.1"}}`, publish(deviceEvents))
+	assert.JSONEq(t, `{"kind":"identify","user":{"key":"me"}}`, publish(func(h http.Handler) http.Handler { return h }))
+}
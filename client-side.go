@@ -4,17 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
-	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 
 	"github.com/gorilla/mux"
-	"github.com/gregjones/httpcache"
 )
 
 type clientSideContext struct {
-	allowedOrigins []string
+	name              string
+	allowedOrigins    []string
+	allowedClientSans []string
+	goals             *goalsCache
 	clientContext
 }
 
@@ -23,23 +24,30 @@ func (c *clientSideContext) AllowedOrigins() []string {
 }
 
 type ClientSideMux struct {
-	contextByKey map[string]*clientSideContext
-	baseUri      string
+	envs    *environmentRegistry
+	baseUri string
 }
 
 func (m ClientSideMux) selectClientByUrlParam(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		envId := mux.Vars(req)["envId"]
-		clientCtx := m.contextByKey[envId]
+		clientCtx := m.envs.withEnvId(envId)
 		if clientCtx == nil {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("ld-relay is not configured for environment id " + envId))
+			auditFailure(auditUnknownEnvId, envId, "", req)
+			writeError(w, req, http.StatusNotFound, "ld-relay is not configured for environment id "+envId)
 			return
 		}
 
+		if !clientCertAllowed(req, clientCtx.allowedClientSans) {
+			auditFailure(auditCertificateDenied, envId, clientCtx.name, req)
+			writeError(w, req, http.StatusForbidden, "Client certificate is not allowed to access this environment")
+			return
+		}
+		auditKeyUse(envId, clientCtx.name)
+		clientCtx.getMetrics().requestAuthorized("clientSide")
+
 		if clientCtx.getClient() == nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("client was not initialized"))
+			writeError(w, req, http.StatusServiceUnavailable, "Environment has not been initialized")
 			return
 		}
 
@@ -50,24 +58,32 @@ func (m ClientSideMux) selectClientByUrlParam(next http.Handler) http.Handler {
 
 func (m ClientSideMux) getGoals(w http.ResponseWriter, req *http.Request) {
 	envId := mux.Vars(req)["envId"]
+	clientCtx := m.envs.withEnvId(envId)
+	if clientCtx == nil {
+		// The environment was removed after the request was routed
+		writeError(w, req, http.StatusNotFound, "ld-relay is not configured for environment id "+envId)
+		return
+	}
 
-	ldReq, _ := http.NewRequest("GET", m.baseUri+"/sdk/goals/"+envId, nil)
-	ldReq.Header.Set("Authorization", req.Header.Get("Authorization"))
-
-	cachingTransport := httpcache.NewMemoryCacheTransport()
-	httpClient := cachingTransport.Client()
-	res, err := httpClient.Do(ldReq)
+	goals, err := clientCtx.goals.get(req.Header.Get("Authorization"), requestId(req))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(ErrorJsonMsgf("Error fetching goals: %s", err))
+		writeErrorf(w, req, errorStatus(err), "Error fetching goals: %s", err)
 		return
 	}
 
-	w.Header().Set("Content-Type", res.Header["Content-Type"][0])
+	if goals.contentType != "" {
+		w.Header().Set("Content-Type", goals.contentType)
+	}
+	if goals.etag != "" {
+		w.Header().Set("ETag", goals.etag)
+		if goals.statusCode == http.StatusOK && req.Header.Get("If-None-Match") == goals.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
 
-	w.WriteHeader(res.StatusCode)
-	bodyBytes, _ := ioutil.ReadAll(res.Body)
-	w.Write(bodyBytes)
+	w.WriteHeader(goals.statusCode)
+	w.Write(goals.body)
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -101,6 +117,7 @@ var allowedHeadersList = []string{
 	"Content-Length",
 	"Accept-Encoding",
 	"X-LaunchDarkly-User-Agent",
+	userHeader,
 	eventSchemaHeader,
 }
 
@@ -126,8 +143,7 @@ func getEventsImage(w http.ResponseWriter, req *http.Request) {
 	clientCtx := getClientContext(req)
 
 	if clientCtx.getHandlers().eventsHandler == nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write(ErrorJsonMsg("Event proxy is not enabled for this environment"))
+		writeError(w, req, http.StatusNotFound, "Event proxy is not enabled for this environment")
 		return
 	}
 
@@ -137,6 +153,8 @@ func getEventsImage(w http.ResponseWriter, req *http.Request) {
 			nullW := httptest.NewRecorder()
 			events, _ := base64.StdEncoding.DecodeString(d)
 			eventsReq, _ := http.NewRequest("POST", "", bytes.NewBuffer(events))
+			// Keep the request's context, which says whether users are to be scrubbed
+			eventsReq = eventsReq.WithContext(req.Context())
 			eventsReq.Header.Add("Content-Type", "application/json")
 			eventsReq.Header.Add("X-LaunchDarkly-User-Agent", eventsReq.Header.Get("X-LaunchDarkly-User-Agent"))
 			clientCtx.getHandlers().eventsHandler.ServeHTTP(nullW, eventsReq)
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	es "github.com/launchdarkly/eventsource"
+)
+
+// coalescingPublisher wraps an ESPublisher and holds back events for a fixed window so that bursts of
+// updates (e.g. many flag edits in a short time) are collapsed into a single broadcast per item. Only the
+// latest event for each flag, segment, or stream is kept, and everything pending is always delivered at
+// the end of the window, so subscribers end up with the same final state they would have seen otherwise.
+type coalescingPublisher struct {
+	publisher ESPublisher
+	window    time.Duration
+	mu        sync.Mutex
+	pending   map[string]*pendingEvent
+	order     []string
+	timer     *time.Timer
+	closed    bool
+}
+
+type pendingEvent struct {
+	channels []string
+	event    es.Event
+}
+
+func newCoalescingPublisher(publisher ESPublisher, window time.Duration) *coalescingPublisher {
+	return &coalescingPublisher{
+		publisher: publisher,
+		window:    window,
+		pending:   make(map[string]*pendingEvent),
+	}
+}
+
+func (p *coalescingPublisher) Publish(channels []string, event es.Event) {
+	channelKey := strings.Join(channels, ",")
+	eventKey, supersedesAll := coalescingKey(event)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+
+	if supersedesAll {
+		// A full payload replaces anything already queued for the same channels
+		order := p.order[:0]
+		for _, k := range p.order {
+			if strings.HasPrefix(k, channelKey+"\x00") {
+				delete(p.pending, k)
+			} else {
+				order = append(order, k)
+			}
+		}
+		p.order = order
+	}
+
+	key := channelKey + "\x00" + eventKey
+	if existing, ok := p.pending[key]; ok {
+		existing.event = event
+	} else {
+		p.pending[key] = &pendingEvent{channels: channels, event: event}
+		p.order = append(p.order, key)
+	}
+
+	if p.timer == nil {
+		p.timer = time.AfterFunc(p.window, p.flush)
+	}
+}
+
+// Comments are heartbeats and carry no state, so they are never delayed
+func (p *coalescingPublisher) PublishComment(channels []string, text string) {
+	p.publisher.PublishComment(channels, text)
+}
+
+func (p *coalescingPublisher) Register(channel string, repo es.Repository) {
+	p.publisher.Register(channel, repo)
+}
+
+// Drops anything pending and stops publishing, once the environment has been removed
+func (p *coalescingPublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.pending = make(map[string]*pendingEvent)
+	p.order = nil
+	p.closed = true
+}
+
+func (p *coalescingPublisher) flush() {
+	p.mu.Lock()
+	events := make([]*pendingEvent, 0, len(p.order))
+	for _, k := range p.order {
+		events = append(events, p.pending[k])
+	}
+	p.pending = make(map[string]*pendingEvent)
+	p.order = nil
+	p.timer = nil
+	p.mu.Unlock()
+
+	for _, e := range events {
+		p.publisher.Publish(e.channels, e.event)
+	}
+}
+
+// coalescingKey identifies which earlier pending events a new event makes redundant. Patches and deletes
+// for the same path replace each other; put events replace everything pending on the channel.
+func coalescingKey(event es.Event) (key string, supersedesAll bool) {
+	switch e := event.(type) {
+	case allPutEvent, flagsPutEvent:
+		return "put", true
+	case upsertEvent:
+		return "path:" + e.Path, false
+	case deleteEvent:
+		return "path:" + e.Path, false
+	}
+	return "event:" + event.Event(), false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	es "github.com/launchdarkly/eventsource"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+type syncTestPublisher struct {
+	testPublisher
+	mu sync.Mutex
+}
+
+func (p *syncTestPublisher) Publish(channels []string, event es.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.testPublisher.Publish(channels, event)
+}
+
+func (p *syncTestPublisher) getEvents() []es.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]es.Event(nil), p.events...)
+}
+
+func TestCoalescingPublisher(t *testing.T) {
+	channels := []string{"api-key"}
+	window := 20 * time.Millisecond
+
+	waitForEvents := func(p *syncTestPublisher, count int) []es.Event {
+		deadline := time.Now().Add(time.Second)
+		for len(p.getEvents()) < count && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		return p.getEvents()
+	}
+
+	t.Run("keeps only the latest patch for each item", func(t *testing.T) {
+		target := &syncTestPublisher{}
+		p := newCoalescingPublisher(target, window)
+
+		p.Publish(channels, makeUpsertEvent(ld.Features, &ld.FeatureFlag{Key: "flag1", Version: 1}))
+		p.Publish(channels, makeUpsertEvent(ld.Features, &ld.FeatureFlag{Key: "flag2", Version: 1}))
+		p.Publish(channels, makeUpsertEvent(ld.Features, &ld.FeatureFlag{Key: "flag1", Version: 2}))
+		p.Publish(channels, makeDeleteEvent(ld.Features, "flag2", 2))
+		assert.Empty(t, target.getEvents())
+
+		assert.EqualValues(t, []es.Event{
+			makeUpsertEvent(ld.Features, &ld.FeatureFlag{Key: "flag1", Version: 2}),
+			makeDeleteEvent(ld.Features, "flag2", 2),
+		}, waitForEvents(target, 2))
+	})
+
+	t.Run("collapses pings", func(t *testing.T) {
+		target := &syncTestPublisher{}
+		p := newCoalescingPublisher(target, window)
+
+		for i := 0; i < 10; i++ {
+			p.Publish(channels, makePingEvent())
+		}
+
+		time.Sleep(3 * window)
+		assert.EqualValues(t, []es.Event{pingEvent{}}, waitForEvents(target, 1))
+	})
+
+	t.Run("put replaces pending patches", func(t *testing.T) {
+		target := &syncTestPublisher{}
+		p := newCoalescingPublisher(target, window)
+
+		p.Publish(channels, makeUpsertEvent(ld.Features, &ld.FeatureFlag{Key: "flag1", Version: 1}))
+		p.Publish(channels, makePutEvent(nil, nil))
+		p.Publish(channels, makeUpsertEvent(ld.Features, &ld.FeatureFlag{Key: "flag2", Version: 1}))
+
+		assert.EqualValues(t, []es.Event{
+			makePutEvent(nil, nil),
+			makeUpsertEvent(ld.Features, &ld.FeatureFlag{Key: "flag2", Version: 1}),
+		}, waitForEvents(target, 2))
+	})
+
+	t.Run("comments are not delayed", func(t *testing.T) {
+		target := &syncTestPublisher{}
+		p := newCoalescingPublisher(target, time.Hour)
+
+		p.PublishComment(channels, "")
+		assert.Equal(t, []string{""}, target.comments)
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type command struct {
+	usage string
+	run   func(c Config, args []string) int
+}
+
+// Subcommands that can be given after the regular flags, e.g. "ld-relay --config ./ld-relay.conf store clean"
+var commands = map[string]command{
+	"store clean":  {usage: "store clean [-dry-run] [prefix...]", run: storeClean},
+	"store export": {usage: "store export [-o file] <environment>", run: storeExport},
+	"store import": {usage: "store import <environment> <file>", run: storeImport},
+}
+
+// Runs the subcommand named by args and returns the process exit code
+func runCommand(c Config, args []string) int {
+	for i := len(args); i > 0; i-- {
+		if cmd, ok := commands[strings.Join(args[:i], " ")]; ok {
+			return cmd.run(c, args[i:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\nAvailable commands:\n", strings.Join(args, " "))
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+	return 2
+}
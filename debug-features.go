@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultDebugTtl = time.Hour
+	maxDebugTtl     = 24 * time.Hour
+)
+
+// debugSetting describes a debug feature that is currently turned on
+type debugSetting struct {
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+type activeDebugFeature struct {
+	setting debugSetting
+	timer   *time.Timer
+	revert  func()
+}
+
+// Debug features, such as verbose logging, can slow the relay down, so they are only ever turned on for a
+// limited time. They are listed in /status while they are on, so that nobody forgets about them.
+var (
+	debugFeaturesLock sync.Mutex
+	debugFeatures     = make(map[string]*activeDebugFeature)
+)
+
+// Records that a debug feature has been turned on, and arranges for revert to be called to turn it off
+// again once ttl has passed. If the feature was already on, its expiry time is reset, but the original
+// revert function is kept so that it still restores the setting from before debugging started.
+func enableDebugFeature(name string, value string, ttl time.Duration, revert func()) {
+	if ttl <= 0 {
+		ttl = defaultDebugTtl
+	}
+	if ttl > maxDebugTtl {
+		ttl = maxDebugTtl
+	}
+
+	debugFeaturesLock.Lock()
+	defer debugFeaturesLock.Unlock()
+	feature := debugFeatures[name]
+	if feature != nil {
+		feature.timer.Stop()
+	} else {
+		feature = &activeDebugFeature{revert: revert}
+		debugFeatures[name] = feature
+	}
+	feature.setting = debugSetting{Value: value, Expires: time.Now().Add(ttl)}
+	feature.timer = time.AfterFunc(ttl, func() {
+		debugFeaturesLock.Lock()
+		if debugFeatures[name] != feature {
+			debugFeaturesLock.Unlock()
+			return
+		}
+		delete(debugFeatures, name)
+		debugFeaturesLock.Unlock()
+		Warning.Printf("Debug setting %s=%s has expired and has been reverted", name, value)
+		feature.revert()
+	})
+}
+
+// Records that a debug feature has been turned off by hand, so that it is no longer reverted automatically
+func disableDebugFeature(name string) {
+	debugFeaturesLock.Lock()
+	defer debugFeaturesLock.Unlock()
+	if feature := debugFeatures[name]; feature != nil {
+		feature.timer.Stop()
+		delete(debugFeatures, name)
+	}
+}
+
+// Returns the debug features that are currently on, keyed by name
+func getDebugFeatures() map[string]debugSetting {
+	debugFeaturesLock.Lock()
+	defer debugFeaturesLock.Unlock()
+	settings := make(map[string]debugSetting, len(debugFeatures))
+	for name, feature := range debugFeatures {
+		settings[name] = feature.setting
+	}
+	return settings
+}
+
+// Changes the log level at an operator's request. The "debug" level is a debug feature, and reverts to the
+// previous level once ttl has passed.
+func setLogLevelWithTtl(level string, ttl time.Duration) error {
+	previous := getLogLevel()
+	if err := setLogLevel(level); err != nil {
+		return err
+	}
+	if level == "debug" {
+		enableDebugFeature("logLevel", level, ttl, func() { setLogLevel(previous) })
+	} else {
+		disableDebugFeature("logLevel")
+	}
+	return nil
+}
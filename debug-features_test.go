@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugLogLevelRevertsAfterTtl(t *testing.T) {
+	defer setLogLevelWithTtl("info", 0)
+
+	assert.NoError(t, setLogLevelWithTtl("warn", 0))
+	assert.NoError(t, setLogLevelWithTtl("debug", 50*time.Millisecond))
+	assert.Equal(t, "debug", getLogLevel())
+	assert.Contains(t, getDebugFeatures(), "logLevel")
+
+	deadline := time.Now().Add(time.Second)
+	for getLogLevel() == "debug" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "warn", getLogLevel())
+	assert.Empty(t, getDebugFeatures())
+}
+
+func TestSettingLogLevelByHandCancelsRevert(t *testing.T) {
+	defer setLogLevelWithTtl("info", 0)
+
+	assert.NoError(t, setLogLevelWithTtl("debug", 50*time.Millisecond))
+	assert.NoError(t, setLogLevelWithTtl("error", 0))
+	assert.Empty(t, getDebugFeatures())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "error", getLogLevel())
+}
+
+func TestStatusShowsDebugFeatures(t *testing.T) {
+	defer setLogLevelWithTtl("info", 0)
+	mux := ClientMux{envs: newEnvironmentRegistry()}
+
+	getStatus := func(handler http.HandlerFunc) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/status", nil)
+		handler(w, req)
+		return w.Body.String()
+	}
+
+	assert.NotContains(t, getStatus(mux.getDetailedStatus), `"debug"`)
+	assert.NoError(t, setLogLevelWithTtl("debug", time.Hour))
+	assert.Contains(t, getStatus(mux.getDetailedStatus), `"debug":{"logLevel":{"value":"debug","expires":`)
+	// Debug settings are only shown to operators
+	assert.NotContains(t, getStatus(mux.getStatus), `"debug"`)
+}
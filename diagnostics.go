@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+const defaultDebugHost = "localhost"
+
+var startTime = time.Now()
+
+// runtimeStats is the JSON representation of /debug/runtime
+type runtimeStats struct {
+	Version       string  `json:"version"`
+	GoVersion     string  `json:"goVersion"`
+	UptimeSecs    float64 `json:"uptimeSecs"`
+	NumCPU        int     `json:"numCPU"`
+	GoMaxProcs    int     `json:"goMaxProcs"`
+	NumGoroutine  int     `json:"numGoroutine"`
+	HeapAlloc     uint64  `json:"heapAllocBytes"`
+	HeapInuse     uint64  `json:"heapInuseBytes"`
+	HeapObjects   uint64  `json:"heapObjects"`
+	Sys           uint64  `json:"sysBytes"`
+	NumGC         uint32  `json:"numGC"`
+	PauseTotalNs  uint64  `json:"gcPauseTotalNs"`
+	LastGCPauseNs uint64  `json:"lastGCPauseNs"`
+}
+
+// Returns the handler for the debug listener, which serves pprof profiles, expvar variables and runtime
+// statistics. These are kept off the main listener, which may be exposed to the internet, so that profiling
+// data can't be reached by accident. Importing net/http/pprof and expvar also registers their handlers on
+// http.DefaultServeMux, but the relay never serves that.
+func makeDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/runtime", getRuntimeStats)
+	return mux
+}
+
+func getRuntimeStats(w http.ResponseWriter, req *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := runtimeStats{
+		Version:      Version,
+		GoVersion:    runtime.Version(),
+		UptimeSecs:   time.Since(startTime).Seconds(),
+		NumCPU:       runtime.NumCPU(),
+		GoMaxProcs:   runtime.GOMAXPROCS(0),
+		NumGoroutine: runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+	}
+	if mem.NumGC > 0 {
+		stats.LastGCPauseNs = mem.PauseNs[(mem.NumGC+255)%256]
+	}
+	data, _ := json.Marshal(stats)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Serves the debug endpoints on their own port, if one is configured. Failing to start the debug listener
+// doesn't stop the relay.
+func startDebugListener(c Config) {
+	if c.Main.DebugPort == 0 {
+		return
+	}
+	host := c.Main.DebugHost
+	if host == "" {
+		host = defaultDebugHost
+	}
+	addr := net.JoinHostPort(host, fmt.Sprint(c.Main.DebugPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		Error.Printf("Unable to serve debug endpoints on %s: %s", addr, err)
+		return
+	}
+	Info.Printf("Serving debug endpoints on %s", addr)
+	go func() {
+		if err := http.Serve(listener, makeDebugHandler()); err != nil {
+			Error.Printf("Debug listener stopped: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugHandlerServesDiagnostics(t *testing.T) {
+	handler := makeDebugHandler()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/vars", "/debug/runtime"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode, path)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/debug/runtime", nil)
+	handler.ServeHTTP(w, req)
+	var stats runtimeStats
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, Version, stats.Version)
+	assert.Equal(t, runtime.Version(), stats.GoVersion)
+	assert.True(t, stats.NumGoroutine > 0)
+	assert.True(t, stats.HeapAlloc > 0)
+}
+
+func TestDiagnosticsAreNotServedOnMainListener(t *testing.T) {
+	handler := makeAdminTestRelay(false).getHandler()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/debug/runtime"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Result().StatusCode, path)
+	}
+}
+
+func TestDebugListenerServesOnConfiguredPort(t *testing.T) {
+	listener, _ := net.Listen("tcp", "localhost:0")
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	var c Config
+	c.Main.DebugPort = port
+	startDebugListener(c)
+
+	var resp *http.Response
+	var err error
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err = http.Get(fmt.Sprintf("http://localhost:%d/debug/runtime", port))
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// Groups of endpoints that can be turned off with the [endpoints] section
+const (
+	// /all and /flags
+	endpointsServerStreaming = "serverStreaming"
+	// /sdk/latest-all, /sdk/latest-flags and /sdk/latest-segments
+	endpointsServerPolling = "serverPolling"
+	// /sdk/eval and /sdk/evalx with an SDK key, and /api/v2/flags/evaluate
+	endpointsServerEval = "serverEval"
+	// /msdk/eval, /msdk/evalx and /mping
+	endpointsMobile = "mobile"
+	// Everything addressed by client-side ID: goals, the snippet, evaluation and the /ping and /eval streams
+	endpointsClientSide = "clientSide"
+	// Every analytics and diagnostic event endpoint
+	endpointsEvents = "events"
+	// /status and /api/v2/status
+	endpointsStatus = "status"
+)
+
+var allEndpointGroups = []string{
+	endpointsServerStreaming,
+	endpointsServerPolling,
+	endpointsServerEval,
+	endpointsMobile,
+	endpointsClientSide,
+	endpointsEvents,
+	endpointsStatus,
+}
+
+// endpointPolicy says which groups of endpoints the relay serves. Endpoints in other groups aren't
+// registered at all, so requests to them are answered as if they didn't exist.
+type endpointPolicy map[string]bool
+
+// Builds the policy from the [endpoints] section. If any groups are exposed, only those are served; groups
+// that are disabled are never served.
+func newEndpointPolicy(expose []string, disable []string) (endpointPolicy, error) {
+	known := make(map[string]bool, len(allEndpointGroups))
+	for _, group := range allEndpointGroups {
+		known[group] = true
+	}
+	policy := make(endpointPolicy, len(allEndpointGroups))
+	for _, group := range expose {
+		if !known[group] {
+			return nil, unknownEndpointGroup(group)
+		}
+		policy[group] = true
+	}
+	if len(expose) == 0 {
+		for _, group := range allEndpointGroups {
+			policy[group] = true
+		}
+	}
+	for _, group := range disable {
+		if !known[group] {
+			return nil, unknownEndpointGroup(group)
+		}
+		delete(policy, group)
+	}
+	return policy, nil
+}
+
+func unknownEndpointGroup(group string) error {
+	groups := append([]string(nil), allEndpointGroups...)
+	sort.Strings(groups)
+	return fmt.Errorf("unknown endpoint group %q; must be one of %v", group, groups)
+}
+
+func (p endpointPolicy) serves(group string) bool {
+	return p[group]
+}
+
+// Serves /status when the status group isn't exposed. Health checks, the systemd watchdog and child relays
+// still depend on it, so it is answered for requests from the relay's own host and for requests that carry
+// the SDK key of one of the relay's environments, as a child relay's do. Anyone else gets a 404.
+func (r *relay) serveHiddenStatus(w http.ResponseWriter, req *http.Request) {
+	if requestFromLocalHost(req) {
+		r.sdkClientMux.getStatus(w, req)
+		return
+	}
+	if sdkKey, err := fetchAuthToken(req); err == nil && r.envs.withSdkKey(sdkKey) != nil {
+		r.sdkClientMux.getStatus(w, req)
+		return
+	}
+	notFoundHandler(w, req)
+}
+
+// Returns true if the request came from a loopback address or from the address it was received on, which is
+// where the relay's own health checks come from
+func requestFromLocalHost(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return local.IP.Equal(ip)
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointPolicy(t *testing.T) {
+	policy, err := newEndpointPolicy(nil, nil)
+	if assert.NoError(t, err) {
+		for _, group := range allEndpointGroups {
+			assert.True(t, policy.serves(group), group)
+		}
+	}
+
+	policy, err = newEndpointPolicy(nil, []string{endpointsEvents})
+	if assert.NoError(t, err) {
+		assert.False(t, policy.serves(endpointsEvents))
+		assert.True(t, policy.serves(endpointsServerStreaming))
+	}
+
+	policy, err = newEndpointPolicy([]string{endpointsServerStreaming, endpointsStatus}, []string{endpointsStatus})
+	if assert.NoError(t, err) {
+		assert.True(t, policy.serves(endpointsServerStreaming))
+		assert.False(t, policy.serves(endpointsStatus))
+		assert.False(t, policy.serves(endpointsServerPolling))
+	}
+
+	_, err = newEndpointPolicy([]string{"streaming"}, nil)
+	assert.Error(t, err)
+	_, err = newEndpointPolicy(nil, []string{"admin"})
+	assert.Error(t, err)
+}
+
+func TestLoadConfigRejectsUnknownEndpointGroups(t *testing.T) {
+	configFile := writeTestConfig(t, `
+[endpoints]
+	disable = "events"
+	disable = "streams"
+`)
+	defer os.Remove(configFile)
+
+	_, err := loadConfig(configFile)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `invalid endpoints configuration: unknown endpoint group "streams"`)
+	}
+}
+
+func TestDisabledEndpointsAreNotServed(t *testing.T) {
+	envId := "env-id"
+	mobileKey := "mob-98e2b0b4-2688-4a59-9810-1e0e3d7e42d1"
+	sdkKey := "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+	config := Config{Environment: map[string]*EnvConfig{
+		"env1": {SdkKey: sdkKey, MobileKey: &mobileKey, EnvId: &envId},
+	}}
+	config.Endpoints.Expose = []string{endpointsServerPolling, endpointsServerEval, endpointsEvents}
+	config.Endpoints.Disable = []string{endpointsEvents}
+	relay := makeTestRelay(config)
+	defer relay.findEnvironment("env1").close()
+	for deadline := time.Now().Add(time.Second); !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler := relay.getHandler()
+
+	specs := []struct {
+		method         string
+		path           string
+		authorization  string
+		expectedStatus int
+	}{
+		{"GET", "/sdk/latest-all", sdkKey, http.StatusOK},
+		{"GET", "/sdk/evalx/users/eyJrZXkiOiJtZSJ9", sdkKey, http.StatusOK},
+		{"GET", "/status", "", http.StatusNotFound},
+		{"GET", "/api/v2/status", "", http.StatusNotFound},
+		{"GET", "/all", sdkKey, http.StatusNotFound},
+		{"GET", "/msdk/evalx/users/eyJrZXkiOiJtZSJ9", mobileKey, http.StatusNotFound},
+		{"GET", "/sdk/evalx/env-id/users/eyJrZXkiOiJtZSJ9", "", http.StatusNotFound},
+		{"GET", "/sdk/goals/env-id", "", http.StatusNotFound},
+		{"POST", "/bulk", sdkKey, http.StatusNotFound},
+		{"POST", "/mobile/events", mobileKey, http.StatusNotFound},
+		{"POST", "/events/bulk/env-id", "", http.StatusNotFound},
+		{"POST", "/sdk/latest-all", sdkKey, http.StatusMethodNotAllowed},
+	}
+	for _, s := range specs {
+		req := httptest.NewRequest(s.method, s.path, strings.NewReader("[]"))
+		req.Header.Set("Content-Type", "application/json")
+		if s.authorization != "" {
+			req.Header.Set("Authorization", s.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, s.expectedStatus, w.Code, "%s %s", s.method, s.path)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/openapi.json", nil))
+	assert.Contains(t, w.Body.String(), "/flags/evaluate")
+	assert.NotContains(t, w.Body.String(), "/environments/{envId}/flags/evaluate")
+	assert.NotContains(t, w.Body.String(), `"/status"`)
+}
+
+func TestHiddenStatusIsStillServedToHealthChecksAndChildRelays(t *testing.T) {
+	sdkKey := "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+	config := Config{Environment: map[string]*EnvConfig{"env1": {SdkKey: sdkKey}}}
+	config.Endpoints.Expose = []string{endpointsServerStreaming}
+	relay := makeTestRelay(config)
+	defer relay.findEnvironment("env1").close()
+	for deadline := time.Now().Add(time.Second); !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler := relay.getHandler()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// ldr --healthcheck
+	assert.NoError(t, checkHealth(server.Client(), server.URL+"/status"))
+
+	// The systemd watchdog
+	assert.NoError(t, checkStatusResponds(server.Client(), server.URL+"/status"))
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	assert.Error(t, checkStatusResponds(notFound.Client(), notFound.URL+"/status"))
+
+	// A child relay, from another host
+	checkFromAnotherHost := func(authorization string) int {
+		req := httptest.NewRequest("GET", "/status", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, checkFromAnotherHost(sdkKey))
+	assert.Equal(t, http.StatusNotFound, checkFromAnotherHost("sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d1"))
+	assert.Equal(t, http.StatusNotFound, checkFromAnotherHost(""))
+}
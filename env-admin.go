@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+const maxEnvAdminBodyBytes = 64 << 10
+
+// Serializes every change to the relay's environments, so that two changes can't claim the same name or key at
+// once. Anything that adds or removes an environment must hold it from checking that the environment's name
+// and keys are free until the environment has been added; at present that is newRelay and /internal/envs.
+var environmentChangesLock sync.Mutex
+
+// envAdminRepresentation is how an environment is described and changed through /internal/envs. Keys and the
+// values of upstream headers are obscured when an environment is listed.
+type envAdminRepresentation struct {
+	Name             string            `json:"name"`
+	SdkKey           string            `json:"sdkKey"`
+	MobileKey        string            `json:"mobileKey,omitempty"`
+	EnvId            string            `json:"envId,omitempty"`
+	Prefix           string            `json:"prefix,omitempty"`
+	AllowedOrigin    []string          `json:"allowedOrigin,omitempty"`
+	AllowedClientSan []string          `json:"allowedClientSan,omitempty"`
+	PubSubTopic      string            `json:"pubSubTopic,omitempty"`
+	SqsQueueUrl      string            `json:"sqsQueueUrl,omitempty"`
+	EventSinksOnly   bool              `json:"eventSinksOnly,omitempty"`
+	Tags             map[string]string `json:"tags,omitempty"`
+	// Override the relay's settings for this environment, if set
+	HeartbeatIntervalSecs *int   `json:"heartbeatIntervalSecs,omitempty"`
+	PingIntervalSecs      *int   `json:"pingIntervalSecs,omitempty"`
+	LocalTtl              *int   `json:"localTtl,omitempty"`
+	CacheMode             string `json:"cacheMode,omitempty"`
+	CacheRefreshSecs      *int   `json:"cacheRefreshSecs,omitempty"`
+	// Given as "Name: value"
+	UpstreamHeader  []string `json:"upstreamHeader,omitempty"`
+	UserAgentSuffix string   `json:"userAgentSuffix,omitempty"`
+	Status          string   `json:"status,omitempty"`
+}
+
+func (e envAdminRepresentation) toEnvConfig() EnvConfig {
+	envConfig := EnvConfig{SdkKey: e.SdkKey, Prefix: e.Prefix, PubSubTopic: e.PubSubTopic, SqsQueueUrl: e.SqsQueueUrl,
+		EventSinksOnly: e.EventSinksOnly, HeartbeatIntervalSecs: e.HeartbeatIntervalSecs, PingIntervalSecs: e.PingIntervalSecs,
+		LocalTtl: e.LocalTtl, CacheMode: e.CacheMode, CacheRefreshSecs: e.CacheRefreshSecs, UserAgentSuffix: e.UserAgentSuffix}
+	if e.MobileKey != "" {
+		mobileKey := e.MobileKey
+		envConfig.MobileKey = &mobileKey
+	}
+	if e.EnvId != "" {
+		envId := e.EnvId
+		envConfig.EnvId = &envId
+	}
+	if len(e.AllowedOrigin) > 0 {
+		allowedOrigin := e.AllowedOrigin
+		envConfig.AllowedOrigin = &allowedOrigin
+	}
+	if len(e.AllowedClientSan) > 0 {
+		allowedClientSan := e.AllowedClientSan
+		envConfig.AllowedClientSan = &allowedClientSan
+	}
+	if len(e.Tags) > 0 {
+		tags := formatEnvTags(e.Tags)
+		envConfig.Tag = &tags
+	}
+	if len(e.UpstreamHeader) > 0 {
+		upstreamHeader := e.UpstreamHeader
+		envConfig.UpstreamHeader = &upstreamHeader
+	}
+	return envConfig
+}
+
+func (r *relay) registerEnvAdmin(adminRouter *mux.Router) {
+	adminRouter.HandleFunc("/envs", r.listEnvironments).Methods("GET")
+	adminRouter.HandleFunc("/envs", r.addEnvironmentHandler).Methods("POST")
+	adminRouter.HandleFunc("/envs/{name}", r.updateEnvironmentHandler).Methods("PUT")
+	adminRouter.HandleFunc("/envs/{name}", r.removeEnvironmentHandler).Methods("DELETE")
+}
+
+func (r *relay) listEnvironments(w http.ResponseWriter, req *http.Request) {
+	environmentChangesLock.Lock()
+	defer environmentChangesLock.Unlock()
+
+	envs := make([]envAdminRepresentation, 0)
+	for _, clientCtx := range r.allEnvironments() {
+		env := envAdminRepresentation{
+			Name:             clientCtx.name,
+			SdkKey:           obscureKey(clientCtx.sdkKey),
+			AllowedClientSan: clientCtx.allowedClientSans,
+			Tags:             clientCtx.tags,
+			Status:           clientCtx.connectionStatus(),
+		}
+		if clientCtx.mobileKey != nil {
+			env.MobileKey = obscureKey(*clientCtx.mobileKey)
+		}
+		if clientCtx.envId != nil {
+			env.EnvId = *clientCtx.envId
+		}
+		if envConfig := r.config.Environment[clientCtx.name]; envConfig != nil {
+			env.Prefix = envConfig.Prefix
+			env.PubSubTopic = envConfig.PubSubTopic
+			env.SqsQueueUrl = envConfig.SqsQueueUrl
+			env.EventSinksOnly = envConfig.EventSinksOnly
+			env.HeartbeatIntervalSecs = envConfig.HeartbeatIntervalSecs
+			env.PingIntervalSecs = envConfig.PingIntervalSecs
+			env.LocalTtl = envConfig.LocalTtl
+			env.CacheMode = envConfig.CacheMode
+			env.CacheRefreshSecs = envConfig.CacheRefreshSecs
+			env.UserAgentSuffix = envConfig.UserAgentSuffix
+			if envConfig.AllowedOrigin != nil {
+				env.AllowedOrigin = *envConfig.AllowedOrigin
+			}
+			if envConfig.UpstreamHeader != nil {
+				// Header values are often tokens for a gateway, so only their names are shown
+				for _, entry := range *envConfig.UpstreamHeader {
+					env.UpstreamHeader = append(env.UpstreamHeader, strings.SplitN(entry, ":", 2)[0]+": ********")
+				}
+			}
+		}
+		envs = append(envs, env)
+	}
+	data, _ := json.Marshal(envs)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (r *relay) addEnvironmentHandler(w http.ResponseWriter, req *http.Request) {
+	var env envAdminRepresentation
+	if !readEnvAdminBody(w, req, &env) {
+		return
+	}
+	r.changeEnvironment(w, req, "", env)
+}
+
+func (r *relay) updateEnvironmentHandler(w http.ResponseWriter, req *http.Request) {
+	var env envAdminRepresentation
+	if !readEnvAdminBody(w, req, &env) {
+		return
+	}
+	name := mux.Vars(req)["name"]
+	if env.Name == "" {
+		env.Name = name
+	}
+	r.changeEnvironment(w, req, name, env)
+}
+
+func (r *relay) removeEnvironmentHandler(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	environmentChangesLock.Lock()
+	defer environmentChangesLock.Unlock()
+
+	clientCtx := r.findEnvironment(name)
+	if clientCtx == nil {
+		writeErrorf(w, req, http.StatusNotFound, "No environment named %q", name)
+		return
+	}
+	r.stopEnvironment(clientCtx)
+	delete(r.config.Environment, name)
+	Info.Printf("Removed environment %s", name)
+
+	if err := r.saveEnvironments(); err != nil {
+		writeErrorf(w, req, http.StatusInternalServerError, "The environment was removed, but the configuration file could not be updated: %s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Adds an environment, or replaces the environment called existingName if that isn't empty. Streaming
+// clients of a replaced environment are disconnected, and reconnect to the new one if their key still
+// belongs to it.
+func (r *relay) changeEnvironment(w http.ResponseWriter, req *http.Request, existingName string, env envAdminRepresentation) {
+	environmentChangesLock.Lock()
+	defer environmentChangesLock.Unlock()
+
+	var existing *clientContextImpl
+	if existingName != "" {
+		if existing = r.findEnvironment(existingName); existing == nil {
+			writeErrorf(w, req, http.StatusNotFound, "No environment named %q", existingName)
+			return
+		}
+	}
+	envConfig := env.toEnvConfig()
+	if err := r.validateEnvironment(env.Name, envConfig, existing); err != nil {
+		status := http.StatusBadRequest
+		if err == errEnvironmentConflict {
+			status = http.StatusConflict
+		}
+		writeError(w, req, status, err.Error())
+		return
+	}
+
+	// The store is created first, so that an environment being replaced keeps running if it can't be
+	store, err := newBaseFeatureStore(r.config, envConfig)
+	if err != nil {
+		writeError(w, req, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	status := http.StatusCreated
+	if existing != nil {
+		r.stopEnvironment(existing)
+		delete(r.config.Environment, existingName)
+		status = http.StatusOK
+	}
+	r.config.Environment[env.Name] = &envConfig
+	r.startEnvironment(env.Name, envConfig, store)
+	Info.Printf("Configured environment %s", env.Name)
+
+	if err := r.saveEnvironments(); err != nil {
+		writeErrorf(w, req, http.StatusInternalServerError, "The environment was configured, but the configuration file could not be updated: %s", err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+var errEnvironmentConflict = errors.New("another environment already has this name, prefix or one of these keys")
+
+// Checks that the environment is complete, and that its name and keys aren't used by any environment other
+// than the one it replaces. Each lookup takes the registry's lock separately, so the caller must hold
+// environmentChangesLock until the environment has been added.
+func (r *relay) validateEnvironment(name string, envConfig EnvConfig, replacing *clientContextImpl) error {
+	if name == "" {
+		return errors.New("name is required")
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return errors.New("name may not contain control characters")
+	}
+	if envConfig.SdkKey == "" {
+		return errors.New("sdkKey is required")
+	}
+	if err := validateEventSinks(r.config, envConfig); err != nil {
+		return err
+	}
+	if _, err := parseEnvTags(envConfig); err != nil {
+		return err
+	}
+	if err := validateEnvCache(r.config, envConfig); err != nil {
+		return err
+	}
+	if err := validateEnvUpstreamHeaders(envConfig); err != nil {
+		return err
+	}
+
+	inUse := func(clientCtx *clientContextImpl) bool {
+		return clientCtx != nil && clientCtx != replacing
+	}
+	if inUse(r.envs.named(name)) || inUse(r.envs.withSdkKey(envConfig.SdkKey)) {
+		return errEnvironmentConflict
+	}
+	if envConfig.MobileKey != nil && inUse(r.envs.withMobileKey(*envConfig.MobileKey)) {
+		return errEnvironmentConflict
+	}
+	if envConfig.EnvId != nil {
+		if clientSideCtx := r.envs.withEnvId(*envConfig.EnvId); clientSideCtx != nil {
+			if inUse(clientSideCtx.clientContext.(*clientContextImpl)) {
+				return errEnvironmentConflict
+			}
+		}
+	}
+	if persistentStoreConfigured(r.config) {
+		// Environments sharing a prefix would overwrite each other's data in the store
+		for otherName, other := range r.config.Environment {
+			if other.Prefix == envConfig.Prefix && inUse(r.envs.named(otherName)) {
+				return errEnvironmentConflict
+			}
+		}
+	}
+	return nil
+}
+
+// Removes an environment's keys from the relay and shuts down its client, its streams and its connections
+// to the persistent store
+func (r *relay) stopEnvironment(clientCtx *clientContextImpl) {
+	r.envs.remove(clientCtx)
+	clientCtx.close()
+}
+
+func readEnvAdminBody(w http.ResponseWriter, req *http.Request, env *envAdminRepresentation) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxEnvAdminBodyBytes))
+	if err == nil {
+		err = json.Unmarshal(body, env)
+	}
+	if err != nil {
+		writeErrorf(w, req, http.StatusBadRequest, "Invalid environment: %s", err)
+		return false
+	}
+	return true
+}
+
+// Writes the relay's current environments back to its configuration file, if it has one
+func (r *relay) saveEnvironments() error {
+	if r.configFile == "" {
+		return nil
+	}
+	return saveEnvironments(r.configFile, r.config.Environment)
+}
+
+var configSectionHeader = regexp.MustCompile(`^\s*\[\s*([A-Za-z][-A-Za-z0-9]*)`)
+
+// Replaces the environment sections of a configuration file with the given environments, keeping the rest
+// of the file, including comments, as it was. The new file is written alongside the old one and then
+// renamed over it, so that a relay starting at the same time never reads half a file.
+func saveEnvironments(configFile string, envs map[string]*EnvConfig) error {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	var out []string
+	inEnvironment := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if match := configSectionHeader.FindStringSubmatch(line); match != nil {
+			inEnvironment = strings.EqualFold(match[1], "environment")
+		}
+		if !inEnvironment {
+			out = append(out, line)
+		}
+	}
+	for len(out) > 0 && strings.TrimSpace(out[len(out)-1]) == "" {
+		out = out[:len(out)-1]
+	}
+
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out = append(out, "", formatEnvironmentSection(name, *envs[name]))
+	}
+
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(configFile), filepath.Base(configFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(strings.Join(out, "\n") + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), configFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func formatEnvironmentSection(name string, envConfig EnvConfig) string {
+	lines := []string{fmt.Sprintf("[environment %s]", quoteConfigValue(name))}
+	add := func(variable string, value string) {
+		lines = append(lines, fmt.Sprintf("\t%s = %s", variable, quoteConfigValue(value)))
+	}
+	add("sdkKey", envConfig.SdkKey)
+	if envConfig.MobileKey != nil {
+		add("mobileKey", *envConfig.MobileKey)
+	}
+	if envConfig.EnvId != nil {
+		add("envId", *envConfig.EnvId)
+	}
+	if envConfig.Prefix != "" {
+		add("prefix", envConfig.Prefix)
+	}
+	if envConfig.AllowedOrigin != nil {
+		for _, origin := range *envConfig.AllowedOrigin {
+			add("allowedOrigin", origin)
+		}
+	}
+	if envConfig.AllowedClientSan != nil {
+		for _, san := range *envConfig.AllowedClientSan {
+			add("allowedClientSan", san)
+		}
+	}
+	if envConfig.PubSubTopic != "" {
+		add("pubSubTopic", envConfig.PubSubTopic)
+	}
+	if envConfig.SqsQueueUrl != "" {
+		add("sqsQueueUrl", envConfig.SqsQueueUrl)
+	}
+	if envConfig.EventSinksOnly {
+		add("eventSinksOnly", "true")
+	}
+	if envConfig.Tag != nil {
+		for _, tag := range *envConfig.Tag {
+			add("tag", tag)
+		}
+	}
+	if envConfig.HeartbeatIntervalSecs != nil {
+		add("heartbeatIntervalSecs", strconv.Itoa(*envConfig.HeartbeatIntervalSecs))
+	}
+	if envConfig.PingIntervalSecs != nil {
+		add("pingIntervalSecs", strconv.Itoa(*envConfig.PingIntervalSecs))
+	}
+	if envConfig.LocalTtl != nil {
+		add("localTtl", strconv.Itoa(*envConfig.LocalTtl))
+	}
+	if envConfig.CacheMode != "" {
+		add("cacheMode", envConfig.CacheMode)
+	}
+	if envConfig.CacheRefreshSecs != nil {
+		add("cacheRefreshSecs", strconv.Itoa(*envConfig.CacheRefreshSecs))
+	}
+	if envConfig.UpstreamHeader != nil {
+		for _, header := range *envConfig.UpstreamHeader {
+			add("upstreamHeader", header)
+		}
+	}
+	if envConfig.UserAgentSuffix != "" {
+		add("userAgentSuffix", envConfig.UserAgentSuffix)
+	}
+	return strings.Join(lines, "\n")
+}
+
+var configValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+
+func quoteConfigValue(value string) string {
+	return `"` + configValueEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/launchdarkly/gcfg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironmentAdminAPI(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	handler := relay.getHandler()
+
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	evaluate := func(sdkKey string) int {
+		req, _ := http.NewRequest("REPORT", "http://localhost/sdk/eval/user", strings.NewReader(`{"key":"me"}`))
+		req.Header.Set("Authorization", sdkKey)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+	newKey := "sdk-11111111-2222-4333-8444-555555555555"
+	otherKey := "sdk-66666666-7777-4888-9999-000000000000"
+
+	t.Run("add", func(t *testing.T) {
+		w := call("POST", "/internal/envs", `{"name":"env2","sdkKey":"`+newKey+`","envId":"env2-id"}`)
+		assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+		deadline := time.Now().Add(time.Second)
+		for !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, http.StatusOK, evaluate(newKey))
+
+		body := call("GET", "/internal/envs", "").Body.String()
+		assert.Contains(t, body, `"name":"env2"`)
+		assert.Contains(t, body, `"envId":"env2-id"`)
+		assert.NotContains(t, body, newKey)
+	})
+
+	t.Run("conflicts", func(t *testing.T) {
+		w := call("POST", "/internal/envs", `{"name":"env3","sdkKey":"`+newKey+`"}`)
+		assert.Equal(t, http.StatusConflict, w.Result().StatusCode)
+		w = call("POST", "/internal/envs", `{"name":"env1","sdkKey":"`+otherKey+`"}`)
+		assert.Equal(t, http.StatusConflict, w.Result().StatusCode)
+		w = call("POST", "/internal/envs", `{"name":"env3"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		w := call("PUT", "/internal/envs/env2", `{"sdkKey":"`+otherKey+`"}`)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, evaluate(newKey))
+		assert.Equal(t, http.StatusNotFound, call("PUT", "/internal/envs/unknown", `{"sdkKey":"`+newKey+`"}`).Result().StatusCode)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, call("DELETE", "/internal/envs/env2", "").Result().StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, evaluate(otherKey))
+		assert.Equal(t, http.StatusNotFound, call("DELETE", "/internal/envs/env2", "").Result().StatusCode)
+		assert.NotContains(t, call("GET", "/internal/envs", "").Body.String(), "env2")
+	})
+}
+
+func TestRemovingAnEnvironmentReleasesItsResources(t *testing.T) {
+	config := Config{Environment: map[string]*EnvConfig{}}
+	config.Admin.Password = "secret"
+	config.Main.CoalesceWindowMs = 100
+	config.Main.HeartbeatIntervalSecs = 60
+	relay := makeTestRelay(config)
+	handler := relay.getHandler()
+	sdkKey := "sdk-11111111-2222-4333-8444-555555555555"
+
+	call := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+	waitForGoroutines := func(atMost int) int {
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > atMost && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return runtime.NumGoroutine()
+	}
+
+	before := runtime.NumGoroutine()
+	assert.Equal(t, http.StatusCreated, call("POST", "/internal/envs", `{"name":"env2","sdkKey":"`+sdkKey+`"}`))
+	clientCtx := relay.findEnvironment("env2")
+	clientCtx.relayStore.allPublisher.Publish(clientCtx.relayStore.keys(), allPutEvent{})
+
+	w, body := NewStreamRecorder()
+	go ioutil.ReadAll(body)
+	req, _ := http.NewRequest("GET", "http://localhost/all", nil)
+	req.Header.Set("Authorization", sdkKey)
+	streamDone := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(w, req)
+		close(streamDone)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, http.StatusNoContent, call("DELETE", "/internal/envs/env2", ""))
+	select {
+	case <-streamDone:
+	case <-time.After(time.Second):
+		t.Error("the stream was not closed")
+	}
+	body.(*io.PipeReader).Close()
+	// The update the coalescing publisher was holding back is dropped rather than sent to a closed channel
+	coalescing := clientCtx.relayStore.allPublisher.(*coalescingPublisher)
+	coalescing.mu.Lock()
+	assert.Empty(t, coalescing.pending)
+	coalescing.mu.Unlock()
+	assert.True(t, waitForGoroutines(before) <= before, "goroutines were left running")
+}
+
+func TestPostgresPoolIsClosedWithItsLastStore(t *testing.T) {
+	url := "postgres://localhost/ldrelay-release-test?sslmode=disable"
+	store1, err := NewPostgresFeatureStore(url, "env1", 0, nullLogger)
+	if !assert.NoError(t, err) {
+		return
+	}
+	store2, _ := NewPostgresFeatureStore(url, "env2", 0, nullLogger)
+	assert.True(t, store1.pg == store2.pg)
+
+	store1.Close()
+	store1.Close()
+	postgresDBsLock.Lock()
+	assert.Contains(t, postgresDBs, url)
+	postgresDBsLock.Unlock()
+
+	store2.Close()
+	postgresDBsLock.Lock()
+	assert.NotContains(t, postgresDBs, url)
+	postgresDBsLock.Unlock()
+}
+
+func TestSaveEnvironmentsKeepsOtherSections(t *testing.T) {
+	configFile := writeTestConfig(t, `; relay settings
+[main]
+	port = 8031
+
+[environment "old"]
+	sdkKey = "sdk-old"
+
+[admin]
+	password = "secret"
+`)
+	defer os.Remove(configFile)
+
+	mobileKey := "mob-key"
+	origins := []string{"https://example.com"}
+	pingInterval := 60
+	localTtl := -1
+	upstreamHeader := []string{"X-Gateway-Token: abc123"}
+	err := saveEnvironments(configFile, map[string]*EnvConfig{
+		`new "one"`: {SdkKey: "sdk-new", MobileKey: &mobileKey, Prefix: "ld:new", AllowedOrigin: &origins, PingIntervalSecs: &pingInterval,
+			LocalTtl: &localTtl, CacheMode: cacheModeReadCombined, UpstreamHeader: &upstreamHeader, UserAgentSuffix: "acme-egress"},
+	})
+	assert.NoError(t, err)
+
+	data, _ := ioutil.ReadFile(configFile)
+	assert.Contains(t, string(data), "; relay settings")
+	assert.NotContains(t, string(data), "sdk-old")
+
+	var c Config
+	if assert.NoError(t, gcfg.ReadFileInto(&c, configFile)) {
+		assert.Equal(t, 8031, c.Main.Port)
+		assert.Equal(t, "secret", c.Admin.Password)
+		assert.Len(t, c.Environment, 1)
+		env := c.Environment[`new "one"`]
+		if assert.NotNil(t, env) {
+			assert.Equal(t, "sdk-new", env.SdkKey)
+			assert.Equal(t, &mobileKey, env.MobileKey)
+			assert.Equal(t, "ld:new", env.Prefix)
+			assert.Equal(t, &origins, env.AllowedOrigin)
+			assert.Equal(t, &pingInterval, env.PingIntervalSecs)
+			assert.Nil(t, env.HeartbeatIntervalSecs)
+			assert.Equal(t, &localTtl, env.LocalTtl)
+			assert.Equal(t, cacheModeReadCombined, env.CacheMode)
+			assert.Nil(t, env.CacheRefreshSecs)
+			assert.Equal(t, &upstreamHeader, env.UpstreamHeader)
+			assert.Equal(t, "acme-egress", env.UserAgentSuffix)
+		}
+	}
+}
+
+func TestEnvironmentAdminAPIRejectsCrossSiteRequests(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	defer relay.findEnvironment("env1").close()
+	handler := relay.getHandler()
+	body := `{"name":"env2","sdkKey":"sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d1"}`
+
+	specs := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		header         map[string]string
+		expectedStatus int
+	}{
+		{"text/plain form", "POST", "/internal/envs", body, map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{"no content type", "POST", "/internal/envs", body, nil, http.StatusUnsupportedMediaType},
+		{"other origin", "POST", "/internal/envs", body, map[string]string{"Content-Type": "application/json", "Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"cross-site fetch", "DELETE", "/internal/envs/env1", "", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same origin", "POST", "/internal/envs", body, map[string]string{"Content-Type": "text/plain", "Origin": "http://localhost"}, http.StatusCreated},
+	}
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			req, _ := http.NewRequest(s.method, "http://localhost"+s.path, strings.NewReader(s.body))
+			for name, value := range s.header {
+				req.Header.Set(name, value)
+			}
+			req.SetBasicAuth("admin", "secret")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, s.expectedStatus, w.Code)
+		})
+	}
+	assert.NotNil(t, relay.findEnvironment("env1"))
+	if env2 := relay.findEnvironment("env2"); assert.NotNil(t, env2) {
+		env2.close()
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Checks that no two environments share a credential, or a prefix in a shared persistent store. Either would
+// let one environment's clients see another environment's data.
+func validateEnvironmentKeys(c Config) error {
+	names := make([]string, 0, len(c.Environment))
+	for name := range c.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type seen map[string]string
+	sdkKeys, mobileKeys, envIds, prefixes := seen{}, seen{}, seen{}, seen{}
+	check := func(s seen, value string, name string, what string) error {
+		if other, exists := s[value]; exists {
+			return fmt.Errorf("environments %q and %q have the same %s", other, name, what)
+		}
+		s[value] = name
+		return nil
+	}
+	for _, name := range names {
+		envConfig := c.Environment[name]
+		sdkKey := envConfig.SdkKey
+		if sdkKey == "" {
+			sdkKey = envConfig.ApiKey
+		}
+		if err := check(sdkKeys, sdkKey, name, "SDK key"); err != nil {
+			return err
+		}
+		if envConfig.MobileKey != nil && *envConfig.MobileKey != "" {
+			if err := check(mobileKeys, *envConfig.MobileKey, name, "mobile key"); err != nil {
+				return err
+			}
+		}
+		if envConfig.EnvId != nil && *envConfig.EnvId != "" {
+			if err := check(envIds, *envConfig.EnvId, name, "environment ID"); err != nil {
+				return err
+			}
+		}
+		if persistentStoreConfigured(c) {
+			if err := check(prefixes, envConfig.Prefix, name, "prefix; each environment needs its own prefix in a shared store"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the channel that an environment's streams are published on. Channels belong to an environment
+// rather than to a credential, so a stream can only ever receive the data of the environment that
+// authorized it, and a client connected to an environment that is replaced keeps receiving updates only if
+// the replacement has the same name and SDK key.
+func envStreamChannel(envName string, sdkKey string) string {
+	return envName + "\x00" + sdkKey
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigRejectsSharedEnvironmentKeys(t *testing.T) {
+	specs := []struct {
+		name          string
+		config        string
+		expectedError string
+	}{
+		{"SDK key", `
+[environment "a"]
+	sdkKey = "sdk-1"
+[environment "b"]
+	sdkKey = "sdk-1"
+`, `environments "a" and "b" have the same SDK key`},
+		{"deprecated API key", `
+[environment "a"]
+	sdkKey = "sdk-1"
+[environment "b"]
+	apiKey = "sdk-1"
+`, `environments "a" and "b" have the same SDK key`},
+		{"mobile key", `
+[environment "a"]
+	sdkKey = "sdk-1"
+	mobileKey = "mob-1"
+[environment "b"]
+	sdkKey = "sdk-2"
+	mobileKey = "mob-1"
+`, `environments "a" and "b" have the same mobile key`},
+		{"environment ID", `
+[environment "a"]
+	sdkKey = "sdk-1"
+	envId = "env-1"
+[environment "b"]
+	sdkKey = "sdk-2"
+	envId = "env-1"
+`, `environments "a" and "b" have the same environment ID`},
+		{"prefix", `
+[redis]
+	host = "localhost"
+	port = 6379
+[environment "a"]
+	sdkKey = "sdk-1"
+[environment "b"]
+	sdkKey = "sdk-2"
+`, `environments "a" and "b" have the same prefix; each environment needs its own prefix in a shared store`},
+	}
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			configFile := writeTestConfig(t, s.config)
+			defer os.Remove(configFile)
+			_, err := loadConfig(configFile)
+			assert.EqualError(t, err, s.expectedError)
+		})
+	}
+}
+
+func TestLoadConfigAllowsSharedPrefixWithoutPersistentStore(t *testing.T) {
+	configFile := writeTestConfig(t, `
+[environment "a"]
+	sdkKey = "sdk-1"
+[environment "b"]
+	sdkKey = "sdk-2"
+`)
+	defer os.Remove(configFile)
+	_, err := loadConfig(configFile)
+	assert.NoError(t, err)
+}
+
+func TestEnvironmentsAreFoundByName(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	clientCtx := relay.findEnvironment("env1")
+	if assert.NotNil(t, clientCtx) {
+		assert.Equal(t, "env1", clientCtx.name)
+		assert.Equal(t, clientCtx, relay.envs.withSdkKey(clientCtx.sdkKey))
+	}
+	assert.Nil(t, relay.findEnvironment("sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"))
+}
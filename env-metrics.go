@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// How long a disconnected stream client is remembered, so that we can tell if it comes back
+	reconnectWindow = 5 * time.Minute
+	// The most disconnected clients remembered per environment, so that a flood of one-off clients can't
+	// use up memory
+	maxRecentDisconnects = 10000
+)
+
+// envMetrics holds counters describing how an environment is being used
+type envMetrics struct {
+	mu                sync.Mutex
+	activeStreams     int
+	recentDisconnects map[string]time.Time
+	connects          []time.Time
+	disconnects       []time.Time
+	reconnects        []time.Time
+	// This month's and last month's usage, if usage tracking is enabled
+	usage         *monthUsage
+	previousUsage *monthUsage
+}
+
+// connectionStats summarizes an environment's stream connections over the reconnect window. A high
+// reconnect rate means the same clients keep dropping and coming back, which usually points to the
+// network between them and the relay; a high disconnect count with few reconnects means clients are
+// going away for good.
+type connectionStats struct {
+	ActiveStreams int     `json:"activeStreams"`
+	Connects      int     `json:"connects"`
+	Disconnects   int     `json:"disconnects"`
+	Reconnects    int     `json:"reconnects"`
+	ReconnectRate float64 `json:"reconnectRate"`
+	// The environment's tags, so that stats can be grouped by them
+	Tags map[string]string `json:"tags,omitempty"`
+	// How the environment's stream replays are being served
+	Replays *replayStats `json:"replays,omitempty"`
+}
+
+func (m *envMetrics) streamOpened(clientId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.prune(now)
+	m.activeStreams++
+	m.streamsChangedLocked()
+	m.connects = append(m.connects, now)
+	if _, ok := m.recentDisconnects[clientId]; ok {
+		delete(m.recentDisconnects, clientId)
+		m.reconnects = append(m.reconnects, now)
+	}
+}
+
+func (m *envMetrics) streamClosed(clientId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.prune(now)
+	m.activeStreams--
+	m.disconnects = append(m.disconnects, now)
+	if m.recentDisconnects == nil {
+		m.recentDisconnects = make(map[string]time.Time)
+	}
+	if len(m.recentDisconnects) < maxRecentDisconnects {
+		m.recentDisconnects[clientId] = now
+	}
+}
+
+func (m *envMetrics) getActiveStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.activeStreams
+}
+
+func (m *envMetrics) getConnectionStats() connectionStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(time.Now())
+	stats := connectionStats{
+		ActiveStreams: m.activeStreams,
+		Connects:      len(m.connects),
+		Disconnects:   len(m.disconnects),
+		Reconnects:    len(m.reconnects),
+	}
+	if stats.Connects > 0 {
+		stats.ReconnectRate = float64(stats.Reconnects) / float64(stats.Connects)
+	}
+	return stats
+}
+
+// Forgets anything that happened longer ago than the reconnect window. The caller must hold the lock.
+func (m *envMetrics) prune(now time.Time) {
+	cutoff := now.Add(-reconnectWindow)
+	m.connects = pruneTimes(m.connects, cutoff)
+	m.disconnects = pruneTimes(m.disconnects, cutoff)
+	m.reconnects = pruneTimes(m.reconnects, cutoff)
+	for clientId, disconnectedAt := range m.recentDisconnects {
+		if disconnectedAt.Before(cutoff) {
+			delete(m.recentDisconnects, clientId)
+		}
+	}
+}
+
+// Drops the times before the cutoff from a list of times in ascending order
+func pruneTimes(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// Identifies a stream client by its credential and address, without keeping either of them in memory
+func streamClientId(req *http.Request) string {
+	host := clientIp(req)
+	credential := req.Header.Get("Authorization")
+	if credential == "" {
+		// Client-side streams identify the environment in the path rather than with a header
+		credential = req.URL.Path
+	}
+	hash := sha256.Sum256([]byte(credential + "\x00" + host))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Serves a long-lived stream, keeping track of it in the environment's connection metrics. Clients that ask
+// to upgrade to a WebSocket are sent the same events over that instead.
+func serveStream(clientCtx clientContext, handler http.Handler, w http.ResponseWriter, req *http.Request) {
+	metrics := clientCtx.getMetrics()
+	clientId := streamClientId(req)
+	metrics.streamOpened(clientId)
+	defer metrics.streamClosed(clientId)
+	if websocket.IsWebSocketUpgrade(req) {
+		serveWebSocketStream(handler, w, req)
+		return
+	}
+	handler.ServeHTTP(w, req)
+}
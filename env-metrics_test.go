@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamClientIdIgnoresPort(t *testing.T) {
+	makeRequest := func(remoteAddr, auth string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://localhost/flags", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", auth)
+		return req
+	}
+
+	id := streamClientId(makeRequest("10.0.0.1:50000", "sdk-key"))
+	assert.Equal(t, id, streamClientId(makeRequest("10.0.0.1:50001", "sdk-key")))
+	assert.NotEqual(t, id, streamClientId(makeRequest("10.0.0.2:50000", "sdk-key")))
+	assert.NotEqual(t, id, streamClientId(makeRequest("10.0.0.1:50000", "other-key")))
+	assert.NotContains(t, id, "sdk-key")
+}
+
+func TestConnectionStatsCountReconnects(t *testing.T) {
+	var m envMetrics
+	m.streamOpened("a")
+	m.streamOpened("b")
+	m.streamClosed("a")
+	m.streamOpened("a")
+
+	stats := m.getConnectionStats()
+	assert.Equal(t, 2, stats.ActiveStreams)
+	assert.Equal(t, 3, stats.Connects)
+	assert.Equal(t, 1, stats.Disconnects)
+	assert.Equal(t, 1, stats.Reconnects)
+	assert.InDelta(t, 1.0/3, stats.ReconnectRate, 0.001)
+}
+
+func TestConnectionStatsForgetOldDisconnects(t *testing.T) {
+	var m envMetrics
+	m.streamOpened("a")
+	m.streamClosed("a")
+
+	// Pretend everything so far happened before the window
+	m.mu.Lock()
+	old := time.Now().Add(-reconnectWindow - time.Second)
+	m.recentDisconnects["a"] = old
+	m.connects[0] = old
+	m.disconnects[0] = old
+	m.mu.Unlock()
+
+	m.streamOpened("a")
+	stats := m.getConnectionStats()
+	assert.Equal(t, 1, stats.Connects)
+	assert.Equal(t, 0, stats.Disconnects)
+	assert.Equal(t, 0, stats.Reconnects)
+}
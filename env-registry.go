@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// envState is where an environment is in its lifecycle
+type envState string
+
+const (
+	// The environment's client is being created and has not connected yet
+	envInitializing envState = "initializing"
+	// The environment's client has connected, or the environment serves what the leader writes to the store
+	envReady envState = "ready"
+	// The environment's client could not be created or did not connect in time. It may still connect later,
+	// in which case the environment becomes ready.
+	envFailed envState = "failed"
+)
+
+// environmentRegistry holds every environment, and finds them by name and by the credentials that SDKs use.
+// Environments are added and removed while requests are being served, so the maps are only ever touched with
+// the registry's lock held.
+type environmentRegistry struct {
+	mu          sync.RWMutex
+	byName      map[string]*clientContextImpl
+	bySdkKey    map[string]*clientContextImpl
+	byMobileKey map[string]*clientContextImpl
+	byEnvId     map[string]*clientSideContext
+}
+
+func newEnvironmentRegistry() *environmentRegistry {
+	return &environmentRegistry{
+		byName:      make(map[string]*clientContextImpl),
+		bySdkKey:    make(map[string]*clientContextImpl),
+		byMobileKey: make(map[string]*clientContextImpl),
+		byEnvId:     make(map[string]*clientSideContext),
+	}
+}
+
+// Adds an environment under its name and keys. clientSideCtx is nil if the environment has no client-side ID.
+// The caller must make sure that none of them are in use, and hold environmentChangesLock while it does.
+func (e *environmentRegistry) add(clientCtx *clientContextImpl, clientSideCtx *clientSideContext) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.byName[clientCtx.name] = clientCtx
+	e.bySdkKey[clientCtx.sdkKey] = clientCtx
+	if clientCtx.mobileKey != nil && *clientCtx.mobileKey != "" {
+		e.byMobileKey[*clientCtx.mobileKey] = clientCtx
+	}
+	if clientSideCtx != nil {
+		e.byEnvId[*clientCtx.envId] = clientSideCtx
+	}
+}
+
+// Removes an environment, so that requests can no longer find it. The caller must hold
+// environmentChangesLock.
+func (e *environmentRegistry) remove(clientCtx *clientContextImpl) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.byName, clientCtx.name)
+	delete(e.bySdkKey, clientCtx.sdkKey)
+	if clientCtx.mobileKey != nil {
+		delete(e.byMobileKey, *clientCtx.mobileKey)
+	}
+	if clientCtx.envId != nil {
+		delete(e.byEnvId, *clientCtx.envId)
+	}
+}
+
+func (e *environmentRegistry) named(name string) *clientContextImpl {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.byName[name]
+}
+
+func (e *environmentRegistry) withSdkKey(sdkKey string) *clientContextImpl {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.bySdkKey[sdkKey]
+}
+
+func (e *environmentRegistry) withMobileKey(mobileKey string) *clientContextImpl {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.byMobileKey[mobileKey]
+}
+
+func (e *environmentRegistry) withEnvId(envId string) *clientSideContext {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.byEnvId[envId]
+}
+
+// Returns every environment, sorted by name
+func (e *environmentRegistry) all() []*clientContextImpl {
+	e.mu.RLock()
+	envs := make([]*clientContextImpl, 0, len(e.byName))
+	for _, clientCtx := range e.byName {
+		envs = append(envs, clientCtx)
+	}
+	e.mu.RUnlock()
+	sort.Slice(envs, func(i, j int) bool { return envs[i].name < envs[j].name })
+	return envs
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestRegistryFindsEnvironmentsByNameAndKeys(t *testing.T) {
+	envs := newEnvironmentRegistry()
+	mobileKey, envId := "mob-1", "env-id-1"
+	clientCtx := &clientContextImpl{name: "env1", sdkKey: "sdk-1", mobileKey: &mobileKey, envId: &envId}
+	clientSideCtx := &clientSideContext{clientContext: clientCtx, name: "env1"}
+	envs.add(clientCtx, clientSideCtx)
+	envs.add(&clientContextImpl{name: "another", sdkKey: "sdk-2"}, nil)
+
+	assert.Equal(t, clientCtx, envs.named("env1"))
+	assert.Equal(t, clientCtx, envs.withSdkKey("sdk-1"))
+	assert.Equal(t, clientCtx, envs.withMobileKey("mob-1"))
+	assert.Equal(t, clientSideCtx, envs.withEnvId("env-id-1"))
+	assert.Nil(t, envs.withMobileKey("sdk-1"))
+	if all := envs.all(); assert.Len(t, all, 2) {
+		assert.Equal(t, "another", all[0].name)
+		assert.Equal(t, "env1", all[1].name)
+	}
+
+	envs.remove(clientCtx)
+	assert.Nil(t, envs.named("env1"))
+	assert.Nil(t, envs.withSdkKey("sdk-1"))
+	assert.Nil(t, envs.withMobileKey("mob-1"))
+	assert.Nil(t, envs.withEnvId("env-id-1"))
+	assert.Len(t, envs.all(), 1)
+}
+
+func TestRegistryCanBeChangedWhileItIsRead(t *testing.T) {
+	envs := newEnvironmentRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				clientCtx := &clientContextImpl{name: fmt.Sprintf("env-%d-%d", i, j), sdkKey: fmt.Sprintf("sdk-%d-%d", i, j)}
+				envs.add(clientCtx, nil)
+				envs.remove(clientCtx)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				envs.withSdkKey(fmt.Sprintf("sdk-%d-%d", i, j))
+				envs.all()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Empty(t, envs.all())
+}
+
+func TestEnvironmentLifecycleStates(t *testing.T) {
+	config := Config{Environment: map[string]*EnvConfig{
+		"good": {SdkKey: "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"},
+		"bad":  {SdkKey: "sdk-bad"},
+	}}
+	config.Main.IgnoreConnectionErrors = true
+	connecting := make(chan struct{})
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		if sdkKey == "sdk-bad" {
+			return FakeLDClient{false}, errors.New("timed out")
+		}
+		<-connecting
+		config.FeatureStore.Init(nil)
+		return FakeLDClient{true}, nil
+	})
+	defer relay.findEnvironment("good").close()
+	defer relay.findEnvironment("bad").close()
+
+	waitForState := func(name string, state envState) {
+		for deadline := time.Now().Add(time.Second); relay.findEnvironment(name).lifecycleState() != state && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, state, relay.findEnvironment(name).lifecycleState(), name)
+	}
+	waitForState("bad", envFailed)
+	assert.Equal(t, "disconnected", relay.findEnvironment("bad").connectionStatus())
+	assert.Equal(t, envInitializing, relay.findEnvironment("good").lifecycleState())
+	close(connecting)
+	waitForState("good", envReady)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Parses an environment's tags, each given as key:value, such as team:payments
+func parseEnvTags(envConfig EnvConfig) (map[string]string, error) {
+	if envConfig.Tag == nil || len(*envConfig.Tag) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string, len(*envConfig.Tag))
+	for _, tag := range *envConfig.Tag {
+		parts := strings.SplitN(tag, ":", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid tag %q; expected key:value", tag)
+		}
+		if _, exists := tags[key]; exists {
+			return nil, fmt.Errorf("tag %q is given more than once", key)
+		}
+		tags[key] = strings.TrimSpace(parts[1])
+	}
+	return tags, nil
+}
+
+// Returns tags in the form they are configured in, sorted by key
+func formatEnvTags(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	formatted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		formatted = append(formatted, key+":"+tags[key])
+	}
+	return formatted
+}
+
+// envTagFilter selects environments by the tag query parameters of a request. Each parameter is either
+// key:value, which an environment matches if it has that tag, or just a key, which it matches if it has a tag
+// with that key whatever the value. An environment must match every parameter.
+type envTagFilter []string
+
+func tagFilterFromRequest(req *http.Request) (envTagFilter, error) {
+	filter := envTagFilter(req.URL.Query()["tag"])
+	for _, f := range filter {
+		if strings.TrimSpace(strings.SplitN(f, ":", 2)[0]) == "" {
+			return nil, errors.New("tag filters must be key:value or key")
+		}
+	}
+	return filter, nil
+}
+
+func (filter envTagFilter) matches(tags map[string]string) bool {
+	for _, f := range filter {
+		parts := strings.SplitN(f, ":", 2)
+		value, exists := tags[strings.TrimSpace(parts[0])]
+		if !exists || (len(parts) == 2 && value != strings.TrimSpace(parts[1])) {
+			return false
+		}
+	}
+	return true
+}
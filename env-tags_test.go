@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnvTags(t *testing.T) {
+	tags, err := parseEnvTags(EnvConfig{Tag: &[]string{"team:payments", "tier: 1", "url:https://example.com"}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "payments", "tier": "1", "url": "https://example.com"}, tags)
+	assert.Equal(t, []string{"team:payments", "tier:1", "url:https://example.com"}, formatEnvTags(tags))
+
+	tags, err = parseEnvTags(EnvConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, tags)
+
+	_, err = parseEnvTags(EnvConfig{Tag: &[]string{"payments"}})
+	assert.Error(t, err)
+	_, err = parseEnvTags(EnvConfig{Tag: &[]string{":payments"}})
+	assert.Error(t, err)
+	_, err = parseEnvTags(EnvConfig{Tag: &[]string{"team:payments", "team:search"}})
+	assert.Error(t, err)
+}
+
+func TestEnvTagFilter(t *testing.T) {
+	tags := map[string]string{"team": "payments", "region": "eu"}
+	assert.True(t, envTagFilter(nil).matches(tags))
+	assert.True(t, envTagFilter(nil).matches(nil))
+	assert.True(t, envTagFilter{"team:payments"}.matches(tags))
+	assert.True(t, envTagFilter{"team:payments", "region"}.matches(tags))
+	assert.False(t, envTagFilter{"team:search"}.matches(tags))
+	assert.False(t, envTagFilter{"team:payments", "tier"}.matches(tags))
+	assert.False(t, envTagFilter{"team"}.matches(nil))
+}
+
+func TestStatusCanBeFilteredByTag(t *testing.T) {
+	config := Config{Environment: map[string]*EnvConfig{
+		"payments": {SdkKey: "sdk-payments", Tag: &[]string{"team:payments", "tier:1"}},
+		"search":   {SdkKey: "sdk-search", Tag: &[]string{"team:search", "tier:1"}},
+		"untagged": {SdkKey: "sdk-untagged"},
+	}}
+	relay := makeTestRelay(config)
+	for deadline := time.Now().Add(time.Second); !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler := relay.getHandler()
+
+	getStatus := func(query string) (int, map[string]EnvironmentStatus) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/status"+query, nil))
+		var status struct {
+			Environments map[string]EnvironmentStatus `json:"environments"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &status)
+		return w.Code, status.Environments
+	}
+
+	code, envs := getStatus("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, envs, 3)
+	assert.Equal(t, map[string]string{"team": "payments", "tier": "1"}, envs["payments"].Tags)
+	assert.Nil(t, envs["untagged"].Tags)
+
+	_, envs = getStatus("?tag=team:payments")
+	assert.Len(t, envs, 1)
+	assert.Contains(t, envs, "payments")
+
+	_, envs = getStatus("?tag=tier:1")
+	assert.Len(t, envs, 2)
+
+	_, envs = getStatus("?tag=tier:1&tag=team:search")
+	assert.Len(t, envs, 1)
+	assert.Contains(t, envs, "search")
+
+	_, envs = getStatus("?tag=team:other")
+	assert.Len(t, envs, 0)
+
+	code, _ = getStatus("?tag=:payments")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
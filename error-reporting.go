@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const (
+	// Events are sent in the background; if Sentry falls this far behind, further events are dropped
+	sentryQueueSize = 100
+	sentryTimeout   = 10 * time.Second
+	// The same message is reported at most once in this period, so that an error repeating on every
+	// reconnection attempt doesn't flood Sentry
+	sentryRepeatInterval = time.Minute
+)
+
+// Reports errors to Sentry, if a DSN has been configured; nil otherwise
+var errorReporter *sentryReporter
+
+// sentryReporter sends events to Sentry's store API. It implements just the parts of the protocol the relay
+// needs, rather than pulling in a client library.
+type sentryReporter struct {
+	storeUri    string
+	auth        string
+	environment string
+	serverName  string
+	client      *http.Client
+	queue       chan sentryEvent
+	mu          sync.Mutex
+	lastSent    map[string]time.Time
+}
+
+type sentryEvent struct {
+	EventId     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Platform    string            `json:"platform"`
+	Release     string            `json:"release"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Message     string            `json:"message"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+// Parses a DSN of the form https://<key>[:<secret>]@<host>/<project> into the URI events are posted to and
+// the value of the X-Sentry-Auth header
+func parseSentryDsn(dsn string) (storeUri string, auth string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return "", "", fmt.Errorf("DSN %q must include a key and a host", dsn)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if project == "" {
+		return "", "", fmt.Errorf("DSN %q must include a project", dsn)
+	}
+
+	storeUri = fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:slash], project)
+	auth = fmt.Sprintf("Sentry sentry_version=7, sentry_client=ld-relay/%s, sentry_key=%s", Version, u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	return storeUri, auth, nil
+}
+
+func newSentryReporter(dsn string, environment string) (*sentryReporter, error) {
+	storeUri, auth, err := parseSentryDsn(dsn)
+	if err != nil {
+		return nil, err
+	}
+	serverName, _ := os.Hostname()
+	s := &sentryReporter{
+		storeUri:    storeUri,
+		auth:        auth,
+		environment: environment,
+		serverName:  serverName,
+		client:      &http.Client{Timeout: sentryTimeout},
+		queue:       make(chan sentryEvent, sentryQueueSize),
+		lastSent:    make(map[string]time.Time),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *sentryReporter) run() {
+	for event := range s.queue {
+		data, _ := json.Marshal(event)
+		req, _ := http.NewRequest("POST", s.storeUri, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", s.auth)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			Warning.Printf("Unable to send error report to Sentry: %s", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			Warning.Printf("Sentry rejected an error report with status %d", resp.StatusCode)
+		}
+	}
+}
+
+func (s *sentryReporter) capture(level string, message string, exception sentryException, tags map[string]string) {
+	now := time.Now()
+	s.mu.Lock()
+	if last, ok := s.lastSent[message]; ok && now.Sub(last) < sentryRepeatInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSent[message] = now
+	for m, sent := range s.lastSent {
+		if now.Sub(sent) >= sentryRepeatInterval {
+			delete(s.lastSent, m)
+		}
+	}
+	s.mu.Unlock()
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := sentryEvent{
+		EventId:     hex.EncodeToString(id),
+		Timestamp:   now.UTC().Format("2006-01-02T15:04:05"),
+		Level:       level,
+		Logger:      "ld-relay",
+		Platform:    "go",
+		Release:     Version,
+		Environment: s.environment,
+		ServerName:  s.serverName,
+		Message:     message,
+		Tags:        tags,
+		Exception:   &sentryExceptions{Values: []sentryException{exception}},
+	}
+	select {
+	case s.queue <- event:
+	default:
+	}
+}
+
+// Reports an error, tagged with details such as the environment it happened in. Does nothing unless Sentry
+// is configured.
+func reportError(err error, tags map[string]string) {
+	if errorReporter == nil || err == nil {
+		return
+	}
+	errorReporter.capture("error", err.Error(), sentryException{Type: fmt.Sprintf("%T", err), Value: err.Error()}, tags)
+}
+
+// Reports a recovered panic, with the stack of the goroutine that panicked. Must be called from the deferred
+// function that recovered.
+func reportPanic(value interface{}, tags map[string]string) {
+	if errorReporter == nil {
+		return
+	}
+	message := fmt.Sprintf("panic: %v", value)
+	exception := sentryException{Type: "panic", Value: fmt.Sprint(value), Stacktrace: currentStacktrace(4)}
+	errorReporter.capture("fatal", message, exception, tags)
+}
+
+// Returns the calling goroutine's stack, skipping the given number of frames, with the outermost call first
+// as Sentry expects
+func currentStacktrace(skip int) *sentryStacktrace {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var result []sentryFrame
+	for {
+		frame, more := frames.Next()
+		result = append([]sentryFrame{{Function: frame.Function, Filename: frame.File, Lineno: frame.Line}}, result...)
+		if !more {
+			break
+		}
+	}
+	return &sentryStacktrace{Frames: result}
+}
+
+// Turns a panic in any handler into a 500 response, logging and reporting it, rather than leaving the client
+// without a response
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					// Used by handlers to abort a response on purpose
+					panic(err)
+				}
+				Error.Printf("Unexpected panic serving %s %s for %s%s: %v\n%s", req.Method, req.URL.Path, clientIp(req), forRequest(req), err, debug.Stack())
+				reportPanic(err, map[string]string{"method": req.Method, "path": req.URL.Path, "requestId": requestId(req)})
+				writeError(w, req, http.StatusInternalServerError, "Internal error")
+			}
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// reportingLogger passes an environment's LaunchDarkly client log messages on to its logger, and also
+// reports those that are errors, such as failures to connect to LaunchDarkly
+type reportingLogger struct {
+	ld.Logger
+	envName string
+}
+
+func (l reportingLogger) Println(values ...interface{}) {
+	l.Logger.Println(values...)
+	l.report(strings.TrimSuffix(fmt.Sprintln(values...), "\n"))
+}
+
+func (l reportingLogger) Printf(format string, values ...interface{}) {
+	l.Logger.Printf(format, values...)
+	l.report(fmt.Sprintf(format, values...))
+}
+
+func (l reportingLogger) report(message string) {
+	if strings.HasPrefix(message, "ERROR:") {
+		reportError(fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(message, "ERROR:"))), map[string]string{"environment": l.envName})
+	}
+}
+
+// errorReportingStore reports any errors from an environment's feature store
+type errorReportingStore struct {
+	ld.FeatureStore
+	envName string
+}
+
+func (s errorReportingStore) report(operation string, err error) error {
+	if err != nil {
+		reportError(err, map[string]string{"environment": s.envName, "storeOperation": operation})
+	}
+	return err
+}
+
+func (s errorReportingStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	item, err := s.FeatureStore.Get(kind, key)
+	return item, s.report("get", err)
+}
+
+func (s errorReportingStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	items, err := s.FeatureStore.All(kind)
+	return items, s.report("all", err)
+}
+
+func (s errorReportingStore) Init(allData map[ld.VersionedDataKind]map[string]ld.VersionedData) error {
+	return s.report("init", s.FeatureStore.Init(allData))
+}
+
+func (s errorReportingStore) Delete(kind ld.VersionedDataKind, key string, version int) error {
+	return s.report("delete", s.FeatureStore.Delete(kind, key, version))
+}
+
+func (s errorReportingStore) Upsert(kind ld.VersionedDataKind, item ld.VersionedData) error {
+	return s.report("upsert", s.FeatureStore.Upsert(kind, item))
+}
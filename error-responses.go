@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ErrorJson is the body of every error response from the relay. Code is a stable, machine-readable name for
+// the kind of failure; Message explains this one. RequestId identifies the request, so that a client's report
+// of a failure can be matched with the relay's logs.
+type ErrorJson struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "service_unavailable",
+	http.StatusGatewayTimeout:        "timeout",
+}
+
+// Returns the code for an error response with the given status
+func errorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return "internal_error"
+	}
+	return "invalid_request"
+}
+
+// Responds to a request with an error status and a JSON body describing the error
+func writeError(w http.ResponseWriter, req *http.Request, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body, _ := json.Marshal(ErrorJson{Code: errorCode(status), Message: message, RequestId: requestId(req)})
+	w.Write(body)
+}
+
+func writeErrorf(w http.ResponseWriter, req *http.Request, status int, format string, args ...interface{}) {
+	writeError(w, req, status, fmt.Sprintf(format, args...))
+}
+
+func notFoundHandler(w http.ResponseWriter, req *http.Request) {
+	writeErrorf(w, req, http.StatusNotFound, "No endpoint at %s", req.URL.Path)
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, req *http.Request) {
+	writeErrorf(w, req, http.StatusMethodNotAllowed, "%s is not allowed for %s", req.Method, req.URL.Path)
+}
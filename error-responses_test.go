@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponsesAreConsistent(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	handler := relay.getHandler()
+	deadline := time.Now().Add(time.Second)
+	for !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sdkKey := "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+
+	specs := []struct {
+		name           string
+		method         string
+		path           string
+		authKey        string
+		body           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"unknown path", "GET", "/no-such-endpoint", "", "", http.StatusNotFound, "not_found"},
+		{"wrong method", "DELETE", "/status", "", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"missing key", "GET", "/sdk/latest-all", "", "", http.StatusUnauthorized, "unauthorized"},
+		{"unknown key", "GET", "/sdk/latest-all", "sdk-00000000-0000-4000-8000-000000000000", "", http.StatusUnauthorized, "unauthorized"},
+		{"unknown flag", "GET", "/sdk/latest-flags/no-such-flag", sdkKey, "", http.StatusNotFound, "not_found"},
+		{"wrong content type", "REPORT", "/sdk/eval/user", sdkKey, `{"key":"user"}`, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"events disabled", "POST", "/bulk", sdkKey, "[]", http.StatusNotFound, "not_found"},
+		{"admin credentials", "GET", "/internal/export/env1", "", "", http.StatusUnauthorized, "unauthorized"},
+	}
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			req, _ := http.NewRequest(s.method, s.path, bytes.NewBufferString(s.body))
+			if s.authKey != "" {
+				req.Header.Set("Authorization", s.authKey)
+			}
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+
+			assert.Equal(t, s.expectedStatus, resp.Code)
+			assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+			var body ErrorJson
+			if assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body)) {
+				assert.Equal(t, s.expectedCode, body.Code)
+				assert.NotEmpty(t, body.Message)
+				assert.NotEmpty(t, body.RequestId)
+				assert.Equal(t, resp.Header().Get(requestIdHeader), body.RequestId)
+			}
+		})
+	}
+}
+
+func TestErrorCodeForUnlistedStatus(t *testing.T) {
+	assert.Equal(t, "invalid_request", errorCode(http.StatusTeapot))
+	assert.Equal(t, "internal_error", errorCode(http.StatusBadGateway))
+}
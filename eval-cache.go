@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The most evaluation results each environment's cache holds by default
+const defaultEvalCacheMaxEntries = 10000
+
+// evalCache holds the results of evaluating every flag for a user for a short time, so that clients which
+// poll with the same user, such as a fleet of mobile apps polling every 30 seconds, are answered without
+// evaluating every flag again. Results are keyed by their ETag, which covers the user and the version of
+// every flag and segment, so a change to any of them is never hidden by the cache. One evalCache serves an
+// environment; it is nil if caching is disabled.
+type evalCache struct {
+	ttl        time.Duration
+	maxEntries int
+	mu         sync.Mutex
+	entries    map[string]evalCacheEntry
+	hits       int64
+	misses     int64
+}
+
+type evalCacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+// evalCacheStats describes how often an environment's evaluation results were served from the cache
+type evalCacheStats struct {
+	Entries int     `json:"entries"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hitRate"`
+}
+
+// Returns a cache that holds results for ttl, or nil if ttl is not positive
+func newEvalCache(ttl time.Duration, maxEntries int) *evalCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultEvalCacheMaxEntries
+	}
+	return &evalCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]evalCacheEntry)}
+}
+
+// Returns the cached response body for the ETag, if it hasn't expired
+func (c *evalCache) get(etag string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[etag]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, etag)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return entry.body, true
+}
+
+// Caches a response body. When the cache is full, expired results are dropped first, then arbitrary ones.
+func (c *evalCache) put(etag string, body []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.maxEntries {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		for key := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+	c.entries[etag] = evalCacheEntry{body: body, expires: now.Add(c.ttl)}
+}
+
+func (c *evalCache) stats() evalCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := evalCacheStats{Entries: len(c.entries), Hits: c.hits, Misses: c.misses}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRate = float64(c.hits) / float64(total)
+	}
+	return stats
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestEvaluationResultsAreServedFromCache(t *testing.T) {
+	clientCtx := makeTestContextWithData()
+	clientCtx.evalCache = newEvalCache(time.Minute, 0)
+	evaluate := func(userJson string) *httptest.ResponseRecorder {
+		headers := map[string]string{"Content-Type": "application/json"}
+		req := buildRequest("REPORT", nil, headers, userJson, clientCtx)
+		resp := httptest.NewRecorder()
+		evaluateAllFeatureFlags(resp, req)
+		return resp
+	}
+
+	first := evaluate(`{"key":"my-user"}`)
+	second := evaluate(`{"key":"my-user"}`)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, evalCacheStats{Entries: 1, Hits: 1, Misses: 1, HitRate: 0.5}, clientCtx.evalCache.stats())
+
+	evaluate(`{"key":"other-user"}`)
+	clientCtx.store.Upsert(ld.Features, &ld.FeatureFlag{Key: "off-variation-key", Version: 4})
+	updated := evaluate(`{"key":"my-user"}`)
+	assert.NotEqual(t, first.Body.String(), updated.Body.String())
+	assert.Equal(t, int64(3), clientCtx.evalCache.stats().Misses)
+}
+
+func TestEvalCacheExpiresAndStaysWithinLimit(t *testing.T) {
+	assert.Nil(t, newEvalCache(0, 10))
+
+	cache := newEvalCache(20*time.Millisecond, 2)
+	cache.put("a", []byte("1"))
+	cache.put("b", []byte("2"))
+	cache.put("c", []byte("3"))
+	assert.Equal(t, 2, cache.stats().Entries)
+	body, ok := cache.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, "3", string(body))
+
+	time.Sleep(30 * time.Millisecond)
+	_, ok = cache.get("c")
+	assert.False(t, ok)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// Evaluation results are specific to the user, so they may only be cached by the client, and must be
+// revalidated each time; the ETag makes revalidation cheap when nothing has changed
+const evalCacheControl = "private, max-age=0, must-revalidate"
+
+// Computes an ETag for the results of evaluating every flag for a user. The results can only change if the
+// user changes or a flag or segment gets a new version, so the tag is a hash of those, and can be checked
+// without evaluating anything.
+func evalETag(user *ld.User, valueOnly bool, flags map[string]ld.VersionedData, segments map[string]ld.VersionedData) string {
+	userJson, _ := json.Marshal(user)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%t\n%s\n%s", valueOnly, userJson, strings.Join(itemVersions(flags, segments), "\n"))
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// Computes an ETag for flags and segments as they are stored, from their versions
+func storeETag(flags map[string]ld.VersionedData, segments map[string]ld.VersionedData) string {
+	hash := sha256.New()
+	fmt.Fprint(hash, strings.Join(itemVersions(flags, segments), "\n"))
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// Lists the key and version of each flag and segment, in a stable order
+func itemVersions(flags map[string]ld.VersionedData, segments map[string]ld.VersionedData) []string {
+	versions := make([]string, 0, len(flags)+len(segments))
+	for key, flag := range flags {
+		versions = append(versions, fmt.Sprintf("%s:%s:%d", ld.Features.GetNamespace(), key, flag.GetVersion()))
+	}
+	for key, segment := range segments {
+		versions = append(versions, fmt.Sprintf("%s:%s:%d", ld.Segments.GetNamespace(), key, segment.GetVersion()))
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Reports whether the request's If-None-Match header matches the ETag, meaning the client already has the
+// current results
+func etagMatches(req *http.Request, etag string) bool {
+	header := req.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
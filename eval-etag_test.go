@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestFlagEvalETag(t *testing.T) {
+	clientCtx := makeTestContextWithData()
+	evaluate := func(userJson string, ifNoneMatch string) *httptest.ResponseRecorder {
+		headers := map[string]string{"Content-Type": "application/json"}
+		if ifNoneMatch != "" {
+			headers["If-None-Match"] = ifNoneMatch
+		}
+		req := buildRequest("REPORT", nil, headers, userJson, clientCtx)
+		resp := httptest.NewRecorder()
+		evaluateAllFeatureFlags(resp, req)
+		return resp
+	}
+
+	first := evaluate(`{"key":"my-user"}`, "")
+	assert.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, evalCacheControl, first.Header().Get("Cache-Control"))
+
+	t.Run("unchanged", func(t *testing.T) {
+		resp := evaluate(`{"key":"my-user"}`, etag)
+		assert.Equal(t, http.StatusNotModified, resp.Code)
+		assert.Empty(t, resp.Body.String())
+		assert.Equal(t, http.StatusNotModified, evaluate(`{"key":"my-user"}`, `"other", W/`+etag).Code)
+	})
+
+	t.Run("different user", func(t *testing.T) {
+		resp := evaluate(`{"key":"other-user"}`, etag)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.NotEqual(t, etag, resp.Header().Get("ETag"))
+	})
+
+	t.Run("flag updated", func(t *testing.T) {
+		clientCtx.store.Upsert(ld.Features, &ld.FeatureFlag{Key: "off-variation-key", Version: 4})
+		resp := evaluate(`{"key":"my-user"}`, etag)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.NotEqual(t, etag, resp.Header().Get("ETag"))
+	})
+}
@@ -7,7 +7,9 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,7 +22,11 @@ type eventVerbatimRelay struct {
 	mu     *sync.Mutex
 	client *http.Client
 	closer chan struct{}
-	queue  []json.RawMessage
+	// Events by the schema version they were received with, since a payload declares a single version
+	queues map[int][]json.RawMessage
+	queued int
+	// Set when events have been dropped because the queue was full, until the queue is next flushed
+	saturated bool
 }
 
 var rGen *rand.Rand
@@ -35,6 +41,8 @@ const (
 	summaryEventsSchemaVersion = 3
 )
 
+var diagnosticEventClient = upstreamClient(30 * time.Second)
+
 type eventRelayHandler struct {
 	config       Config
 	sdkKey       string
@@ -42,6 +50,13 @@ type eventRelayHandler struct {
 
 	verbatimRelay    *eventVerbatimRelay
 	summarizingRelay *eventSummarizingRelay
+	// Events are also published to these, and only to these if sinksOnly is set
+	sinks     []*eventSinkForwarder
+	sinksOnly bool
+	// The environment's metrics, which count the users in events if usage tracking is enabled
+	metrics *envMetrics
+	// Added to requests to LaunchDarkly
+	headers upstreamHeaders
 
 	mu sync.Mutex
 }
@@ -49,18 +64,43 @@ type eventRelayHandler struct {
 func (r *eventRelayHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	body, bodyErr := ioutil.ReadAll(req.Body)
 	if bodyErr != nil {
-		Error.Printf("Error reading event post body: %+v", bodyErr)
+		Error.Printf("Error reading event post body%s: %+v", forRequest(req), bodyErr)
+		writeBodyReadError(w, req, bodyErr)
+		return
+	}
+	evts := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(body, &evts); err != nil {
+		writeErrorf(w, req, http.StatusBadRequest, "Events must be a JSON array: %s", err)
+		return
 	}
 
 	go func() {
-		if err := recover(); err != nil {
-			Error.Printf("Unexpected panic in event relay : %+v", err)
+		defer func() {
+			if err := recover(); err != nil {
+				Error.Printf("Unexpected panic in event relay : %+v", err)
+				reportPanic(err, map[string]string{"component": "eventRelay"})
+			}
+		}()
+
+		recordEventUsers(r.metrics, evts)
+		if r.config.Events.AddClientIp && isDeviceEventsRequest(req) {
+			ip := clientIp(req)
+			for i, evt := range evts {
+				evts[i] = addUserIp(evt, ip)
+			}
+		}
+		// This comes after adding the address, so that the address can be scrubbed too
+		if privacy := userPrivacyForRequest(req); privacy != nil {
+			for i, evt := range evts {
+				evts[i] = privacy.scrubEvent(evt)
+			}
 		}
 
-		evts := make([]json.RawMessage, 0)
-		err := json.Unmarshal(body, &evts)
-		if err != nil {
-			Error.Printf("Error unmarshaling event post body: %+v", err)
+		for _, sink := range r.sinks {
+			sink.enqueue(evts)
+		}
+		if r.sinksOnly || !r.config.Events.SendEvents {
+			return
 		}
 
 		payloadVersion, _ := strconv.Atoi(req.Header.Get(eventSchemaHeader))
@@ -69,7 +109,7 @@ func (r *eventRelayHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 		}
 		if payloadVersion >= summaryEventsSchemaVersion {
 			// New-style events that have already gone through summarization - deliver them as-is
-			r.getVerbatimRelay().enqueue(evts)
+			r.getVerbatimRelay().enqueue(evts, payloadVersion)
 		} else {
 			r.getSummarizingRelay().enqueue(evts, payloadVersion)
 		}
@@ -78,11 +118,64 @@ func (r *eventRelayHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// Diagnostic events describe an SDK's configuration and connection rather than users, and an SDK sends one only
+// every few minutes, so each is passed straight on to the same path at LaunchDarkly with the SDK's own
+// credentials, rather than being queued with analytics events
+func (r *eventRelayHandler) forwardDiagnosticEvent(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeBodyReadError(w, req, err)
+		return
+	}
+	if !json.Valid(body) {
+		writeError(w, req, http.StatusBadRequest, "Diagnostic event must be JSON")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if r.sinksOnly || !r.config.Events.SendEvents {
+		return
+	}
+
+	uri := diagnosticEventsUri(r.config.Events.EventsUri, req.URL.Path)
+	forwardReq, err := http.NewRequest("POST", uri, bytes.NewReader(body))
+	if err != nil {
+		Error.Printf("Unexpected error while creating diagnostic event request: %+v", err)
+		return
+	}
+	forwardReq.Header.Set("Content-Type", "application/json")
+	forwardRequestId(req, forwardReq)
+	for _, header := range []string{"Authorization", "User-Agent", "X-LaunchDarkly-User-Agent"} {
+		if value := req.Header.Get(header); value != "" {
+			forwardReq.Header.Set(header, value)
+		}
+	}
+	r.headers.apply(forwardReq)
+	go func() {
+		resp, err := diagnosticEventClient.Do(forwardReq)
+		if err != nil {
+			Error.Printf("Unexpected error while sending diagnostic event%s: %+v", forRequest(req), err)
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err := checkStatusCode(resp.StatusCode, uri); err != nil {
+			Error.Printf("Unexpected status code when sending diagnostic event%s: %+v", forRequest(req), err)
+		}
+	}()
+}
+
+// Returns the URL to send diagnostic events to at LaunchDarkly, or at a parent relay, for the path they would
+// be posted to on the events host. The default eventsUri ends in /api/events, under which LaunchDarkly only
+// accepts bulk analytics events, so diagnostic events go to the events host itself.
+func diagnosticEventsUri(eventsUri string, path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(eventsUri, "/"), "/api/events") + path
+}
+
 func (r *eventRelayHandler) getVerbatimRelay() *eventVerbatimRelay {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.verbatimRelay == nil {
-		r.verbatimRelay = newEventVerbatimRelay(r.sdkKey, r.config)
+		r.verbatimRelay = newEventVerbatimRelay(r.sdkKey, r.config, r.headers)
 	}
 	return r.verbatimRelay
 }
@@ -91,11 +184,43 @@ func (r *eventRelayHandler) getSummarizingRelay() *eventSummarizingRelay {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.summarizingRelay == nil {
-		r.summarizingRelay = newEventSummarizingRelay(r.sdkKey, r.config, r.featureStore)
+		r.summarizingRelay = newEventSummarizingRelay(r.sdkKey, r.config, r.featureStore, r.headers)
 	}
 	return r.summarizingRelay
 }
 
+// Returns true if events for this environment are currently being dropped because the queue is full
+func (r *eventRelayHandler) queueSaturated() bool {
+	r.mu.Lock()
+	verbatimRelay := r.verbatimRelay
+	r.mu.Unlock()
+	if verbatimRelay == nil {
+		return false
+	}
+	verbatimRelay.mu.Lock()
+	defer verbatimRelay.mu.Unlock()
+	return verbatimRelay.saturated
+}
+
+// Delivers any queued events and stops the relay's background work, once the environment has been removed
+func (r *eventRelayHandler) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.verbatimRelay != nil {
+		r.verbatimRelay.flush()
+		close(r.verbatimRelay.closer)
+		r.verbatimRelay = nil
+	}
+	if r.summarizingRelay != nil {
+		r.summarizingRelay.close()
+		r.summarizingRelay = nil
+	}
+	for _, sink := range r.sinks {
+		sink.close()
+	}
+	r.sinks = nil
+}
+
 // Create a new handler for serving a specified channel
 func newEventRelayHandler(sdkKey string, config Config, featureStore ld.FeatureStore) *eventRelayHandler {
 	return &eventRelayHandler{
@@ -105,20 +230,23 @@ func newEventRelayHandler(sdkKey string, config Config, featureStore ld.FeatureS
 	}
 }
 
-func newEventVerbatimRelay(sdkKey string, config Config) *eventVerbatimRelay {
+func newEventVerbatimRelay(sdkKey string, config Config, headers upstreamHeaders) *eventVerbatimRelay {
 	res := &eventVerbatimRelay{
-		queue:  make([]json.RawMessage, 0),
+		queues: make(map[int][]json.RawMessage),
 		sdkKey: sdkKey,
 		config: config,
-		client: &http.Client{},
+		client: headers.client(0),
 		closer: make(chan struct{}),
 		mu:     &sync.Mutex{},
 	}
 
 	go func() {
-		if err := recover(); err != nil {
-			Error.Printf("Unexpected panic in event relay : %+v", err)
-		}
+		defer func() {
+			if err := recover(); err != nil {
+				Error.Printf("Unexpected panic in event relay : %+v", err)
+				reportPanic(err, map[string]string{"component": "eventRelay"})
+			}
+		}()
 
 		ticker := time.NewTicker(time.Duration(config.Events.FlushIntervalSecs) * time.Second)
 		for {
@@ -136,18 +264,39 @@ func newEventVerbatimRelay(sdkKey string, config Config) *eventVerbatimRelay {
 }
 
 func (er *eventVerbatimRelay) flush() {
-	uri := er.config.Events.EventsUri + "/bulk"
 	er.mu.Lock()
-	if len(er.queue) == 0 {
+	if er.queued == 0 {
 		er.mu.Unlock()
 		return
 	}
 
-	events := er.queue
-	er.queue = make([]json.RawMessage, 0)
+	queues := er.queues
+	er.queues = make(map[int][]json.RawMessage)
+	er.queued = 0
+	er.saturated = false
 	er.mu.Unlock()
 
+	versions := make([]int, 0, len(queues))
+	for version := range queues {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	for _, version := range versions {
+		events := queues[version]
+		// When throttled, the events are sent in batches that can each go out without a long wait
+		batchSize := eventThrottle.batchSize()
+		for batchSize > 0 && len(events) > batchSize {
+			er.send(events[:batchSize], version)
+			events = events[batchSize:]
+		}
+		er.send(events, version)
+	}
+}
+
+func (er *eventVerbatimRelay) send(events []json.RawMessage, schemaVersion int) {
+	uri := er.config.Events.EventsUri + "/bulk"
 	payload, _ := json.Marshal(events)
+	eventThrottle.wait(len(events), len(payload))
 
 	req, reqErr := http.NewRequest("POST", uri, bytes.NewReader(payload))
 
@@ -158,7 +307,7 @@ func (er *eventVerbatimRelay) flush() {
 	req.Header.Add("Authorization", er.sdkKey)
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("User-Agent", "LDRelay/"+Version)
-	req.Header.Add(eventSchemaHeader, strconv.Itoa(summaryEventsSchemaVersion))
+	req.Header.Add(eventSchemaHeader, strconv.Itoa(schemaVersion))
 
 	resp, respErr := er.client.Do(req)
 
@@ -179,7 +328,7 @@ func (er *eventVerbatimRelay) flush() {
 	}
 }
 
-func (er *eventVerbatimRelay) enqueue(evts []json.RawMessage) {
+func (er *eventVerbatimRelay) enqueue(evts []json.RawMessage, schemaVersion int) {
 	if !er.config.Events.SendEvents {
 		return
 	}
@@ -191,10 +340,12 @@ func (er *eventVerbatimRelay) enqueue(evts []json.RawMessage) {
 	er.mu.Lock()
 	defer er.mu.Unlock()
 
-	if len(er.queue) >= er.config.Events.Capacity {
+	if er.queued >= er.config.Events.Capacity {
 		Warning.Println("Exceeded event queue capacity. Increase capacity to avoid dropping events.")
+		er.saturated = true
 	} else {
-		er.queue = append(er.queue, evts...)
+		er.queues[schemaVersion] = append(er.queues[schemaVersion], evts...)
+		er.queued += len(evts)
 	}
 }
 
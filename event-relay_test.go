@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+type receivedEventPost struct {
+	path    string
+	headers http.Header
+	body    string
+}
+
+func startFakeEventsServer() (*httptest.Server, func() []receivedEventPost) {
+	var mu sync.Mutex
+	var posts []receivedEventPost
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		posts = append(posts, receivedEventPost{path: req.URL.Path, headers: req.Header, body: string(body)})
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return server, func() []receivedEventPost {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			count := len(posts)
+			mu.Unlock()
+			if count > 0 {
+				break
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received := posts
+		posts = nil
+		return received
+	}
+}
+
+func TestEventsAreForwardedWithTheirSchemaVersion(t *testing.T) {
+	server, received := startFakeEventsServer()
+	defer server.Close()
+
+	var config Config
+	config.Events.EventsUri = server.URL
+	config.Events.SendEvents = true
+	config.Events.Capacity = defaultEventCapacity
+	config.Events.FlushIntervalSecs = 60
+	relay := newEventVerbatimRelay("sdk-key", config, upstreamHeaders{})
+	relay.enqueue([]json.RawMessage{json.RawMessage(`{"kind":"identify"}`)}, 3)
+	relay.enqueue([]json.RawMessage{json.RawMessage(`{"kind":"alias"}`)}, 4)
+	relay.enqueue([]json.RawMessage{json.RawMessage(`{"kind":"custom"}`)}, 3)
+	relay.flush()
+	close(relay.closer)
+
+	posts := received()
+	if assert.Len(t, posts, 2) {
+		assert.Equal(t, "3", posts[0].headers.Get(eventSchemaHeader))
+		assert.JSONEq(t, `[{"kind":"identify"},{"kind":"custom"}]`, posts[0].body)
+		assert.Equal(t, "4", posts[1].headers.Get(eventSchemaHeader))
+		assert.JSONEq(t, `[{"kind":"alias"}]`, posts[1].body)
+	}
+}
+
+func TestDiagnosticEventsAreForwarded(t *testing.T) {
+	server, received := startFakeEventsServer()
+	defer server.Close()
+
+	mobileKey := "mob-98e2b0b4-2688-4a59-9810-1e0e3d7e42d1"
+	envId := "env-id"
+	config := Config{Environment: map[string]*EnvConfig{
+		"env1": {SdkKey: "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0", MobileKey: &mobileKey, EnvId: &envId},
+	}}
+	config.Events.EventsUri = server.URL
+	config.Events.SendEvents = true
+	config.Events.Capacity = defaultEventCapacity
+	config.Events.FlushIntervalSecs = 60
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		return FakeLDClient{true}, nil
+	})
+	defer relay.findEnvironment("env1").close()
+	for deadline := time.Now().Add(time.Second); !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler := relay.getHandler()
+
+	specs := []struct {
+		path          string
+		authorization string
+	}{
+		{"/mobile/events/diagnostic", "mob-98e2b0b4-2688-4a59-9810-1e0e3d7e42d1"},
+		{"/events/diagnostic/env-id", ""},
+		{"/diagnostic", "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"},
+	}
+	for _, s := range specs {
+		req := httptest.NewRequest("POST", s.path, strings.NewReader(`{"kind":"diagnostic","id":{"diagnosticId":"1"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		if s.authorization != "" {
+			req.Header.Set("Authorization", s.authorization)
+		}
+		req.Header.Set("User-Agent", "iOS/4.0.0")
+		req.Header.Set(requestIdHeader, "ios-request-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusAccepted, w.Code, s.path)
+
+		posts := received()
+		if assert.Len(t, posts, 1, s.path) {
+			assert.Equal(t, s.path, posts[0].path)
+			assert.Equal(t, s.authorization, posts[0].headers.Get("Authorization"))
+			assert.Equal(t, "iOS/4.0.0", posts[0].headers.Get("User-Agent"))
+			assert.Equal(t, "ios-request-1", posts[0].headers.Get(requestIdHeader))
+			assert.JSONEq(t, `{"kind":"diagnostic","id":{"diagnosticId":"1"}}`, posts[0].body)
+		}
+	}
+
+	for _, path := range []string{"/diagnostic", "/bulk"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`not json`))
+		req.Header.Set("Authorization", "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+	assert.Len(t, received(), 0)
+}
+
+func TestDiagnosticEventsGoToTheEventsHost(t *testing.T) {
+	specs := []struct {
+		eventsUri string
+		path      string
+		expected  string
+	}{
+		{defaultEventsUri, "/diagnostic", "https://events.launchdarkly.com/diagnostic"},
+		{defaultEventsUri, "/mobile/events/diagnostic", "https://events.launchdarkly.com/mobile/events/diagnostic"},
+		{defaultEventsUri, "/events/diagnostic/env-id", "https://events.launchdarkly.com/events/diagnostic/env-id"},
+		{"https://relay.internal:8030", "/diagnostic", "https://relay.internal:8030/diagnostic"},
+		{"https://events.example.com/api/events/", "/diagnostic", "https://events.example.com/diagnostic"},
+	}
+	for _, s := range specs {
+		assert.Equal(t, s.expected, diagnosticEventsUri(s.eventsUri, s.path))
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPubSubUri          = "https://pubsub.googleapis.com"
+	googleMetadataTokenUri    = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	googlePubSubScope         = "https://www.googleapis.com/auth/pubsub"
+	pubSubMaxMessagesPerBatch = 1000
+	// Pub/Sub allows 10MB per request, and the data is base64-encoded
+	pubSubMaxBatchBytes = 7 * 1024 * 1024
+	eventSinkTimeout    = 30 * time.Second
+	// Access tokens are renewed this long before they expire
+	googleTokenRenewal = time.Minute
+)
+
+var pubSubTopicPattern = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+
+// pubSubSink publishes events to a Google Cloud Pub/Sub topic with the REST API, rather than pulling in the
+// Google Cloud client libraries
+type pubSubSink struct {
+	publishUri string
+	topic      string
+	tokens     *googleTokenSource
+	client     *http.Client
+}
+
+type pubSubMessage struct {
+	Data       string            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Creates a sink for the topic, given as projects/<project>/topics/<topic>. If PUBSUB_EMULATOR_HOST is set,
+// events are sent to the emulator instead, without authorization.
+func newPubSubSinkFromConfig(topic string, c Config) (*pubSubSink, error) {
+	if !pubSubTopicPattern.MatchString(topic) {
+		return nil, fmt.Errorf("invalid pubSubTopic %q; expected projects/<project>/topics/<topic>", topic)
+	}
+	if emulatorHost := os.Getenv("PUBSUB_EMULATOR_HOST"); emulatorHost != "" {
+		return newPubSubSink("http://"+emulatorHost, topic, nil), nil
+	}
+	tokens, err := newGoogleTokenSource(c, googlePubSubScope)
+	if err != nil {
+		return nil, err
+	}
+	return newPubSubSink(defaultPubSubUri, topic, tokens), nil
+}
+
+func newPubSubSink(baseUri string, topic string, tokens *googleTokenSource) *pubSubSink {
+	return &pubSubSink{
+		publishUri: strings.TrimRight(baseUri, "/") + "/v1/" + topic + ":publish",
+		topic:      topic,
+		tokens:     tokens,
+		client:     &http.Client{Timeout: eventSinkTimeout},
+	}
+}
+
+func (s *pubSubSink) String() string {
+	return "Pub/Sub topic " + s.topic
+}
+
+func (s *pubSubSink) publish(messages []eventSinkMessage) error {
+	batches, tooLarge := batchEventSinkMessages(messages, pubSubMaxMessagesPerBatch, pubSubMaxBatchBytes)
+	for _, batch := range batches {
+		if err := s.publishBatch(batch); err != nil {
+			return err
+		}
+	}
+	if tooLarge > 0 {
+		return fmt.Errorf("%d events were too large to publish", tooLarge)
+	}
+	return nil
+}
+
+func (s *pubSubSink) publishBatch(batch []eventSinkMessage) error {
+	body := struct {
+		Messages []pubSubMessage `json:"messages"`
+	}{make([]pubSubMessage, 0, len(batch))}
+	for _, m := range batch {
+		body.Messages = append(body.Messages, pubSubMessage{Data: base64.StdEncoding.EncodeToString(m.data), Attributes: m.attributes})
+	}
+	payload, _ := json.Marshal(body)
+
+	req, err := http.NewRequest("POST", s.publishUri, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "LDRelay/"+Version)
+	if s.tokens != nil {
+		token, err := s.tokens.getToken()
+		if err != nil {
+			return fmt.Errorf("unable to get a Google access token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// googleServiceAccount is the part of a service account key file needed to get access tokens
+type googleServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenUri    string `json:"token_uri"`
+	key         *rsa.PrivateKey
+}
+
+func loadGoogleServiceAccount(path string) (*googleServiceAccount, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account googleServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, errors.New("not a service account key file")
+	}
+	if account.TokenUri == "" {
+		account.TokenUri = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("private_key is not PEM-encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid private_key: %s", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	account.key = key
+	return &account, nil
+}
+
+// googleTokenSource supplies access tokens for Google Cloud APIs, exchanging a JWT signed with a service
+// account's key for one if there is a key, and otherwise asking the metadata server of the Compute Engine
+// instance or GKE node. Tokens are reused until shortly before they expire.
+type googleTokenSource struct {
+	account     *googleServiceAccount
+	scope       string
+	metadataUri string
+	client      *http.Client
+	mu          sync.Mutex
+	token       string
+	expires     time.Time
+}
+
+type googleTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Returns a token source for the scope that uses the service account key in [gcp] credentialsFile or
+// GOOGLE_APPLICATION_CREDENTIALS if there is one, and otherwise the service account of the instance the relay
+// runs on
+func newGoogleTokenSource(c Config, scope string) (*googleTokenSource, error) {
+	credentialsFile := c.GCP.CredentialsFile
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	tokens := &googleTokenSource{scope: scope, client: &http.Client{Timeout: eventSinkTimeout}}
+	if credentialsFile != "" {
+		account, err := loadGoogleServiceAccount(credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read Google credentials from %s: %s", credentialsFile, err)
+		}
+		tokens.account = account
+	}
+	return tokens, nil
+}
+
+func (s *googleTokenSource) getToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.expires.Add(-googleTokenRenewal)) {
+		return s.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if s.account != nil {
+		assertion, err := s.account.signedJwt(s.scope, time.Now())
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+		if req, err = http.NewRequest("POST", s.account.TokenUri, strings.NewReader(form.Encode())); err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		metadataUri := s.metadataUri
+		if metadataUri == "" {
+			metadataUri = googleMetadataTokenUri
+		}
+		if req, err = http.NewRequest("GET", metadataUri, nil); err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response code %d from %s: %s", resp.StatusCode, req.URL, strings.TrimSpace(string(body)))
+	}
+	var token googleTokenResponse
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("invalid token response from %s", req.URL)
+	}
+	s.token = token.AccessToken
+	s.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// Returns the assertion that the token endpoint exchanges for an access token
+func (a *googleServiceAccount) signedJwt(scope string, now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   a.ClientEmail,
+		"scope": scope,
+		"aud":   a.TokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sqsApiVersion          = "2012-11-05"
+	sqsMaxMessagesPerBatch = 10
+	// SQS allows 256KB per request, including all of its messages
+	sqsMaxBatchBytes = 256 * 1024
+)
+
+// Matches the regional SQS endpoints, sqs.<region>.amazonaws.com and the older <region>.queue.amazonaws.com
+var sqsHostPattern = regexp.MustCompile(`^(?:sqs\.([a-z0-9-]+)|([a-z0-9-]+)\.queue)\.amazonaws\.com(?:\.cn)?$`)
+
+// sqsSink sends events to an AWS SQS queue with the query API, signing requests itself rather than pulling
+// in the AWS SDK
+type sqsSink struct {
+	queueUrl    string
+	region      string
+	credentials awsCredentials
+	client      *http.Client
+}
+
+type awsCredentials struct {
+	accessKeyId     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+type sqsBatchResponse struct {
+	Failed []struct {
+		Id      string
+		Code    string
+		Message string
+	} `xml:"SendMessageBatchResult>BatchResultErrorEntry"`
+}
+
+type sqsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// Creates a sink for the queue. The region is taken from [aws] region if set, and otherwise from the queue
+// URL.
+func newSqsSinkFromConfig(queueUrl string, c Config) (*sqsSink, error) {
+	parsed, err := url.Parse(queueUrl)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" || strings.Trim(parsed.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid sqsQueueUrl %q; expected https://sqs.<region>.amazonaws.com/<account>/<queue>", queueUrl)
+	}
+	region := c.AWS.Region
+	if region == "" {
+		if match := sqsHostPattern.FindStringSubmatch(parsed.Hostname()); match != nil {
+			region = match[1] + match[2]
+		}
+	}
+	if region == "" {
+		return nil, fmt.Errorf("unable to tell the AWS region from sqsQueueUrl %q; set region in [aws]", queueUrl)
+	}
+	credentials, err := awsCredentialsFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	return &sqsSink{
+		queueUrl:    queueUrl,
+		region:      region,
+		credentials: credentials,
+		client:      &http.Client{Timeout: eventSinkTimeout},
+	}, nil
+}
+
+// Returns the credentials in [aws] accessKeyId and secretAccessKey if set, and otherwise those in the
+// standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables
+func awsCredentialsFromConfig(c Config) (awsCredentials, error) {
+	credentials := awsCredentials{accessKeyId: c.AWS.AccessKeyId, secretAccessKey: c.AWS.SecretAccessKey}
+	if credentials.accessKeyId == "" {
+		credentials = awsCredentials{
+			accessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	if credentials.accessKeyId == "" || credentials.secretAccessKey == "" {
+		return credentials, errors.New("no AWS credentials; set accessKeyId and secretAccessKey in [aws], or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return credentials, nil
+}
+
+func (s *sqsSink) String() string {
+	return "SQS queue " + s.queueUrl
+}
+
+func (s *sqsSink) publish(messages []eventSinkMessage) error {
+	batches, tooLarge := batchEventSinkMessages(messages, sqsMaxMessagesPerBatch, sqsMaxBatchBytes)
+	for _, batch := range batches {
+		if err := s.publishBatch(batch); err != nil {
+			return err
+		}
+	}
+	if tooLarge > 0 {
+		return fmt.Errorf("%d events were too large to publish", tooLarge)
+	}
+	return nil
+}
+
+func (s *sqsSink) publishBatch(batch []eventSinkMessage) error {
+	form := url.Values{"Action": {"SendMessageBatch"}, "Version": {sqsApiVersion}}
+	for i, m := range batch {
+		entry := "SendMessageBatchRequestEntry." + strconv.Itoa(i+1) + "."
+		form.Set(entry+"Id", strconv.Itoa(i))
+		form.Set(entry+"MessageBody", string(m.data))
+		names := make([]string, 0, len(m.attributes))
+		for name := range m.attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for j, name := range names {
+			attribute := entry + "MessageAttribute." + strconv.Itoa(j+1) + "."
+			form.Set(attribute+"Name", name)
+			form.Set(attribute+"Value.DataType", "String")
+			form.Set(attribute+"Value.StringValue", m.attributes[name])
+		}
+	}
+	body := []byte(form.Encode())
+
+	req, err := http.NewRequest("POST", s.queueUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "LDRelay/"+Version)
+	signAwsRequest(req, body, "sqs", s.region, s.credentials, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		var errorResponse sqsErrorResponse
+		if xml.Unmarshal(respBody, &errorResponse) == nil && errorResponse.Code != "" {
+			return fmt.Errorf("unexpected response code %d: %s: %s", resp.StatusCode, errorResponse.Code, errorResponse.Message)
+		}
+		return fmt.Errorf("unexpected response code %d", resp.StatusCode)
+	}
+	var result sqsBatchResponse
+	if err := xml.Unmarshal(respBody, &result); err == nil && len(result.Failed) > 0 {
+		return fmt.Errorf("%d of %d events were rejected: %s: %s", len(result.Failed), len(batch), result.Failed[0].Code, result.Failed[0].Message)
+	}
+	return nil
+}
+
+// Adds an AWS Signature Version 4 authorization to a request. The host, the x-amz-* headers and the
+// content type, if any, are signed.
+func signAwsRequest(req *http.Request, body []byte, service string, region string, credentials awsCredentials, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// Query parameters are sorted by key and then value, and encoded with %20 for spaces
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var queryParts []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			queryParts = append(queryParts, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{req.Method, path, strings.Join(queryParts, "&"), canonicalHeaders.String(),
+		signedHeaders, hex.EncodeToString(bodyHash[:])}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSha256([]byte("AWS4"+credentials.secretAccessKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.accessKeyId, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func awsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Events are published at the events flush interval, or at this interval if none is configured
+const defaultEventSinkFlushInterval = 5 * time.Second
+
+// eventSink publishes analytics events to a message queue, so that systems other than LaunchDarkly can
+// consume them as they arrive
+type eventSink interface {
+	// Publishes each message separately, splitting them into as many requests as the service needs
+	publish(messages []eventSinkMessage) error
+	String() string
+}
+
+// eventSinkMessage is one event, with attributes that let consumers filter events without parsing them
+type eventSinkMessage struct {
+	data       json.RawMessage
+	attributes map[string]string
+}
+
+// eventSinkForwarder queues the events received for an environment and publishes them to a sink in batches
+type eventSinkForwarder struct {
+	sink      eventSink
+	envName   string
+	capacity  int
+	mu        sync.Mutex
+	queue     []json.RawMessage
+	saturated bool
+	closer    chan struct{}
+}
+
+// Creates forwarders for the sinks configured for an environment
+func newEventSinks(envName string, envConfig EnvConfig, c Config) ([]*eventSinkForwarder, error) {
+	var forwarders []*eventSinkForwarder
+	if envConfig.PubSubTopic != "" {
+		sink, err := newPubSubSinkFromConfig(envConfig.PubSubTopic, c)
+		if err != nil {
+			return nil, err
+		}
+		forwarders = append(forwarders, newEventSinkForwarder(sink, envName, c))
+	}
+	if envConfig.SqsQueueUrl != "" {
+		sink, err := newSqsSinkFromConfig(envConfig.SqsQueueUrl, c)
+		if err != nil {
+			for _, f := range forwarders {
+				f.close()
+			}
+			return nil, err
+		}
+		forwarders = append(forwarders, newEventSinkForwarder(sink, envName, c))
+	}
+	return forwarders, nil
+}
+
+// Checks an environment's sink settings, so that mistakes are found when the relay starts rather than when
+// the first events arrive
+func validateEventSinks(c Config, envConfig EnvConfig) error {
+	if envConfig.PubSubTopic != "" {
+		if _, err := newPubSubSinkFromConfig(envConfig.PubSubTopic, c); err != nil {
+			return err
+		}
+	}
+	if envConfig.SqsQueueUrl != "" {
+		if _, err := newSqsSinkFromConfig(envConfig.SqsQueueUrl, c); err != nil {
+			return err
+		}
+	}
+	if envConfig.EventSinksOnly && envConfig.PubSubTopic == "" && envConfig.SqsQueueUrl == "" {
+		return errors.New("eventSinksOnly requires pubSubTopic or sqsQueueUrl")
+	}
+	return nil
+}
+
+func newEventSinkForwarder(sink eventSink, envName string, c Config) *eventSinkForwarder {
+	f := &eventSinkForwarder{
+		sink:     sink,
+		envName:  envName,
+		capacity: c.Events.Capacity,
+		closer:   make(chan struct{}),
+	}
+	interval := time.Duration(c.Events.FlushIntervalSecs) * time.Second
+	if interval <= 0 {
+		interval = defaultEventSinkFlushInterval
+	}
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				Error.Printf("Unexpected panic in event sink : %+v", err)
+				reportPanic(err, map[string]string{"component": "eventSink"})
+			}
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.flush()
+			case <-f.closer:
+				return
+			}
+		}
+	}()
+
+	return f
+}
+
+func (f *eventSinkForwarder) enqueue(evts []json.RawMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.capacity > 0 && len(f.queue) >= f.capacity {
+		if !f.saturated {
+			Warning.Printf("Exceeded event queue capacity for %s. Increase capacity to avoid dropping events.", f.sink)
+		}
+		f.saturated = true
+		return
+	}
+	f.queue = append(f.queue, evts...)
+}
+
+func (f *eventSinkForwarder) flush() {
+	f.mu.Lock()
+	events := f.queue
+	f.queue = nil
+	f.saturated = false
+	f.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	messages := make([]eventSinkMessage, 0, len(events))
+	for _, evt := range events {
+		attributes := map[string]string{"environment": f.envName}
+		if kind := eventKind(evt); kind != "" {
+			attributes["kind"] = kind
+		}
+		messages = append(messages, eventSinkMessage{data: evt, attributes: attributes})
+	}
+	if err := f.sink.publish(messages); err != nil {
+		Error.Printf("Error publishing events for environment %s to %s: %s", f.envName, f.sink, err)
+	}
+}
+
+// Publishes any queued events and stops publishing, once the environment has been removed
+func (f *eventSinkForwarder) close() {
+	f.flush()
+	close(f.closer)
+}
+
+func eventKind(evt json.RawMessage) string {
+	var fields struct {
+		Kind string `json:"kind"`
+	}
+	json.Unmarshal(evt, &fields)
+	return fields.Kind
+}
+
+// Splits messages into batches of at most maxCount messages and, if maxBytes is > 0, at most maxBytes of
+// message data. Messages that are too large to send at all are left out, and counted.
+func batchEventSinkMessages(messages []eventSinkMessage, maxCount int, maxBytes int) (batches [][]eventSinkMessage, tooLarge int) {
+	var batch []eventSinkMessage
+	batchBytes := 0
+	for _, m := range messages {
+		if maxBytes > 0 && len(m.data) > maxBytes {
+			tooLarge++
+			continue
+		}
+		if len(batch) == maxCount || (maxBytes > 0 && batchBytes+len(m.data) > maxBytes) {
+			batches = append(batches, batch)
+			batch, batchBytes = nil, 0
+		}
+		batch = append(batch, m)
+		batchBytes += len(m.data)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, tooLarge
+}
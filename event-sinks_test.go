@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeEventSink struct {
+	mu       sync.Mutex
+	messages []eventSinkMessage
+}
+
+func (s *fakeEventSink) publish(messages []eventSinkMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, messages...)
+	return nil
+}
+
+func (s *fakeEventSink) String() string {
+	return "fake sink"
+}
+
+func (s *fakeEventSink) published() []eventSinkMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.messages
+}
+
+// Events are handed on to sinks in the background, so this waits until some have been queued
+func waitForSinkQueue(forwarder *eventSinkForwarder, count int) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		forwarder.mu.Lock()
+		queued := len(forwarder.queue)
+		forwarder.mu.Unlock()
+		if queued >= count {
+			return
+		}
+	}
+}
+
+func TestEventsArePublishedToSinksOnly(t *testing.T) {
+	var config Config
+	config.Events.Capacity = defaultEventCapacity
+	sink := &fakeEventSink{}
+	handler := newEventRelayHandler("sdk-key", config, nil)
+	handler.sinks = []*eventSinkForwarder{newEventSinkForwarder(sink, "env1", config)}
+	handler.sinksOnly = true
+
+	body := `[{"kind":"feature","key":"flag"},{"kind":"custom","key":"click"}]`
+	req, _ := http.NewRequest("POST", "/bulk", strings.NewReader(body))
+	req.Header.Set(eventSchemaHeader, "3")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	waitForSinkQueue(handler.sinks[0], 2)
+	handler.close()
+
+	messages := sink.published()
+	if assert.Len(t, messages, 2) {
+		assert.JSONEq(t, `{"kind":"feature","key":"flag"}`, string(messages[0].data))
+		assert.Equal(t, map[string]string{"environment": "env1", "kind": "feature"}, messages[0].attributes)
+		assert.Equal(t, map[string]string{"environment": "env1", "kind": "custom"}, messages[1].attributes)
+	}
+	assert.Nil(t, handler.verbatimRelay, "events should not have been sent to LaunchDarkly")
+}
+
+func TestBatchEventSinkMessages(t *testing.T) {
+	message := func(size int) eventSinkMessage {
+		return eventSinkMessage{data: bytes.Repeat([]byte("x"), size)}
+	}
+	batches, tooLarge := batchEventSinkMessages([]eventSinkMessage{message(1), message(1), message(1)}, 2, 0)
+	assert.Equal(t, 0, tooLarge)
+	assert.Equal(t, [][]eventSinkMessage{{message(1), message(1)}, {message(1)}}, batches)
+
+	batches, tooLarge = batchEventSinkMessages([]eventSinkMessage{message(6), message(20), message(5), message(4)}, 10, 10)
+	assert.Equal(t, 1, tooLarge)
+	assert.Equal(t, [][]eventSinkMessage{{message(6)}, {message(5), message(4)}}, batches)
+}
+
+func TestValidateEventSinks(t *testing.T) {
+	var config Config
+	config.AWS.AccessKeyId = "AKID"
+	config.AWS.SecretAccessKey = "secret"
+
+	assert.NoError(t, validateEventSinks(config, EnvConfig{PubSubTopic: "projects/p/topics/t", EventSinksOnly: true}))
+	assert.NoError(t, validateEventSinks(config, EnvConfig{SqsQueueUrl: "https://sqs.eu-west-1.amazonaws.com/123456789012/events"}))
+	assert.Error(t, validateEventSinks(config, EnvConfig{PubSubTopic: "my-topic"}))
+	assert.Error(t, validateEventSinks(config, EnvConfig{SqsQueueUrl: "https://queue.example.com/123456789012/events"}))
+	assert.Error(t, validateEventSinks(config, EnvConfig{SqsQueueUrl: "https://sqs.eu-west-1.amazonaws.com"}))
+	assert.Error(t, validateEventSinks(config, EnvConfig{EventSinksOnly: true}))
+
+	config.AWS.Region = "us-west-2"
+	assert.NoError(t, validateEventSinks(config, EnvConfig{SqsQueueUrl: "https://queue.example.com/123456789012/events"}))
+}
+
+func TestSignAwsRequest(t *testing.T) {
+	// The get-vanilla case from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	credentials := awsCredentials{accessKeyId: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAwsRequest(req, nil, "service", "us-east-1", credentials, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", req.Header.Get("Authorization"))
+}
+
+func TestSqsSinkSendsBatches(t *testing.T) {
+	var requests []*http.Request
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		requests = append(requests, req)
+		forms = append(forms, req.PostForm)
+		w.Write([]byte(`<SendMessageBatchResponse><SendMessageBatchResult></SendMessageBatchResult></SendMessageBatchResponse>`))
+	}))
+	defer server.Close()
+
+	var config Config
+	config.AWS.AccessKeyId = "AKID"
+	config.AWS.SecretAccessKey = "secret"
+	config.AWS.Region = "us-east-1"
+	sink, err := newSqsSinkFromConfig(server.URL+"/123456789012/events", config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var messages []eventSinkMessage
+	for i := 0; i < 12; i++ {
+		messages = append(messages, eventSinkMessage{data: json.RawMessage(`{"kind":"custom"}`), attributes: map[string]string{"kind": "custom"}})
+	}
+	assert.NoError(t, sink.publish(messages))
+
+	if assert.Len(t, requests, 2) {
+		assert.Equal(t, "/123456789012/events", requests[0].URL.Path)
+		assert.True(t, strings.HasPrefix(requests[0].Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		assert.Contains(t, requests[0].Header.Get("Authorization"), "/us-east-1/sqs/aws4_request")
+		assert.Equal(t, "SendMessageBatch", forms[0].Get("Action"))
+		assert.Equal(t, `{"kind":"custom"}`, forms[0].Get("SendMessageBatchRequestEntry.10.MessageBody"))
+		assert.Equal(t, "custom", forms[0].Get("SendMessageBatchRequestEntry.1.MessageAttribute.1.Value.StringValue"))
+		assert.Equal(t, "", forms[0].Get("SendMessageBatchRequestEntry.11.MessageBody"))
+		assert.Equal(t, `{"kind":"custom"}`, forms[1].Get("SendMessageBatchRequestEntry.2.MessageBody"))
+	}
+}
+
+func TestSqsSinkReportsRejectedMessages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`<SendMessageBatchResponse><SendMessageBatchResult><BatchResultErrorEntry><Id>0</Id>` +
+			`<Code>InvalidMessageContents</Code><Message>bad</Message></BatchResultErrorEntry></SendMessageBatchResult></SendMessageBatchResponse>`))
+	}))
+	defer server.Close()
+
+	var config Config
+	config.AWS.AccessKeyId = "AKID"
+	config.AWS.SecretAccessKey = "secret"
+	config.AWS.Region = "us-east-1"
+	sink, _ := newSqsSinkFromConfig(server.URL+"/123456789012/events", config)
+	err := sink.publish([]eventSinkMessage{{data: json.RawMessage(`{}`)}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "InvalidMessageContents")
+	}
+}
+
+func TestPubSubSinkPublishesWithServiceAccountToken(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyBytes, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		parts := strings.Split(req.PostForm.Get("assertion"), ".")
+		if !assert.Len(t, parts, 3) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature))
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		assert.Contains(t, string(claims), `"iss":"relay@project.iam.gserviceaccount.com"`)
+		w.Write([]byte(`{"access_token":"the-token","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer tokenServer.Close()
+
+	credentialsFile, _ := ioutil.TempFile("", "credentials")
+	defer os.Remove(credentialsFile.Name())
+	credentials, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "relay@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})),
+		"token_uri":    tokenServer.URL,
+	})
+	credentialsFile.Write(credentials)
+	credentialsFile.Close()
+
+	var published struct {
+		Messages []pubSubMessage `json:"messages"`
+	}
+	var authorization, path string
+	pubSubServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		path = req.URL.Path
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &published)
+		w.Write([]byte(`{"messageIds":["1"]}`))
+	}))
+	defer pubSubServer.Close()
+
+	var config Config
+	config.GCP.CredentialsFile = credentialsFile.Name()
+	sink, err := newPubSubSinkFromConfig("projects/project/topics/events", config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sink.publishUri = pubSubServer.URL + "/v1/projects/project/topics/events:publish"
+	err = sink.publish([]eventSinkMessage{{data: json.RawMessage(`{"kind":"custom"}`), attributes: map[string]string{"kind": "custom"}}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Bearer the-token", authorization)
+	assert.Equal(t, "/v1/projects/project/topics/events:publish", path)
+	if assert.Len(t, published.Messages, 1) {
+		data, _ := base64.StdEncoding.DecodeString(published.Messages[0].Data)
+		assert.Equal(t, `{"kind":"custom"}`, string(data))
+		assert.Equal(t, map[string]string{"kind": "custom"}, published.Messages[0].Attributes)
+	}
+}
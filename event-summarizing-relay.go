@@ -12,18 +12,36 @@ import (
 type eventSummarizingRelay struct {
 	eventProcessor ld.EventProcessor
 	featureStore   ld.FeatureStore
+	// Set if events are throttled
+	throttledTransport *throttledTransport
 }
 
-func newEventSummarizingRelay(sdkKey string, config Config, featureStore ld.FeatureStore) *eventSummarizingRelay {
+func newEventSummarizingRelay(sdkKey string, config Config, featureStore ld.FeatureStore, headers upstreamHeaders) *eventSummarizingRelay {
 	ldConfig := ld.DefaultConfig
 	ldConfig.EventsUri = config.Events.EventsUri
 	ldConfig.Capacity = config.Events.Capacity
 	ldConfig.InlineUsersInEvents = config.Events.InlineUsers
 	ldConfig.FlushInterval = time.Duration(config.Events.FlushIntervalSecs) * time.Second
-	ep := ld.NewDefaultEventProcessor(sdkKey, ldConfig, nil)
+	ldConfig.UserAgent = "LDRelay/" + Version
+	client := headers.client(0)
+	var throttled *throttledTransport
+	if eventThrottle != nil {
+		throttled = newThrottledTransport(client.Transport, eventThrottle, maxQueuedEventPayloads)
+		client.Transport = throttled
+	}
+	ep := ld.NewDefaultEventProcessor(sdkKey, ldConfig, client)
 	return &eventSummarizingRelay{
-		eventProcessor: ep,
-		featureStore:   featureStore,
+		eventProcessor:     ep,
+		featureStore:       featureStore,
+		throttledTransport: throttled,
+	}
+}
+
+// Delivers any events that are waiting and stops the event processor
+func (er *eventSummarizingRelay) close() {
+	er.eventProcessor.Close()
+	if er.throttledTransport != nil {
+		er.throttledTransport.close()
 	}
 }
 
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limits the rate at which events are sent to LaunchDarkly across all environments, if a limit is
+// configured; nil otherwise
+var eventThrottle *outboundThrottle
+
+// outboundThrottle spaces out event payloads so that a backlog, such as the one built up by SDKs during an
+// outage, is trickled out rather than sent all at once, where it could saturate the relay's link or trip
+// LaunchDarkly's rate limits. Events wait in the event queue, or payloads from an SDK event processor in a
+// throttledTransport's queue, until they can be sent.
+type outboundThrottle struct {
+	events *tokenBucket
+	bytes  *tokenBucket
+}
+
+// tokenBucket allows a steady rate with bursts of up to a second's worth. Taking more tokens than are
+// available puts the bucket into debt, which later takers wait to be paid off, so a single large payload
+// is never held back forever.
+type tokenBucket struct {
+	rate   float64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newOutboundThrottle(eventsPerSec int, bytesPerSec int) *outboundThrottle {
+	if eventsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	return &outboundThrottle{events: newTokenBucket(eventsPerSec), bytes: newTokenBucket(bytesPerSec)}
+}
+
+// Returns a bucket for the rate, or nil if there is no limit
+func newTokenBucket(perSec int) *tokenBucket {
+	if perSec <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(perSec), tokens: float64(perSec), last: time.Now()}
+}
+
+// Takes n tokens, waiting until the bucket is out of debt
+func (b *tokenBucket) take(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// Waits until a payload of this many events and bytes may be sent
+func (t *outboundThrottle) wait(events int, bytes int) {
+	if t == nil {
+		return
+	}
+	t.events.take(events)
+	t.bytes.take(bytes)
+}
+
+// Returns the most events to send in one payload, so that each payload waits about a second at most
+func (t *outboundThrottle) batchSize() int {
+	if t == nil || t.events == nil {
+		return 0
+	}
+	return int(t.events.rate)
+}
+
+// How many event payloads from an SDK event processor may wait to be sent before more are dropped
+const maxQueuedEventPayloads = 100
+
+// throttledTransport throttles the event payloads sent by an SDK event processor. Each payload is queued and
+// answered with a 202 straight away, so that the processor's flush workers aren't held up while it waits,
+// and a goroutine of the transport's own sends the payloads in turn as the throttle allows. A payload that
+// arrives while the queue is full is dropped, as the processor drops events when its own buffer is full.
+type throttledTransport struct {
+	transport http.RoundTripper
+	throttle  *outboundThrottle
+	queue     chan throttledPayload
+	mu        sync.Mutex
+	closed    bool
+	done      chan struct{}
+}
+
+type throttledPayload struct {
+	req    *http.Request
+	body   []byte
+	events int
+}
+
+func newThrottledTransport(transport http.RoundTripper, throttle *outboundThrottle, queueSize int) *throttledTransport {
+	t := &throttledTransport{
+		transport: transport,
+		throttle:  throttle,
+		queue:     make(chan throttledPayload, queueSize),
+		done:      make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var events []json.RawMessage
+	json.Unmarshal(body, &events)
+	// The payload is sent after this request has been answered, so it mustn't be cancelled along with it
+	payload := throttledPayload{req: req.WithContext(context.Background()), body: body, events: len(events)}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, errors.New("the event transport has been closed")
+	}
+	select {
+	case t.queue <- payload:
+	default:
+		Warning.Printf("Too many event payloads are waiting to be sent; dropping %d events", len(events))
+	}
+	return &http.Response{
+		Status:     "202 Accepted",
+		StatusCode: http.StatusAccepted,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}, nil
+}
+
+// Sends the queued payloads, waiting for the throttle before each, until the transport is closed and the
+// queue is empty
+func (t *throttledTransport) run() {
+	defer close(t.done)
+	for payload := range t.queue {
+		t.throttle.wait(payload.events, len(payload.body))
+		req := payload.req
+		req.Body = ioutil.NopCloser(bytes.NewReader(payload.body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(payload.body)), nil
+		}
+		resp, err := t.transport.RoundTrip(req)
+		if err != nil {
+			Error.Printf("Unexpected error while sending events: %+v", err)
+			continue
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err := checkStatusCode(resp.StatusCode, req.URL.String()); err != nil {
+			Error.Printf("Unexpected status code when sending events: %+v", err)
+		}
+	}
+}
+
+// Sends any payloads that are still queued, and stops the transport
+func (t *throttledTransport) close() {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	<-t.done
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketAllowsBurstThenWaits(t *testing.T) {
+	bucket := newTokenBucket(1000)
+	start := time.Now()
+	bucket.take(1000)
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+
+	bucket.take(100)
+	assert.True(t, time.Since(start) >= 80*time.Millisecond)
+
+	var unlimited *tokenBucket
+	unlimited.take(1000000)
+}
+
+func TestNoThrottleWithoutLimits(t *testing.T) {
+	assert.Nil(t, newOutboundThrottle(0, 0))
+	assert.Equal(t, 0, (*outboundThrottle)(nil).batchSize())
+}
+
+func TestThrottledEventsAreSentInBatches(t *testing.T) {
+	eventThrottle = newOutboundThrottle(100, 0)
+	defer func() { eventThrottle = nil }()
+	server, received := startFakeEventsServer()
+	defer server.Close()
+
+	var config Config
+	config.Events.EventsUri = server.URL
+	config.Events.SendEvents = true
+	config.Events.Capacity = defaultEventCapacity
+	config.Events.FlushIntervalSecs = 60
+	relay := newEventVerbatimRelay("sdk-key", config, upstreamHeaders{})
+	var events []json.RawMessage
+	for i := 0; i < 150; i++ {
+		events = append(events, json.RawMessage(`{"kind":"identify"}`))
+	}
+	relay.enqueue(events, 3)
+	start := time.Now()
+	relay.flush()
+	close(relay.closer)
+
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	posts := received()
+	if assert.Len(t, posts, 2) {
+		var first, second []json.RawMessage
+		json.Unmarshal([]byte(posts[0].body), &first)
+		json.Unmarshal([]byte(posts[1].body), &second)
+		assert.Len(t, first, 100)
+		assert.Len(t, second, 50)
+	}
+}
+
+func TestThrottledTransportQueuesPayloadsUntilThereIsBandwidth(t *testing.T) {
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- body
+	}))
+	defer server.Close()
+
+	transport := newThrottledTransport(http.DefaultTransport, newOutboundThrottle(0, 1000), 1)
+	client := &http.Client{Transport: transport}
+	payload := bytes.Repeat([]byte("x"), 1200)
+	start := time.Now()
+	resp, err := client.Post(server.URL, "application/json", bytes.NewReader(payload))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+	// The caller doesn't wait for the payload to be sent
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+
+	assert.Equal(t, payload, <-received)
+	assert.True(t, time.Since(start) >= 150*time.Millisecond)
+
+	transport.close()
+	_, err = client.Post(server.URL, "application/json", bytes.NewReader(payload))
+	assert.Error(t, err)
+}
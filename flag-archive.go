@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const (
+	defaultGcsUri      = "https://storage.googleapis.com"
+	googleGcsScope     = "https://www.googleapis.com/auth/devstorage.read_write"
+	flagArchiveTimeout = 30 * time.Second
+)
+
+// The archive that environments are bootstrapped from, if one is configured; nil otherwise
+var archive flagArchive
+
+// flagArchive keeps snapshots of each environment's flags and segments outside the relay, in S3 or Google
+// Cloud Storage, so that a relay can start serving straight away instead of waiting for its stream to
+// LaunchDarkly. Each environment's snapshot is an object named after the environment.
+type flagArchive interface {
+	// Returns the environment's snapshot, or nil if there isn't one yet
+	read(envName string) (*storeSnapshot, error)
+	write(envName string, snapshot *storeSnapshot) error
+	String() string
+}
+
+// Splits an archive URL, s3://<bucket>/<prefix> or gs://<bucket>/<prefix>, into its parts. The prefix may be
+// empty.
+func parseArchiveUrl(archiveUrl string) (scheme string, bucket string, prefix string, err error) {
+	parsed, err := url.Parse(archiveUrl)
+	if err != nil || (parsed.Scheme != "s3" && parsed.Scheme != "gs") || parsed.Host == "" {
+		return "", "", "", fmt.Errorf("invalid archive url %q; expected s3://<bucket>/<prefix> or gs://<bucket>/<prefix>", archiveUrl)
+	}
+	return parsed.Scheme, parsed.Host, strings.Trim(parsed.Path, "/"), nil
+}
+
+// Creates the archive in [archive] url
+func newFlagArchiveFromConfig(c Config) (flagArchive, error) {
+	scheme, bucket, prefix, err := parseArchiveUrl(c.Archive.Url)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "s3" {
+		return newS3ArchiveFromConfig(bucket, prefix, c)
+	}
+	baseUri := c.Archive.Endpoint
+	if baseUri == "" {
+		baseUri = defaultGcsUri
+	}
+	tokens, err := newGoogleTokenSource(c, googleGcsScope)
+	if err != nil {
+		return nil, err
+	}
+	return newGcsArchive(baseUri, bucket, prefix, tokens), nil
+}
+
+// Returns the name of the object holding the environment's snapshot
+func archiveObjectName(prefix string, envName string) string {
+	if prefix == "" {
+		return envName + ".json"
+	}
+	return prefix + "/" + envName + ".json"
+}
+
+// Fills an environment's store from its snapshot in the archive, unless the store already has data, as a
+// shared persistent store may. Returns true if the store was filled.
+func bootstrapFromArchive(from flagArchive, envName string, store ld.FeatureStore) bool {
+	if store.Initialized() {
+		return false
+	}
+	snapshot, err := from.read(envName)
+	if err != nil {
+		Warning.Printf("Unable to read the snapshot of environment %s from %s: %s", envName, from, err)
+		return false
+	}
+	if snapshot == nil {
+		Info.Printf("There is no snapshot of environment %s in %s yet", envName, from)
+		return false
+	}
+	if err := store.Init(snapshot.allData()); err != nil {
+		Warning.Printf("Unable to write the snapshot of environment %s to the feature store: %s", envName, err)
+		return false
+	}
+	age := "unknown age"
+	if snapshot.ExportedAt != nil {
+		age = "from " + time.Since(*snapshot.ExportedAt).Round(time.Second).String() + " ago"
+	}
+	Info.Printf("Loaded %d flags and %d segments for environment %s from a snapshot %s", len(snapshot.Flags), len(snapshot.Segments), envName, age)
+	return true
+}
+
+// bootstrappedClient stands in for the client of an environment that was filled from the archive until the
+// real client has been created, so that requests are answered from the store rather than refused
+type bootstrappedClient struct{}
+
+func (bootstrappedClient) Initialized() bool {
+	return false
+}
+
+// Writes a snapshot of the environment to the archive at each interval, until the environment is removed.
+// Nothing is written until the environment has data from LaunchDarkly, and, with leader election, only the
+// leader writes.
+func (c *clientContextImpl) writeArchiveSnapshots(to flagArchive, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.RLock()
+		removed, client := c.removed, c.client
+		c.mu.RUnlock()
+		if removed {
+			return
+		}
+		if client == nil || !client.Initialized() || (election != nil && !election.isLeader()) {
+			continue
+		}
+		store := c.store
+		if overriding, ok := store.(overridingFeatureStore); ok {
+			// Overrides are temporary and don't belong in a snapshot
+			store = overriding.FeatureStore
+		}
+		snapshot, err := exportSnapshot(store, c.name)
+		if err == nil {
+			err = to.write(c.name, snapshot)
+		}
+		if err != nil {
+			Warning.Printf("Unable to write a snapshot of environment %s to %s: %s", c.name, to, err)
+		}
+	}
+}
+
+// s3Archive keeps snapshots in an S3 bucket, signing requests itself as the SQS sink does
+type s3Archive struct {
+	bucketUri   string
+	bucket      string
+	prefix      string
+	region      string
+	credentials awsCredentials
+	client      *http.Client
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Creates an archive in the bucket. The region must be set in [aws] region. If [archive] endpoint is set,
+// the bucket is addressed as a path under it, as S3-compatible stores expect.
+func newS3ArchiveFromConfig(bucket string, prefix string, c Config) (*s3Archive, error) {
+	if c.AWS.Region == "" {
+		return nil, errors.New("an S3 archive needs the bucket's region; set region in [aws]")
+	}
+	credentials, err := awsCredentialsFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	bucketUri := "https://" + bucket + ".s3." + c.AWS.Region + ".amazonaws.com"
+	if c.Archive.Endpoint != "" {
+		bucketUri = strings.TrimRight(c.Archive.Endpoint, "/") + "/" + awsEscape(bucket)
+	}
+	return &s3Archive{
+		bucketUri:   bucketUri,
+		bucket:      bucket,
+		prefix:      prefix,
+		region:      c.AWS.Region,
+		credentials: credentials,
+		client:      upstreamClient(flagArchiveTimeout),
+	}, nil
+}
+
+func (a *s3Archive) String() string {
+	return "s3://" + a.bucket + "/" + a.prefix
+}
+
+func (a *s3Archive) read(envName string) (*storeSnapshot, error) {
+	resp, err := a.do("GET", envName, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := s3ResponseError(resp); err != nil {
+		return nil, err
+	}
+	return readSnapshot(resp.Body)
+}
+
+func (a *s3Archive) write(envName string, snapshot *storeSnapshot) error {
+	body, _ := json.Marshal(snapshot)
+	resp, err := a.do("PUT", envName, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3ResponseError(resp)
+}
+
+func (a *s3Archive) do(method string, envName string, body []byte) (*http.Response, error) {
+	// Each segment of the key is escaped as S3 escapes it when checking the signature
+	segments := strings.Split(archiveObjectName(a.prefix, envName), "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	req, err := http.NewRequest(method, a.bucketUri+"/"+strings.Join(segments, "/"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", "LDRelay/"+Version)
+	bodyHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(bodyHash[:]))
+	signAwsRequest(req, body, "s3", a.region, a.credentials, time.Now())
+	return a.client.Do(req)
+}
+
+func s3ResponseError(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	var errorResponse s3ErrorResponse
+	if xml.Unmarshal(body, &errorResponse) == nil && errorResponse.Code != "" {
+		return fmt.Errorf("unexpected response code %d: %s: %s", resp.StatusCode, errorResponse.Code, errorResponse.Message)
+	}
+	return fmt.Errorf("unexpected response code %d", resp.StatusCode)
+}
+
+// gcsArchive keeps snapshots in a Google Cloud Storage bucket, using the JSON API as the Pub/Sub sink does
+type gcsArchive struct {
+	baseUri string
+	bucket  string
+	prefix  string
+	tokens  *googleTokenSource
+	client  *http.Client
+}
+
+func newGcsArchive(baseUri string, bucket string, prefix string, tokens *googleTokenSource) *gcsArchive {
+	return &gcsArchive{
+		baseUri: strings.TrimRight(baseUri, "/"),
+		bucket:  bucket,
+		prefix:  prefix,
+		tokens:  tokens,
+		client:  upstreamClient(flagArchiveTimeout),
+	}
+}
+
+func (a *gcsArchive) String() string {
+	return "gs://" + a.bucket + "/" + a.prefix
+}
+
+func (a *gcsArchive) read(envName string) (*storeSnapshot, error) {
+	// The object name is one path segment, so its slashes are escaped too
+	uri := a.baseUri + "/storage/v1/b/" + url.PathEscape(a.bucket) + "/o/" + url.PathEscape(archiveObjectName(a.prefix, envName)) + "?alt=media"
+	resp, err := a.do("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := gcsResponseError(resp); err != nil {
+		return nil, err
+	}
+	return readSnapshot(resp.Body)
+}
+
+func (a *gcsArchive) write(envName string, snapshot *storeSnapshot) error {
+	body, _ := json.Marshal(snapshot)
+	uri := a.baseUri + "/upload/storage/v1/b/" + url.PathEscape(a.bucket) + "/o?uploadType=media&name=" + url.QueryEscape(archiveObjectName(a.prefix, envName))
+	resp, err := a.do("POST", uri, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return gcsResponseError(resp)
+}
+
+func (a *gcsArchive) do(method string, uri string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", "LDRelay/"+Version)
+	if a.tokens != nil {
+		token, err := a.tokens.getToken()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get a Google access token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return a.client.Do(req)
+}
+
+func gcsResponseError(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
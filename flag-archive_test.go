@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// memoryArchive keeps snapshots in memory, for testing
+type memoryArchive struct {
+	mu        sync.Mutex
+	snapshots map[string]*storeSnapshot
+}
+
+func (a *memoryArchive) read(envName string) (*storeSnapshot, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.snapshots[envName], nil
+}
+
+func (a *memoryArchive) write(envName string, snapshot *storeSnapshot) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.snapshots[envName] = snapshot
+	return nil
+}
+
+func (a *memoryArchive) String() string {
+	return "memory"
+}
+
+func TestParseArchiveUrl(t *testing.T) {
+	scheme, bucket, prefix, err := parseArchiveUrl("s3://flags/relay/prod/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "s3", scheme)
+		assert.Equal(t, "flags", bucket)
+		assert.Equal(t, "relay/prod", prefix)
+	}
+	scheme, bucket, prefix, err = parseArchiveUrl("gs://flags")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gs", scheme)
+		assert.Equal(t, "flags", bucket)
+		assert.Equal(t, "", prefix)
+	}
+	for _, invalid := range []string{"https://flags/relay", "s3:///relay", "flags"} {
+		_, _, _, err = parseArchiveUrl(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestS3ArchiveWritesAndReadsSnapshots(t *testing.T) {
+	objects := make(map[string][]byte)
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req)
+		switch req.Method {
+		case "PUT":
+			objects[req.URL.EscapedPath()], _ = ioutil.ReadAll(req.Body)
+		case "GET":
+			if data, ok := objects[req.URL.EscapedPath()]; ok {
+				w.Write(data)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		}
+	}))
+	defer server.Close()
+
+	var config Config
+	config.AWS.AccessKeyId = "AKID"
+	config.AWS.SecretAccessKey = "secret"
+	config.AWS.Region = "us-east-1"
+	config.Archive.Url = "s3://flags/relay"
+	config.Archive.Endpoint = server.URL
+	archive, err := newFlagArchiveFromConfig(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "s3://flags/relay", archive.String())
+
+	snapshot, err := archive.read("Spree Production")
+	assert.NoError(t, err)
+	assert.Nil(t, snapshot)
+
+	exported, _ := exportSnapshot(makeStoreWithData(true), "Spree Production")
+	assert.NoError(t, archive.write("Spree Production", exported))
+	snapshot, err = archive.read("Spree Production")
+	if assert.NoError(t, err) && assert.NotNil(t, snapshot) {
+		assert.Equal(t, len(exported.Flags), len(snapshot.Flags))
+		assert.Equal(t, "Spree Production", snapshot.Environment)
+	}
+
+	if assert.Len(t, requests, 3) {
+		put := requests[1]
+		assert.Equal(t, "/flags/relay/Spree%20Production.json", put.URL.EscapedPath())
+		assert.Contains(t, put.Header.Get("Authorization"), "/us-east-1/s3/aws4_request")
+		assert.Contains(t, put.Header.Get("Authorization"), "x-amz-content-sha256")
+		assert.Len(t, put.Header.Get("X-Amz-Content-Sha256"), 64)
+	}
+
+	config.AWS.Region = ""
+	_, err = newFlagArchiveFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestS3ArchiveReportsErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+	}))
+	defer server.Close()
+
+	var config Config
+	config.AWS.AccessKeyId = "AKID"
+	config.AWS.SecretAccessKey = "secret"
+	config.AWS.Region = "us-east-1"
+	config.Archive.Url = "s3://flags"
+	config.Archive.Endpoint = server.URL
+	archive, _ := newFlagArchiveFromConfig(config)
+	_, err := archive.read("env")
+	assert.EqualError(t, err, "unexpected response code 403: AccessDenied: Access Denied")
+}
+
+func TestGcsArchiveWritesAndReadsSnapshots(t *testing.T) {
+	var written []byte
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.Method+" "+req.URL.RequestURI())
+		switch {
+		case req.Method == "POST":
+			written, _ = ioutil.ReadAll(req.Body)
+			w.Write([]byte(`{}`))
+		case written != nil:
+			w.Write(written)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	archive := newGcsArchive(server.URL, "flags", "relay/prod", nil)
+	snapshot, err := archive.read("env")
+	assert.NoError(t, err)
+	assert.Nil(t, snapshot)
+
+	exported, _ := exportSnapshot(makeStoreWithData(true), "env")
+	assert.NoError(t, archive.write("env", exported))
+	snapshot, err = archive.read("env")
+	if assert.NoError(t, err) && assert.NotNil(t, snapshot) {
+		assert.Equal(t, len(exported.Flags), len(snapshot.Flags))
+	}
+	assert.Equal(t, []string{
+		"GET /storage/v1/b/flags/o/relay%2Fprod%2Fenv.json?alt=media",
+		"POST /upload/storage/v1/b/flags/o?uploadType=media&name=relay%2Fprod%2Fenv.json",
+		"GET /storage/v1/b/flags/o/relay%2Fprod%2Fenv.json?alt=media",
+	}, paths)
+}
+
+func TestEnvironmentIsBootstrappedFromArchive(t *testing.T) {
+	exported, _ := exportSnapshot(makeStoreWithData(true), "env1")
+	archive = &memoryArchive{snapshots: map[string]*storeSnapshot{"env1": exported}}
+	defer func() { archive = nil }()
+
+	sdkKey := "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+	config := Config{Environment: map[string]*EnvConfig{"env1": {SdkKey: sdkKey}}}
+	// The client never finishes connecting
+	connecting := make(chan struct{})
+	defer close(connecting)
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		<-connecting
+		return FakeLDClient{true}, nil
+	})
+	defer relay.findEnvironment("env1").close()
+
+	req := httptest.NewRequest("GET", "/sdk/latest-flags", nil)
+	req.Header.Set("Authorization", sdkKey)
+	w := httptest.NewRecorder()
+	relay.getHandler().ServeHTTP(w, req)
+	if assert.Equal(t, http.StatusOK, w.Code) {
+		var flags map[string]json.RawMessage
+		json.Unmarshal(w.Body.Bytes(), &flags)
+		assert.Len(t, flags, len(exported.Flags))
+	}
+	assert.Equal(t, "initializing", relay.findEnvironment("env1").connectionStatus())
+}
+
+func TestSnapshotsAreWrittenToArchiveOnceConnected(t *testing.T) {
+	memory := &memoryArchive{snapshots: map[string]*storeSnapshot{}}
+	archive = memory
+	defer func() { archive = nil }()
+
+	config := Config{Environment: map[string]*EnvConfig{"env1": {SdkKey: "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"}}}
+	config.Archive.WriteIntervalSecs = 1
+	data, _ := exportSnapshot(makeStoreWithData(true), "env1")
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		config.FeatureStore.Init(data.allData())
+		return FakeLDClient{true}, nil
+	})
+	defer relay.findEnvironment("env1").close()
+
+	var snapshot *storeSnapshot
+	for deadline := time.Now().Add(3 * time.Second); snapshot == nil && time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		snapshot, _ = memory.read("env1")
+	}
+	if assert.NotNil(t, snapshot) {
+		assert.Equal(t, "env1", snapshot.Environment)
+		assert.NotEmpty(t, snapshot.Flags)
+		assert.True(t, strings.HasPrefix(snapshot.RelayVersion, Version))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const flagChangeLogSize = 50
+
+type flagChange struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Key     string    `json:"key,omitempty"`
+	Version int       `json:"version,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// flagChangeLog remembers the most recent changes to an environment's flags and segments, for operators
+// trying to work out what the relay has received lately
+type flagChangeLog struct {
+	mu      sync.Mutex
+	changes []flagChange
+	next    int
+}
+
+func newFlagChangeLog() *flagChangeLog {
+	return &flagChangeLog{changes: make([]flagChange, 0, flagChangeLogSize)}
+}
+
+func (l *flagChangeLog) add(change flagChange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.changes) < flagChangeLogSize {
+		l.changes = append(l.changes, change)
+		return
+	}
+	l.changes[l.next] = change
+	l.next = (l.next + 1) % flagChangeLogSize
+}
+
+// Returns the changes in the log, most recent first
+func (l *flagChangeLog) recent() []flagChange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make([]flagChange, 0, len(l.changes))
+	for i := len(l.changes) - 1; i >= 0; i-- {
+		result = append(result, l.changes[(l.next+i)%len(l.changes)])
+	}
+	return result
+}
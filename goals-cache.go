@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// After a failed fetch, the stale goals are served without asking LaunchDarkly again for a while. The wait
+// doubles with each failure in a row.
+var goalsRetryBackoff = reconnectBackoff{initial: time.Second, max: time.Minute}
+
+// goalsCache proxies the goals endpoint for a single client-side environment. Responses are kept in
+// memory for the configured TTL; after that the relay revalidates them with LaunchDarkly using the ETag it
+// was given, and if LaunchDarkly can't be reached the last good response continues to be served. Only one
+// fetch is made at a time, and requests that arrive during it wait for its result rather than making their
+// own, so a slow response from LaunchDarkly doesn't hold up requests that the cache can answer.
+type goalsCache struct {
+	uri      string
+	ttl      time.Duration
+	client   *http.Client
+	mu       sync.Mutex
+	cached   *cachedGoals
+	fetching *goalsFetch
+	failures int
+	retryAt  time.Time
+}
+
+type cachedGoals struct {
+	body        []byte
+	contentType string
+	etag        string
+	statusCode  int
+	fetchedAt   time.Time
+}
+
+// goalsFetch is a fetch from LaunchDarkly that is under way. done is closed once result and err are set.
+type goalsFetch struct {
+	done   chan struct{}
+	result *cachedGoals
+	err    error
+}
+
+// Creates the cache for an environment's goals. Fetching goals from LaunchDarkly gives up after the timeout,
+// if it is not 0.
+func newGoalsCache(baseUri string, envId string, ttl time.Duration, timeout time.Duration, headers upstreamHeaders) *goalsCache {
+	return &goalsCache{
+		uri:    baseUri + "/sdk/goals/" + envId,
+		ttl:    ttl,
+		client: headers.client(timeout),
+	}
+}
+
+// get returns the current goals, fetching or revalidating them with LaunchDarkly when necessary. Only
+// successful responses are cached; other responses are passed back to the caller as they are. The request ID,
+// if any, is sent along with a fetch so that it can be traced back to the request that caused it.
+func (g *goalsCache) get(authorization string, requestId string) (*cachedGoals, error) {
+	g.mu.Lock()
+	if g.cached != nil && (time.Since(g.cached.fetchedAt) < g.ttl || time.Now().Before(g.retryAt)) {
+		cached := g.cached
+		g.mu.Unlock()
+		return cached, nil
+	}
+	if f := g.fetching; f != nil {
+		g.mu.Unlock()
+		<-f.done
+		return f.result, f.err
+	}
+	f := &goalsFetch{done: make(chan struct{})}
+	g.fetching = f
+	etag := ""
+	if g.cached != nil {
+		etag = g.cached.etag
+	}
+	g.mu.Unlock()
+
+	result, err := g.fetch(authorization, requestId, etag)
+
+	g.mu.Lock()
+	f.result, f.err = g.update(result, err)
+	g.fetching = nil
+	g.mu.Unlock()
+	close(f.done)
+	return f.result, f.err
+}
+
+// Updates the cache with the result of a fetch, and returns what should be served. It is called with g.mu held.
+func (g *goalsCache) update(result *cachedGoals, err error) (*cachedGoals, error) {
+	if err == nil && result.statusCode >= http.StatusInternalServerError {
+		err = fmt.Errorf("Unexpected response code: %d when accessing URL: %s", result.statusCode, g.uri)
+	}
+	if err != nil {
+		if g.cached != nil {
+			delay := goalsRetryBackoff.delay(g.failures)
+			g.failures++
+			g.retryAt = time.Now().Add(delay)
+			Warning.Printf("Error fetching goals, serving stale goals fetched at %s for %s: %s", g.cached.fetchedAt, delay, err)
+			return g.cached, nil
+		}
+		if result != nil {
+			return result, nil
+		}
+		return nil, err
+	}
+
+	g.failures = 0
+	g.retryAt = time.Time{}
+	if result.statusCode == http.StatusNotModified && g.cached != nil {
+		// Earlier callers may still be reading the goals they were given, so they aren't changed in place
+		refreshed := *g.cached
+		refreshed.fetchedAt = result.fetchedAt
+		g.cached = &refreshed
+		return g.cached, nil
+	}
+	if result.statusCode == http.StatusOK {
+		g.cached = result
+	}
+	return result, nil
+}
+
+func (g *goalsCache) fetch(authorization string, requestId string, etag string) (*cachedGoals, error) {
+	req, err := http.NewRequest("GET", g.uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	if requestId != "" {
+		req.Header.Set(requestIdHeader, requestId)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedGoals{
+		body:        body,
+		contentType: res.Header.Get("Content-Type"),
+		etag:        res.Header.Get("ETag"),
+		statusCode:  res.StatusCode,
+		fetchedAt:   time.Now(),
+	}, nil
+}
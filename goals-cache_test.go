@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGoalsCache(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	var failing bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req)
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`["goal"]`))
+	}))
+	defer server.Close()
+
+	reset := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = nil
+		failing = false
+	}
+	setFailing := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		failing = true
+	}
+	getRequests := func() []*http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	t.Run("serves cached goals within the TTL", func(t *testing.T) {
+		reset()
+		cache := newGoalsCache(server.URL, "env", time.Hour, 0, upstreamHeaders{})
+		for i := 0; i < 3; i++ {
+			goals, err := cache.get("auth", "")
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, goals.statusCode)
+			assert.Equal(t, `["goal"]`, string(goals.body))
+			assert.Equal(t, "application/json", goals.contentType)
+		}
+		if requests := getRequests(); assert.Len(t, requests, 1) {
+			assert.Equal(t, "/sdk/goals/env", requests[0].URL.Path)
+			assert.Equal(t, "auth", requests[0].Header.Get("Authorization"))
+		}
+	})
+
+	t.Run("revalidates with the ETag after the TTL", func(t *testing.T) {
+		reset()
+		cache := newGoalsCache(server.URL, "env", 0, 0, upstreamHeaders{})
+		cache.get("auth", "")
+		goals, err := cache.get("auth", "request-2")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, goals.statusCode)
+		assert.Equal(t, `["goal"]`, string(goals.body))
+		if requests := getRequests(); assert.Len(t, requests, 2) {
+			assert.Equal(t, "", requests[0].Header.Get(requestIdHeader))
+			assert.Equal(t, `"v1"`, requests[1].Header.Get("If-None-Match"))
+			assert.Equal(t, "request-2", requests[1].Header.Get(requestIdHeader))
+		}
+	})
+
+	t.Run("serves stale goals when LaunchDarkly is unavailable", func(t *testing.T) {
+		reset()
+		cache := newGoalsCache(server.URL, "env", 0, 0, upstreamHeaders{})
+		cache.get("auth", "")
+		setFailing()
+		goals, err := cache.get("auth", "")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, goals.statusCode)
+		assert.Equal(t, `["goal"]`, string(goals.body))
+
+		// LaunchDarkly isn't asked again straight away
+		goals, err = cache.get("auth", "")
+		assert.NoError(t, err)
+		assert.Equal(t, `["goal"]`, string(goals.body))
+		assert.Len(t, getRequests(), 2)
+	})
+
+	t.Run("passes errors through when nothing is cached", func(t *testing.T) {
+		reset()
+		setFailing()
+		cache := newGoalsCache(server.URL, "env", time.Hour, 0, upstreamHeaders{})
+		goals, err := cache.get("auth", "")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, goals.statusCode)
+	})
+}
+
+func TestGoalsCacheMakesOneFetchForConcurrentRequests(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Write([]byte(`["goal"]`))
+	}))
+	defer server.Close()
+
+	cache := newGoalsCache(server.URL, "env", time.Hour, 0, upstreamHeaders{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			goals, err := cache.get("auth", "")
+			if assert.NoError(t, err) {
+				assert.Equal(t, `["goal"]`, string(goals.body))
+			}
+		}()
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&requests) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const healthcheckTimeout = 5 * time.Second
+
+// Returns the URI of the status endpoint of a relay running on this machine with the given configuration,
+// and a client for querying it. The relay is reached through the host it listens on, or localhost if it
+// listens on every interface. If the relay requires client certificates, the client presents the
+// relay's own certificate.
+func localStatusClient(c Config) (string, *http.Client, error) {
+	port := c.Main.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	host := listenHost(c)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	client := &http.Client{Timeout: healthcheckTimeout}
+	if !tlsEnabled(c) {
+		return fmt.Sprintf("http://%s/status", addr), client, nil
+	}
+
+	// The relay's certificate is unlikely to be issued for "localhost", so we don't verify it
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if acmeEnabled(c) {
+		// Certificates are only obtained for the configured hosts
+		tlsConfig.ServerName = c.ACME.Host[0]
+	}
+	if c.TLS.ClientCaFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return "", nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return fmt.Sprintf("https://%s/status", addr), client, nil
+}
+
+// checkHealth queries a relay's status endpoint and returns an error unless every environment is connected
+func checkHealth(client *http.Client, statusUri string) error {
+	resp, err := client.Get(statusUri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response code: %d when accessing URL: %s", resp.StatusCode, statusUri)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+	if status.Status != "healthy" {
+		return fmt.Errorf("relay status is %q", status.Status)
+	}
+	return nil
+}
+
+// checkStatusResponds returns an error unless a relay's status endpoint answers, whether or not every
+// environment is connected. This is what keeps the systemd watchdog fed.
+func checkStatusResponds(client *http.Client, statusUri string) error {
+	resp, err := client.Get(statusUri)
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response code: %d when accessing URL: %s", resp.StatusCode, statusUri)
+	}
+	return nil
+}
+
+// runHealthcheck implements the --healthcheck mode, for use as a Docker HEALTHCHECK or similar
+func runHealthcheck(c Config) int {
+	statusUri, client, err := localStatusClient(c)
+	if err == nil {
+		err = checkHealth(client, statusUri)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: %s\n", err)
+		return 1
+	}
+	fmt.Println("healthy")
+	return 0
+}
+
+// sdNotify sends a state notification such as "READY=1" to systemd. It does nothing unless the relay
+// was started by systemd with NotifyAccess enabled, i.e. if NOTIFY_SOCKET is set.
+func sdNotify(state string) error {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketAddr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Returns how often systemd expects a watchdog notification, or zero if the watchdog is not enabled
+func sdWatchdogInterval() (time.Duration, error) {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0, nil
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return 0, fmt.Errorf("invalid WATCHDOG_PID: %s", pidStr)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC: " + usecStr)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// notifySystemd tells systemd the relay is ready once startup is complete, and then keeps the systemd watchdog
+// fed for as long as the relay's HTTP listener keeps answering status requests. Startup is complete when every
+// environment has either connected or failed to; with ignoreConnectionErrors set, the relay goes on serving
+// the environments that did connect, so systemd is told that it is ready either way.
+func notifySystemd(r *relay) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	statusUri, client, err := localStatusClient(r.config)
+	if err != nil {
+		Error.Printf("Not enabling systemd notifications: %s", err)
+		return
+	}
+
+	interval, err := sdWatchdogInterval()
+	if err != nil {
+		Error.Printf("Not enabling systemd watchdog: %s", err)
+	}
+
+	var watchdog <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	readyCheck := time.NewTicker(time.Second)
+	defer readyCheck.Stop()
+	ready := false
+	for {
+		if !ready && r.sdkClientMux.allStarted() {
+			ready = true
+			readyCheck.Stop()
+			if err := sdNotify("READY=1"); err != nil {
+				Error.Printf("Error notifying systemd: %s", err)
+			} else {
+				Info.Println("Notified systemd that the relay has started")
+			}
+		}
+		if ready && watchdog == nil {
+			return
+		}
+
+		select {
+		case <-readyCheck.C:
+		case <-watchdog:
+			if err := checkStatusResponds(client, statusUri); err != nil {
+				Error.Printf("Not notifying systemd watchdog, status endpoint is not responding: %s", err)
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				Error.Printf("Error notifying systemd watchdog: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestCheckHealth(t *testing.T) {
+	specs := []struct {
+		name       string
+		statusCode int
+		body       string
+		healthy    bool
+	}{
+		{"healthy", http.StatusOK, `{"status":"healthy"}`, true},
+		{"degraded", http.StatusOK, `{"status":"degraded"}`, false},
+		{"error", http.StatusInternalServerError, ``, false},
+		{"invalid json", http.StatusOK, `not json`, false},
+	}
+
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(s.statusCode)
+				w.Write([]byte(s.body))
+			}))
+			defer server.Close()
+
+			err := checkHealth(server.Client(), server.URL+"/status")
+			if s.healthy {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestHealthcheckUsesListenHost(t *testing.T) {
+	specs := []struct {
+		host string
+		uri  string
+	}{
+		{"", "http://localhost:8030/status"},
+		{"0.0.0.0", "http://localhost:8030/status"},
+		{"[::]", "http://localhost:8030/status"},
+		{"127.0.0.2", "http://127.0.0.2:8030/status"},
+		{"::1", "http://[::1]:8030/status"},
+		{"relay.internal", "http://relay.internal:8030/status"},
+	}
+	for _, s := range specs {
+		var c Config
+		c.Main.Host = s.host
+		uri, _, err := localStatusClient(c)
+		if assert.NoError(t, err) {
+			assert.Equal(t, s.uri, uri, s.host)
+		}
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ld-relay-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	assert.NoError(t, sdNotify("READY=1"))
+	buf := make([]byte, 64)
+	n, _, err := conn.ReadFromUnix(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "READY=1", string(buf[:n]))
+	}
+}
+
+func TestSystemdIsNotifiedWhenAnEnvironmentFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ld-relay-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	config := Config{Environment: map[string]*EnvConfig{
+		"good": {SdkKey: "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"},
+		"bad":  {SdkKey: "sdk-bad"},
+	}}
+	config.Main.IgnoreConnectionErrors = true
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		if sdkKey == "sdk-bad" {
+			return FakeLDClient{false}, errors.New("timed out")
+		}
+		config.FeatureStore.Init(nil)
+		return FakeLDClient{true}, nil
+	})
+	defer relay.findEnvironment("good").close()
+	defer relay.findEnvironment("bad").close()
+
+	done := make(chan struct{})
+	go func() {
+		notifySystemd(relay)
+		close(done)
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := conn.ReadFromUnix(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "READY=1", string(buf[:n]))
+	}
+	<-done
+}
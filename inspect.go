@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// environmentInspection is the relay's view of an environment's flags and segments and how they depend on
+// each other, for working out why an SDK is seeing stale or missing data without reading the store directly
+type environmentInspection struct {
+	Environment   string                       `json:"environment"`
+	Status        string                       `json:"status"`
+	Initialized   bool                         `json:"initialized"`
+	Flags         map[string]flagInspection    `json:"flags"`
+	Segments      map[string]segmentInspection `json:"segments"`
+	RecentChanges []flagChange                 `json:"recentChanges"`
+}
+
+type flagInspection struct {
+	Version    int  `json:"version"`
+	On         bool `json:"on"`
+	Deleted    bool `json:"deleted,omitempty"`
+	Overridden bool `json:"overridden,omitempty"`
+	// Left out when values are redacted
+	Variations     []interface{}     `json:"variations,omitempty"`
+	VariationCount int               `json:"variationCount"`
+	Prerequisites  []ld.Prerequisite `json:"prerequisites,omitempty"`
+	Segments       []string          `json:"segments,omitempty"`
+	// The flags that have this one as a prerequisite
+	Dependents []string `json:"dependents,omitempty"`
+	// Prerequisites and segments that the flag refers to but that aren't in the store, as "flags/key" or
+	// "segments/key"
+	Missing []string `json:"missing,omitempty"`
+}
+
+type segmentInspection struct {
+	Version int  `json:"version"`
+	Deleted bool `json:"deleted,omitempty"`
+	// Left out when values are redacted
+	Included      []string `json:"included,omitempty"`
+	Excluded      []string `json:"excluded,omitempty"`
+	IncludedCount int      `json:"includedCount"`
+	ExcludedCount int      `json:"excludedCount"`
+	RuleCount     int      `json:"ruleCount"`
+	// The flags whose rules refer to this segment
+	UsedBy []string `json:"usedBy,omitempty"`
+}
+
+// Describes the named environment's flags and segments, as served by the relay. With ?redact=true, flag
+// variation values and segment user keys are left out.
+func (r *relay) inspectEnvironment(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	name := mux.Vars(req)["name"]
+	clientCtx := r.findEnvironment(name)
+	if clientCtx == nil {
+		writeErrorf(w, req, http.StatusNotFound, "No environment named %q", name)
+		return
+	}
+	store := clientCtx.getStore()
+	flags, err := store.All(ld.Features)
+	var segments map[string]ld.VersionedData
+	if err == nil {
+		segments, err = store.All(ld.Segments)
+	}
+	if err != nil {
+		writeErrorf(w, req, errorStatus(err), "Unable to read the feature store: %s", err)
+		return
+	}
+
+	inspection := inspectData(flags, segments, req.URL.Query().Get("redact") == "true")
+	inspection.Environment = name
+	inspection.Status = clientCtx.connectionStatus()
+	inspection.Initialized = store.Initialized()
+	if clientCtx.overrides != nil {
+		for _, key := range clientCtx.overrides.keys() {
+			if flag, ok := inspection.Flags[key]; ok {
+				flag.Overridden = true
+				inspection.Flags[key] = flag
+			}
+		}
+	}
+	if clientCtx.changes != nil {
+		inspection.RecentChanges = clientCtx.changes.recent()
+	}
+	data, _ := json.Marshal(inspection)
+	w.Write(data)
+}
+
+func inspectData(flags map[string]ld.VersionedData, segments map[string]ld.VersionedData, redact bool) environmentInspection {
+	inspection := environmentInspection{
+		Flags:    make(map[string]flagInspection, len(flags)),
+		Segments: make(map[string]segmentInspection, len(segments)),
+	}
+	for key, item := range segments {
+		segment, ok := item.(*ld.Segment)
+		if !ok {
+			continue
+		}
+		view := segmentInspection{
+			Version:       segment.Version,
+			Deleted:       segment.Deleted,
+			IncludedCount: len(segment.Included),
+			ExcludedCount: len(segment.Excluded),
+			RuleCount:     len(segment.Rules),
+		}
+		if !redact {
+			view.Included, view.Excluded = segment.Included, segment.Excluded
+		}
+		inspection.Segments[key] = view
+	}
+
+	dependents := make(map[string][]string)
+	usedBy := make(map[string][]string)
+	for key, item := range flags {
+		flag, ok := item.(*ld.FeatureFlag)
+		if !ok {
+			continue
+		}
+		view := flagInspection{
+			Version:        flag.Version,
+			On:             flag.On,
+			Deleted:        flag.Deleted,
+			VariationCount: len(flag.Variations),
+			Prerequisites:  flag.Prerequisites,
+			Segments:       referencedSegments(flag),
+		}
+		if !redact {
+			view.Variations = flag.Variations
+		}
+		for _, prereq := range flag.Prerequisites {
+			dependents[prereq.Key] = append(dependents[prereq.Key], key)
+			if isMissing(flags[prereq.Key]) {
+				view.Missing = append(view.Missing, "flags/"+prereq.Key)
+			}
+		}
+		for _, segmentKey := range view.Segments {
+			usedBy[segmentKey] = append(usedBy[segmentKey], key)
+			if isMissing(segments[segmentKey]) {
+				view.Missing = append(view.Missing, "segments/"+segmentKey)
+			}
+		}
+		inspection.Flags[key] = view
+	}
+
+	for key, flagKeys := range dependents {
+		if view, ok := inspection.Flags[key]; ok {
+			sort.Strings(flagKeys)
+			view.Dependents = flagKeys
+			inspection.Flags[key] = view
+		}
+	}
+	for key, flagKeys := range usedBy {
+		if view, ok := inspection.Segments[key]; ok {
+			sort.Strings(flagKeys)
+			view.UsedBy = flagKeys
+			inspection.Segments[key] = view
+		}
+	}
+	return inspection
+}
+
+// Returns the keys of the segments that a flag's rules match users against, in the order they appear
+func referencedSegments(flag *ld.FeatureFlag) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, rule := range flag.Rules {
+		for _, clause := range rule.Clauses {
+			if clause.Op != ld.OperatorSegmentMatch {
+				continue
+			}
+			for _, value := range clause.Values {
+				if key, ok := value.(string); ok && !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+	return keys
+}
+
+func isMissing(item ld.VersionedData) bool {
+	return item == nil || item.IsDeleted()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestInspectionShowsDependencies(t *testing.T) {
+	flags := map[string]ld.VersionedData{
+		"parent": &ld.FeatureFlag{Key: "parent", Version: 1, On: true, Variations: []interface{}{"a", "b"}},
+		"child": &ld.FeatureFlag{Key: "child", Version: 2,
+			Prerequisites: []ld.Prerequisite{{Key: "parent", Variation: 1}, {Key: "gone", Variation: 0}},
+			Rules: []ld.Rule{{Clauses: []ld.Clause{
+				{Attribute: "key", Op: ld.OperatorSegmentMatch, Values: []interface{}{"beta", "missing-segment"}},
+				{Attribute: "country", Op: ld.OperatorIn, Values: []interface{}{"nz"}},
+			}}},
+		},
+	}
+	segments := map[string]ld.VersionedData{
+		"beta": &ld.Segment{Key: "beta", Version: 3, Included: []string{"user1", "user2"}},
+	}
+
+	inspection := inspectData(flags, segments, false)
+	assert.Equal(t, []string{"child"}, inspection.Flags["parent"].Dependents)
+	assert.Equal(t, []interface{}{"a", "b"}, inspection.Flags["parent"].Variations)
+	assert.Equal(t, []string{"beta", "missing-segment"}, inspection.Flags["child"].Segments)
+	assert.Equal(t, []string{"flags/gone", "segments/missing-segment"}, inspection.Flags["child"].Missing)
+	assert.Equal(t, segmentInspection{Version: 3, Included: []string{"user1", "user2"}, IncludedCount: 2, UsedBy: []string{"child"}},
+		inspection.Segments["beta"])
+
+	redacted := inspectData(flags, segments, true)
+	assert.Nil(t, redacted.Flags["parent"].Variations)
+	assert.Equal(t, 2, redacted.Flags["parent"].VariationCount)
+	assert.Nil(t, redacted.Segments["beta"].Included)
+	assert.Equal(t, 2, redacted.Segments["beta"].IncludedCount)
+}
+
+func TestInspectEndpoint(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	handler := relay.getHandler()
+	deadline := time.Now().Add(time.Second)
+	for !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	makeSnapshotRequest(handler, "POST", "/internal/import/env1", testSnapshot)
+
+	w := makeSnapshotRequest(handler, "GET", "/internal/inspect/env1?redact=true", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var inspection environmentInspection
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &inspection)) {
+		assert.Equal(t, "env1", inspection.Environment)
+		assert.True(t, inspection.Initialized)
+		assert.Equal(t, 2, inspection.Flags["flag1"].Version)
+		assert.Nil(t, inspection.Flags["flag1"].Variations)
+		assert.Equal(t, 1, inspection.Segments["segment1"].IncludedCount)
+		assert.NotEmpty(t, inspection.RecentChanges)
+	}
+
+	w = makeSnapshotRequest(handler, "GET", "/internal/inspect/unknown", "")
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
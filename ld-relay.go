@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -10,10 +11,11 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,7 +25,6 @@ import (
 	"github.com/launchdarkly/eventsource"
 	"github.com/launchdarkly/gcfg"
 	ld "gopkg.in/launchdarkly/go-client.v4"
-	ldr "gopkg.in/launchdarkly/go-client.v4/redis"
 )
 
 const (
@@ -35,6 +36,10 @@ const (
 	defaultBaseUri               = "https://app.launchdarkly.com/"
 	defaultStreamUri             = "https://stream.launchdarkly.com/"
 	defaultHeartbeatIntervalSecs = 180
+	defaultGoalsCacheTtlSecs     = 60
+	defaultInitTimeoutSecs       = 10
+	// Carries the base64-encoded user for evaluation requests that can't give it in the path
+	userHeader = "X-LaunchDarkly-User"
 )
 
 var (
@@ -45,6 +50,9 @@ var (
 	Error             *log.Logger
 	uuidHeaderPattern = regexp.MustCompile(`^(?:api_key )?((?:[a-z]{3}-)?[a-f0-9]{8}-[a-f0-9]{4}-4[a-f0-9]{3}-[89aAbB][a-f0-9]{3}-[a-f0-9]{12})$`)
 	configFile        string
+	healthcheck       bool
+	once              bool
+	serviceAction     string
 )
 
 type EnvConfig struct {
@@ -54,16 +62,64 @@ type EnvConfig struct {
 	EnvId         *string
 	Prefix        string
 	AllowedOrigin *[]string
+	// If provided, only clients presenting a certificate with one of these subject alternative names may
+	// use the environment
+	AllowedClientSan *[]string
+	// Analytics events are also published to these, if set
+	PubSubTopic string
+	SqsQueueUrl string
+	// If true, events are published only to the sinks above and not sent to LaunchDarkly
+	EventSinksOnly bool
+	// Metadata such as team:payments, for operators to find and filter environments by
+	Tag *[]string
+	// Override the [main] settings of the same names for this environment
+	HeartbeatIntervalSecs *int
+	PingIntervalSecs      *int
+	// Cache settings that replace the persistent store's localTtl for this environment
+	LocalTtl         *int
+	CacheMode        string
+	CacheRefreshSecs *int
+	// Added to the [upstream] headers for this environment's requests to LaunchDarkly
+	UpstreamHeader  *[]string
+	UserAgentSuffix string
 }
 
 type Config struct {
 	Main struct {
-		ExitOnError            bool
-		IgnoreConnectionErrors bool
-		StreamUri              string
-		BaseUri                string
-		Port                   int
-		HeartbeatIntervalSecs  int
+		ExitOnError             bool
+		IgnoreConnectionErrors  bool
+		StreamUri               string
+		BaseUri                 string
+		ParentRelayUri          string
+		Port                    int
+		Host                    string
+		HeartbeatIntervalSecs   int
+		PingIntervalSecs        int
+		CoalesceWindowMs        int
+		GoalsCacheTtlSecs       int
+		InitTimeoutSecs         int
+		BackgroundInit          bool
+		MaxEvalBodyBytes        int
+		MaxStreamConnections    int
+		MaxEnvStreamConnections int
+		Store                   string
+		DebugPort               int
+		DebugHost               string
+		ReconnectInitialDelayMs int
+		ReconnectMaxDelayMs     int
+		ReconnectJitterPercent  int
+		StreamStaleSecs         int
+		ReadHeaderTimeoutSecs   int
+		RequestTimeoutSecs      int
+		IdleTimeoutSecs         int
+		StoreTimeoutMs          int
+		GoalsTimeoutSecs        int
+		TrustedProxy            []string
+		StreamBufferSize        int
+		MaxConcurrentReplays    int
+		StoreFallbackSecs       int
+		EvalCacheTtlMs          int
+		EvalCacheMaxEntries     int
 	}
 	Events struct {
 		EventsUri         string
@@ -72,24 +128,107 @@ type Config struct {
 		SamplingInterval  int32
 		Capacity          int
 		InlineUsers       bool
+		MaxBodyBytes      int
+		AddClientIp       bool
+		MaxEventsPerSec   int
+		MaxBytesPerSec    int
+		// The relay sends diagnostic events of its own to LaunchDarkly unless this is set
+		DisableDiagnostics     bool
+		DiagnosticIntervalSecs int
 	}
 	Redis struct {
 		Host     string
 		Port     int
 		LocalTtl *int
 	}
+	Postgres struct {
+		Url      string
+		LocalTtl *int
+	}
+	Memcached struct {
+		Server   []string
+		LocalTtl *int
+	}
+	Admin struct {
+		Username string
+		Password string
+		EnableUI bool
+	}
+	TLS struct {
+		CertFile     string
+		KeyFile      string
+		ClientCaFile string
+	}
+	Privacy struct {
+		HashUserKeys    bool
+		HashSalt        string
+		StripAttribute  []string
+		RedactAttribute []string
+	}
+	LeaderElection struct {
+		Backend           string
+		LeaseName         string
+		LeaseDurationSecs int
+		Namespace         string
+		PollIntervalSecs  int
+	}
+	ACME struct {
+		Host         []string
+		CacheDir     string
+		Email        string
+		DirectoryUrl string
+		HttpPort     int
+	}
+	Sentry struct {
+		Dsn         string
+		Environment string
+	}
+	Audit struct {
+		Enabled    bool
+		LogFile    string
+		WebhookUrl string
+	}
+	Upstream  upstreamConfig
+	Endpoints struct {
+		Expose  []string
+		Disable []string
+	}
+	Archive struct {
+		Url               string
+		Endpoint          string
+		WriteIntervalSecs int
+	}
+	Usage struct {
+		Enabled            bool
+		ReportUrl          string
+		ReportIntervalSecs int
+	}
+	GCP struct {
+		CredentialsFile string
+	}
+	AWS struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Region          string
+	}
+	Store       map[string]*StoreConfig
 	Environment map[string]*EnvConfig
 }
 
 type EnvironmentStatus struct {
-	SdkKey    string `json:"sdkKey"`
-	EnvId     string `json:"envId,omitempty"`
-	MobileKey string `json:"mobileKey,omitempty"`
-	Status    string `json:"status"`
-}
-
-type ErrorJson struct {
-	Message string `json:"message"`
+	SdkKey    string            `json:"sdkKey"`
+	EnvId     string            `json:"envId,omitempty"`
+	MobileKey string            `json:"mobileKey,omitempty"`
+	Status    string            `json:"status"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	// Where the environment is in its lifecycle: initializing, ready or failed
+	State string `json:"state"`
+	// The keys of the flags that are overridden through /internal/overrides
+	Overrides []string `json:"overrides,omitempty"`
+	// The environment's usage this month, if usage tracking is enabled
+	Usage *usageSummary `json:"usage,omitempty"`
+	// How often evaluation results were served from the cache, if it is enabled
+	EvalCache *evalCacheStats `json:"evalCache,omitempty"`
 }
 
 type corsContext interface {
@@ -104,7 +243,9 @@ type clientHandlers struct {
 	flagsStreamHandler http.Handler
 	allStreamHandler   http.Handler
 	pingStreamHandler  http.Handler
-	eventsHandler      http.Handler
+	// Serves ping stream clients that asked for periodic pings
+	pingingStreamHandler http.Handler
+	eventsHandler        http.Handler
 }
 
 type clientContext interface {
@@ -113,24 +254,80 @@ type clientContext interface {
 	getStore() ld.FeatureStore
 	getLogger() ld.Logger
 	getHandlers() clientHandlers
+	getMetrics() *envMetrics
+	getEvalCache() *evalCache
 }
 
 type clientContextImpl struct {
-	mu        sync.RWMutex
-	client    ldClientContext
-	store     ld.FeatureStore
-	logger    ld.Logger
-	handlers  clientHandlers
-	sdkKey    string
-	envId     *string
-	mobileKey *string
-	name      string
+	mu     sync.RWMutex
+	client ldClientContext
+	store  ld.FeatureStore
+	logger ld.Logger
+	// The store the environment's data is kept in, without the wrappers above it, which is closed along with
+	// the environment to release its connections
+	baseStore ld.FeatureStore
+	// Publishes the environment's flag changes to streaming clients
+	relayStore *SSERelayFeatureStore
+	handlers   clientHandlers
+	sdkKey     string
+	envId      *string
+	mobileKey  *string
+	name       string
+	metrics    envMetrics
+	changes    *flagChangeLog
+	// Flag values served in place of the real ones, as set through /internal/overrides
+	overrides *flagOverrides
+	// Payloads held for replaying to new stream clients
+	replays *streamReplays
+	// Serves the data last read from the persistent store while the store is failing, if enabled
+	fallback *lastKnownGoodStore
+	// Recent results of evaluating every flag for a user, if caching is enabled
+	evalCache *evalCache
+	// Caches the persistent store with the environment's own settings, if it has any
+	localCache *localCacheStore
+	connect    func()
+	// Held while a resync closes the client and connects a new one
+	resyncLock sync.Mutex
+	// Subject alternative names of the client certificates allowed to use the environment, if restricted
+	allowedClientSans []string
+	// Where the environment is in its lifecycle
+	state envState
+	// Added to the environment's requests to LaunchDarkly
+	upstreamHeaders upstreamHeaders
+	// Reports whether the persistent store can be reached, if there is one
+	storeCheck func() error
+	// Set once the environment has been removed, after which no client may be attached to it
+	removed bool
+	// The connection to LaunchDarkly's stream made by the current client
+	upstream *upstreamStream
+	tags     map[string]string
+	// Set while another relay is the leader, and this one serves what the leader writes to the shared store
+	follower *storeFollower
 }
 
 type relay struct {
+	config Config
+	// Every environment, which the muxes below find by their credentials
+	envs            *environmentRegistry
 	sdkClientMux    ClientMux
 	mobileClientMux ClientMux
 	clientSideMux   ClientSideMux
+	// Where the configuration was read from, so that changes to environments can be saved; empty if they
+	// shouldn't be
+	configFile     string
+	clientFactory  func(sdkKey string, config ld.Config) (ldClientContext, error)
+	allPublisher   *eventsource.Server
+	flagsPublisher *eventsource.Server
+	pingPublisher  *eventsource.Server
+	storeCheck     func() error
+	streamLimiter  *streamLimiter
+	// Limits how many stream replays are built and sent at once across the relay, if maxConcurrentReplays
+	// is set; nil otherwise
+	replaySlots chan struct{}
+	// Scrubs the users in client-side and mobile requests, if configured
+	privacy *userPrivacy
+	// Publishes changes in the environments' status to operators, if the admin endpoints are enabled
+	statusStream *statusStream
 }
 
 type EvalXResult struct {
@@ -143,16 +340,66 @@ type EvalXResult struct {
 
 func (c *clientContextImpl) getClient() ldClientContext {
 	c.mu.RLock()
-	defer c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.client
 }
 
 func (c *clientContextImpl) setClient(client ldClientContext) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.removed || c.follower != nil {
+		// The environment was removed, or another relay became the leader, while this client was connecting
+		if closer, ok := client.(io.Closer); ok {
+			closer.Close()
+		}
+		return
+	}
 	c.client = client
 }
 
+func (c *clientContextImpl) setState(state envState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+}
+
+// Returns where the environment is in its lifecycle. An environment is ready as soon as its client has
+// connected, including a client that failed to connect in time but connected after all.
+func (c *clientContextImpl) lifecycleState() envState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.client != nil && c.client.Initialized() {
+		return envReady
+	}
+	return c.state
+}
+
+func (c *clientContextImpl) setUpstream(upstream *upstreamStream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upstream = upstream
+}
+
+// Describes the environment's connection to LaunchDarkly: "connected", "degraded" if the stream has received
+// nothing for longer than it should, "initializing" or "disconnected"
+func (c *clientContextImpl) connectionStatus() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.client != nil && c.client.Initialized() {
+		if c.upstream != nil && c.upstream.stale() {
+			return "degraded"
+		}
+		if c.fallback != nil && c.fallback.servingFallback() {
+			return "degraded"
+		}
+		return "connected"
+	}
+	if c.state == envInitializing {
+		return "initializing"
+	}
+	return "disconnected"
+}
+
 func (c *clientContextImpl) getStore() ld.FeatureStore {
 	return c.store
 }
@@ -165,33 +412,144 @@ func (c *clientContextImpl) getHandlers() clientHandlers {
 	return c.handlers
 }
 
+func (c *clientContextImpl) getEvalCache() *evalCache {
+	return c.evalCache
+}
+
+func (c *clientContextImpl) getMetrics() *envMetrics {
+	return &c.metrics
+}
+
+// Discards the environment's LaunchDarkly client and connects a new one, which fetches all flag data again.
+// A resync asked for while another is connecting waits for it, so that only one new client is connected.
+func (c *clientContextImpl) resync() {
+	if c.following() {
+		// The leader's client is the one connected to LaunchDarkly
+		return
+	}
+	go func() {
+		c.resyncLock.Lock()
+		defer c.resyncLock.Unlock()
+		if closer, ok := c.getClient().(io.Closer); ok {
+			closer.Close()
+		}
+		if c.connect != nil {
+			c.connect()
+		}
+	}()
+}
+
+// Shuts down the environment's client and background work, once it has been removed from the relay
+func (c *clientContextImpl) close() {
+	c.mu.Lock()
+	client := c.client
+	c.client = nil
+	c.removed = true
+	follower := c.follower
+	c.mu.Unlock()
+	if follower != nil {
+		follower.close()
+	}
+	if closer, ok := client.(io.Closer); ok {
+		closer.Close()
+	}
+	if c.relayStore != nil {
+		c.relayStore.Close()
+	}
+	if c.localCache != nil {
+		c.localCache.close()
+	}
+	if eventsHandler, ok := c.handlers.eventsHandler.(*eventRelayHandler); ok {
+		eventsHandler.close()
+	}
+	if closer, ok := c.baseStore.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
 func main() {
 
 	flag.StringVar(&configFile, "config", "/etc/ld-relay.conf", "configuration file location")
+	flag.BoolVar(&healthcheck, "healthcheck", false, "check the status of a relay running with the same configuration, exiting with 0 if it is healthy")
+	flag.BoolVar(&once, "once", false, "populate the persistent store for every environment and exit, instead of running the relay")
+	flag.StringVar(&serviceAction, "service", "", "install, uninstall, start or stop the relay's Windows service")
 
 	flag.Parse()
 
 	initLogging(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
+	configFile = resolveConfigPath(configFile)
 
-	var c Config
-	c.Events.Capacity = defaultEventCapacity
-	c.Events.EventsUri = defaultEventsUri
-	c.Main.BaseUri = defaultBaseUri
-	c.Main.StreamUri = defaultStreamUri
-	c.Main.HeartbeatIntervalSecs = defaultHeartbeatIntervalSecs
+	if serviceAction != "" {
+		os.Exit(runServiceCommand(serviceAction, configFile))
+	}
+	logErrorsToEventLog()
+
+	if healthcheck || once || flag.NArg() > 0 {
+		c, err := loadConfig(configFile)
+		if err != nil {
+			Error.Printf("Failed to read configuration file: %s", err)
+			os.Exit(1)
+		}
+		if healthcheck {
+			os.Exit(runHealthcheck(c))
+		}
+		if once {
+			os.Exit(runOnce(c))
+		}
+		os.Exit(runCommand(c, flag.Args()))
+	}
 
 	Info.Printf("Starting LaunchDarkly relay version %s with configuration file %s\n", formatVersion(Version), configFile)
 
-	err := gcfg.ReadFileInto(&c, configFile)
+	c, err := loadConfig(configFile)
 
 	if err != nil {
-		Error.Println("Failed to read configuration file. Exiting.")
+		Error.Printf("Failed to read configuration file: %s. Exiting.", err)
 		os.Exit(1)
 	}
 
-	if c.Redis.LocalTtl == nil {
-		localTtl := defaultRedisLocalTtlMs
-		c.Redis.LocalTtl = &localTtl
+	if c.Sentry.Dsn != "" {
+		if errorReporter, err = newSentryReporter(c.Sentry.Dsn, c.Sentry.Environment); err != nil {
+			Error.Printf("Unable to report errors to Sentry: %s. Exiting.", err)
+			os.Exit(1)
+		}
+		Info.Println("Reporting errors to Sentry")
+	}
+
+	if c.Audit.Enabled {
+		if auditor, err = newAuditLog(c.Audit.LogFile, c.Audit.WebhookUrl); err != nil {
+			Error.Printf("Unable to open audit log: %s. Exiting.", err)
+			os.Exit(1)
+		}
+		Info.Println("Recording authorization failures and key usage")
+	}
+
+	configureUpstreamTransport(upstreamTransport, c.Upstream)
+
+	if eventThrottle = newOutboundThrottle(c.Events.MaxEventsPerSec, c.Events.MaxBytesPerSec); eventThrottle != nil {
+		Info.Println("Limiting the rate at which events are sent to LaunchDarkly")
+	}
+
+	if c.Usage.Enabled {
+		usageReporter = newUsageReport(c.Usage.ReportUrl, time.Duration(c.Usage.ReportIntervalSecs)*time.Second)
+		Info.Println("Tracking monthly active users and connections")
+	}
+
+	if c.Archive.Url != "" {
+		if archive, err = newFlagArchiveFromConfig(c); err != nil {
+			Error.Printf("Unable to use the flag archive: %s. Exiting.", err)
+			os.Exit(1)
+		}
+		Info.Printf("Bootstrapping environments from %s", archive)
+	}
+
+	// The proxies have already been validated
+	trustedProxies, _ = parseTrustedProxies(c.Main.TrustedProxy)
+
+	if c.Main.ParentRelayUri != "" {
+		Info.Printf("Using parent relay %s", c.Main.ParentRelayUri)
+		parentRelay = newParentRelayChecker(c.Main.ParentRelayUri, parentRelaySdkKey(c), newUpstreamHeaders(c, EnvConfig{}))
+		go parentRelay.run()
 	}
 
 	if c.Main.Port == 0 {
@@ -204,39 +562,293 @@ func main() {
 		os.Exit(1)
 	}
 
-	relay := newRelay(c, defaultClientFactory).getHandler()
+	waitFor := time.Duration(c.Main.InitTimeoutSecs) * time.Second
+	if c.Main.BackgroundInit {
+		// Clients are made available straight away, and finish connecting in the background
+		waitFor = 0
+	}
+	if leaderElectionEnabled(c) {
+		if election, err = newLeaderElection(c); err != nil {
+			Error.Printf("Unable to elect a leader: %s. Exiting.", err)
+			os.Exit(1)
+		}
+		Info.Printf("Electing a leader to connect to LaunchDarkly with %s", election.lease)
+	}
+
+	r, err := newRelay(c, makeDefaultClientFactory(waitFor))
+	if err != nil {
+		Error.Printf("Unable to start: %s. Exiting.", err)
+		os.Exit(1)
+	}
+	r.configFile = configFile
+	if election != nil {
+		go election.run(r.setLeader)
+	}
+	if usageReporter != nil && usageReporter.reportUrl != "" {
+		Info.Printf("Reporting usage to %s", usageReporter.reportUrl)
+		go usageReporter.run(r)
+	}
+	if relayDiagnosticsEnabled(c) {
+		Info.Println("Sending the relay's diagnostics to LaunchDarkly")
+		go newRelayDiagnostics(r).run(time.Duration(c.Events.DiagnosticIntervalSecs) * time.Second)
+	}
+
+	startDebugListener(c)
 
-	Info.Printf("Listening on port %d\n", c.Main.Port)
+	Info.Printf("Listening on %s\n", listenAddress(c))
 
-	err = http.ListenAndServe(fmt.Sprintf(":%d", c.Main.Port), relay)
+	if acmeEnabled(c) {
+		Info.Printf("Obtaining certificates with ACME for %s", strings.Join(c.ACME.Host, ", "))
+		acmeManager = newAcmeManager(c)
+		startAcmeHttpListener(c, acmeManager)
+	}
+
+	listener, err := net.Listen("tcp", listenAddress(c))
+	if err == nil && tlsEnabled(c) {
+		var tlsConfig *tls.Config
+		if tlsConfig, err = makeTLSConfig(c); err == nil {
+			Info.Println("Serving HTTPS")
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+	}
+	if err == nil {
+		go notifySystemd(r)
+		err = newHttpServer(c, r.getHandler()).Serve(listener)
+	}
 	if err != nil {
 		if c.Main.ExitOnError {
-			Error.Fatalf("Error starting http listener on port: %d  %s", c.Main.Port, err.Error())
+			Error.Fatalf("Error starting http listener on %s: %s", listenAddress(c), err.Error())
 		}
-		Error.Printf("Error starting http listener on port: %d  %s", c.Main.Port, err.Error())
+		Error.Printf("Error starting http listener on %s: %s", listenAddress(c), err.Error())
 	}
 }
 
-func defaultClientFactory(sdkKey string, config ld.Config) (ldClientContext, error) {
-	return ld.MakeCustomClient(sdkKey, config, time.Second*10)
+// Returns the address the relay listens on. Without a host, it listens on every interface, over both IPv4
+// and IPv6 where the system supports them.
+func listenAddress(c Config) string {
+	return net.JoinHostPort(listenHost(c), strconv.Itoa(c.Main.Port))
 }
 
-func newRelay(c Config, clientFactory func(sdkKey string, config ld.Config) (ldClientContext, error)) *relay {
+// Returns the configured host without the brackets an IPv6 address may be written with
+func listenHost(c Config) string {
+	return strings.TrimSuffix(strings.TrimPrefix(c.Main.Host, "["), "]")
+}
+
+// Checks that the host to listen on is an IP address or a host name, rather than an address with a port or
+// a URL
+func validateListenHost(c Config) error {
+	host := listenHost(c)
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+	if strings.ContainsAny(host, ":/[] ") {
+		return fmt.Errorf("%q is not an IP address or host name", c.Main.Host)
+	}
+	return nil
+}
+
+// Reads the configuration file, filling in defaults for anything not specified
+func loadConfig(configFile string) (Config, error) {
+	var c Config
+	c.Events.Capacity = defaultEventCapacity
+	c.Events.EventsUri = defaultEventsUri
+	c.Main.BaseUri = defaultBaseUri
+	c.Main.StreamUri = defaultStreamUri
+	c.Main.HeartbeatIntervalSecs = defaultHeartbeatIntervalSecs
+	c.Main.GoalsCacheTtlSecs = defaultGoalsCacheTtlSecs
+	c.Main.InitTimeoutSecs = defaultInitTimeoutSecs
+	c.Main.ReconnectInitialDelayMs = defaultReconnectInitialDelayMs
+	c.Main.ReconnectMaxDelayMs = defaultReconnectMaxDelayMs
+	c.Main.ReconnectJitterPercent = defaultReconnectJitterPercent
+	c.Main.StreamStaleSecs = defaultStreamStaleSecs
+	c.Main.ReadHeaderTimeoutSecs = defaultReadHeaderTimeoutSecs
+	c.Main.RequestTimeoutSecs = defaultRequestTimeoutSecs
+	c.Main.IdleTimeoutSecs = defaultIdleTimeoutSecs
+	c.Main.StoreTimeoutMs = defaultStoreTimeoutMs
+	c.Main.GoalsTimeoutSecs = defaultGoalsTimeoutSecs
+	c.Main.MaxEvalBodyBytes = defaultMaxEvalBodyBytes
+	c.Main.StreamBufferSize = defaultStreamBufferSize
+	c.Main.EvalCacheMaxEntries = defaultEvalCacheMaxEntries
+	c.Usage.ReportIntervalSecs = defaultUsageReportIntervalSecs
+	c.Events.DiagnosticIntervalSecs = defaultDiagnosticIntervalSecs
+	c.Upstream = defaultUpstreamConfig()
+	c.Events.MaxBodyBytes = defaultMaxEventBodyBytes
+
+	err := gcfg.ReadFileInto(&c, configFile)
+	if err != nil {
+		return c, err
+	}
+
+	if c.Redis.LocalTtl == nil {
+		localTtl := defaultRedisLocalTtlMs
+		c.Redis.LocalTtl = &localTtl
+	}
+	if c.Postgres.LocalTtl == nil {
+		localTtl := defaultRedisLocalTtlMs
+		c.Postgres.LocalTtl = &localTtl
+	}
+	if c.Memcached.LocalTtl == nil {
+		localTtl := defaultRedisLocalTtlMs
+		c.Memcached.LocalTtl = &localTtl
+	}
+
+	storesConfigured := 0
+	for _, configured := range []bool{c.Redis.Host != "", c.Postgres.Url != "", len(c.Memcached.Server) > 0} {
+		if configured {
+			storesConfigured++
+		}
+	}
+	if storesConfigured > 1 {
+		return c, errors.New("only one of Redis, Postgres and Memcached may be configured")
+	}
+	if c.Main.Store != "" {
+		if storesConfigured > 0 {
+			return c, errors.New("a custom store may not be combined with Redis, Postgres or Memcached")
+		}
+		if err := validateCustomStore(c); err != nil {
+			return c, err
+		}
+	}
+	if c.Postgres.Url != "" {
+		if err := validatePostgresUrl(c.Postgres.Url); err != nil {
+			return c, fmt.Errorf("invalid Postgres url: %s", err)
+		}
+	}
+	if c.Main.ParentRelayUri != "" {
+		if c.Main.StreamUri != defaultStreamUri || c.Main.BaseUri != defaultBaseUri || c.Events.EventsUri != defaultEventsUri {
+			return c, errors.New("parentRelayUri may not be combined with streamUri, baseUri or eventsUri")
+		}
+		parentUri, err := parseParentRelayUri(c.Main.ParentRelayUri)
+		if err != nil {
+			return c, fmt.Errorf("invalid parentRelayUri: %s", err)
+		}
+		// The parent relay serves the stream, polling and event endpoints from the same place
+		c.Main.ParentRelayUri = parentUri
+		c.Main.StreamUri = parentUri
+		c.Main.BaseUri = parentUri
+		c.Events.EventsUri = parentUri
+	}
+	if err := validateListenHost(c); err != nil {
+		return c, fmt.Errorf("invalid host: %s", err)
+	}
+	if _, err := parseTrustedProxies(c.Main.TrustedProxy); err != nil {
+		return c, fmt.Errorf("invalid trustedProxy: %s", err)
+	}
+	if _, err := newEndpointPolicy(c.Endpoints.Expose, c.Endpoints.Disable); err != nil {
+		return c, fmt.Errorf("invalid endpoints configuration: %s", err)
+	}
+	if c.Archive.Url != "" {
+		if _, _, _, err := parseArchiveUrl(c.Archive.Url); err != nil {
+			return c, err
+		}
+	}
+	if _, err := parseUpstreamHeaders(c.Upstream.Header); err != nil {
+		return c, fmt.Errorf("invalid upstream header: %s", err)
+	}
+	if err := validateUserAgentSuffix(c.Upstream.UserAgentSuffix); err != nil {
+		return c, err
+	}
+	if err := validateReconnectBackoff(c); err != nil {
+		return c, err
+	}
+	if err := validateEnvironmentKeys(c); err != nil {
+		return c, err
+	}
+	for name, envConfig := range c.Environment {
+		if err := validateEventSinks(c, *envConfig); err != nil {
+			return c, fmt.Errorf("invalid event sink for environment %q: %s", name, err)
+		}
+		if _, err := parseEnvTags(*envConfig); err != nil {
+			return c, fmt.Errorf("invalid tags for environment %q: %s", name, err)
+		}
+		if err := validateEnvCache(c, *envConfig); err != nil {
+			return c, fmt.Errorf("invalid cache settings for environment %q: %s", name, err)
+		}
+		if err := validateEnvUpstreamHeaders(*envConfig); err != nil {
+			return c, fmt.Errorf("invalid upstream headers for environment %q: %s", name, err)
+		}
+	}
+	if err := validateAcmeConfig(c); err != nil {
+		return c, err
+	}
+	if c.LeaderElection.LeaseName == "" {
+		c.LeaderElection.LeaseName = defaultLeaseName
+	}
+	if c.LeaderElection.LeaseDurationSecs == 0 {
+		c.LeaderElection.LeaseDurationSecs = defaultLeaseDurationSecs
+	}
+	if c.LeaderElection.PollIntervalSecs <= 0 {
+		c.LeaderElection.PollIntervalSecs = defaultFollowerPollSecs
+	}
+	if err := validateLeaderElection(c); err != nil {
+		return c, fmt.Errorf("invalid leader election configuration: %s", err)
+	}
+	if err := validateUserPrivacy(c); err != nil {
+		return c, fmt.Errorf("invalid privacy configuration: %s", err)
+	}
+	if c.Audit.WebhookUrl != "" {
+		if err := validateAuditWebhookUrl(c.Audit.WebhookUrl); err != nil {
+			return c, fmt.Errorf("invalid audit webhookUrl: %s", err)
+		}
+	}
+	if c.Usage.ReportUrl != "" {
+		if err := validateAuditWebhookUrl(c.Usage.ReportUrl); err != nil {
+			return c, fmt.Errorf("invalid usage reportUrl: %s", err)
+		}
+		if c.Usage.ReportIntervalSecs <= 0 {
+			return c, errors.New("usage reportIntervalSecs must be positive")
+		}
+	}
+	if !c.Events.DisableDiagnostics && c.Events.DiagnosticIntervalSecs < minDiagnosticIntervalSecs {
+		return c, fmt.Errorf("diagnosticIntervalSecs must be at least %d", minDiagnosticIntervalSecs)
+	}
+	if c.Sentry.Dsn != "" {
+		if _, _, err := parseSentryDsn(c.Sentry.Dsn); err != nil {
+			return c, fmt.Errorf("invalid Sentry DSN: %s", err)
+		}
+	}
+
+	return c, nil
+}
+
+func makeDefaultClientFactory(waitFor time.Duration) func(sdkKey string, config ld.Config) (ldClientContext, error) {
+	return func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		return ld.MakeCustomClient(sdkKey, config, waitFor)
+	}
+}
+
+// Waits for a client that was created without blocking to finish connecting, unless its stream fails first
+func waitForInitialization(client ldClientContext, upstream *upstreamStream, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !client.Initialized() {
+		if err := upstream.failure(); err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return ld.ErrInitializationTimeout
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// Creates the relay and starts each of its environments, unless one of their stores can't be created
+func newRelay(c Config, clientFactory func(sdkKey string, config ld.Config) (ldClientContext, error)) (*relay, error) {
 	allPublisher := eventsource.NewServer()
 	allPublisher.Gzip = false
 	allPublisher.AllowCORS = true
-	allPublisher.ReplayAll = true
 	flagsPublisher := eventsource.NewServer()
 	flagsPublisher.Gzip = false
 	flagsPublisher.AllowCORS = true
-	flagsPublisher.ReplayAll = true
 	pingPublisher := eventsource.NewServer()
 	pingPublisher.Gzip = false
 	pingPublisher.AllowCORS = true
-	pingPublisher.ReplayAll = true
-	clients := map[string]*clientContextImpl{}
-	mobileClients := map[string]*clientContextImpl{}
-	clientSideMux := ClientSideMux{baseUri: c.Main.BaseUri, contextByKey: map[string]*clientSideContext{}}
+	// Replays are requested by replayOnConnect for each stream client instead of ReplayAll
+	if c.Main.StreamBufferSize > 0 {
+		allPublisher.BufferSize = c.Main.StreamBufferSize
+		flagsPublisher.BufferSize = c.Main.StreamBufferSize
+		pingPublisher.BufferSize = c.Main.StreamBufferSize
+	}
 	for key, envConfig := range c.Environment {
 		if envConfig.ApiKey != "" {
 			if envConfig.SdkKey == "" {
@@ -247,181 +859,488 @@ func newRelay(c Config, clientFactory func(sdkKey string, config ld.Config) (ldC
 				Warning.Println(`"apiKey" and "sdkKey" were both specified; "apiKey" is deprecated, will use "sdkKey" value`)
 			}
 		}
-		clients[envConfig.SdkKey] = nil
 	}
+	if c.Environment == nil {
+		c.Environment = make(map[string]*EnvConfig)
+	}
+
+	envs := newEnvironmentRegistry()
+	r := relay{
+		config:          c,
+		envs:            envs,
+		sdkClientMux:    ClientMux{envs: envs},
+		mobileClientMux: ClientMux{envs: envs, mobile: true},
+		clientSideMux:   ClientSideMux{baseUri: c.Main.BaseUri, envs: envs},
+		clientFactory:   clientFactory,
+		allPublisher:    allPublisher,
+		flagsPublisher:  flagsPublisher,
+		pingPublisher:   pingPublisher,
+		storeCheck:      newStoreCheck(c),
+		streamLimiter:   newStreamLimiter(c.Main.MaxStreamConnections, c.Main.MaxEnvStreamConnections),
+		privacy:         newUserPrivacy(c),
+	}
+	if c.Main.MaxConcurrentReplays > 0 {
+		r.replaySlots = make(chan struct{}, c.Main.MaxConcurrentReplays)
+	}
+	if c.Admin.Password != "" {
+		r.statusStream = newStatusStream(&r, statusStreamCheckInterval)
+	}
+	// Every store is created before any environment starts, so that a relay that can't run doesn't connect
+	stores := make(map[string]ld.FeatureStore, len(c.Environment))
 	for envName, envConfig := range c.Environment {
-		var baseFeatureStore ld.FeatureStore
-		if c.Redis.Host != "" && c.Redis.Port != 0 {
-			Info.Printf("Using Redis Feature Store: %s:%d with prefix: %s", c.Redis.Host, c.Redis.Port, envConfig.Prefix)
-			baseFeatureStore = ldr.NewRedisFeatureStore(c.Redis.Host, c.Redis.Port, envConfig.Prefix, time.Duration(*c.Redis.LocalTtl)*time.Millisecond, Info)
-		} else {
-			baseFeatureStore = ld.NewInMemoryFeatureStore(Info)
+		store, err := newBaseFeatureStore(c, *envConfig)
+		if err != nil {
+			for _, opened := range stores {
+				if closer, ok := opened.(io.Closer); ok {
+					closer.Close()
+				}
+			}
+			return nil, fmt.Errorf("environment %s: %s", envName, err)
 		}
+		stores[envName] = store
+	}
+	environmentChangesLock.Lock()
+	for envName, envConfig := range c.Environment {
+		r.startEnvironment(envName, *envConfig, stores[envName])
+	}
+	environmentChangesLock.Unlock()
+	return &r, nil
+}
 
-		logger := log.New(os.Stderr, fmt.Sprintf("[LaunchDarkly Relay (SdkKey ending with %s)] ", last5(envConfig.SdkKey)), log.LstdFlags)
+// Creates the client, stores and handlers for an environment, keeping its data in the given store made by
+// newBaseFeatureStore, and starts connecting it to LaunchDarkly in the background. The caller must make sure
+// that none of the environment's keys are in use, and hold environmentChangesLock.
+func (r *relay) startEnvironment(envName string, envConfig EnvConfig, baseFeatureStore ld.FeatureStore) *clientContextImpl {
+	c := r.config
+	unwrappedStore := baseFeatureStore
+	if persistentStoreConfigured(c) && c.Main.StoreTimeoutMs > 0 {
+		baseFeatureStore = newTimeoutFeatureStore(baseFeatureStore, time.Duration(c.Main.StoreTimeoutMs)*time.Millisecond, maxStoreReadsInFlight)
+	}
+	localCache := newEnvCache(c, envConfig, baseFeatureStore)
+	if localCache != nil {
+		baseFeatureStore = localCache
+	}
 
-		clientConfig := ld.DefaultConfig
-		clientConfig.Stream = true
-		clientConfig.FeatureStore = NewSSERelayFeatureStore(envConfig.SdkKey, allPublisher, flagsPublisher, pingPublisher, baseFeatureStore, c.Main.HeartbeatIntervalSecs)
-		clientConfig.StreamUri = c.Main.StreamUri
-		clientConfig.BaseUri = c.Main.BaseUri
-		clientConfig.Logger = logger
-		clientConfig.UserAgent = "LDRelay/" + Version
+	logger := log.New(os.Stderr, fmt.Sprintf("[LaunchDarkly Relay (SdkKey ending with %s)] ", last5(envConfig.SdkKey)), log.LstdFlags)
+	var clientLogger ld.Logger = logger
+	if errorReporter != nil {
+		baseFeatureStore = errorReportingStore{FeatureStore: baseFeatureStore, envName: envName}
+		clientLogger = reportingLogger{Logger: logger, envName: envName}
+	}
+	var fallback *lastKnownGoodStore
+	if persistentStoreConfigured(c) && c.Main.StoreFallbackSecs > 0 {
+		fallback = newLastKnownGoodStore(baseFeatureStore, time.Duration(c.Main.StoreFallbackSecs)*time.Second, envName)
+		baseFeatureStore = fallback
+	}
 
-		clientContext := &clientContextImpl{
-			name:      envName,
-			envId:     envConfig.EnvId,
-			sdkKey:    envConfig.SdkKey,
-			mobileKey: envConfig.MobileKey,
-			store:     baseFeatureStore,
-			logger:    logger,
-			handlers: clientHandlers{
-				allStreamHandler:   allPublisher.Handler(envConfig.SdkKey),
-				flagsStreamHandler: flagsPublisher.Handler(envConfig.SdkKey),
-				pingStreamHandler:  pingPublisher.Handler(envConfig.SdkKey),
-			},
-		}
+	replays := newStreamReplays(r.replaySlots)
+	var envAllPublisher, envFlagsPublisher, envPingPublisher ESPublisher = replays.wrap(r.allPublisher), replays.wrap(r.flagsPublisher), replays.wrap(r.pingPublisher)
+	if c.Main.CoalesceWindowMs > 0 {
+		window := time.Duration(c.Main.CoalesceWindowMs) * time.Millisecond
+		envAllPublisher = newCoalescingPublisher(envAllPublisher, window)
+		envFlagsPublisher = newCoalescingPublisher(envFlagsPublisher, window)
+		envPingPublisher = newCoalescingPublisher(envPingPublisher, window)
+	}
 
-		clients[envConfig.SdkKey] = clientContext
+	clientConfig := ld.DefaultConfig
+	clientConfig.Stream = true
+	channel := envStreamChannel(envName, envConfig.SdkKey)
+	overrides := newFlagOverrides()
+	// Everything that serves flags reads them through the overrides; only the events handler sees the real ones
+	servedStore := overridingFeatureStore{FeatureStore: baseFeatureStore, overrides: overrides}
+	heartbeatInterval, pingInterval := c.Main.HeartbeatIntervalSecs, c.Main.PingIntervalSecs
+	if envConfig.HeartbeatIntervalSecs != nil {
+		heartbeatInterval = *envConfig.HeartbeatIntervalSecs
+	}
+	if envConfig.PingIntervalSecs != nil {
+		pingInterval = *envConfig.PingIntervalSecs
+	}
+	relayStore := NewSSERelayFeatureStore(channel, envAllPublisher, envFlagsPublisher, envPingPublisher, servedStore, heartbeatInterval)
+	if pingInterval > 0 {
+		relayStore.sendPings(time.Duration(pingInterval) * time.Second)
+	}
+	clientConfig.FeatureStore = relayStore
+	clientConfig.StreamUri = c.Main.StreamUri
+	clientConfig.BaseUri = c.Main.BaseUri
+	clientConfig.Logger = clientLogger
+	clientConfig.UserAgent = "LDRelay/" + Version
+
+	var allowedClientSans []string
+	if envConfig.AllowedClientSan != nil {
+		allowedClientSans = *envConfig.AllowedClientSan
+	}
+	// Tags and headers have already been validated
+	tags, _ := parseEnvTags(envConfig)
+	headers := newUpstreamHeaders(c, envConfig)
+
+	clientContext := &clientContextImpl{
+		name:              envName,
+		envId:             envConfig.EnvId,
+		sdkKey:            envConfig.SdkKey,
+		mobileKey:         envConfig.MobileKey,
+		store:             servedStore,
+		baseStore:         unwrappedStore,
+		relayStore:        relayStore,
+		overrides:         overrides,
+		replays:           replays,
+		fallback:          fallback,
+		evalCache:         newEvalCache(time.Duration(c.Main.EvalCacheTtlMs)*time.Millisecond, c.Main.EvalCacheMaxEntries),
+		localCache:        localCache,
+		logger:            logger,
+		changes:           relayStore.changes,
+		storeCheck:        r.storeCheck,
+		state:             envInitializing,
+		allowedClientSans: allowedClientSans,
+		tags:              tags,
+		upstreamHeaders:   headers,
+		handlers: clientHandlers{
+			allStreamHandler:     relayStore.disconnectOnClose(replayOnConnect(r.allPublisher.Handler(channel))),
+			flagsStreamHandler:   relayStore.disconnectOnClose(replayOnConnect(r.flagsPublisher.Handler(channel))),
+			pingStreamHandler:    relayStore.disconnectOnClose(replayOnConnect(r.pingPublisher.Handler(channel))),
+			pingingStreamHandler: relayStore.disconnectOnClose(replayOnConnect(r.pingPublisher.Handler(channel + pingingChannelSuffix))),
+		},
+	}
 
-		if envConfig.MobileKey != nil && *envConfig.MobileKey != "" {
-			mobileClients[*envConfig.MobileKey] = clientContext
+	var clientSideCtx *clientSideContext
+	if envConfig.EnvId != nil && *envConfig.EnvId != "" {
+		var allowedOrigins []string
+		if envConfig.AllowedOrigin != nil && len(*envConfig.AllowedOrigin) != 0 {
+			allowedOrigins = *envConfig.AllowedOrigin
 		}
+		goals := newGoalsCache(c.Main.BaseUri, *envConfig.EnvId, time.Duration(c.Main.GoalsCacheTtlSecs)*time.Second,
+			time.Duration(c.Main.GoalsTimeoutSecs)*time.Second, headers)
+		clientSideCtx = &clientSideContext{clientContext: clientContext, name: envName, allowedOrigins: allowedOrigins,
+			allowedClientSans: allowedClientSans, goals: goals}
+	}
+	r.envs.add(clientContext, clientSideCtx)
 
-		if envConfig.EnvId != nil && *envConfig.EnvId != "" {
-			var allowedOrigins []string
-			if envConfig.AllowedOrigin != nil && len(*envConfig.AllowedOrigin) != 0 {
-				allowedOrigins = *envConfig.AllowedOrigin
-			}
-			clientSideMux.contextByKey[*envConfig.EnvId] = &clientSideContext{clientContext: clientContext, allowedOrigins: allowedOrigins}
+	sinks, err := newEventSinks(envName, envConfig, c)
+	if err != nil {
+		Error.Printf("Unable to publish events for environment %s: %s", envName, err)
+	}
+	if c.Events.SendEvents || len(sinks) > 0 {
+		eventsHandler := newEventRelayHandler(envConfig.SdkKey, c, baseFeatureStore)
+		eventsHandler.sinks = sinks
+		eventsHandler.sinksOnly = envConfig.EventSinksOnly
+		eventsHandler.metrics = &clientContext.metrics
+		eventsHandler.headers = headers
+		if c.Events.SendEvents && !envConfig.EventSinksOnly {
+			Info.Printf("Proxying events for environment %s", envName)
+		}
+		for _, sink := range sinks {
+			Info.Printf("Publishing events for environment %s to %s", envName, sink.sink)
 		}
+		clientContext.handlers.eventsHandler = eventsHandler
+	}
 
-		if c.Events.SendEvents {
-			Info.Printf("Proxying events for environment %s", envName)
-			clientContext.handlers.eventsHandler = newEventRelayHandler(envConfig.SdkKey, c, baseFeatureStore)
+	if archive != nil {
+		// This comes before connecting, so that the snapshot can't overwrite newer data from LaunchDarkly
+		if bootstrapFromArchive(archive, envName, relayStore) {
+			clientContext.setClient(bootstrappedClient{})
+		}
+		if c.Archive.WriteIntervalSecs > 0 {
+			go clientContext.writeArchiveSnapshots(archive, time.Duration(c.Archive.WriteIntervalSecs)*time.Second)
 		}
+	}
 
-		// Connecting may take time, so do this in parallel
-		go func(envName string, envConfig EnvConfig) {
-			client, err := clientFactory(envConfig.SdkKey, clientConfig)
-			clientContext.setClient(client)
+	clientFactory := r.clientFactory
+	backoff := newReconnectBackoff(c)
+	staleAfter := time.Duration(c.Main.StreamStaleSecs) * time.Second
+	clientContext.connect = func() {
+		clientContext.setState(envInitializing)
+		// Each client needs a stream of its own
+		clientConfig := clientConfig
+		upstream := newUpstreamStream(envConfig.SdkKey, clientConfig, backoff, staleAfter, headers)
+		clientConfig.UpdateProcessor = upstream
+		clientContext.setUpstream(upstream)
+		client, err := clientFactory(envConfig.SdkKey, clientConfig)
+		clientContext.setClient(client)
+		if err == nil && c.Main.BackgroundInit {
+			err = waitForInitialization(client, upstream, time.Duration(c.Main.InitTimeoutSecs)*time.Second)
+		}
+		if err == nil {
+			// The client reports success if the stream gave up on an invalid SDK key before connecting
+			err = upstream.failure()
+		}
+		if err != nil {
+			clientContext.setState(envFailed)
+		} else {
+			clientContext.setState(envReady)
+		}
 
-			if err != nil {
-				if !c.Main.IgnoreConnectionErrors {
-					Error.Printf("Error initializing LaunchDarkly client for %s: %+v\n", envName, err)
+		if err != nil {
+			reportError(err, map[string]string{"environment": envName})
+			if !c.Main.IgnoreConnectionErrors {
+				Error.Printf("Error initializing LaunchDarkly client for %s: %+v\n", envName, err)
 
-					if c.Main.ExitOnError {
-						os.Exit(1)
-					}
-					return
+				if c.Main.ExitOnError {
+					os.Exit(1)
 				}
+				return
+			}
+
+			Error.Printf("Ignoring error initializing LaunchDarkly client for %s: %+v\n", envName, err)
+		} else {
+			Info.Printf("Initialized LaunchDarkly client for %s\n", envName)
+		}
+	}
 
-				Error.Printf("Ignoring error initializing LaunchDarkly client for %s: %+v\n", envName, err)
+	if election != nil {
+		election.withRole(func(leader bool) {
+			if leader {
+				go clientContext.connect()
 			} else {
-				Info.Printf("Initialized LaunchDarkly client for %s\n", envName)
+				clientContext.follow(time.Duration(c.LeaderElection.PollIntervalSecs) * time.Second)
 			}
-		}(envName, *envConfig)
+		})
+		return clientContext
 	}
 
-	r := relay{
-		sdkClientMux:    ClientMux{clientContextByKey: clients},
-		mobileClientMux: ClientMux{clientContextByKey: mobileClients},
-		clientSideMux:   clientSideMux,
+	// Connecting may take time, so do this in parallel
+	go clientContext.connect()
+	return clientContext
+}
+
+func redisConfigured(c Config) bool {
+	return c.Redis.Host != "" && c.Redis.Port != 0
+}
+
+func persistentStoreConfigured(c Config) bool {
+	return redisConfigured(c) || c.Postgres.Url != "" || len(c.Memcached.Server) > 0 || c.Main.Store != ""
+}
+
+// Creates the store that holds an environment's flags and segments: Redis, Postgres, memcached or a custom
+// store if one of them is configured, or otherwise memory. The store's own cache is turned off for an
+// environment that has cache settings of its own, since it is cached in front of the store instead. An error
+// is returned if the configured store can't be created, rather than keeping flags in memory where other
+// relays and SDKs in daemon mode wouldn't see them.
+func newBaseFeatureStore(c Config, envConfig EnvConfig) (ld.FeatureStore, error) {
+	localTtl := func(configured *int) time.Duration {
+		if envCacheConfigured(envConfig) {
+			return 0
+		}
+		return time.Duration(*configured) * time.Millisecond
+	}
+	if c.Main.Store != "" {
+		Info.Printf("Using %s Feature Store with prefix: %s", c.Main.Store, envConfig.Prefix)
+		store, err := newCustomFeatureStore(c, envConfig)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create the %s store: %s", c.Main.Store, err)
+		}
+		return store, nil
+	}
+	if redisConfigured(c) {
+		Info.Printf("Using Redis Feature Store: %s:%d with prefix: %s", c.Redis.Host, c.Redis.Port, envConfig.Prefix)
+		return newRedisFeatureStore(c.Redis.Host, c.Redis.Port, envConfig.Prefix, localTtl(c.Redis.LocalTtl), Info), nil
+	}
+	if c.Postgres.Url != "" {
+		Info.Printf("Using Postgres Feature Store with prefix: %s", envConfig.Prefix)
+		store, err := NewPostgresFeatureStore(c.Postgres.Url, envConfig.Prefix, localTtl(c.Postgres.LocalTtl), Info)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open Postgres: %s", err)
+		}
+		return store, nil
 	}
-	return &r
+	if len(c.Memcached.Server) > 0 {
+		Info.Printf("Using Memcached Feature Store: %s with prefix: %s", strings.Join(c.Memcached.Server, ","), envConfig.Prefix)
+		return NewMemcachedFeatureStore(c.Memcached.Server, envConfig.Prefix, localTtl(c.Memcached.LocalTtl), Info), nil
+	}
+	return ld.NewInMemoryFeatureStore(Info), nil
+}
+
+// Returns a function that reports whether the configured persistent store can be reached, or nil if
+// flags are only kept in memory
+func newStoreCheck(c Config) func() error {
+	if redisConfigured(c) {
+		return newRedisStoreCheck(c.Redis.Host, c.Redis.Port)
+	}
+	if c.Postgres.Url != "" {
+		url := c.Postgres.Url
+		return func() error {
+			return pingPostgres(url)
+		}
+	}
+	if len(c.Memcached.Server) > 0 {
+		return memcachedClient(c.Memcached.Server).Ping
+	}
+	return nil
 }
 
 func (r *relay) getHandler() http.Handler {
+	// The configuration was checked when it was loaded
+	policy, _ := newEndpointPolicy(r.config.Endpoints.Expose, r.config.Endpoints.Disable)
+
 	router := mux.NewRouter()
-	router.HandleFunc("/status", r.sdkClientMux.getStatus).Methods("GET")
+	router.Use(requestTimeout(time.Duration(r.config.Main.RequestTimeoutSecs) * time.Second))
+	if policy.serves(endpointsStatus) {
+		router.HandleFunc("/status", r.sdkClientMux.getStatus).Methods("GET")
+	} else {
+		router.HandleFunc("/status", r.serveHiddenStatus).Methods("GET")
+	}
+
+	r.registerApiV2(router, policy)
+	r.registerAdmin(router)
+
+	evalBodyLimit := limitBodySize(r.config.Main.MaxEvalBodyBytes)
+	eventsBodyLimit := limitBodySize(r.config.Events.MaxBodyBytes)
+	streamLimit := r.streamLimiter.middleware
+	scrubUsers := r.privacy.middleware
 
 	// Client-side evaluation
 	clientSideMiddlewareStack := chainMiddleware(corsMiddleware, r.clientSideMux.selectClientByUrlParam)
 
-	goalsRouter := router.PathPrefix("/sdk/goals").Subrouter()
-	goalsRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(goalsRouter))
-	goalsRouter.HandleFunc("/{envId}", r.clientSideMux.getGoals).Methods("GET", "OPTIONS")
+	if policy.serves(endpointsClientSide) {
+		goalsRouter := router.PathPrefix("/sdk/goals").Subrouter()
+		goalsRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(goalsRouter))
+		goalsRouter.HandleFunc("/{envId}", r.clientSideMux.getGoals).Methods("GET", "OPTIONS")
+
+		snippetRouter := router.PathPrefix("/sdk/snippet/{envId}").Subrouter()
+		snippetRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(snippetRouter), scrubUsers)
+		snippetRouter.HandleFunc("", getSnippet).Methods("GET", "OPTIONS")
 
-	clientSideSdkEvalRouter := router.PathPrefix("/sdk/eval/{envId}/").Subrouter()
-	clientSideSdkEvalRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideSdkEvalRouter))
-	clientSideSdkEvalRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlagsValueOnly).Methods("GET", "OPTIONS")
-	clientSideSdkEvalRouter.HandleFunc("/user", evaluateAllFeatureFlagsValueOnly).Methods("REPORT", "OPTIONS")
+		clientSideSdkEvalRouter := router.PathPrefix("/sdk/eval/{envId}/").Subrouter()
+		clientSideSdkEvalRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideSdkEvalRouter), evalBodyLimit, scrubUsers)
+		clientSideSdkEvalRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlagsValueOnly).Methods("GET", "OPTIONS")
+		clientSideSdkEvalRouter.HandleFunc("/user", evaluateAllFeatureFlagsValueOnly).Methods("GET", "REPORT", "OPTIONS")
 
-	clientSideSdkEvalXRouter := router.PathPrefix("/sdk/evalx/{envId}/").Subrouter()
-	clientSideSdkEvalXRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideSdkEvalXRouter))
-	clientSideSdkEvalXRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlags).Methods("GET", "OPTIONS")
-	clientSideSdkEvalXRouter.HandleFunc("/user", evaluateAllFeatureFlags).Methods("REPORT", "OPTIONS")
+		clientSideSdkEvalXRouter := router.PathPrefix("/sdk/evalx/{envId}/").Subrouter()
+		clientSideSdkEvalXRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideSdkEvalXRouter), evalBodyLimit, scrubUsers)
+		clientSideSdkEvalXRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlags).Methods("GET", "OPTIONS")
+		clientSideSdkEvalXRouter.HandleFunc("/user", evaluateAllFeatureFlags).Methods("GET", "REPORT", "OPTIONS")
+	}
 
 	serverSideSdkRouter := router.PathPrefix("/sdk/").Subrouter()
 	serverSideSdkRouter.Use(r.sdkClientMux.selectClientByAuthorizationKey)
 
-	serverSideEvalRouter := serverSideSdkRouter.PathPrefix("/eval/").Subrouter()
-	serverSideEvalRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlagsValueOnly).Methods("GET")
-	serverSideEvalRouter.HandleFunc("/user", evaluateAllFeatureFlagsValueOnly).Methods("REPORT")
-
-	serverSideEvalXRouter := serverSideSdkRouter.PathPrefix("/evalx/").Subrouter()
-	serverSideEvalXRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlags).Methods("GET")
-	serverSideEvalXRouter.HandleFunc("/user", evaluateAllFeatureFlags).Methods("REPORT")
+	if policy.serves(endpointsServerEval) {
+		serverSideEvalRouter := serverSideSdkRouter.PathPrefix("/eval/").Subrouter()
+		serverSideEvalRouter.Use(evalBodyLimit)
+		serverSideEvalRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlagsValueOnly).Methods("GET")
+		serverSideEvalRouter.HandleFunc("/user", evaluateAllFeatureFlagsValueOnly).Methods("GET", "REPORT")
 
-	// Mobile evaluation
-	msdkRouter := router.PathPrefix("/msdk/").Subrouter()
-	msdkRouter.Use(r.mobileClientMux.selectClientByAuthorizationKey)
-
-	msdkEvalRouter := msdkRouter.PathPrefix("/eval/").Subrouter()
-	msdkEvalRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlagsValueOnly).Methods("GET")
-	msdkEvalRouter.HandleFunc("/user", evaluateAllFeatureFlagsValueOnly).Methods("REPORT")
+		serverSideEvalXRouter := serverSideSdkRouter.PathPrefix("/evalx/").Subrouter()
+		serverSideEvalXRouter.Use(evalBodyLimit)
+		serverSideEvalXRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlags).Methods("GET")
+		serverSideEvalXRouter.HandleFunc("/user", evaluateAllFeatureFlags).Methods("GET", "REPORT")
+	}
 
-	msdkEvalXRouter := msdkRouter.PathPrefix("/evalx/").Subrouter()
-	msdkEvalXRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlags).Methods("GET")
-	msdkEvalXRouter.HandleFunc("/user", evaluateAllFeatureFlags).Methods("REPORT")
+	if policy.serves(endpointsServerPolling) {
+		serverSideSdkRouter.HandleFunc("/latest-all", pollAllHandler).Methods("GET")
+		serverSideSdkRouter.HandleFunc("/latest-flags", pollFlagsHandler).Methods("GET")
+		serverSideSdkRouter.HandleFunc("/latest-flags/{key}", pollFlagHandler).Methods("GET")
+		serverSideSdkRouter.HandleFunc("/latest-segments", pollSegmentsHandler).Methods("GET")
+		serverSideSdkRouter.HandleFunc("/latest-segments/{key}", pollSegmentHandler).Methods("GET")
+	}
 
-	router.Handle("/mping", r.mobileClientMux.selectClientByAuthorizationKey(http.HandlerFunc(pingStreamHandler))).Methods("GET")
+	// Mobile evaluation
+	if policy.serves(endpointsMobile) {
+		msdkRouter := router.PathPrefix("/msdk/").Subrouter()
+		msdkRouter.Use(r.mobileClientMux.selectClientByAuthorizationKey, scrubUsers)
 
-	clientSidePingRouter := router.PathPrefix("/ping/{envId}").Subrouter()
-	clientSidePingRouter.Use(clientSideMiddlewareStack)
-	clientSidePingRouter.Use(mux.CORSMethodMiddleware(clientSidePingRouter))
-	clientSidePingRouter.HandleFunc("", pingStreamHandler).Methods("GET", "OPTIONS")
+		msdkEvalRouter := msdkRouter.PathPrefix("/eval/").Subrouter()
+		msdkEvalRouter.Use(evalBodyLimit)
+		msdkEvalRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlagsValueOnly).Methods("GET")
+		msdkEvalRouter.HandleFunc("/user", evaluateAllFeatureFlagsValueOnly).Methods("GET", "REPORT")
 
-	clientSideStreamEvalRouter := router.PathPrefix("/eval/{envId}").Subrouter()
-	clientSideStreamEvalRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideStreamEvalRouter))
-	// For now we implement eval as simply ping
-	clientSideStreamEvalRouter.HandleFunc("/{user}", pingStreamHandler).Methods("GET", "OPTIONS")
-	clientSideStreamEvalRouter.HandleFunc("", pingStreamHandler).Methods("REPORT", "OPTIONS")
+		msdkEvalXRouter := msdkRouter.PathPrefix("/evalx/").Subrouter()
+		msdkEvalXRouter.Use(evalBodyLimit)
+		msdkEvalXRouter.HandleFunc("/users/{user}", evaluateAllFeatureFlags).Methods("GET")
+		msdkEvalXRouter.HandleFunc("/user", evaluateAllFeatureFlags).Methods("GET", "REPORT")
 
-	mobileEventsRouter := router.PathPrefix("/mobile").Subrouter()
-	mobileEventsRouter.Use(r.mobileClientMux.selectClientByAuthorizationKey)
-	mobileEventsRouter.HandleFunc("/events/bulk", bulkEventHandler).Methods("POST")
-	mobileEventsRouter.HandleFunc("/events", bulkEventHandler).Methods("POST")
-	mobileEventsRouter.HandleFunc("", bulkEventHandler).Methods("POST")
+		router.Handle("/mping", streamHandler{r.mobileClientMux.selectClientByAuthorizationKey(streamLimit(http.HandlerFunc(pingStreamHandler)))}).Methods("GET")
+	}
 
-	clientSideBulkEventsRouter := router.PathPrefix("/events/bulk/{envId}").Subrouter()
-	clientSideBulkEventsRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideBulkEventsRouter))
-	clientSideBulkEventsRouter.HandleFunc("", bulkEventHandler).Methods("POST", "OPTIONS")
+	if policy.serves(endpointsClientSide) {
+		clientSidePingRouter := router.PathPrefix("/ping/{envId}").Subrouter()
+		clientSidePingRouter.Use(clientSideMiddlewareStack)
+		clientSidePingRouter.Use(mux.CORSMethodMiddleware(clientSidePingRouter), streamLimit)
+		clientSidePingRouter.Handle("", streamHandler{http.HandlerFunc(pingStreamHandler)}).Methods("GET", "OPTIONS")
+
+		clientSideStreamEvalRouter := router.PathPrefix("/eval/{envId}").Subrouter()
+		clientSideStreamEvalRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideStreamEvalRouter), streamLimit)
+		// For now we implement eval as simply ping
+		clientSideStreamEvalRouter.Handle("/{user}", streamHandler{http.HandlerFunc(pingStreamHandler)}).Methods("GET", "OPTIONS")
+		clientSideStreamEvalRouter.Handle("", streamHandler{http.HandlerFunc(pingStreamHandler)}).Methods("REPORT", "OPTIONS")
+	}
 
-	clientSideImageEventsRouter := router.PathPrefix("/a/{envId}.gif").Subrouter()
-	clientSideImageEventsRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideImageEventsRouter))
-	clientSideImageEventsRouter.HandleFunc("", getEventsImage).Methods("GET", "OPTIONS")
+	if policy.serves(endpointsEvents) {
+		mobileEventsRouter := router.PathPrefix("/mobile").Subrouter()
+		mobileEventsRouter.Use(r.mobileClientMux.selectClientByAuthorizationKey, eventsBodyLimit, deviceEvents, scrubUsers)
+		mobileEventsRouter.HandleFunc("/events/bulk", bulkEventHandler).Methods("POST")
+		mobileEventsRouter.HandleFunc("/events/diagnostic", diagnosticEventHandler).Methods("POST")
+		mobileEventsRouter.HandleFunc("/events", bulkEventHandler).Methods("POST")
+		mobileEventsRouter.HandleFunc("", bulkEventHandler).Methods("POST")
+
+		clientSideBulkEventsRouter := router.PathPrefix("/events/bulk/{envId}").Subrouter()
+		clientSideBulkEventsRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideBulkEventsRouter), eventsBodyLimit, deviceEvents, scrubUsers)
+		clientSideBulkEventsRouter.HandleFunc("", bulkEventHandler).Methods("POST", "OPTIONS")
+
+		clientSideDiagnosticEventsRouter := router.PathPrefix("/events/diagnostic/{envId}").Subrouter()
+		clientSideDiagnosticEventsRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideDiagnosticEventsRouter), eventsBodyLimit)
+		clientSideDiagnosticEventsRouter.HandleFunc("", diagnosticEventHandler).Methods("POST", "OPTIONS")
+
+		clientSideImageEventsRouter := router.PathPrefix("/a/{envId}.gif").Subrouter()
+		clientSideImageEventsRouter.Use(clientSideMiddlewareStack, mux.CORSMethodMiddleware(clientSideImageEventsRouter), deviceEvents, scrubUsers)
+		clientSideImageEventsRouter.HandleFunc("", getEventsImage).Methods("GET", "OPTIONS")
+	}
 
 	serverSideRouter := router.PathPrefix("").Subrouter()
 	serverSideRouter.Use(r.sdkClientMux.selectClientByAuthorizationKey)
-	serverSideRouter.HandleFunc("/all", allStreamHandler).Methods("GET")
-	serverSideRouter.HandleFunc("/flags", flagsStreamHandler).Methods("GET")
-	serverSideRouter.HandleFunc("/bulk", bulkEventHandler).Methods("POST")
+	if policy.serves(endpointsServerStreaming) {
+		serverSideRouter.Handle("/all", streamHandler{streamLimit(http.HandlerFunc(allStreamHandler))}).Methods("GET")
+		serverSideRouter.Handle("/flags", streamHandler{streamLimit(http.HandlerFunc(flagsStreamHandler))}).Methods("GET")
+	}
+	if policy.serves(endpointsEvents) {
+		serverSideRouter.Handle("/bulk", eventsBodyLimit(http.HandlerFunc(bulkEventHandler))).Methods("POST")
+		serverSideRouter.Handle("/diagnostic", eventsBodyLimit(http.HandlerFunc(diagnosticEventHandler))).Methods("POST")
+	}
 
-	return router
+	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+	return assignRequestId(recoveryMiddleware(router))
 }
 
 type ClientMux struct {
-	clientContextByKey map[string]*clientContextImpl
+	envs *environmentRegistry
+	// Finds environments by their mobile keys rather than their SDK keys
+	mobile bool
 }
 
+func (m ClientMux) find(authKey string) *clientContextImpl {
+	if m.mobile {
+		return m.envs.withMobileKey(authKey)
+	}
+	return m.envs.withSdkKey(authKey)
+}
+
+// Serves the public status resource, which says whether each environment is connected and which relays are
+// upstream of this one, without the relay's internal state
 func (m ClientMux) getStatus(w http.ResponseWriter, req *http.Request) {
+	m.writeStatus(w, req, false)
+}
+
+// Serves the status resource for operators, which adds overrides, usage, cache statistics, leader election and
+// debug features, and the parent relay's address and errors
+func (m ClientMux) getDetailedStatus(w http.ResponseWriter, req *http.Request) {
+	m.writeStatus(w, req, true)
+}
+
+func (m ClientMux) writeStatus(w http.ResponseWriter, req *http.Request, detailed bool) {
 	w.Header().Set("Content-Type", "application/json")
+	filter, err := tagFilterFromRequest(req)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
 	envs := make(map[string]EnvironmentStatus)
 
 	healthy := true
-	for _, clientCtx := range m.clientContextByKey {
+	for _, clientCtx := range m.envs.all() {
+		if !filter.matches(clientCtx.tags) {
+			continue
+		}
 		var status EnvironmentStatus
+		status.Tags = clientCtx.tags
 		if clientCtx.envId != nil {
 			status.EnvId = *clientCtx.envId
 		}
@@ -429,12 +1348,23 @@ func (m ClientMux) getStatus(w http.ResponseWriter, req *http.Request) {
 			status.MobileKey = obscureKey(*clientCtx.mobileKey)
 		}
 		status.SdkKey = obscureKey(clientCtx.sdkKey)
-		client := clientCtx.getClient()
-		if client == nil || !client.Initialized() {
-			status.Status = "disconnected"
+		status.Status = clientCtx.connectionStatus()
+		status.State = string(clientCtx.lifecycleState())
+		if detailed {
+			if clientCtx.overrides != nil {
+				status.Overrides = clientCtx.overrides.keys()
+			}
+			if usageReporter != nil {
+				usage := clientCtx.metrics.usageSummary()
+				status.Usage = &usage
+			}
+			if clientCtx.evalCache != nil {
+				stats := clientCtx.evalCache.stats()
+				status.EvalCache = &stats
+			}
+		}
+		if status.Status != "connected" {
 			healthy = false
-		} else {
-			status.Status = "connected"
 		}
 		envs[clientCtx.name] = status
 	}
@@ -442,6 +1372,26 @@ func (m ClientMux) getStatus(w http.ResponseWriter, req *http.Request) {
 	resp := make(map[string]interface{})
 
 	resp["environments"] = envs
+	resp["relayId"] = relayId
+	if parentRelay != nil {
+		parentStatus, ok := parentRelay.status()
+		if !detailed {
+			// Child relays only need the chain, to detect loops
+			parentStatus = parentRelayStatus{RelayIds: parentStatus.RelayIds}
+		}
+		resp["parentRelay"] = parentStatus
+		if !ok {
+			healthy = false
+		}
+	}
+	if detailed {
+		if election != nil {
+			resp["leaderElection"] = election.status()
+		}
+		if debug := getDebugFeatures(); len(debug) > 0 {
+			resp["debug"] = debug
+		}
+	}
 	if healthy {
 		resp["status"] = "healthy"
 	} else {
@@ -453,25 +1403,52 @@ func (m ClientMux) getStatus(w http.ResponseWriter, req *http.Request) {
 	w.Write(data)
 }
 
+func (m ClientMux) allInitialized() bool {
+	for _, clientCtx := range m.envs.all() {
+		client := clientCtx.getClient()
+		if client == nil || !client.Initialized() {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true once no environment is still initializing, whether each one has connected or failed to
+func (m ClientMux) allStarted() bool {
+	for _, clientCtx := range m.envs.all() {
+		if clientCtx.lifecycleState() == envInitializing {
+			return false
+		}
+	}
+	return true
+}
+
 func (m ClientMux) selectClientByAuthorizationKey(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		authKey, err := fetchAuthToken(req)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+			auditFailure(auditMissingKey, "", "", req)
+			writeError(w, req, http.StatusUnauthorized, err.Error())
 			return
 		}
 
-		clientCtx := m.clientContextByKey[authKey]
-
+		clientCtx := m.find(authKey)
 		if clientCtx == nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("ld-relay is not configured for the provided key"))
+			auditFailure(auditUnknownKey, authKey, "", req)
+			writeError(w, req, http.StatusUnauthorized, "ld-relay is not configured for the provided key")
+			return
+		}
+
+		if !clientCertAllowed(req, clientCtx.allowedClientSans) {
+			auditFailure(auditCertificateDenied, authKey, clientCtx.name, req)
+			writeError(w, req, http.StatusForbidden, "Client certificate is not allowed to access this environment")
 			return
 		}
+		auditKeyUse(authKey, clientCtx.name)
+		clientCtx.metrics.requestAuthorized(keyType(authKey))
 
 		if clientCtx.getClient() == nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("client was not initialized"))
+			writeError(w, req, http.StatusServiceUnavailable, "Environment has not been initialized")
 			return
 		}
 
@@ -491,24 +1468,29 @@ func evaluateAllFeatureFlags(w http.ResponseWriter, req *http.Request) {
 func evaluateAllShared(w http.ResponseWriter, req *http.Request, valueOnly bool) {
 	var user *ld.User
 	var userDecodeErr error
-	if req.Method == "REPORT" {
+	if req.Method == "REPORT" || req.Method == "POST" {
 		if req.Header.Get("Content-Type") != "application/json" {
-			w.WriteHeader(http.StatusUnsupportedMediaType)
-			w.Write([]byte("Content-Type must be application/json."))
+			writeError(w, req, http.StatusUnsupportedMediaType, "Content-Type must be application/json.")
 			return
 		}
 
-		body, _ := ioutil.ReadAll(req.Body)
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeBodyReadError(w, req, err)
+			return
+		}
 		userDecodeErr = json.Unmarshal(body, &user)
+		if userDecodeErr == nil && user == nil {
+			userDecodeErr = errors.New("User must have a 'key' attribute")
+		}
 	} else {
-		base64User := mux.Vars(req)["user"]
-		user, userDecodeErr = UserV2FromBase64(base64User)
+		user, userDecodeErr = userFromGetRequest(req)
 	}
 	if userDecodeErr != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(ErrorJsonMsg(userDecodeErr.Error()))
+		writeError(w, req, http.StatusBadRequest, userDecodeErr.Error())
 		return
 	}
+	recordEvaluationUser(req, user)
 
 	clientCtx := getClientContext(req)
 	client := clientCtx.getClient()
@@ -519,26 +1501,43 @@ func evaluateAllShared(w http.ResponseWriter, req *http.Request, valueOnly bool)
 
 	if !client.Initialized() {
 		if store.Initialized() {
-			logger.Println("WARN: Called before client initialization; using last known values from feature store")
+			logger.Printf("WARN: Called before client initialization%s; using last known values from feature store", forRequest(req))
 		} else {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			logger.Println("WARN: Called before client initialization. Feature store not available")
-			w.Write(ErrorJsonMsg("Service not initialized"))
+			logger.Printf("WARN: Called before client initialization%s. Feature store not available", forRequest(req))
+			writeError(w, req, http.StatusServiceUnavailable, "Service not initialized")
 			return
 		}
 	}
 
 	if user.Key == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(ErrorJsonMsg("User must have a 'key' attribute"))
+		writeError(w, req, http.StatusBadRequest, "User must have a 'key' attribute")
 		return
 	}
 
 	items, err := store.All(ld.Features)
 	if err != nil {
-		logger.Printf("WARN: Unable to fetch flags from feature store. Returning nil map. Error: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(ErrorJsonMsgf("Error fetching flags from feature store: %s", err))
+		logger.Printf("WARN: Unable to fetch flags from feature store%s. Returning nil map. Error: %s", forRequest(req), err)
+		writeErrorf(w, req, errorStatus(err), "Error fetching flags from feature store: %s", err)
+		return
+	}
+	segments, err := store.All(ld.Segments)
+	if err != nil {
+		logger.Printf("WARN: Unable to fetch segments from feature store%s. Error: %s", forRequest(req), err)
+		writeErrorf(w, req, errorStatus(err), "Error fetching segments from feature store: %s", err)
+		return
+	}
+
+	etag := evalETag(user, valueOnly, items, segments)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", evalCacheControl)
+	if etagMatches(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	cache := clientCtx.getEvalCache()
+	if cached, ok := cache.get(etag); ok {
+		w.WriteHeader(http.StatusOK)
+		w.Write(cached)
 		return
 	}
 
@@ -563,59 +1562,98 @@ func evaluateAllShared(w http.ResponseWriter, req *http.Request, valueOnly bool)
 	}
 
 	result, _ := json.Marshal(response)
+	cache.put(etag, result)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(result)
 }
 
+// Clients may add a ping query parameter to be sent the environment's periodic pings, so that they can tell
+// when the stream has died even if they can't see heartbeats
 func pingStreamHandler(w http.ResponseWriter, req *http.Request) {
 	clientCtx := getClientContext(req)
-	clientCtx.getHandlers().pingStreamHandler.ServeHTTP(w, req)
+	handler := clientCtx.getHandlers().pingStreamHandler
+	if _, ok := req.URL.Query()["ping"]; ok && clientCtx.getHandlers().pingingStreamHandler != nil {
+		handler = clientCtx.getHandlers().pingingStreamHandler
+	}
+	serveStream(clientCtx, handler, w, req)
 }
 
 func allStreamHandler(w http.ResponseWriter, req *http.Request) {
 	clientCtx := getClientContext(req)
-	clientCtx.getHandlers().allStreamHandler.ServeHTTP(w, req)
+	serveStream(clientCtx, clientCtx.getHandlers().allStreamHandler, w, req)
 }
 
 func flagsStreamHandler(w http.ResponseWriter, req *http.Request) {
 	clientCtx := getClientContext(req)
-	clientCtx.getHandlers().flagsStreamHandler.ServeHTTP(w, req)
+	serveStream(clientCtx, clientCtx.getHandlers().flagsStreamHandler, w, req)
 }
 
 func bulkEventHandler(w http.ResponseWriter, req *http.Request) {
 	clientCtx := getClientContext(req)
 	if clientCtx.getHandlers().eventsHandler == nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write(ErrorJsonMsg("Event proxy is not enabled for this environment"))
+		writeError(w, req, http.StatusNotFound, "Event proxy is not enabled for this environment")
 		return
 	}
 	clientCtx.getHandlers().eventsHandler.ServeHTTP(w, req)
 }
 
-func ErrorJsonMsg(msg string) (j []byte) {
-	j, _ = json.Marshal(ErrorJson{msg})
-	return
+func diagnosticEventHandler(w http.ResponseWriter, req *http.Request) {
+	eventsHandler, ok := getClientContext(req).getHandlers().eventsHandler.(*eventRelayHandler)
+	if !ok {
+		writeError(w, req, http.StatusNotFound, "Event proxy is not enabled for this environment")
+		return
+	}
+	eventsHandler.forwardDiagnosticEvent(w, req)
 }
 
-func ErrorJsonMsgf(fmtStr string, args ...interface{}) []byte {
-	return ErrorJsonMsg(fmt.Sprintf(fmtStr, args...))
+// Finds the base64-encoded user in a GET request. It is usually part of the path, but can instead be given
+// in the user query parameter or the X-LaunchDarkly-User header, for clients behind intermediaries that
+// block REPORT requests or limit the length of paths.
+func userFromGetRequest(req *http.Request) (*ld.User, error) {
+	var sources []string
+	var base64User string
+	if pathUser, ok := mux.Vars(req)["user"]; ok {
+		sources = append(sources, "url path")
+		base64User = pathUser
+	}
+	if queryUser := req.URL.Query().Get("user"); queryUser != "" {
+		sources = append(sources, "user query parameter")
+		base64User = queryUser
+	}
+	if headerUser := req.Header.Get(userHeader); headerUser != "" {
+		sources = append(sources, userHeader+" header")
+		base64User = headerUser
+	}
+	switch len(sources) {
+	case 0:
+		return nil, fmt.Errorf("A user must be given in the url path, the user query parameter or the %s header", userHeader)
+	case 1:
+		return userFromBase64(base64User, sources[0])
+	default:
+		return nil, fmt.Errorf("The user must be given only once, but was given in the %s", strings.Join(sources, " and "))
+	}
 }
 
 // Decodes a base64-encoded go-client v2 user.
 // If any decoding/unmarshaling errors occur or
 // the user is missing the 'key' attribute an error is returned.
 func UserV2FromBase64(base64User string) (*ld.User, error) {
+	return userFromBase64(base64User, "url path")
+}
+
+// Decodes a user as UserV2FromBase64 does, naming where it was found in any error
+func userFromBase64(base64User string, source string) (*ld.User, error) {
 	var user ld.User
 	idStr, decodeErr := base64urlDecode(base64User)
 	if decodeErr != nil {
-		return nil, errors.New("User part of url path did not decode as valid base64")
+		return nil, fmt.Errorf("User in %s did not decode as valid base64", source)
 	}
 
 	jsonErr := json.Unmarshal(idStr, &user)
 
 	if jsonErr != nil {
-		return nil, errors.New("User part of url path did not decode to valid user as json")
+		return nil, fmt.Errorf("User in %s did not decode to valid user as json", source)
 	}
 
 	if user.Key == nil {
@@ -669,6 +1707,10 @@ func initLogging(
 	warningHandle io.Writer,
 	errorHandle io.Writer) {
 
+	logLevelLock.Lock()
+	logOutput = infoHandle
+	logLevelLock.Unlock()
+
 	Debug = log.New(debugHandle,
 		"DEBUG: ",
 		log.Ldate|log.Ltime|log.Lshortfile)
@@ -686,6 +1728,47 @@ func initLogging(
 		log.Ldate|log.Ltime|log.Lshortfile)
 }
 
+var (
+	logLevelLock sync.Mutex
+	logLevel     = "info"
+	logLevels    = []string{"debug", "info", "warn", "error"}
+	// Where the loggers that the log level enables write to: the Info logger's output, as given to initLogging
+	logOutput io.Writer = os.Stdout
+)
+
+// Changes which of the relay's loggers produce output. The default level is "info", which disables Debug.
+func setLogLevel(level string) error {
+	logLevelLock.Lock()
+	defer logLevelLock.Unlock()
+
+	debugOut, infoOut, warningOut := ioutil.Discard, ioutil.Discard, ioutil.Discard
+	switch level {
+	case "debug":
+		debugOut = logOutput
+		fallthrough
+	case "info":
+		infoOut = logOutput
+		fallthrough
+	case "warn":
+		warningOut = logOutput
+	case "error":
+	default:
+		return fmt.Errorf("unknown log level %q", level)
+	}
+
+	Debug.SetOutput(debugOut)
+	Info.SetOutput(infoOut)
+	Warning.SetOutput(warningOut)
+	logLevel = level
+	return nil
+}
+
+func getLogLevel() string {
+	logLevelLock.Lock()
+	defer logLevelLock.Unlock()
+	return logLevel
+}
+
 func last5(str string) string {
 	if len(str) >= 5 {
 		return str[len(str)-5:]
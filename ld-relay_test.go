@@ -26,6 +26,13 @@ import (
 	ld "gopkg.in/launchdarkly/go-client.v4"
 )
 
+// The loggers are set up once for every test, since goroutines left running by one test may still be
+// logging while the next one runs
+func TestMain(m *testing.M) {
+	initLogging(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	os.Exit(m.Run())
+}
+
 type FakeLDClient struct{ initialized bool }
 
 func (c FakeLDClient) Initialized() bool {
@@ -35,6 +42,15 @@ func (c FakeLDClient) Initialized() bool {
 var nullLogger = log.New(ioutil.Discard, "", 0)
 var emptyStore = ld.NewInMemoryFeatureStore(nullLogger)
 
+// Creates a relay whose environments have all connected, with nothing in their stores
+func makeTestRelay(config Config) *relay {
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		config.FeatureStore.Init(nil)
+		return FakeLDClient{true}, nil
+	})
+	return relay
+}
+
 // Returns a key matching the UUID header pattern
 func key() string {
 	return "mob-ffffffff-ffff-4fff-afff-ffffffffffff"
@@ -45,14 +61,17 @@ func user() string {
 }
 
 func handler() ClientMux {
-	clients := map[string]*clientContextImpl{key(): &clientContextImpl{client: FakeLDClient{}, store: emptyStore, logger: nullLogger}}
-	return ClientMux{clientContextByKey: clients}
+	envs := newEnvironmentRegistry()
+	envs.add(&clientContextImpl{sdkKey: key(), client: FakeLDClient{}, store: emptyStore, logger: nullLogger}, nil)
+	return ClientMux{envs: envs}
 }
 
 func clientSideHandler(allowedOrigins []string) ClientSideMux {
-	testClientSideContext := &clientSideContext{allowedOrigins: allowedOrigins, clientContext: &clientContextImpl{client: FakeLDClient{}, store: emptyStore, logger: nullLogger}}
-	contexts := map[string]*clientSideContext{key(): testClientSideContext}
-	return ClientSideMux{contextByKey: contexts}
+	envId := key()
+	clientCtx := &clientContextImpl{envId: &envId, client: FakeLDClient{}, store: emptyStore, logger: nullLogger}
+	envs := newEnvironmentRegistry()
+	envs.add(clientCtx, &clientSideContext{allowedOrigins: allowedOrigins, clientContext: clientCtx})
+	return ClientSideMux{envs: envs}
 }
 
 func buildRequest(verb string, vars map[string]string, headers map[string]string, body string, ctx interface{}) *http.Request {
@@ -145,6 +164,54 @@ func TestReportFlagEvalSucceeds(t *testing.T) {
 }`, string(b))
 }
 
+func TestGetFlagEvalAcceptsUserInQueryOrHeader(t *testing.T) {
+	specs := []struct {
+		name string
+		req  *http.Request
+	}{
+		{"query", buildRequest("GET", nil, nil, "", makeTestContextWithData())},
+		{"header", buildRequest("GET", nil, map[string]string{userHeader: user()}, "", makeTestContextWithData())},
+	}
+	specs[0].req.URL.RawQuery = "user=" + user()
+
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			evaluateAllFeatureFlagsValueOnly(resp, s.req)
+
+			assert.Equal(t, http.StatusOK, resp.Code)
+			b, _ := ioutil.ReadAll(resp.Body)
+			assert.JSONEq(t, `{"another-flag-key":3,"some-flag-key":true, "off-variation-key": null}`, string(b))
+		})
+	}
+}
+
+func TestGetFlagEvalRejectsMissingOrRepeatedUser(t *testing.T) {
+	missing := buildRequest("GET", nil, nil, "", makeTestContextWithData())
+	repeated := buildRequest("GET", map[string]string{"user": user()}, map[string]string{userHeader: user()}, "", makeTestContextWithData())
+	invalid := buildRequest("GET", nil, map[string]string{userHeader: "not base64!"}, "", makeTestContextWithData())
+
+	specs := []struct {
+		name            string
+		req             *http.Request
+		expectedMessage string
+	}{
+		{"missing", missing, "A user must be given in the url path, the user query parameter or the X-LaunchDarkly-User header"},
+		{"repeated", repeated, "The user must be given only once, but was given in the url path and X-LaunchDarkly-User header"},
+		{"invalid", invalid, "User in X-LaunchDarkly-User header did not decode as valid base64"},
+	}
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			evaluateAllFeatureFlags(resp, s.req)
+
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+			b, _ := ioutil.ReadAll(resp.Body)
+			assert.JSONEq(t, `{"code":"invalid_request","message":"`+s.expectedMessage+`"}`, string(b))
+		})
+	}
+}
+
 func TestAuthorizeMethodFailsOnInvalidAuthKey(t *testing.T) {
 	vars := map[string]string{"user": user()}
 	headers := map[string]string{"Authorization": "mob-eeeeeeee-eeee-4eee-aeee-eeeeeeeeeeee", "Content-Type": "application/json"}
@@ -175,7 +242,7 @@ func TestReportFlagEvalFailsWithMissingUserKey(t *testing.T) {
 
 	b, _ := ioutil.ReadAll(resp.Body)
 
-	assert.JSONEq(t, `{"message":"User must have a 'key' attribute"}`, string(b))
+	assert.JSONEq(t, `{"code":"invalid_request","message":"User must have a 'key' attribute"}`, string(b))
 }
 
 func TestReportFlagEvalFailsallowMethodOptionsHandlerWithUninitializedClientAndStore(t *testing.T) {
@@ -193,7 +260,7 @@ func TestReportFlagEvalFailsallowMethodOptionsHandlerWithUninitializedClientAndS
 
 	b, _ := ioutil.ReadAll(resp.Body)
 
-	assert.JSONEq(t, `{"message":"Service not initialized"}`, string(b))
+	assert.JSONEq(t, `{"code":"service_unavailable","message":"Service not initialized"}`, string(b))
 }
 
 func TestReportFlagEvalWorksWithUninitializedClientButInitializedStore(t *testing.T) {
@@ -229,7 +296,7 @@ func TestCorsMiddlewareSetsCorrectDefaultHeaders(t *testing.T) {
 		assert.Equal(t, w.Header().Get("Access-Control-Allow-Origin"), "*")
 		assert.Equal(t, w.Header().Get("Access-Control-Allow-Credentials"), "false")
 		assert.Equal(t, w.Header().Get("Access-Control-Max-Age"), "300")
-		assert.Equal(t, w.Header().Get("Access-Control-Allow-Headers"), "Content-Type,Content-Length,Accept-Encoding,X-LaunchDarkly-User-Agent,"+eventSchemaHeader)
+		assert.Equal(t, w.Header().Get("Access-Control-Allow-Headers"), "Content-Type,Content-Length,Accept-Encoding,X-LaunchDarkly-User-Agent,X-LaunchDarkly-User,"+eventSchemaHeader)
 		assert.Equal(t, w.Header().Get("Access-Control-Expose-Headers"), "Date")
 	})).ServeHTTP(resp, req)
 }
@@ -330,8 +397,6 @@ func makeTestEventBuffer(userKey string) []byte {
 }
 
 func TestRelay(t *testing.T) {
-	initLogging(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
-
 	publishedEvents := make(chan publishedEvent)
 
 	expectEventBuffer := func(data []byte) {
@@ -404,7 +469,8 @@ func TestRelay(t *testing.T) {
 		return &FakeLDClient{true}, nil
 	}
 
-	relay := newRelay(config, createDummyClient).getHandler()
+	r, _ := newRelay(config, createDummyClient)
+	relay := r.getHandler()
 
 	expectedEvalBody := expectJSONBody(`{"my-flag":1}`)
 	expectedEvalxBody := expectJSONBody(`{"my-flag":{"value":1,"variation":0,"version":0,"trackEvents":false}}`)
@@ -413,13 +479,20 @@ func TestRelay(t *testing.T) {
 	expectedAllData, _ := json.Marshal(map[string]map[string]interface{}{"data": {"flags": allFlags, "segments": map[string]interface{}{}}})
 
 	getStatus := func(relay http.Handler, t *testing.T) string {
-		w := httptest.NewRecorder()
-		r, _ := http.NewRequest("GET", "http://localhost/status", nil)
-		relay.ServeHTTP(w, r)
-		result := w.Result()
-		assert.Equal(t, http.StatusOK, result.StatusCode)
-		body, _ := ioutil.ReadAll(result.Body)
-		return string(body)
+		// Clients are created asynchronously, so give them a moment to connect
+		deadline := time.Now().Add(time.Second)
+		for {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "http://localhost/status", nil)
+			relay.ServeHTTP(w, r)
+			result := w.Result()
+			assert.Equal(t, http.StatusOK, result.StatusCode)
+			body, _ := ioutil.ReadAll(result.Body)
+			if !strings.Contains(string(body), `"degraded"`) || time.Now().After(deadline) {
+				return string(body)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
 	}
 
 	t.Run("if apiKey is present and sdkKey is absent, sdkKey is set to apiKey", func(t *testing.T) {
@@ -431,12 +504,13 @@ func TestRelay(t *testing.T) {
 			},
 		}
 
-		relay := newRelay(newConfig, createDummyClient).getHandler()
+		r, _ := newRelay(newConfig, createDummyClient)
+		relay := r.getHandler()
 		status := getStatus(relay, t)
 		assert.JSONEq(t, `
 {"environments": {
-	"test": {"sdkKey":"sdk-********-****-****-****-*******98989","status":"connected"}
-}, "status":"healthy"}`, status)
+	"test": {"sdkKey":"sdk-********-****-****-****-*******98989","status":"connected","state":"ready"}
+}, "relayId":"`+relayId+`", "status":"healthy"}`, status)
 	})
 
 	t.Run("if apiKey and sdkKey are both present, apiKey is ignored", func(t *testing.T) {
@@ -449,22 +523,23 @@ func TestRelay(t *testing.T) {
 			},
 		}
 
-		relay := newRelay(newConfig, createDummyClient).getHandler()
+		r, _ := newRelay(newConfig, createDummyClient)
+		relay := r.getHandler()
 		status := getStatus(relay, t)
 		assert.JSONEq(t, `
 {"environments": {
-	"test": {"sdkKey":"sdk-********-****-****-****-*******e42d0","status":"connected"}
-}, "status":"healthy"}`, status)
+	"test": {"sdkKey":"sdk-********-****-****-****-*******e42d0","status":"connected","state":"ready"}
+}, "relayId":"`+relayId+`", "status":"healthy"}`, status)
 	})
 
 	t.Run("status", func(t *testing.T) {
 		status := getStatus(relay, t)
 		assert.JSONEq(t, `
 {"environments": {
-	"sdk test": {"sdkKey":"sdk-********-****-****-****-*******e42d0","status":"connected"},
-	"client-side test": {"sdkKey":"sdk-********-****-****-****-*******e42d1", "envId": "507f1f77bcf86cd799439011", "status":"connected"},
-	"mobile test": {"sdkKey":"sdk-********-****-****-****-*******e42d2", "mobileKey":"mob-********-****-****-****-*******e42db", "status":"connected"}
-}, "status":"healthy"}`, status)
+	"sdk test": {"sdkKey":"sdk-********-****-****-****-*******e42d0","status":"connected","state":"ready"},
+	"client-side test": {"sdkKey":"sdk-********-****-****-****-*******e42d1", "envId": "507f1f77bcf86cd799439011", "status":"connected","state":"ready"},
+	"mobile test": {"sdkKey":"sdk-********-****-****-****-*******e42d2", "mobileKey":"mob-********-****-****-****-*******e42db", "status":"connected","state":"ready"}
+}, "relayId":"`+relayId+`", "status":"healthy"}`, status)
 	})
 
 	t.Run("sdk and mobile routes", func(t *testing.T) {
@@ -508,6 +583,64 @@ func TestRelay(t *testing.T) {
 		}
 	})
 
+	t.Run("api v2", func(t *testing.T) {
+		specs := []struct {
+			name           string
+			method         string
+			path           string
+			authHeader     string
+			body           []byte
+			expectedStatus int
+			bodyMatcher    bodyMatcher
+		}{
+			{"status", "GET", "/api/v2/status", "", nil, http.StatusOK, nil},
+			{"sdk key eval", "POST", "/api/v2/flags/evaluate", sdkKey, user, http.StatusOK, expectedEvalxBody},
+			{"mobile key eval", "POST", "/api/v2/flags/evaluate", mobileKey, user, http.StatusOK, expectedEvalxBody},
+			{"unknown key eval", "POST", "/api/v2/flags/evaluate", "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42ff", user, http.StatusUnauthorized, nil},
+			{"client-side eval", "POST", fmt.Sprintf("/api/v2/environments/%s/flags/evaluate", envId), "", user, http.StatusOK, expectedEvalxBody},
+			{"invalid user", "POST", "/api/v2/flags/evaluate", sdkKey, []byte("{}"), http.StatusBadRequest, nil},
+		}
+
+		for _, s := range specs {
+			t.Run(s.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				var bodyBuffer io.Reader
+				if s.body != nil {
+					bodyBuffer = bytes.NewBuffer(s.body)
+				}
+				r, _ := http.NewRequest(s.method, "http://localhost"+s.path, bodyBuffer)
+				r.Header.Set("Content-Type", "application/json")
+				if s.authHeader != "" {
+					r.Header.Set("Authorization", s.authHeader)
+				}
+				relay.ServeHTTP(w, r)
+				result := w.Result()
+				assert.Equal(t, s.expectedStatus, result.StatusCode)
+				if s.bodyMatcher != nil {
+					body, _ := ioutil.ReadAll(result.Body)
+					s.bodyMatcher(t, body)
+				}
+			})
+		}
+
+		t.Run("openapi document", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "http://localhost/api/v2/openapi.json", nil)
+			relay.ServeHTTP(w, r)
+			result := w.Result()
+			if assert.Equal(t, http.StatusOK, result.StatusCode) {
+				var spec struct {
+					Paths map[string]map[string]interface{} `json:"paths"`
+				}
+				body, _ := ioutil.ReadAll(result.Body)
+				assert.NoError(t, json.Unmarshal(body, &spec))
+				assert.Contains(t, spec.Paths, "/api/v2/status")
+				assert.Contains(t, spec.Paths["/api/v2/flags/evaluate"], "post")
+				assert.Contains(t, spec.Paths["/api/v2/environments/{envId}/flags/evaluate"], "post")
+			}
+		})
+	})
+
 	t.Run("sdk and mobile streams", func(t *testing.T) {
 		specs := []struct {
 			name          string
@@ -566,11 +699,21 @@ func TestRelay(t *testing.T) {
 			{"report evalx", "REPORT", fmt.Sprintf("/sdk/evalx/%s/user", envId), user, http.StatusOK, expectedEvalxBody},
 			{"get eval", "GET", fmt.Sprintf("/sdk/eval/%s/users/%s", envId, base64User), nil, http.StatusOK, expectedEvalBody},
 			{"get evalx", "GET", fmt.Sprintf("/sdk/evalx/%s/users/%s", envId, base64User), nil, http.StatusOK, expectedEvalxBody},
+			{"get eval with user query", "GET", fmt.Sprintf("/sdk/eval/%s/user?user=%s", envId, base64User), nil, http.StatusOK, expectedEvalBody},
+			{"get evalx with user query", "GET", fmt.Sprintf("/sdk/evalx/%s/user?user=%s", envId, base64User), nil, http.StatusOK, expectedEvalxBody},
 			{"post events", "POST", fmt.Sprintf("/events/bulk/%s", envId), []byte("[]"), http.StatusAccepted, nil},
 			{"get events image", "GET", fmt.Sprintf("/a/%s.gif?d=%s", envId, base64Events), nil, http.StatusOK, expectBody(string(transparent1PixelImg))},
 			{"get goals", "GET", fmt.Sprintf("/sdk/goals/%s", envId), nil, http.StatusOK, expectBody(`["got some goals"]`)},
 		}
 
+		// The /user routes accept both REPORT and GET
+		allowedMethods := func(method string, path string) []string {
+			if strings.HasSuffix(strings.Split(path, "?")[0], "/user") {
+				return []string{"GET", "REPORT", "OPTIONS", "OPTIONS"}
+			}
+			return []string{method, "OPTIONS", "OPTIONS"}
+		}
+
 		for _, s := range specs {
 			t.Run(s.name, func(t *testing.T) {
 				t.Run("requests", func(t *testing.T) {
@@ -584,7 +727,7 @@ func TestRelay(t *testing.T) {
 					relay.ServeHTTP(w, r)
 					result := w.Result()
 					if assert.Equal(t, s.expectedStatus, result.StatusCode) {
-						assert.ElementsMatch(t, []string{s.method, "OPTIONS", "OPTIONS"}, strings.Split(result.Header.Get("Access-Control-Allow-Methods"), ","))
+						assert.ElementsMatch(t, allowedMethods(s.method, s.path), strings.Split(result.Header.Get("Access-Control-Allow-Methods"), ","))
 						assert.Equal(t, "*", result.Header.Get("Access-Control-Allow-Origin"))
 					}
 					if s.bodyMatcher != nil {
@@ -601,7 +744,7 @@ func TestRelay(t *testing.T) {
 					relay.ServeHTTP(w, r)
 					result := w.Result()
 					if assert.Equal(t, http.StatusOK, result.StatusCode) {
-						assert.ElementsMatch(t, []string{s.method, "OPTIONS", "OPTIONS"}, strings.Split(result.Header.Get("Access-Control-Allow-Methods"), ","))
+						assert.ElementsMatch(t, allowedMethods(s.method, s.path), strings.Split(result.Header.Get("Access-Control-Allow-Methods"), ","))
 						assert.Equal(t, "*", result.Header.Get("Access-Control-Allow-Origin"))
 					}
 				})
@@ -613,7 +756,7 @@ func TestRelay(t *testing.T) {
 					relay.ServeHTTP(w, r)
 					result := w.Result()
 					if assert.Equal(t, http.StatusOK, result.StatusCode) {
-						assert.ElementsMatch(t, []string{s.method, "OPTIONS", "OPTIONS"}, strings.Split(result.Header.Get("Access-Control-Allow-Methods"), ","))
+						assert.ElementsMatch(t, allowedMethods(s.method, s.path), strings.Split(result.Header.Get("Access-Control-Allow-Methods"), ","))
 						assert.Equal(t, "my-host.com", result.Header.Get("Access-Control-Allow-Origin"))
 					}
 				})
@@ -742,3 +885,71 @@ func TestRelay(t *testing.T) {
 
 	eventsServer.Close()
 }
+
+type slowLDClient struct{ ready chan struct{} }
+
+func (c slowLDClient) Initialized() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestBackgroundInitReportsInitializingUntilConnected(t *testing.T) {
+	sdkKey := "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+	config := Config{Environment: map[string]*EnvConfig{"test": {SdkKey: sdkKey}}}
+	config.Main.BackgroundInit = true
+	config.Main.InitTimeoutSecs = 5
+
+	client := slowLDClient{ready: make(chan struct{})}
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		return client, nil
+	})
+	clientCtx := relay.envs.withSdkKey(sdkKey)
+
+	assert.Equal(t, "initializing", clientCtx.connectionStatus())
+	close(client.ready)
+	deadline := time.Now().Add(time.Second)
+	for clientCtx.connectionStatus() != "connected" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "connected", clientCtx.connectionStatus())
+}
+
+func TestBackgroundInitReportsDisconnectedAfterTimeout(t *testing.T) {
+	sdkKey := "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+	config := Config{Environment: map[string]*EnvConfig{"test": {SdkKey: sdkKey}}}
+	config.Main.BackgroundInit = true
+	config.Main.IgnoreConnectionErrors = true
+
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		return slowLDClient{ready: make(chan struct{})}, nil
+	})
+	clientCtx := relay.envs.withSdkKey(sdkKey)
+
+	deadline := time.Now().Add(time.Second)
+	for clientCtx.connectionStatus() == "initializing" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "disconnected", clientCtx.connectionStatus())
+}
+
+func TestListenAddressUsesConfiguredHost(t *testing.T) {
+	var c Config
+	c.Main.Port = 8030
+	assert.Equal(t, ":8030", listenAddress(c))
+	c.Main.Host = "127.0.0.1"
+	assert.Equal(t, "127.0.0.1:8030", listenAddress(c))
+	c.Main.Host = "[::1]"
+	assert.Equal(t, "[::1]:8030", listenAddress(c))
+	assert.NoError(t, validateListenHost(c))
+
+	c.Main.Host = "relay.internal"
+	assert.NoError(t, validateListenHost(c))
+	c.Main.Host = "127.0.0.1:8030"
+	assert.Error(t, validateListenHost(c))
+	c.Main.Host = "http://relay.internal"
+	assert.Error(t, validateListenHost(c))
+}
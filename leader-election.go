@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	r "github.com/garyburd/redigo/redis"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const (
+	defaultLeaseName             = "ld-relay"
+	defaultLeaseDurationSecs     = 15
+	defaultFollowerPollSecs      = 5
+	kubernetesServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// The format of times in Kubernetes leases
+	kubernetesMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// Elects one of the relays sharing a persistent store to connect to LaunchDarkly, if configured; nil otherwise
+var election *leaderElection
+
+// leaderLease is a lease that at most one relay holds at a time, such as a Redis key or a Kubernetes Lease
+type leaderLease interface {
+	// Takes the lease for the holder if nobody else holds it, or renews it if the holder already does,
+	// returning true if the holder has the lease for the given duration
+	acquire(holder string, duration time.Duration) (bool, error)
+	String() string
+}
+
+// leaderElection keeps trying to take or renew a lease. The relay holding it connects to LaunchDarkly and
+// writes to the shared store, while the others serve what it writes.
+type leaderElection struct {
+	lease    leaderLease
+	id       string
+	duration time.Duration
+	// Guards the role, and is held while the relay changes role, so that environments started meanwhile
+	// take on the right one
+	mu        sync.Mutex
+	leader    bool
+	renewedAt time.Time
+	onChange  func(leader bool)
+}
+
+func leaderElectionEnabled(c Config) bool {
+	return c.LeaderElection.Backend != ""
+}
+
+func validateLeaderElection(c Config) error {
+	switch c.LeaderElection.Backend {
+	case "":
+		return nil
+	case "redis":
+		if !redisConfigured(c) {
+			return errors.New("the redis backend requires Redis to be configured")
+		}
+	case "kubernetes":
+		if !persistentStoreConfigured(c) {
+			return errors.New("leader election requires a persistent store shared by the relays")
+		}
+	default:
+		return fmt.Errorf("unknown backend %q; expected redis or kubernetes", c.LeaderElection.Backend)
+	}
+	if c.LeaderElection.LeaseDurationSecs < 3 {
+		return errors.New("leaseDurationSecs must be at least 3")
+	}
+	return nil
+}
+
+func newLeaderElection(c Config) (*leaderElection, error) {
+	var lease leaderLease
+	if c.LeaderElection.Backend == "kubernetes" {
+		var err error
+		if lease, err = newInClusterKubernetesLease(c.LeaderElection.Namespace, c.LeaderElection.LeaseName); err != nil {
+			return nil, err
+		}
+	} else {
+		lease = newRedisLease(c.Redis.Host, c.Redis.Port, c.LeaderElection.LeaseName)
+	}
+	id := relayId
+	if hostname, err := os.Hostname(); err == nil {
+		id = hostname + "_" + relayId
+	}
+	return &leaderElection{lease: lease, id: id, duration: time.Duration(c.LeaderElection.LeaseDurationSecs) * time.Second}, nil
+}
+
+// Tries to take the lease straight away, and then renews it three times per lease duration
+func (e *leaderElection) run(onChange func(leader bool)) {
+	e.mu.Lock()
+	e.onChange = onChange
+	e.mu.Unlock()
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+	for {
+		e.step()
+		<-ticker.C
+	}
+}
+
+func (e *leaderElection) step() {
+	attemptedAt := time.Now()
+	acquired, err := e.lease.acquire(e.id, e.duration)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	wasLeader := e.leader
+	if err != nil {
+		Warning.Printf("Unable to renew leader lease %s: %s", e.lease, err)
+		// A brief outage shouldn't change the leader, but after two missed renewals the lease is about to
+		// expire, and another relay may take it
+		if e.leader && time.Since(e.renewedAt) >= e.duration*2/3 {
+			e.leader = false
+		}
+	} else {
+		e.leader = acquired
+		if acquired {
+			e.renewedAt = attemptedAt
+		}
+	}
+	if e.leader != wasLeader {
+		if e.leader {
+			Info.Printf("Elected leader with lease %s; connecting to LaunchDarkly", e.lease)
+		} else {
+			Info.Printf("Following the leader with lease %s; serving flags from the shared store", e.lease)
+		}
+		if e.onChange != nil {
+			e.onChange(e.leader)
+		}
+	}
+}
+
+func (e *leaderElection) isLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Calls f with the relay's current role, which can't change until f returns
+func (e *leaderElection) withRole(f func(leader bool)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f(e.leader)
+}
+
+func (e *leaderElection) status() map[string]interface{} {
+	role := "follower"
+	if e.isLeader() {
+		role = "leader"
+	}
+	return map[string]interface{}{"role": role, "lease": e.lease.String(), "id": e.id}
+}
+
+// Connects or disconnects every environment when the relay becomes the leader or stops being it
+func (r *relay) setLeader(leader bool) {
+	for _, clientCtx := range r.envs.all() {
+		if leader {
+			clientCtx.lead()
+		} else {
+			clientCtx.follow(time.Duration(r.config.LeaderElection.PollIntervalSecs) * time.Second)
+		}
+	}
+}
+
+// followerClient stands in for the LaunchDarkly client of an environment whose data another relay writes
+type followerClient struct {
+	store ld.FeatureStore
+}
+
+func (c followerClient) Initialized() bool {
+	return c.store.Initialized()
+}
+
+// Stops the environment's LaunchDarkly client, if it has one, and serves the flags that the leader writes to
+// the shared store instead
+func (c *clientContextImpl) follow(pollInterval time.Duration) {
+	c.mu.Lock()
+	if c.removed || c.follower != nil {
+		c.mu.Unlock()
+		return
+	}
+	client := c.client
+	c.follower = newStoreFollower(c.relayStore, pollInterval)
+	c.client = followerClient{c.store}
+	c.upstream = nil
+	c.state = envReady
+	go c.follower.run()
+	c.mu.Unlock()
+	if closer, ok := client.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Connects the environment to LaunchDarkly, if it was following another relay
+func (c *clientContextImpl) lead() {
+	c.mu.Lock()
+	follower := c.follower
+	c.follower = nil
+	c.mu.Unlock()
+	if follower == nil {
+		return
+	}
+	follower.close()
+	if c.connect != nil {
+		go c.connect()
+	}
+}
+
+func (c *clientContextImpl) following() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.follower != nil
+}
+
+// storeFollower polls the shared store of an environment whose data another relay writes, and publishes the
+// changes it finds to the environment's stream clients, as if they had come from LaunchDarkly
+type storeFollower struct {
+	relayStore *SSERelayFeatureStore
+	interval   time.Duration
+	versions   map[ld.VersionedDataKind]map[string]int
+	closer     chan struct{}
+	closeOnce  sync.Once
+}
+
+func newStoreFollower(relayStore *SSERelayFeatureStore, interval time.Duration) *storeFollower {
+	return &storeFollower{
+		relayStore: relayStore,
+		interval:   interval,
+		versions:   make(map[ld.VersionedDataKind]map[string]int),
+		closer:     make(chan struct{}),
+	}
+}
+
+func (f *storeFollower) run() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		if err := f.poll(); err != nil {
+			Warning.Printf("Unable to read the shared store: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-f.closer:
+			return
+		}
+	}
+}
+
+func (f *storeFollower) close() {
+	f.closeOnce.Do(func() { close(f.closer) })
+}
+
+// Compares the store with what it held last time. The first poll only records what is there, since new
+// stream clients are sent everything in the store anyway.
+func (f *storeFollower) poll() error {
+	for _, kind := range []ld.VersionedDataKind{ld.Features, ld.Segments} {
+		items, err := f.relayStore.store.All(kind)
+		if err != nil {
+			return err
+		}
+		known, polled := f.versions[kind]
+		versions := make(map[string]int, len(items))
+		for key, item := range items {
+			versions[key] = item.GetVersion()
+			if version, ok := known[key]; polled && (!ok || version < item.GetVersion()) {
+				f.relayStore.publishUpsert(kind, item)
+			}
+		}
+		for key, version := range known {
+			if _, ok := items[key]; !ok {
+				f.relayStore.publishDelete(kind, key, version+1)
+			}
+		}
+		f.versions[kind] = versions
+	}
+	return nil
+}
+
+// redisLease is a Redis key holding the ID of the relay that has the lease, which expires unless renewed
+type redisLease struct {
+	pool *r.Pool
+	key  string
+}
+
+// Extends the lease only if it is still held by the same relay
+var renewRedisLeaseScript = r.NewScript(1, `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+func newRedisLease(host string, port int, name string) *redisLease {
+	pool := &r.Pool{
+		MaxIdle:     1,
+		IdleTimeout: time.Minute,
+		Dial: func() (r.Conn, error) {
+			return r.Dial("tcp", fmt.Sprintf("%s:%d", host, port), r.DialConnectTimeout(time.Second),
+				r.DialReadTimeout(time.Second), r.DialWriteTimeout(time.Second))
+		},
+	}
+	return &redisLease{pool: pool, key: name + ":leader"}
+}
+
+func (l *redisLease) acquire(holder string, duration time.Duration) (bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+	ms := int64(duration / time.Millisecond)
+	reply, err := r.String(conn.Do("SET", l.key, holder, "NX", "PX", ms))
+	if err == nil && reply == "OK" {
+		return true, nil
+	}
+	if err != nil && err != r.ErrNil {
+		return false, err
+	}
+	renewed, err := r.Int(renewRedisLeaseScript.Do(conn, l.key, holder, ms))
+	return renewed == 1, err
+}
+
+func (l *redisLease) String() string {
+	return "redis key " + l.key
+}
+
+// kubernetesLease is a Lease in the coordination.k8s.io API. Leases are updated with the resource version
+// they were read with, so if two relays try to take one at once, only one of them succeeds.
+type kubernetesLease struct {
+	leasesUri string
+	namespace string
+	name      string
+	tokenFile string
+	client    *http.Client
+}
+
+type kubernetesLeaseResource struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace,omitempty"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// Uses the API server and service account credentials that Kubernetes gives every pod
+func newInClusterKubernetesLease(namespace, name string) (*kubernetesLease, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("the kubernetes backend only works inside a Kubernetes cluster")
+	}
+	if namespace == "" {
+		data, err := ioutil.ReadFile(kubernetesServiceAccountPath + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("unable to find the pod's namespace: %s", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	ca, err := ioutil.ReadFile(kubernetesServiceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the cluster's CA certificate: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+	uri := fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), url.PathEscape(namespace))
+	return newKubernetesLease(uri, namespace, name, kubernetesServiceAccountPath+"/token", client), nil
+}
+
+func newKubernetesLease(leasesUri, namespace, name, tokenFile string, client *http.Client) *kubernetesLease {
+	return &kubernetesLease{leasesUri: leasesUri, namespace: namespace, name: name, tokenFile: tokenFile, client: client}
+}
+
+func (l *kubernetesLease) acquire(holder string, duration time.Duration) (bool, error) {
+	lease, status, err := l.request("GET", l.leasesUri+"/"+url.PathEscape(l.name), nil)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	method, uri := "PUT", l.leasesUri+"/"+url.PathEscape(l.name)
+	switch status {
+	case http.StatusOK:
+		renewTime, _ := time.Parse(kubernetesMicroTime, lease.Spec.RenewTime)
+		expiresAt := renewTime.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+		if lease.Spec.HolderIdentity != holder && lease.Spec.HolderIdentity != "" && now.Before(expiresAt) {
+			return false, nil
+		}
+	case http.StatusNotFound:
+		method, uri = "POST", l.leasesUri
+		lease = &kubernetesLeaseResource{ApiVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name = l.name
+		lease.Metadata.Namespace = l.namespace
+	default:
+		return false, fmt.Errorf("unexpected status %d reading lease", status)
+	}
+
+	if lease.Spec.HolderIdentity != holder {
+		lease.Spec.HolderIdentity = holder
+		lease.Spec.AcquireTime = now.UTC().Format(kubernetesMicroTime)
+		if method == "PUT" {
+			lease.Spec.LeaseTransitions++
+		}
+	}
+	lease.Spec.RenewTime = now.UTC().Format(kubernetesMicroTime)
+	lease.Spec.LeaseDurationSeconds = int(duration / time.Second)
+	_, status, err = l.request(method, uri, lease)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		// Another relay updated the lease since it was read
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %d updating lease", status)
+}
+
+func (l *kubernetesLease) request(method, uri string, body *kubernetesLeaseResource) (*kubernetesLeaseResource, int, error) {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, uri, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Service account tokens are rotated, so the token is read each time
+	if token, err := ioutil.ReadFile(l.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, resp.StatusCode, nil
+	}
+	var lease kubernetesLeaseResource
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, 0, fmt.Errorf("invalid lease: %s", err)
+	}
+	return &lease, resp.StatusCode, nil
+}
+
+func (l *kubernetesLease) String() string {
+	return fmt.Sprintf("kubernetes lease %s/%s", l.namespace, l.name)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	es "github.com/launchdarkly/eventsource"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+type fakeLease struct {
+	mu       sync.Mutex
+	acquired bool
+	err      error
+}
+
+func (l *fakeLease) acquire(holder string, duration time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.acquired, l.err
+}
+
+func (l *fakeLease) set(acquired bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acquired, l.err = acquired, err
+}
+
+func (l *fakeLease) String() string {
+	return "fake lease"
+}
+
+func TestValidateLeaderElection(t *testing.T) {
+	var c Config
+	assert.NoError(t, validateLeaderElection(c))
+
+	c.LeaderElection.LeaseDurationSecs = defaultLeaseDurationSecs
+	c.LeaderElection.Backend = "redis"
+	assert.Error(t, validateLeaderElection(c))
+	c.Redis.Host = "localhost"
+	c.Redis.Port = 6379
+	assert.NoError(t, validateLeaderElection(c))
+
+	c.LeaderElection.Backend = "kubernetes"
+	assert.NoError(t, validateLeaderElection(c))
+	c.LeaderElection.LeaseDurationSecs = 1
+	assert.Error(t, validateLeaderElection(c))
+
+	c.LeaderElection.LeaseDurationSecs = defaultLeaseDurationSecs
+	c.LeaderElection.Backend = "zookeeper"
+	assert.Error(t, validateLeaderElection(c))
+
+	c = Config{}
+	c.LeaderElection.Backend = "kubernetes"
+	c.LeaderElection.LeaseDurationSecs = defaultLeaseDurationSecs
+	assert.Error(t, validateLeaderElection(c), "followers would have nothing to serve without a shared store")
+}
+
+func TestLeaderKeepsLeadingThroughABriefOutage(t *testing.T) {
+	lease := &fakeLease{acquired: true}
+	var changes []bool
+	e := &leaderElection{lease: lease, id: "relay", duration: time.Minute, onChange: func(leader bool) { changes = append(changes, leader) }}
+
+	e.step()
+	assert.True(t, e.isLeader())
+
+	lease.set(false, errors.New("connection refused"))
+	e.step()
+	assert.True(t, e.isLeader())
+
+	// Two renewals have been missed
+	e.renewedAt = time.Now().Add(-41 * time.Second)
+	e.step()
+	assert.False(t, e.isLeader())
+
+	lease.set(false, nil)
+	e.step()
+	assert.Equal(t, []bool{true, false}, changes)
+}
+
+func TestFollowersConnectOnlyOnceElected(t *testing.T) {
+	lease := &fakeLease{}
+	election = &leaderElection{lease: lease, id: "relay", duration: time.Minute}
+	defer func() { election = nil }()
+
+	var mu sync.Mutex
+	connections := 0
+	config := Config{Environment: map[string]*EnvConfig{"env1": {SdkKey: "sdk-key"}}}
+	config.LeaderElection.PollIntervalSecs = 1
+	relay, _ := newRelay(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		mu.Lock()
+		connections++
+		mu.Unlock()
+		return FakeLDClient{true}, nil
+	})
+	election.onChange = relay.setLeader
+	connected := func() int {
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		return connections
+	}
+	env := relay.findEnvironment("env1")
+
+	assert.True(t, env.following())
+	assert.Equal(t, 0, connected())
+
+	lease.set(true, nil)
+	election.step()
+	assert.False(t, env.following())
+	assert.Equal(t, 1, connected())
+
+	lease.set(false, nil)
+	election.step()
+	assert.True(t, env.following())
+	assert.IsType(t, followerClient{}, env.getClient())
+	assert.Equal(t, 1, connected())
+	env.close()
+}
+
+func TestStoreFollowerPublishesChangesToTheSharedStore(t *testing.T) {
+	baseStore := ld.NewInMemoryFeatureStore(nil)
+	baseStore.Init(nil)
+	baseStore.Upsert(ld.Features, &ld.FeatureFlag{Key: "unchanged", Version: 1})
+	baseStore.Upsert(ld.Features, &ld.FeatureFlag{Key: "updated", Version: 1})
+	baseStore.Upsert(ld.Segments, &ld.Segment{Key: "deleted", Version: 2})
+	allPublisher := &testPublisher{}
+	relayStore := NewSSERelayFeatureStore("api-key", allPublisher, &testPublisher{}, &testPublisher{}, baseStore, 0)
+	follower := newStoreFollower(relayStore, time.Minute)
+
+	assert.NoError(t, follower.poll())
+	assert.Empty(t, allPublisher.events)
+
+	// Another relay writes to the store
+	updated := &ld.FeatureFlag{Key: "updated", Version: 2}
+	baseStore.Upsert(ld.Features, updated)
+	baseStore.Delete(ld.Segments, "deleted", 3)
+	assert.NoError(t, follower.poll())
+	assert.EqualValues(t, []es.Event{
+		upsertEvent{Path: "/flags/updated", D: updated},
+		deleteEvent{Path: "/segments/deleted", Version: 3},
+	}, allPublisher.events)
+
+	assert.NoError(t, follower.poll())
+	assert.Len(t, allPublisher.events, 2)
+}
+
+func TestKubernetesLease(t *testing.T) {
+	var mu sync.Mutex
+	var stored *kubernetesLeaseResource
+	version := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+		var lease kubernetesLeaseResource
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/leases/ld-relay":
+			if stored == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(stored)
+			return
+		case req.Method == "POST" && req.URL.Path == "/leases":
+			json.NewDecoder(req.Body).Decode(&lease)
+			if stored != nil {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		case req.Method == "PUT" && req.URL.Path == "/leases/ld-relay":
+			json.NewDecoder(req.Body).Decode(&lease)
+			if lease.Metadata.ResourceVersion != stored.Metadata.ResourceVersion {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		version++
+		lease.Metadata.ResourceVersion = fmt.Sprint(version)
+		stored = &lease
+		json.NewEncoder(w).Encode(stored)
+	}))
+	defer server.Close()
+
+	tokenFile, _ := ioutil.TempFile("", "token")
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("token\n")
+	tokenFile.Close()
+	lease := newKubernetesLease(server.URL+"/leases", "default", "ld-relay", tokenFile.Name(), http.DefaultClient)
+
+	acquired, err := lease.acquire("relay-a", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, "relay-a", stored.Spec.HolderIdentity)
+	assert.Equal(t, 60, stored.Spec.LeaseDurationSeconds)
+
+	acquired, err = lease.acquire("relay-b", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+
+	acquired, err = lease.acquire("relay-a", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, 0, stored.Spec.LeaseTransitions)
+
+	// The holder stopped renewing the lease
+	mu.Lock()
+	stored.Spec.RenewTime = time.Now().Add(-2 * time.Minute).UTC().Format(kubernetesMicroTime)
+	mu.Unlock()
+	acquired, err = lease.acquire("relay-b", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, "relay-b", stored.Spec.HolderIdentity)
+	assert.Equal(t, 1, stored.Spec.LeaseTransitions)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/patrickmn/go-cache"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// How many times an update is retried when another relay changes the same key at the same moment
+const memcachedMaxUpdateAttempts = 10
+
+var errMemcachedContention = errors.New("gave up updating memcached after repeated concurrent changes")
+
+var (
+	memcachedClientsLock sync.Mutex
+	memcachedClients     = make(map[string]*memcache.Client)
+)
+
+// Returns the client for the given servers. The client can't be closed, so environments using the same servers
+// share one, and removing an environment leaves no idle connections behind.
+func memcachedClient(servers []string) *memcache.Client {
+	key := strings.Join(servers, ",")
+	memcachedClientsLock.Lock()
+	defer memcachedClientsLock.Unlock()
+	client, ok := memcachedClients[key]
+	if !ok {
+		client = memcache.New(servers...)
+		memcachedClients[key] = client
+	}
+	return client
+}
+
+// MemcachedFeatureStore is a feature store backed by memcached. Each item is kept under
+// "<prefix>:<namespace>:<key>", alongside a list of the keys of each namespace under "<prefix>:<namespace>",
+// since memcached can't list its keys. Updates use compare-and-swap, so that several relays can share the
+// same servers without a stale update overwriting a newer one.
+//
+// Memcached may evict items when it runs out of memory, so it should have room for every environment's
+// data.
+type MemcachedFeatureStore struct {
+	client    *memcache.Client
+	prefix    string
+	cache     *cache.Cache
+	timeout   time.Duration
+	logger    ld.Logger
+	mu        sync.Mutex
+	initCheck bool
+}
+
+// Creates a store for the environment with the given prefix, using the given memcached servers. If the
+// prefix is empty, "launchdarkly" is used, as it is for Redis.
+func NewMemcachedFeatureStore(servers []string, prefix string, timeout time.Duration, logger ld.Logger) *MemcachedFeatureStore {
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+	store := &MemcachedFeatureStore{
+		client:  memcachedClient(servers),
+		prefix:  prefix,
+		timeout: timeout,
+		logger:  logger,
+	}
+	if timeout > 0 {
+		store.cache = cache.New(timeout, 5*time.Minute)
+	}
+	return store
+}
+
+func (store *MemcachedFeatureStore) itemKey(kind ld.VersionedDataKind, key string) string {
+	return store.prefix + ":" + kind.GetNamespace() + ":" + key
+}
+
+func (store *MemcachedFeatureStore) indexKey(kind ld.VersionedDataKind) string {
+	return store.prefix + ":" + kind.GetNamespace()
+}
+
+func (store *MemcachedFeatureStore) initedKey() string {
+	return store.prefix + ":$inited"
+}
+
+func (store *MemcachedFeatureStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	if store.cache != nil {
+		if data, present := store.cache.Get(localCacheKey(kind, key)); present {
+			return liveItem(data.(ld.VersionedData)), nil
+		}
+	}
+
+	it, err := store.client.Get(store.itemKey(kind, key))
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	item, err := unmarshalStoreItem(kind, string(it.Value))
+	if err != nil {
+		return nil, err
+	}
+	if store.cache != nil {
+		store.cache.Set(localCacheKey(kind, key), item, store.timeout)
+	}
+	return liveItem(item), nil
+}
+
+func (store *MemcachedFeatureStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	if store.cache != nil {
+		if data, present := store.cache.Get(localAllCacheKey(kind)); present {
+			return data.(map[string]ld.VersionedData), nil
+		}
+	}
+
+	keys, _, err := store.getIndex(kind)
+	if err != nil {
+		return nil, err
+	}
+	itemKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		itemKeys = append(itemKeys, store.itemKey(kind, key))
+	}
+	items, err := store.client.GetMulti(itemKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]ld.VersionedData)
+	for _, key := range keys {
+		it, ok := items[store.itemKey(kind, key)]
+		if !ok {
+			continue
+		}
+		item, err := unmarshalStoreItem(kind, string(it.Value))
+		if err != nil {
+			return nil, err
+		}
+		if !item.IsDeleted() {
+			results[key] = item
+		}
+	}
+	if store.cache != nil {
+		store.cache.Set(localAllCacheKey(kind), results, store.timeout)
+	}
+	return results, nil
+}
+
+func (store *MemcachedFeatureStore) Init(allData map[ld.VersionedDataKind]map[string]ld.VersionedData) error {
+	for kind, items := range allData {
+		oldKeys, _, err := store.getIndex(kind)
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(items))
+		for key, item := range items {
+			data, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if err := store.client.Set(&memcache.Item{Key: store.itemKey(kind, key), Value: data}); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		index, _ := json.Marshal(keys)
+		if err := store.client.Set(&memcache.Item{Key: store.indexKey(kind), Value: index}); err != nil {
+			return err
+		}
+
+		for _, key := range oldKeys {
+			if _, ok := items[key]; !ok {
+				if err := store.client.Delete(store.itemKey(kind, key)); err != nil && err != memcache.ErrCacheMiss {
+					return err
+				}
+			}
+		}
+	}
+	if err := store.client.Set(&memcache.Item{Key: store.initedKey(), Value: []byte("1")}); err != nil {
+		return err
+	}
+
+	if store.cache != nil {
+		store.cache.Flush()
+		for kind, items := range allData {
+			for key, item := range items {
+				store.cache.Set(localCacheKey(kind, key), item, store.timeout)
+			}
+			store.cache.Set(localAllCacheKey(kind), items, store.timeout)
+		}
+	}
+
+	store.mu.Lock()
+	store.initCheck = true
+	store.mu.Unlock()
+	return nil
+}
+
+func (store *MemcachedFeatureStore) Delete(kind ld.VersionedDataKind, key string, version int) error {
+	return store.updateWithVersioning(kind, kind.MakeDeletedItem(key, version))
+}
+
+func (store *MemcachedFeatureStore) Upsert(kind ld.VersionedDataKind, item ld.VersionedData) error {
+	return store.updateWithVersioning(kind, item)
+}
+
+// Writes the item unless memcached already has the same or a later version of it, retrying if another
+// relay changes the item between our read and our write
+func (store *MemcachedFeatureStore) updateWithVersioning(kind ld.VersionedDataKind, item ld.VersionedData) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if store.cache != nil {
+		defer func() {
+			store.cache.Delete(localCacheKey(kind, item.GetKey()))
+			store.cache.Delete(localAllCacheKey(kind))
+		}()
+	}
+
+	itemKey := store.itemKey(kind, item.GetKey())
+	for attempt := 0; attempt < memcachedMaxUpdateAttempts; attempt++ {
+		it, err := store.client.Get(itemKey)
+		if err == memcache.ErrCacheMiss {
+			err = store.client.Add(&memcache.Item{Key: itemKey, Value: data})
+			if err == memcache.ErrNotStored {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			return store.addToIndex(kind, item.GetKey())
+		}
+		if err != nil {
+			return err
+		}
+
+		existing, err := unmarshalStoreItem(kind, string(it.Value))
+		if err == nil && existing.GetVersion() >= item.GetVersion() {
+			store.logger.Printf("Attempted to update %s with key %s to version %d, but version %d already exists",
+				kind.GetNamespace(), item.GetKey(), item.GetVersion(), existing.GetVersion())
+			return nil
+		}
+		it.Value = data
+		err = store.client.CompareAndSwap(it)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// The index normally lists the key already, but may not if the index was evicted
+		return store.addToIndex(kind, item.GetKey())
+	}
+	return errMemcachedContention
+}
+
+// Returns the keys listed for the kind, along with the memcached item holding them, which is nil if there is
+// no list yet
+func (store *MemcachedFeatureStore) getIndex(kind ld.VersionedDataKind) ([]string, *memcache.Item, error) {
+	it, err := store.client.Get(store.indexKey(kind))
+	if err == memcache.ErrCacheMiss {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var keys []string
+	if err := json.Unmarshal(it.Value, &keys); err != nil {
+		return nil, nil, err
+	}
+	return keys, it, nil
+}
+
+func (store *MemcachedFeatureStore) addToIndex(kind ld.VersionedDataKind, key string) error {
+	for attempt := 0; attempt < memcachedMaxUpdateAttempts; attempt++ {
+		keys, it, err := store.getIndex(kind)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if k == key {
+				return nil
+			}
+		}
+		index, _ := json.Marshal(append(keys, key))
+		if it == nil {
+			err = store.client.Add(&memcache.Item{Key: store.indexKey(kind), Value: index})
+		} else {
+			it.Value = index
+			err = store.client.CompareAndSwap(it)
+		}
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		return err
+	}
+	return errMemcachedContention
+}
+
+func (store *MemcachedFeatureStore) Initialized() bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if !store.initCheck {
+		_, err := store.client.Get(store.initedKey())
+		store.initCheck = err == nil
+	}
+	return store.initCheck
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+type fakeMemcachedItem struct {
+	value []byte
+	cas   uint64
+}
+
+// fakeMemcached implements just enough of the memcached text protocol for the store's tests
+type fakeMemcached struct {
+	listener net.Listener
+	mu       sync.Mutex
+	items    map[string]fakeMemcachedItem
+	nextCas  uint64
+}
+
+func startFakeMemcached(t *testing.T) *fakeMemcached {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	m := &fakeMemcached{listener: listener, items: make(map[string]fakeMemcachedItem)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "gets":
+			m.mu.Lock()
+			for _, key := range args[1:] {
+				if it, ok := m.items[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d %d\r\n%s\r\n", key, len(it.value), it.cas, it.value)
+				}
+			}
+			m.mu.Unlock()
+			rw.WriteString("END\r\n")
+		case "set", "add", "cas":
+			size, _ := strconv.Atoi(args[4])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(rw, value); err != nil {
+				return
+			}
+			rw.WriteString(m.store(args, value[:size]))
+		case "delete":
+			m.mu.Lock()
+			if _, ok := m.items[args[1]]; ok {
+				delete(m.items, args[1])
+				rw.WriteString("DELETED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+			m.mu.Unlock()
+		case "version":
+			rw.WriteString("VERSION fake\r\n")
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		rw.Flush()
+	}
+}
+
+func (m *fakeMemcached) store(args []string, value []byte) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := args[1]
+	existing, exists := m.items[key]
+	switch args[0] {
+	case "add":
+		if exists {
+			return "NOT_STORED\r\n"
+		}
+	case "cas":
+		if !exists {
+			return "NOT_FOUND\r\n"
+		}
+		if cas, _ := strconv.ParseUint(args[5], 10, 64); cas != existing.cas {
+			return "EXISTS\r\n"
+		}
+	}
+	m.nextCas++
+	m.items[key] = fakeMemcachedItem{value: value, cas: m.nextCas}
+	return "STORED\r\n"
+}
+
+func TestMemcachedFeatureStore(t *testing.T) {
+	server := startFakeMemcached(t)
+	defer server.listener.Close()
+	servers := []string{server.listener.Addr().String()}
+
+	store := NewMemcachedFeatureStore(servers, "ld:test", 0, nullLogger)
+	assert.False(t, store.Initialized())
+
+	flag1 := ld.FeatureFlag{Key: "flag1", Version: 1}
+	flag2 := ld.FeatureFlag{Key: "flag2", Version: 1}
+	assert.NoError(t, store.Init(map[ld.VersionedDataKind]map[string]ld.VersionedData{
+		ld.Features: {"flag1": &flag1, "flag2": &flag2},
+		ld.Segments: {},
+	}))
+	assert.True(t, store.Initialized())
+	assert.True(t, NewMemcachedFeatureStore(servers, "ld:test", 0, nullLogger).Initialized())
+	assert.False(t, NewMemcachedFeatureStore(servers, "ld:other", 0, nullLogger).Initialized())
+
+	t.Run("get", func(t *testing.T) {
+		item, err := store.Get(ld.Features, "flag1")
+		assert.NoError(t, err)
+		assert.Equal(t, &flag1, item)
+
+		item, err = store.Get(ld.Features, "unknown")
+		assert.NoError(t, err)
+		assert.Nil(t, item)
+	})
+
+	t.Run("upsert keeps the newest version", func(t *testing.T) {
+		assert.NoError(t, store.Upsert(ld.Features, &ld.FeatureFlag{Key: "flag1", Version: 3}))
+		assert.NoError(t, store.Upsert(ld.Features, &ld.FeatureFlag{Key: "flag1", Version: 2}))
+		item, _ := store.Get(ld.Features, "flag1")
+		assert.Equal(t, 3, item.GetVersion())
+	})
+
+	t.Run("upsert adds new items to all", func(t *testing.T) {
+		assert.NoError(t, store.Upsert(ld.Features, &ld.FeatureFlag{Key: "flag3", Version: 1}))
+		all, err := store.All(ld.Features)
+		assert.NoError(t, err)
+		assert.Len(t, all, 3)
+		assert.Contains(t, all, "flag3")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.NoError(t, store.Delete(ld.Features, "flag2", 2))
+		item, err := store.Get(ld.Features, "flag2")
+		assert.NoError(t, err)
+		assert.Nil(t, item)
+		assert.NoError(t, store.Upsert(ld.Features, &ld.FeatureFlag{Key: "flag2", Version: 1}))
+		item, _ = store.Get(ld.Features, "flag2")
+		assert.Nil(t, item)
+		all, _ := store.All(ld.Features)
+		assert.NotContains(t, all, "flag2")
+	})
+
+	t.Run("init removes items that are gone", func(t *testing.T) {
+		assert.NoError(t, store.Init(map[ld.VersionedDataKind]map[string]ld.VersionedData{
+			ld.Features: {"flag1": &flag1},
+			ld.Segments: {},
+		}))
+		all, err := store.All(ld.Features)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]ld.VersionedData{"flag1": &flag1}, all)
+		server.mu.Lock()
+		assert.NotContains(t, server.items, "ld:test:features:flag3")
+		server.mu.Unlock()
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// runOnce implements the --once mode: it fills the persistent store with every environment's flags and
+// segments and exits, so that it can be run as an init container to pre-warm the store before application
+// pods start
+func runOnce(c Config) int {
+	if !persistentStoreConfigured(c) {
+		Error.Println("The --once option requires a Redis, Postgres, Memcached or custom store to be configured")
+		return 1
+	}
+	if len(c.Environment) == 0 {
+		Error.Println("You must specify at least one environment in your configuration file.")
+		return 1
+	}
+
+	waitFor := time.Duration(c.Main.InitTimeoutSecs) * time.Second
+	newStore := func(envConfig EnvConfig) (ld.FeatureStore, error) { return newBaseFeatureStore(c, envConfig) }
+	if failed := syncEnvironments(c, makeDefaultClientFactory(waitFor), newStore); len(failed) > 0 {
+		Error.Printf("Failed to populate the store for %d environment(s): %v", len(failed), failed)
+		return 1
+	}
+	Info.Println("Populated the store for all environments")
+	return 0
+}
+
+// Connects to LaunchDarkly for every environment in parallel, writing their data to the stores made by
+// newStore, and returns the names of any environments that could not be synchronized
+func syncEnvironments(c Config, clientFactory func(sdkKey string, config ld.Config) (ldClientContext, error),
+	newStore func(envConfig EnvConfig) (ld.FeatureStore, error)) []string {
+	var mu sync.Mutex
+	var failed []string
+	var wg sync.WaitGroup
+
+	for envName, envConfig := range c.Environment {
+		wg.Add(1)
+		go func(envName string, envConfig EnvConfig) {
+			defer wg.Done()
+			fail := func(err error) {
+				Error.Printf("Error populating the store for %s: %+v", envName, err)
+				mu.Lock()
+				failed = append(failed, envName)
+				mu.Unlock()
+			}
+
+			store, err := newStore(envConfig)
+			if err != nil {
+				fail(err)
+				return
+			}
+			clientConfig := ld.DefaultConfig
+			clientConfig.Stream = true
+			clientConfig.SendEvents = false
+			clientConfig.FeatureStore = store
+			clientConfig.StreamUri = c.Main.StreamUri
+			clientConfig.BaseUri = c.Main.BaseUri
+			clientConfig.Logger = log.New(os.Stderr, fmt.Sprintf("[LaunchDarkly Relay (SdkKey ending with %s)] ", last5(envConfig.SdkKey)), log.LstdFlags)
+			clientConfig.UserAgent = "LDRelay/" + Version
+			// The relay's own stream, rather than the SDK's, so that the [upstream] settings apply
+			upstream := newUpstreamStream(envConfig.SdkKey, clientConfig, newReconnectBackoff(c), 0, newUpstreamHeaders(c, envConfig))
+			clientConfig.UpdateProcessor = upstream
+
+			client, err := clientFactory(envConfig.SdkKey, clientConfig)
+			if closer, ok := client.(io.Closer); ok {
+				defer closer.Close()
+			}
+			if err == nil {
+				err = upstream.failure()
+			}
+			if err == nil && (client == nil || !client.Initialized()) {
+				err = ld.ErrInitializationTimeout
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			Info.Printf("Populated the store for %s", envName)
+		}(envName, *envConfig)
+	}
+
+	wg.Wait()
+	return failed
+}
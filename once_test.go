@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestSyncEnvironments(t *testing.T) {
+	config := Config{Environment: map[string]*EnvConfig{
+		"good":    {SdkKey: "sdk-good"},
+		"slow":    {SdkKey: "sdk-slow"},
+		"invalid": {SdkKey: "sdk-invalid"},
+	}}
+
+	stores := make(map[string]ld.FeatureStore)
+	for _, envConfig := range config.Environment {
+		stores[envConfig.SdkKey] = ld.NewInMemoryFeatureStore(nullLogger)
+	}
+	newStore := func(envConfig EnvConfig) (ld.FeatureStore, error) {
+		if store, ok := stores[envConfig.SdkKey]; ok {
+			return store, nil
+		}
+		return nil, errors.New("no store")
+	}
+
+	failed := syncEnvironments(config, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		switch sdkKey {
+		case "sdk-good":
+			config.FeatureStore.Init(nil)
+			return FakeLDClient{true}, nil
+		case "sdk-slow":
+			return FakeLDClient{false}, nil
+		default:
+			return nil, errors.New("unauthorized")
+		}
+	}, newStore)
+
+	assert.ElementsMatch(t, []string{"slow", "invalid"}, failed)
+	assert.True(t, stores["sdk-good"].Initialized())
+}
+
+func TestRunOnceRequiresRedis(t *testing.T) {
+	config := Config{Environment: map[string]*EnvConfig{"env": {SdkKey: "sdk-key"}}}
+	assert.Equal(t, 1, runOnce(config))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const (
+	defaultOverrideTtl = time.Hour
+	maxOverrideTtl     = 24 * time.Hour
+	// Overridden flags are served with their version plus a serial number above this, so that SDKs and ETags
+	// treat each override as a change
+	overrideVersionBase = 1000000
+)
+
+var lastOverrideSerial int64 = overrideVersionBase
+
+// flagOverride makes a flag return the same value for every user until it expires
+type flagOverride struct {
+	Flag      string      `json:"flag"`
+	Value     interface{} `json:"value"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+	serial    int64
+	timer     *time.Timer
+}
+
+// flagOverrides holds the overrides of an environment's flags. Overrides are only held in memory, by the
+// relay they were made on, and are never written to the persistent store.
+type flagOverrides struct {
+	mu    sync.RWMutex
+	byKey map[string]*flagOverride
+}
+
+func newFlagOverrides() *flagOverrides {
+	return &flagOverrides{byKey: make(map[string]*flagOverride)}
+}
+
+// Overrides a flag for ttl, after which the override is removed and expired is called
+func (o *flagOverrides) set(key string, value interface{}, ttl time.Duration, expired func()) flagOverride {
+	if ttl <= 0 {
+		ttl = defaultOverrideTtl
+	}
+	if ttl > maxOverrideTtl {
+		ttl = maxOverrideTtl
+	}
+	override := &flagOverride{
+		Flag:      key,
+		Value:     value,
+		ExpiresAt: time.Now().Add(ttl),
+		serial:    atomic.AddInt64(&lastOverrideSerial, 1),
+	}
+	override.timer = time.AfterFunc(ttl, func() {
+		o.mu.Lock()
+		if o.byKey[key] != override {
+			o.mu.Unlock()
+			return
+		}
+		delete(o.byKey, key)
+		o.mu.Unlock()
+		Warning.Printf("Override of flag %s has expired", key)
+		expired()
+	})
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if previous := o.byKey[key]; previous != nil {
+		previous.timer.Stop()
+	}
+	o.byKey[key] = override
+	return *override
+}
+
+// Removes a flag's override, returning false if it had none
+func (o *flagOverrides) remove(key string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	override := o.byKey[key]
+	if override == nil {
+		return false
+	}
+	override.timer.Stop()
+	delete(o.byKey, key)
+	return true
+}
+
+// Returns the overrides, sorted by flag key
+func (o *flagOverrides) list() []flagOverride {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	overrides := make([]flagOverride, 0, len(o.byKey))
+	for _, override := range o.byKey {
+		overrides = append(overrides, *override)
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Flag < overrides[j].Flag })
+	return overrides
+}
+
+func (o *flagOverrides) keys() []string {
+	var keys []string
+	for _, override := range o.list() {
+		keys = append(keys, override.Flag)
+	}
+	return keys
+}
+
+// Returns the flag as it is to be served, which is a copy that is off and whose off variation is the
+// override's value, if the flag is overridden. Reusing an existing variation for the value keeps the
+// variation indexes in analytics events meaningful.
+func (o *flagOverrides) apply(item ld.VersionedData) ld.VersionedData {
+	flag, ok := item.(*ld.FeatureFlag)
+	if !ok || flag == nil {
+		return item
+	}
+	o.mu.RLock()
+	override := o.byKey[flag.Key]
+	o.mu.RUnlock()
+	if override == nil {
+		return item
+	}
+
+	overridden := *flag
+	overridden.Version = flag.Version + int(override.serial)
+	overridden.On = false
+	variation := -1
+	for i, value := range flag.Variations {
+		if reflect.DeepEqual(value, override.Value) {
+			variation = i
+			break
+		}
+	}
+	if variation < 0 {
+		overridden.Variations = append(append([]interface{}{}, flag.Variations...), override.Value)
+		variation = len(overridden.Variations) - 1
+	}
+	overridden.OffVariation = &variation
+	return &overridden
+}
+
+func (o *flagOverrides) applyAll(items map[string]ld.VersionedData) map[string]ld.VersionedData {
+	o.mu.RLock()
+	none := len(o.byKey) == 0
+	o.mu.RUnlock()
+	if none {
+		return items
+	}
+	applied := make(map[string]ld.VersionedData, len(items))
+	for key, item := range items {
+		applied[key] = o.apply(item)
+	}
+	return applied
+}
+
+// overridingFeatureStore serves an environment's flags with their overrides applied. Writes go to the
+// underlying store unchanged.
+type overridingFeatureStore struct {
+	ld.FeatureStore
+	overrides *flagOverrides
+}
+
+func (s overridingFeatureStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	item, err := s.FeatureStore.Get(kind, key)
+	if err != nil || item == nil || kind != ld.Features {
+		return item, err
+	}
+	return s.overrides.apply(item), nil
+}
+
+func (s overridingFeatureStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	items, err := s.FeatureStore.All(kind)
+	if err != nil || kind != ld.Features {
+		return items, err
+	}
+	return s.overrides.applyAll(items), nil
+}
+
+// Returns data about to be written to a store as the store will serve it
+func overriddenData(store ld.FeatureStore, allData map[ld.VersionedDataKind]map[string]ld.VersionedData) map[ld.VersionedDataKind]map[string]ld.VersionedData {
+	overriding, ok := store.(overridingFeatureStore)
+	if !ok {
+		return allData
+	}
+	applied := make(map[ld.VersionedDataKind]map[string]ld.VersionedData, len(allData))
+	for kind, items := range allData {
+		if kind == ld.Features {
+			items = overriding.overrides.applyAll(items)
+		}
+		applied[kind] = items
+	}
+	return applied
+}
+
+// Lists the flag overrides of every environment
+func (r *relay) getOverrides(w http.ResponseWriter, req *http.Request) {
+	overrides := make(map[string][]flagOverride)
+	for _, clientCtx := range r.allEnvironments() {
+		if list := clientCtx.overrides.list(); len(list) > 0 {
+			overrides[clientCtx.name] = list
+		}
+	}
+	data, _ := json.Marshal(overrides)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Overrides a flag in an environment, with a body such as {"value": true, "ttlSecs": 600}
+func (r *relay) putOverride(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	clientCtx, key, ok := r.findOverriddenFlag(w, req)
+	if !ok {
+		return
+	}
+	var body struct {
+		Value   *json.RawMessage `json:"value"`
+		TtlSecs int              `json:"ttlSecs"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Value == nil {
+		writeError(w, req, http.StatusBadRequest, `Body must be a JSON object with a "value" property`)
+		return
+	}
+	var value interface{}
+	json.Unmarshal(*body.Value, &value)
+
+	override := clientCtx.overrides.set(key, value, time.Duration(body.TtlSecs)*time.Second, clientCtx.republish)
+	clientCtx.republish()
+	Warning.Printf("Flag %s in environment %s is overridden until %s", key, clientCtx.name, override.ExpiresAt.Format(time.RFC3339))
+	data, _ := json.Marshal(override)
+	w.Write(data)
+}
+
+func (r *relay) deleteOverride(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	clientCtx, key, ok := r.findOverriddenFlag(w, req)
+	if !ok {
+		return
+	}
+	if !clientCtx.overrides.remove(key) {
+		writeErrorf(w, req, http.StatusNotFound, "Flag %q is not overridden", key)
+		return
+	}
+	clientCtx.republish()
+	Info.Printf("Override of flag %s in environment %s has been removed", key, clientCtx.name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Finds the environment and flag named in the request, writing a 404 if either doesn't exist
+func (r *relay) findOverriddenFlag(w http.ResponseWriter, req *http.Request) (*clientContextImpl, string, bool) {
+	name, key := mux.Vars(req)["name"], mux.Vars(req)["flag"]
+	clientCtx := r.findEnvironment(name)
+	if clientCtx == nil || clientCtx.overrides == nil {
+		writeErrorf(w, req, http.StatusNotFound, "No environment named %q", name)
+		return nil, "", false
+	}
+	flag, err := clientCtx.getStore().Get(ld.Features, key)
+	if err != nil {
+		writeErrorf(w, req, errorStatus(err), "Unable to read the feature store: %s", err)
+		return nil, "", false
+	}
+	if flag == nil && req.Method != "DELETE" {
+		writeErrorf(w, req, http.StatusNotFound, "No flag with key %q", key)
+		return nil, "", false
+	}
+	return clientCtx, key, true
+}
+
+// Sends the environment's flags to its stream clients again, after its overrides have changed
+func (c *clientContextImpl) republish() {
+	if c.relayStore == nil {
+		return
+	}
+	if err := c.relayStore.republish(); err != nil {
+		Error.Printf("Unable to send overridden flags for environment %s to stream clients: %s", c.name, err)
+	}
+}
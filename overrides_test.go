@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestFlagOverridesChangeServedFlags(t *testing.T) {
+	overrides := newFlagOverrides()
+	store := overridingFeatureStore{FeatureStore: makeStoreWithData(true), overrides: overrides}
+
+	overrides.set("some-flag-key", false, time.Minute, func() {})
+	overrides.set("another-flag-key", 3, time.Minute, func() {})
+
+	item, _ := store.Get(ld.Features, "some-flag-key")
+	flag := item.(*ld.FeatureFlag)
+	assert.False(t, flag.On)
+	assert.Equal(t, []interface{}{true, false}, flag.Variations)
+	assert.Equal(t, 1, *flag.OffVariation)
+	assert.True(t, flag.Version > overrideVersionBase)
+
+	all, _ := store.All(ld.Features)
+	flag = all["another-flag-key"].(*ld.FeatureFlag)
+	assert.False(t, flag.On)
+	assert.Equal(t, []interface{}{3}, flag.Variations)
+	assert.Equal(t, 0, *flag.OffVariation)
+	assert.Equal(t, 3, all["off-variation-key"].GetVersion())
+
+	assert.Equal(t, []string{"another-flag-key", "some-flag-key"}, overrides.keys())
+	assert.True(t, overrides.remove("some-flag-key"))
+	assert.False(t, overrides.remove("some-flag-key"))
+	item, _ = store.Get(ld.Features, "some-flag-key")
+	assert.Equal(t, 2, item.GetVersion())
+	assert.Equal(t, []interface{}{true}, item.(*ld.FeatureFlag).Variations)
+}
+
+func TestFlagOverrideExpires(t *testing.T) {
+	overrides := newFlagOverrides()
+	expired := make(chan struct{}, 1)
+	overrides.set("some-flag-key", false, 10*time.Millisecond, func() { expired <- struct{}{} })
+
+	select {
+	case <-expired:
+		assert.Empty(t, overrides.list())
+	case <-time.After(time.Second):
+		assert.Fail(t, "override did not expire")
+	}
+}
+
+func TestOverridesAreSentToStreamClients(t *testing.T) {
+	overrides := newFlagOverrides()
+	allPublisher, flagsPublisher, pingPublisher := &testPublisher{}, &testPublisher{}, &testPublisher{}
+	relayStore := NewSSERelayFeatureStore("api-key", allPublisher, flagsPublisher, pingPublisher,
+		overridingFeatureStore{FeatureStore: ld.NewInMemoryFeatureStore(nil), overrides: overrides}, 0)
+	overrides.set("flag1", "overridden", time.Minute, func() {})
+
+	flag := ld.FeatureFlag{Key: "flag1", Version: 1, On: true, Variations: []interface{}{"a", "b"}}
+	relayStore.Init(map[ld.VersionedDataKind]map[string]ld.VersionedData{ld.Features: {"flag1": &flag}, ld.Segments: {}})
+	if assert.Len(t, flagsPublisher.events, 1) {
+		assert.Contains(t, flagsPublisher.events[0].Data(), `"overridden"`)
+	}
+
+	overrides.remove("flag1")
+	assert.NoError(t, relayStore.republish())
+	if assert.Len(t, flagsPublisher.events, 2) {
+		assert.NotContains(t, flagsPublisher.events[1].Data(), `"overridden"`)
+	}
+	assert.Len(t, allPublisher.events, 2)
+	assert.Len(t, pingPublisher.events, 2)
+}
+
+func TestOverridesEndpoints(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	handler := relay.getHandler()
+	deadline := time.Now().Add(time.Second)
+	for !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	makeSnapshotRequest(handler, "POST", "/internal/import/env1", testSnapshot)
+
+	w := makeSnapshotRequest(handler, "PUT", "/internal/overrides/env1/flag1", `{"value": "mitigated", "ttlSecs": 60}`)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var override flagOverride
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &override)) {
+		assert.Equal(t, "flag1", override.Flag)
+		assert.Equal(t, "mitigated", override.Value)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), override.ExpiresAt, 5*time.Second)
+	}
+
+	w = makeSnapshotRequest(handler, "GET", "/internal/overrides", "")
+	var listed map[string][]flagOverride
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed)) && assert.Len(t, listed["env1"], 1) {
+		assert.Equal(t, "mitigated", listed["env1"][0].Value)
+	}
+
+	flag, _ := relay.findEnvironment("env1").getStore().Get(ld.Features, "flag1")
+	assert.False(t, flag.(*ld.FeatureFlag).On)
+
+	w = makeSnapshotRequest(handler, "GET", "/internal/export/env1", "")
+	var snapshot storeSnapshot
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshot)) {
+		assert.True(t, snapshot.Flags["flag1"].On)
+		assert.Equal(t, 2, snapshot.Flags["flag1"].Version)
+	}
+
+	w = makeSnapshotRequest(handler, "GET", "/internal/status", "")
+	var status struct {
+		Environments map[string]EnvironmentStatus `json:"environments"`
+	}
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status)) {
+		assert.Equal(t, []string{"flag1"}, status.Environments["env1"].Overrides)
+	}
+
+	specs := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{"missing value", "PUT", "/internal/overrides/env1/flag1", `{"ttlSecs": 60}`, http.StatusBadRequest},
+		{"unknown flag", "PUT", "/internal/overrides/env1/unknown", `{"value": true}`, http.StatusNotFound},
+		{"unknown environment", "PUT", "/internal/overrides/unknown/flag1", `{"value": true}`, http.StatusNotFound},
+		{"remove", "DELETE", "/internal/overrides/env1/flag1", "", http.StatusNoContent},
+		{"remove again", "DELETE", "/internal/overrides/env1/flag1", "", http.StatusNotFound},
+	}
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			w := makeSnapshotRequest(handler, s.method, s.path, s.body)
+			assert.Equal(t, s.expectedStatus, w.Result().StatusCode)
+		})
+	}
+
+	flag, _ = relay.findEnvironment("env1").getStore().Get(ld.Features, "flag1")
+	assert.True(t, flag.(*ld.FeatureFlag).On)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// Polling responses may only be seen by clients holding the SDK key, so shared caches mustn't store them
+const pollingCacheControl = "private, max-age=0, must-revalidate"
+
+// Serves the polling API that server-side SDKs use in polling mode, from the environment's feature store,
+// in the same form as LaunchDarkly's. Responses carry an ETag computed from the versions of the items in
+// them, so an SDK polling with If-None-Match gets an empty 304 response until something changes.
+func pollAllHandler(w http.ResponseWriter, req *http.Request) {
+	pollStore(w, req, ld.Features, ld.Segments)
+}
+
+func pollFlagsHandler(w http.ResponseWriter, req *http.Request) {
+	pollStore(w, req, ld.Features)
+}
+
+func pollSegmentsHandler(w http.ResponseWriter, req *http.Request) {
+	pollStore(w, req, ld.Segments)
+}
+
+func pollFlagHandler(w http.ResponseWriter, req *http.Request) {
+	pollItem(w, req, ld.Features)
+}
+
+func pollSegmentHandler(w http.ResponseWriter, req *http.Request) {
+	pollItem(w, req, ld.Segments)
+}
+
+// Returns every item of the given kinds. With a single kind the response is a map of the items by key, and
+// with both it is an object with "flags" and "segments" properties, as for /sdk/latest-all.
+func pollStore(w http.ResponseWriter, req *http.Request, kinds ...ld.VersionedDataKind) {
+	store, ok := pollableStore(w, req)
+	if !ok {
+		return
+	}
+	all := make(map[ld.VersionedDataKind]map[string]ld.VersionedData, len(kinds))
+	for _, kind := range kinds {
+		items, err := store.All(kind)
+		if err != nil {
+			getClientContext(req).getLogger().Printf("WARN: Unable to fetch %s from feature store%s: %s", kind.GetNamespace(), forRequest(req), err)
+			writeErrorf(w, req, errorStatus(err), "Error fetching %s from feature store: %s", kind.GetNamespace(), err)
+			return
+		}
+		all[kind] = items
+	}
+
+	var body interface{}
+	if len(kinds) == 1 {
+		body = all[kinds[0]]
+	} else {
+		body = map[string]map[string]ld.VersionedData{"flags": all[ld.Features], "segments": all[ld.Segments]}
+	}
+	writePollingResponse(w, req, storeETag(all[ld.Features], all[ld.Segments]), body)
+}
+
+// Returns a single flag or segment, which a polling SDK fetches when a stream tells it to
+func pollItem(w http.ResponseWriter, req *http.Request, kind ld.VersionedDataKind) {
+	store, ok := pollableStore(w, req)
+	if !ok {
+		return
+	}
+	key := mux.Vars(req)["key"]
+	item, err := store.Get(kind, key)
+	if err != nil {
+		getClientContext(req).getLogger().Printf("WARN: Unable to fetch %s %q from feature store%s: %s", kind.GetNamespace(), key, forRequest(req), err)
+		writeErrorf(w, req, errorStatus(err), "Error fetching %s from feature store: %s", kind.GetNamespace(), err)
+		return
+	}
+	if item == nil {
+		writeErrorf(w, req, http.StatusNotFound, "No %s with key %q", kind.GetNamespace(), key)
+		return
+	}
+	items := map[string]ld.VersionedData{key: item}
+	var etag string
+	if kind == ld.Features {
+		etag = storeETag(items, nil)
+	} else {
+		etag = storeETag(nil, items)
+	}
+	writePollingResponse(w, req, etag, item)
+}
+
+// Returns the environment's feature store if it can be polled, or writes an error response. As with
+// evaluation, a store that was initialized earlier is used even if the client isn't connected yet.
+func pollableStore(w http.ResponseWriter, req *http.Request) (ld.FeatureStore, bool) {
+	clientCtx := getClientContext(req)
+	store := clientCtx.getStore()
+	w.Header().Set("Content-Type", "application/json")
+	if !clientCtx.getClient().Initialized() && !store.Initialized() {
+		clientCtx.getLogger().Printf("WARN: Polled before client initialization%s. Feature store not available", forRequest(req))
+		writeError(w, req, http.StatusServiceUnavailable, "Service not initialized")
+		return nil, false
+	}
+	return store, true
+}
+
+func writePollingResponse(w http.ResponseWriter, req *http.Request, etag string, body interface{}) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", pollingCacheControl)
+	if etagMatches(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		writeErrorf(w, req, http.StatusInternalServerError, "Unable to encode response: %s", err)
+		return
+	}
+	w.Write(data)
+}
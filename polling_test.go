@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestPollingEndpointsReturnStoreContents(t *testing.T) {
+	ctx := makeTestContextWithData()
+	ctx.store.Upsert(ld.Segments, &ld.Segment{Key: "segment-key", Included: []string{"me"}, Version: 4})
+
+	poll := func(handler http.HandlerFunc, vars map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, buildRequest("GET", vars, nil, "", ctx))
+		return w
+	}
+
+	w := poll(pollAllHandler, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var all struct {
+		Flags    map[string]ld.FeatureFlag `json:"flags"`
+		Segments map[string]ld.Segment     `json:"segments"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &all))
+	assert.Len(t, all.Flags, 3)
+	assert.Equal(t, 2, all.Flags["some-flag-key"].Version)
+	assert.Equal(t, []string{"me"}, all.Segments["segment-key"].Included)
+
+	w = poll(pollFlagsHandler, nil)
+	var flags map[string]ld.FeatureFlag
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &flags))
+	assert.Len(t, flags, 3)
+
+	w = poll(pollSegmentsHandler, nil)
+	var segments map[string]ld.Segment
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &segments))
+	assert.Equal(t, 4, segments["segment-key"].Version)
+
+	w = poll(pollFlagHandler, map[string]string{"key": "another-flag-key"})
+	var flag ld.FeatureFlag
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &flag))
+	assert.Equal(t, "another-flag-key", flag.Key)
+
+	assert.Equal(t, http.StatusNotFound, poll(pollFlagHandler, map[string]string{"key": "no-such-flag"}).Code)
+	assert.Equal(t, http.StatusOK, poll(pollSegmentHandler, map[string]string{"key": "segment-key"}).Code)
+}
+
+func TestPollingETagChangesOnlyWhenStoreChanges(t *testing.T) {
+	ctx := makeTestContextWithData()
+	poll := func(etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		pollAllHandler(w, buildRequest("GET", nil, map[string]string{"If-None-Match": etag}, "", ctx))
+		return w
+	}
+
+	w := poll("")
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, pollingCacheControl, w.Header().Get("Cache-Control"))
+
+	w = poll(etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.Bytes())
+
+	ctx.store.Upsert(ld.Features, &ld.FeatureFlag{Key: "some-flag-key", Version: 5})
+	w = poll(etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestPollingBeforeStoreIsInitialized(t *testing.T) {
+	ctx := &clientContextImpl{client: FakeLDClient{initialized: false}, store: makeStoreWithData(false), logger: nullLogger}
+	w := httptest.NewRecorder()
+	pollAllHandler(w, buildRequest("GET", nil, nil, "", ctx))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestPollingEndpointsRequireSdkKey(t *testing.T) {
+	handler := makeAdminTestRelay(false).getHandler()
+	for _, path := range []string{"/sdk/latest-all", "/sdk/latest-flags", "/sdk/latest-segments/segment-key"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0")
+		handler.ServeHTTP(w, req)
+		assert.NotEqual(t, http.StatusUnauthorized, w.Code, path)
+	}
+}
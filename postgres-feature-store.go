@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/patrickmn/go-cache"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const (
+	postgresItemsTable = "launchdarkly_items"
+	postgresInitTable  = "launchdarkly_init"
+)
+
+// Items of every kind for every environment are kept in one table, distinguished by the environment's
+// prefix and the kind's namespace. Deleted items are kept, with a deleted placeholder in place of the item,
+// so that an out-of-date update can't bring them back.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS ` + postgresItemsTable + ` (
+		prefix TEXT NOT NULL,
+		namespace TEXT NOT NULL,
+		key TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		item TEXT NOT NULL,
+		PRIMARY KEY (prefix, namespace, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + postgresInitTable + ` (
+		prefix TEXT PRIMARY KEY
+	)`,
+}
+
+// postgresDB is a connection pool shared by the stores of every environment that uses the same database. It
+// is closed once every store using it has been.
+type postgresDB struct {
+	url         string
+	db          *sql.DB
+	mu          sync.Mutex
+	schemaReady bool
+	// How many stores are using the pool, guarded by postgresDBsLock
+	users int
+}
+
+var (
+	postgresDBsLock sync.Mutex
+	postgresDBs     = make(map[string]*postgresDB)
+)
+
+func openPostgres(url string) (*postgresDB, error) {
+	postgresDBsLock.Lock()
+	defer postgresDBsLock.Unlock()
+	if pg, ok := postgresDBs[url]; ok {
+		pg.users++
+		return pg, nil
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	pg := &postgresDB{url: url, db: db, users: 1}
+	postgresDBs[url] = pg
+	return pg, nil
+}
+
+// Checks a Postgres connection string without opening a pool. URLs are parsed here; connection strings of
+// key=value settings are only checked when the first connection is made.
+func validatePostgresUrl(url string) error {
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		_, err := pq.ParseURL(url)
+		return err
+	}
+	return nil
+}
+
+// Pings the pool that the environments' stores share, if any of them is open. The pool is only held while
+// pinging, so that it is still closed when the last environment using it is removed.
+func pingPostgres(url string) error {
+	postgresDBsLock.Lock()
+	pg := postgresDBs[url]
+	if pg != nil {
+		pg.users++
+	}
+	postgresDBsLock.Unlock()
+	if pg == nil {
+		return nil
+	}
+	defer pg.release()
+	return pg.db.Ping()
+}
+
+// Closes the pool once nothing else is using it
+func (pg *postgresDB) release() {
+	postgresDBsLock.Lock()
+	defer postgresDBsLock.Unlock()
+	pg.users--
+	if pg.users == 0 {
+		delete(postgresDBs, pg.url)
+		pg.db.Close()
+	}
+}
+
+// Creates the tables if they don't exist yet. This is done when they are first needed rather than at
+// startup, so that the relay can start while the database is unavailable.
+func (pg *postgresDB) ensureSchema() error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	if pg.schemaReady {
+		return nil
+	}
+	for _, statement := range postgresSchema {
+		if _, err := pg.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	pg.schemaReady = true
+	return nil
+}
+
+// PostgresFeatureStore is a feature store backed by a PostgreSQL database. Like the Redis store, it can
+// keep items in memory for a while to avoid querying the database for every evaluation.
+type PostgresFeatureStore struct {
+	pg        *postgresDB
+	prefix    string
+	cache     *cache.Cache
+	timeout   time.Duration
+	logger    ld.Logger
+	mu        sync.Mutex
+	inited    bool
+	initCheck bool
+	closeOnce sync.Once
+}
+
+// Creates a store for the environment with the given prefix. If the prefix is empty, "launchdarkly" is
+// used, as it is for Redis.
+func NewPostgresFeatureStore(url string, prefix string, timeout time.Duration, logger ld.Logger) (*PostgresFeatureStore, error) {
+	pg, err := openPostgres(url)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+	store := &PostgresFeatureStore{
+		pg:      pg,
+		prefix:  prefix,
+		timeout: timeout,
+		logger:  logger,
+	}
+	if timeout > 0 {
+		store.cache = cache.New(timeout, 5*time.Minute)
+	}
+	return store, nil
+}
+
+func (store *PostgresFeatureStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	if store.cache != nil {
+		if data, present := store.cache.Get(localCacheKey(kind, key)); present {
+			return liveItem(data.(ld.VersionedData)), nil
+		}
+	}
+
+	var itemJson string
+	err := store.pg.db.QueryRow(`SELECT item FROM `+postgresItemsTable+` WHERE prefix = $1 AND namespace = $2 AND key = $3`,
+		store.prefix, kind.GetNamespace(), key).Scan(&itemJson)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	item, err := unmarshalStoreItem(kind, itemJson)
+	if err != nil {
+		return nil, err
+	}
+	if store.cache != nil {
+		store.cache.Set(localCacheKey(kind, key), item, store.timeout)
+	}
+	return liveItem(item), nil
+}
+
+func (store *PostgresFeatureStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	if store.cache != nil {
+		if data, present := store.cache.Get(localAllCacheKey(kind)); present {
+			return data.(map[string]ld.VersionedData), nil
+		}
+	}
+
+	rows, err := store.pg.db.Query(`SELECT key, item FROM `+postgresItemsTable+` WHERE prefix = $1 AND namespace = $2`,
+		store.prefix, kind.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make(map[string]ld.VersionedData)
+	for rows.Next() {
+		var key, itemJson string
+		if err := rows.Scan(&key, &itemJson); err != nil {
+			return nil, err
+		}
+		item, err := unmarshalStoreItem(kind, itemJson)
+		if err != nil {
+			return nil, err
+		}
+		if !item.IsDeleted() {
+			results[key] = item
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if store.cache != nil {
+		store.cache.Set(localAllCacheKey(kind), results, store.timeout)
+	}
+	return results, nil
+}
+
+func (store *PostgresFeatureStore) Init(allData map[ld.VersionedDataKind]map[string]ld.VersionedData) error {
+	if err := store.pg.ensureSchema(); err != nil {
+		return err
+	}
+
+	tx, err := store.pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM `+postgresItemsTable+` WHERE prefix = $1`, store.prefix); err != nil {
+		return err
+	}
+	for kind, items := range allData {
+		for key, item := range items {
+			data, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT INTO `+postgresItemsTable+` (prefix, namespace, key, version, item) VALUES ($1, $2, $3, $4, $5)`,
+				store.prefix, kind.GetNamespace(), key, item.GetVersion(), string(data)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO `+postgresInitTable+` (prefix) VALUES ($1) ON CONFLICT DO NOTHING`, store.prefix); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if store.cache != nil {
+		store.cache.Flush()
+		for kind, items := range allData {
+			for key, item := range items {
+				store.cache.Set(localCacheKey(kind, key), item, store.timeout)
+			}
+			store.cache.Set(localAllCacheKey(kind), items, store.timeout)
+		}
+	}
+
+	store.mu.Lock()
+	store.inited = true
+	store.initCheck = true
+	store.mu.Unlock()
+	return nil
+}
+
+func (store *PostgresFeatureStore) Delete(kind ld.VersionedDataKind, key string, version int) error {
+	return store.updateWithVersioning(kind, kind.MakeDeletedItem(key, version))
+}
+
+func (store *PostgresFeatureStore) Upsert(kind ld.VersionedDataKind, item ld.VersionedData) error {
+	return store.updateWithVersioning(kind, item)
+}
+
+// Writes the item unless the database already has the same or a later version of it. The comparison is
+// made by the database, so concurrent updates from several relays can't overwrite a newer version.
+func (store *PostgresFeatureStore) updateWithVersioning(kind ld.VersionedDataKind, item ld.VersionedData) error {
+	if err := store.pg.ensureSchema(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = store.pg.db.Exec(`INSERT INTO `+postgresItemsTable+` (prefix, namespace, key, version, item) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (prefix, namespace, key) DO UPDATE SET version = EXCLUDED.version, item = EXCLUDED.item
+		WHERE `+postgresItemsTable+`.version < EXCLUDED.version`,
+		store.prefix, kind.GetNamespace(), item.GetKey(), item.GetVersion(), string(data))
+	if err != nil {
+		return err
+	}
+	if store.cache != nil {
+		// We don't know whether our version won, so let the next read fetch whichever did
+		store.cache.Delete(localCacheKey(kind, item.GetKey()))
+		store.cache.Delete(localAllCacheKey(kind))
+	}
+	return nil
+}
+
+// Releases the store's share of the connection pool, once its environment has been removed
+func (store *PostgresFeatureStore) Close() error {
+	store.closeOnce.Do(store.pg.release)
+	return nil
+}
+
+func (store *PostgresFeatureStore) Initialized() bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if !store.initCheck {
+		var exists bool
+		err := store.pg.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+postgresInitTable+` WHERE prefix = $1)`, store.prefix).Scan(&exists)
+		if err == nil {
+			// Only remember the answer once we've had one; the table may not exist yet
+			store.inited = exists
+			store.initCheck = exists
+		}
+	}
+	return store.inited
+}
+
+// The helpers below are shared with the memcached store
+
+func localCacheKey(kind ld.VersionedDataKind, key string) string {
+	return kind.GetNamespace() + ":" + key
+}
+
+func localAllCacheKey(kind ld.VersionedDataKind) string {
+	return "all:" + kind.GetNamespace()
+}
+
+func liveItem(item ld.VersionedData) ld.VersionedData {
+	if item != nil && item.IsDeleted() {
+		return nil
+	}
+	return item
+}
+
+func unmarshalStoreItem(kind ld.VersionedDataKind, itemJson string) (ld.VersionedData, error) {
+	data := kind.GetDefaultItem()
+	if err := json.Unmarshal([]byte(itemJson), &data); err != nil {
+		return nil, err
+	}
+	if item, ok := data.(ld.VersionedData); ok {
+		return item, nil
+	}
+	return nil, fmt.Errorf("Unexpected data type from JSON unmarshal: %T", data)
+}
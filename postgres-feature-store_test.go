@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func writeTestConfig(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "ld-relay-config")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer f.Close()
+	f.WriteString(contents)
+	return f.Name()
+}
+
+func TestLoadConfigRejectsRedisAndPostgresTogether(t *testing.T) {
+	configFile := writeTestConfig(t, `
+[redis]
+	host = "localhost"
+	port = 6379
+[postgres]
+	url = "postgres://localhost/ldrelay"
+`)
+	defer os.Remove(configFile)
+
+	_, err := loadConfig(configFile)
+	assert.EqualError(t, err, "only one of Redis, Postgres and Memcached may be configured")
+}
+
+func TestPostgresStoreIsSelectedWhenConfigured(t *testing.T) {
+	configFile := writeTestConfig(t, `
+[postgres]
+	url = "postgres://localhost/ldrelay?sslmode=disable"
+`)
+	defer os.Remove(configFile)
+
+	c, err := loadConfig(configFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, defaultRedisLocalTtlMs, *c.Postgres.LocalTtl)
+	assert.True(t, persistentStoreConfigured(c))
+
+	baseStore, err := newBaseFeatureStore(c, EnvConfig{Prefix: "ld:test"})
+	store, ok := baseStore.(*PostgresFeatureStore)
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "ld:test", store.prefix)
+	}
+}
+
+// The store's behaviour is tested against a real database when LD_RELAY_TEST_POSTGRES_URL is set, as it is in CI
+func TestPostgresFeatureStore(t *testing.T) {
+	url := os.Getenv("LD_RELAY_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("LD_RELAY_TEST_POSTGRES_URL is not set")
+	}
+
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		t.Run("localTtl "+timeout.String(), func(t *testing.T) {
+			prefix := "ld:test:" + timeout.String()
+			store, err := NewPostgresFeatureStore(url, prefix, timeout, nullLogger)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer func() {
+				store.pg.db.Exec(`DELETE FROM `+postgresItemsTable+` WHERE prefix = $1`, prefix)
+				store.pg.db.Exec(`DELETE FROM `+postgresInitTable+` WHERE prefix = $1`, prefix)
+			}()
+			store.pg.ensureSchema()
+			store.pg.db.Exec(`DELETE FROM `+postgresInitTable+` WHERE prefix = $1`, prefix)
+			assert.False(t, store.Initialized())
+
+			flag1 := ld.FeatureFlag{Key: "flag1", Version: 1}
+			flag2 := ld.FeatureFlag{Key: "flag2", Version: 1}
+			assert.NoError(t, store.Init(map[ld.VersionedDataKind]map[string]ld.VersionedData{
+				ld.Features: {"flag1": &flag1, "flag2": &flag2},
+				ld.Segments: {},
+			}))
+			assert.True(t, store.Initialized())
+			other, _ := NewPostgresFeatureStore(url, prefix, 0, nullLogger)
+			assert.True(t, other.Initialized())
+			other, _ = NewPostgresFeatureStore(url, prefix+":other", 0, nullLogger)
+			assert.False(t, other.Initialized())
+
+			t.Run("get", func(t *testing.T) {
+				item, err := store.Get(ld.Features, "flag1")
+				assert.NoError(t, err)
+				assert.Equal(t, &flag1, item)
+
+				item, err = store.Get(ld.Features, "unknown")
+				assert.NoError(t, err)
+				assert.Nil(t, item)
+			})
+
+			t.Run("upsert keeps the newest version", func(t *testing.T) {
+				assert.NoError(t, store.Upsert(ld.Features, &ld.FeatureFlag{Key: "flag1", Version: 3}))
+				assert.NoError(t, store.Upsert(ld.Features, &ld.FeatureFlag{Key: "flag1", Version: 2}))
+				item, _ := store.Get(ld.Features, "flag1")
+				assert.Equal(t, 3, item.GetVersion())
+			})
+
+			t.Run("upsert adds new items to all", func(t *testing.T) {
+				assert.NoError(t, store.Upsert(ld.Features, &ld.FeatureFlag{Key: "flag3", Version: 1}))
+				all, err := store.All(ld.Features)
+				assert.NoError(t, err)
+				assert.Len(t, all, 3)
+				assert.Contains(t, all, "flag3")
+			})
+
+			t.Run("delete", func(t *testing.T) {
+				assert.NoError(t, store.Delete(ld.Features, "flag2", 2))
+				item, err := store.Get(ld.Features, "flag2")
+				assert.NoError(t, err)
+				assert.Nil(t, item)
+				// The deleted placeholder keeps an older version from bringing the item back
+				assert.NoError(t, store.Upsert(ld.Features, &ld.FeatureFlag{Key: "flag2", Version: 1}))
+				item, _ = store.Get(ld.Features, "flag2")
+				assert.Nil(t, item)
+				all, _ := store.All(ld.Features)
+				assert.NotContains(t, all, "flag2")
+			})
+
+			t.Run("init removes items that are gone", func(t *testing.T) {
+				assert.NoError(t, store.Init(map[ld.VersionedDataKind]map[string]ld.VersionedData{
+					ld.Features: {"flag1": &flag1},
+					ld.Segments: {},
+				}))
+				all, err := store.All(ld.Features)
+				assert.NoError(t, err)
+				assert.Equal(t, map[string]ld.VersionedData{"flag1": &flag1}, all)
+				item, _ := store.Get(ld.Features, "flag3")
+				assert.Nil(t, item)
+			})
+		})
+	}
+}
+
+func TestConfigAndStoreCheckDontHoldThePostgresPool(t *testing.T) {
+	url := "postgres://localhost/ldrelay-check-test?sslmode=disable"
+	configFile := writeTestConfig(t, "[postgres]\n\turl = \""+url+"\"\n")
+	defer os.Remove(configFile)
+	c, err := loadConfig(configFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	isOpen := func() bool {
+		postgresDBsLock.Lock()
+		defer postgresDBsLock.Unlock()
+		_, ok := postgresDBs[url]
+		return ok
+	}
+	assert.False(t, isOpen())
+
+	storeCheck := newStoreCheck(c)
+	assert.NoError(t, storeCheck(), "nothing to check until an environment opens the pool")
+	store, _ := NewPostgresFeatureStore(url, "env1", 0, nullLogger)
+	storeCheck()
+	store.Close()
+	assert.False(t, isOpen())
+
+	configFile2 := writeTestConfig(t, "[postgres]\n\turl = \"postgres://localhost:notaport/ldrelay\"\n")
+	defer os.Remove(configFile2)
+	_, err = loadConfig(configFile2)
+	assert.Error(t, err)
+}
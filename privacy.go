@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// The user attributes that are not custom attributes
+var builtInUserAttributes = map[string]bool{
+	"key": true, "secondary": true, "ip": true, "country": true, "email": true, "firstName": true, "lastName": true,
+	"avatar": true, "name": true, "anonymous": true,
+}
+
+type userPrivacyContextKey struct{}
+
+// userPrivacy hashes user keys and removes configured attributes from the users in client-side and mobile
+// events, so that personal data from end users' devices doesn't leave the network the relay runs in. Flags
+// are still evaluated for the real user, so that targets, rules and rollouts give the same results as they
+// do in server-side SDKs. Server-side SDKs send their own events, so those are left alone.
+type userPrivacy struct {
+	hashKeys bool
+	salt     []byte
+	// Attributes removed without a trace, and attributes removed but listed as private, as SDKs do
+	strip  []string
+	redact []string
+}
+
+func validateUserPrivacy(c Config) error {
+	if c.Privacy.HashUserKeys && c.Privacy.HashSalt == "" {
+		// Without a secret, hashed keys such as email addresses could be recovered by hashing guesses
+		return errors.New("hashUserKeys requires hashSalt")
+	}
+	for _, attr := range append(append([]string{}, c.Privacy.StripAttribute...), c.Privacy.RedactAttribute...) {
+		if attr == "key" {
+			return errors.New("the key attribute can't be removed; use hashUserKeys instead")
+		}
+		if attr == "" {
+			return errors.New("attribute names can't be empty")
+		}
+	}
+	return nil
+}
+
+// Returns nil if nothing about users is to be changed
+func newUserPrivacy(c Config) *userPrivacy {
+	if !c.Privacy.HashUserKeys && len(c.Privacy.StripAttribute) == 0 && len(c.Privacy.RedactAttribute) == 0 {
+		return nil
+	}
+	return &userPrivacy{
+		hashKeys: c.Privacy.HashUserKeys,
+		salt:     []byte(c.Privacy.HashSalt),
+		strip:    c.Privacy.StripAttribute,
+		redact:   c.Privacy.RedactAttribute,
+	}
+}
+
+// Marks requests as coming from client-side or mobile SDKs, whose users are to be scrubbed
+func (p *userPrivacy) middleware(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), userPrivacyContextKey{}, p)))
+	})
+}
+
+// Returns the privacy settings that apply to a request, or nil if its users are to be left alone
+func userPrivacyForRequest(req *http.Request) *userPrivacy {
+	p, _ := req.Context().Value(userPrivacyContextKey{}).(*userPrivacy)
+	return p
+}
+
+func (p *userPrivacy) hashKey(key string) string {
+	mac := hmac.New(sha256.New, p.salt)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns an event with its user scrubbed. Events that can't be parsed are passed on unchanged, as they
+// would be without scrubbing.
+func (p *userPrivacy) scrubEvent(evt json.RawMessage) json.RawMessage {
+	decoder := json.NewDecoder(bytes.NewReader(evt))
+	// Keep numbers such as timestamps exactly as they were
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil || fields == nil {
+		return evt
+	}
+	if user, ok := fields["user"].(map[string]interface{}); ok {
+		p.scrubUser(user)
+	}
+	if key, ok := fields["userKey"].(string); ok && p.hashKeys {
+		fields["userKey"] = p.hashKey(key)
+	}
+	if fields["kind"] == "alias" && p.hashKeys {
+		// Alias events link the keys a user had before and after logging in
+		for _, name := range []string{"key", "previousKey"} {
+			if key, ok := fields[name].(string); ok {
+				fields[name] = p.hashKey(key)
+			}
+		}
+	}
+	scrubbed, err := json.Marshal(fields)
+	if err != nil {
+		return evt
+	}
+	return scrubbed
+}
+
+func (p *userPrivacy) scrubUser(user map[string]interface{}) {
+	if key, ok := user["key"]; ok && p.hashKeys {
+		user["key"] = p.hashKey(fmt.Sprint(key))
+	}
+	for _, attr := range p.strip {
+		removeUserAttribute(user, attr)
+	}
+	var redacted []string
+	for _, attr := range p.redact {
+		if removeUserAttribute(user, attr) {
+			redacted = append(redacted, attr)
+		}
+	}
+	if len(redacted) > 0 {
+		privateAttrs := make(map[string]bool)
+		if existing, ok := user["privateAttrs"].([]interface{}); ok {
+			for _, attr := range existing {
+				if name, ok := attr.(string); ok {
+					privateAttrs[name] = true
+				}
+			}
+		}
+		for _, attr := range redacted {
+			privateAttrs[attr] = true
+		}
+		names := make([]string, 0, len(privateAttrs))
+		for name := range privateAttrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		user["privateAttrs"] = names
+	}
+}
+
+// Removes a built-in or custom attribute from a user, returning true if it was there
+func removeUserAttribute(user map[string]interface{}, attr string) bool {
+	if builtInUserAttributes[attr] {
+		_, exists := user[attr]
+		delete(user, attr)
+		return exists
+	}
+	custom, ok := user["custom"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, exists := custom[attr]
+	delete(custom, attr)
+	if len(custom) == 0 {
+		delete(user, "custom")
+	}
+	return exists
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func makeTestUserPrivacy() *userPrivacy {
+	var c Config
+	c.Privacy.HashUserKeys = true
+	c.Privacy.HashSalt = "salt"
+	c.Privacy.StripAttribute = []string{"ip", "deviceId"}
+	c.Privacy.RedactAttribute = []string{"email", "plan"}
+	return newUserPrivacy(c)
+}
+
+func TestValidateUserPrivacy(t *testing.T) {
+	var c Config
+	assert.NoError(t, validateUserPrivacy(c))
+	assert.Nil(t, newUserPrivacy(c))
+
+	c.Privacy.HashUserKeys = true
+	assert.Error(t, validateUserPrivacy(c))
+	c.Privacy.HashSalt = "salt"
+	assert.NoError(t, validateUserPrivacy(c))
+
+	c.Privacy.StripAttribute = []string{"key"}
+	assert.Error(t, validateUserPrivacy(c))
+	c.Privacy.StripAttribute = nil
+	c.Privacy.RedactAttribute = []string{""}
+	assert.Error(t, validateUserPrivacy(c))
+}
+
+func TestUserPrivacyHashesKeys(t *testing.T) {
+	p := makeTestUserPrivacy()
+	hashed := p.hashKey("me@example.com")
+	assert.Len(t, hashed, 64)
+	assert.Equal(t, hashed, p.hashKey("me@example.com"))
+	assert.NotEqual(t, hashed, p.hashKey("you@example.com"))
+}
+
+func TestFlagsAreEvaluatedForTheRealKeyWhenKeysAreHashed(t *testing.T) {
+	p := makeTestUserPrivacy()
+	store := ld.NewInMemoryFeatureStore(nullLogger)
+	store.Init(nil)
+	zero := 0
+	store.Upsert(ld.Features, &ld.FeatureFlag{Key: "targeted", On: true, Version: 1,
+		Targets:     []ld.Target{{Values: []string{"test"}, Variation: 1}},
+		Fallthrough: ld.VariationOrRollout{Variation: &zero}, Variations: []interface{}{false, true}})
+	ctx := &clientContextImpl{client: FakeLDClient{initialized: true}, store: store, logger: nullLogger}
+
+	resp := httptest.NewRecorder()
+	p.middleware(http.HandlerFunc(evaluateAllFeatureFlagsValueOnly)).ServeHTTP(resp, buildRequest("GET", map[string]string{"user": user()}, nil, "", ctx))
+	assert.JSONEq(t, `{"targeted":true}`, resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	req := buildRequest("GET", nil, map[string]string{"X-LaunchDarkly-User": user()}, "", ctx)
+	p.middleware(http.HandlerFunc(getSnippet)).ServeHTTP(resp, req)
+	assert.Contains(t, resp.Body.String(), `"targeted":true`)
+}
+
+func TestUserPrivacyScrubsEvents(t *testing.T) {
+	p := makeTestUserPrivacy()
+	hashed := p.hashKey("me@example.com")
+
+	evt := p.scrubEvent(json.RawMessage(`{"kind":"identify","creationDate":1526000000123,` +
+		`"user":{"key":"me@example.com","ip":"10.0.0.1","email":"me@example.com","name":"Me","privateAttrs":["name"],` +
+		`"custom":{"deviceId":"abc","plan":"gold","team":"payments"}}}`))
+	assert.JSONEq(t, `{"kind":"identify","creationDate":1526000000123,`+
+		`"user":{"key":"`+hashed+`","name":"Me","privateAttrs":["email","name","plan"],"custom":{"team":"payments"}}}`, string(evt))
+
+	evt = p.scrubEvent(json.RawMessage(`{"kind":"feature","key":"flag","userKey":"me@example.com"}`))
+	assert.JSONEq(t, `{"kind":"feature","key":"flag","userKey":"`+hashed+`"}`, string(evt))
+
+	evt = p.scrubEvent(json.RawMessage(`{"kind":"custom","user":{"key":"me@example.com","custom":{"deviceId":"abc"}}}`))
+	assert.JSONEq(t, `{"kind":"custom","user":{"key":"`+hashed+`"}}`, string(evt))
+
+	evt = p.scrubEvent(json.RawMessage(`{"kind":"alias","key":"me@example.com","previousKey":"anonymous-1","contextKind":"user"}`))
+	assert.JSONEq(t, `{"kind":"alias","key":"`+hashed+`","previousKey":"`+p.hashKey("anonymous-1")+`","contextKind":"user"}`, string(evt))
+
+	assert.Equal(t, `not json`, string(p.scrubEvent(json.RawMessage(`not json`))))
+}
+
+func TestOnlyClientSideAndMobileEventsAreScrubbed(t *testing.T) {
+	var config Config
+	config.Events.Capacity = defaultEventCapacity
+	p := makeTestUserPrivacy()
+
+	publish := func(scrub bool) eventSinkMessage {
+		sink := &fakeEventSink{}
+		handler := newEventRelayHandler("sdk-key", config, nil)
+		handler.sinks = []*eventSinkForwarder{newEventSinkForwarder(sink, "env1", config)}
+		handler.sinksOnly = true
+		var h http.Handler = handler
+		if scrub {
+			h = p.middleware(handler)
+		}
+		req, _ := http.NewRequest("POST", "/mobile", strings.NewReader(`[{"kind":"identify","user":{"key":"me","ip":"10.0.0.1"}}]`))
+		req.Header.Set(eventSchemaHeader, "3")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		waitForSinkQueue(handler.sinks[0], 1)
+		handler.close()
+		messages := sink.published()
+		if !assert.Len(t, messages, 1) {
+			return eventSinkMessage{}
+		}
+		return messages[0]
+	}
+
+	assert.JSONEq(t, `{"kind":"identify","user":{"key":"`+p.hashKey("me")+`"}}`, string(publish(true).data))
+	assert.JSONEq(t, `{"kind":"identify","user":{"key":"me","ip":"10.0.0.1"}}`, string(publish(false).data))
+}
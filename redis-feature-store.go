@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	r "github.com/garyburd/redigo/redis"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+	ldr "gopkg.in/launchdarkly/go-client.v4/redis"
+)
+
+// redisFeatureStore is the SDK's Redis store with a connection pool of its own, which is closed when the
+// environment is removed
+type redisFeatureStore struct {
+	*ldr.RedisFeatureStore
+	pool *r.Pool
+}
+
+// Creates a store with the same pool settings as the SDK's own: 16 concurrent connections, with requests for
+// more waiting for one to be free
+func newRedisFeatureStore(host string, port int, prefix string, timeout time.Duration, logger ld.Logger) redisFeatureStore {
+	url := fmt.Sprintf("redis://%s:%d", host, port)
+	pool := &r.Pool{
+		MaxIdle:     20,
+		MaxActive:   16,
+		Wait:        true,
+		IdleTimeout: 300 * time.Second,
+		Dial: func() (r.Conn, error) {
+			return r.DialURL(url)
+		},
+		TestOnBorrow: func(c r.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	return redisFeatureStore{RedisFeatureStore: ldr.NewRedisFeatureStoreWithPool(pool, prefix, timeout, logger), pool: pool}
+}
+
+func (store redisFeatureStore) Close() error {
+	return store.pool.Close()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	parentRelayCheckInterval = time.Minute
+	parentRelayTimeout       = 10 * time.Second
+)
+
+// Identifies this relay instance to relays that use it as their parent, so that they can tell if they have
+// been chained in a loop
+var relayId = newRelayId()
+
+// Tracks the parent relay, if one is configured; nil otherwise
+var parentRelay *parentRelayChecker
+
+func newRelayId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Checks that a parent relay URI is usable, returning it in the form the rest of the configuration expects
+func parseParentRelayUri(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q must be an absolute http or https URL", uri)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q must not have a query or fragment", uri)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// parentRelayChecker periodically asks the parent relay for its status, to confirm that it is a relay and to
+// learn which relays it in turn gets its data from. If this relay appears among them, the relays have been
+// chained in a loop and none of them will ever receive any data.
+type parentRelayChecker struct {
+	uri string
+	// Sent with each status request, so that a parent that doesn't expose /status still answers
+	sdkKey string
+	client *http.Client
+	mu     sync.RWMutex
+	chain  []string
+	err    error
+	loop   bool
+}
+
+// The parent relay's part of the status resource
+type parentRelayStatus struct {
+	Uri      string   `json:"uri,omitempty"`
+	RelayIds []string `json:"relayIds,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func newParentRelayChecker(uri string, sdkKey string, headers upstreamHeaders) *parentRelayChecker {
+	return &parentRelayChecker{
+		uri:    uri,
+		sdkKey: sdkKey,
+		client: headers.client(parentRelayTimeout),
+	}
+}
+
+// Returns the SDK key of the first environment by name, which the parent relay must also serve
+func parentRelaySdkKey(c Config) string {
+	names := make([]string, 0, len(c.Environment))
+	for name := range c.Environment {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return c.Environment[names[0]].SdkKey
+}
+
+func (p *parentRelayChecker) run() {
+	for {
+		p.check()
+		time.Sleep(parentRelayCheckInterval)
+	}
+}
+
+func (p *parentRelayChecker) check() {
+	chain, err := p.fetchChain()
+	loop := false
+	if err == nil {
+		for i, id := range chain {
+			if id == relayId {
+				// Stop the chain here, or it would grow on every check as the relays in the loop learn about
+				// each other
+				chain = chain[:i+1]
+				loop = true
+				err = errors.New("relay loop detected: the parent relay gets its data from this relay")
+				break
+			}
+		}
+	}
+
+	p.mu.Lock()
+	wasLoop := p.loop
+	previousErr := p.err
+	p.chain, p.err, p.loop = chain, err, loop
+	p.mu.Unlock()
+
+	if loop && !wasLoop {
+		Error.Printf("Parent relay %s gets its data from this relay (relay chain %v); no environment can receive flag data", p.uri, chain)
+		reportError(err, map[string]string{"parentRelay": p.uri})
+	} else if err != nil && (previousErr == nil || previousErr.Error() != err.Error()) {
+		Warning.Printf("Unable to check parent relay %s: %s", p.uri, err)
+	}
+}
+
+// Returns the IDs of the parent relay and of each relay above it, nearest first
+func (p *parentRelayChecker) fetchChain() ([]string, error) {
+	req, _ := http.NewRequest("GET", p.uri+"/status", nil)
+	req.Header.Set("User-Agent", "LDRelay/"+Version)
+	if p.sdkKey != "" {
+		req.Header.Set("Authorization", p.sdkKey)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s/status", resp.StatusCode, p.uri)
+	}
+
+	var status struct {
+		RelayId     string             `json:"relayId"`
+		ParentRelay *parentRelayStatus `json:"parentRelay"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || status.RelayId == "" {
+		return nil, fmt.Errorf("%s does not appear to be a relay", p.uri)
+	}
+	chain := []string{status.RelayId}
+	if status.ParentRelay != nil {
+		chain = append(chain, status.ParentRelay.RelayIds...)
+	}
+	return chain, nil
+}
+
+// Describes the parent relay for the status resource, and whether the relay has been chained in a loop
+func (p *parentRelayChecker) status() (parentRelayStatus, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	status := parentRelayStatus{Uri: p.uri, RelayIds: p.chain}
+	if p.err != nil {
+		status.Error = p.err.Error()
+	}
+	return status, !p.loop
+}
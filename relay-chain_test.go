@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParentRelayUriReplacesUpstreamUris(t *testing.T) {
+	configFile := writeTestConfig(t, `
+[main]
+	parentRelayUri = "https://relay.example.com:8030/"
+`)
+	defer os.Remove(configFile)
+
+	c, err := loadConfig(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://relay.example.com:8030", c.Main.ParentRelayUri)
+	assert.Equal(t, "https://relay.example.com:8030", c.Main.StreamUri)
+	assert.Equal(t, "https://relay.example.com:8030", c.Main.BaseUri)
+	assert.Equal(t, "https://relay.example.com:8030", c.Events.EventsUri)
+}
+
+func TestParentRelayUriIsValidated(t *testing.T) {
+	for _, config := range []string{
+		`[main]
+	parentRelayUri = "relay.example.com"`,
+		`[main]
+	parentRelayUri = "ftp://relay.example.com"`,
+		`[main]
+	parentRelayUri = "https://relay.example.com?x=1"`,
+		`[main]
+	parentRelayUri = "https://relay.example.com"
+	streamUri = "https://stream.example.com"`,
+		`[main]
+	parentRelayUri = "https://relay.example.com"
+[events]
+	eventsUri = "https://events.example.com"`,
+	} {
+		configFile := writeTestConfig(t, config)
+		_, err := loadConfig(configFile)
+		os.Remove(configFile)
+		assert.Error(t, err, config)
+	}
+}
+
+// Serves a status resource like that of a relay with the given ID, whose own parent relays are upstreamIds
+func startFakeParentRelay(id string, upstreamIds ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := map[string]interface{}{"status": "healthy", "relayId": id}
+		if len(upstreamIds) > 0 {
+			status["parentRelay"] = parentRelayStatus{Uri: "http://upstream", RelayIds: upstreamIds}
+		}
+		data, _ := json.Marshal(status)
+		w.Write(data)
+	}))
+}
+
+func getTestStatus(detailed bool) map[string]interface{} {
+	mux := ClientMux{envs: newEnvironmentRegistry()}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/status", nil)
+	mux.writeStatus(w, req, detailed)
+	var status map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	return status
+}
+
+func TestParentRelayChainIsReportedInStatus(t *testing.T) {
+	server := startFakeParentRelay("parent", "grandparent")
+	defer server.Close()
+	parentRelay = newParentRelayChecker(server.URL, "", upstreamHeaders{})
+	defer func() { parentRelay = nil }()
+
+	parentRelay.check()
+	status := getTestStatus(true)
+	assert.Equal(t, relayId, status["relayId"])
+	assert.Equal(t, "healthy", status["status"])
+	assert.Equal(t, map[string]interface{}{
+		"uri":      server.URL,
+		"relayIds": []interface{}{"parent", "grandparent"},
+	}, status["parentRelay"])
+
+	// The public status only has what a child relay needs
+	status = getTestStatus(false)
+	assert.Equal(t, relayId, status["relayId"])
+	assert.Equal(t, map[string]interface{}{
+		"relayIds": []interface{}{"parent", "grandparent"},
+	}, status["parentRelay"])
+}
+
+func TestRelayLoopIsDetected(t *testing.T) {
+	server := startFakeParentRelay("parent", relayId, "parent")
+	defer server.Close()
+	parentRelay = newParentRelayChecker(server.URL, "", upstreamHeaders{})
+	defer func() { parentRelay = nil }()
+
+	parentRelay.check()
+	status := getTestStatus(true)
+	assert.Equal(t, "degraded", status["status"])
+	parentStatus := status["parentRelay"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"parent", relayId}, parentStatus["relayIds"])
+	assert.Contains(t, parentStatus["error"], "relay loop detected")
+}
+
+func TestParentMustBeARelay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"message": "not a relay"}`))
+	}))
+	defer server.Close()
+	checker := newParentRelayChecker(server.URL, "", upstreamHeaders{})
+
+	checker.check()
+	status, ok := checker.status()
+	assert.True(t, ok)
+	assert.Contains(t, status.Error, "does not appear to be a relay")
+}
+
+func TestParentRelayChecksSendAnSdkKey(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		w.Write([]byte(`{"relayId": "parent"}`))
+	}))
+	defer server.Close()
+
+	config := Config{Environment: map[string]*EnvConfig{"prod": {SdkKey: "sdk-prod"}, "dev": {SdkKey: "sdk-dev"}}}
+	assert.Equal(t, "sdk-dev", parentRelaySdkKey(config))
+	assert.Equal(t, "", parentRelaySdkKey(Config{}))
+
+	checker := newParentRelayChecker(server.URL, "sdk-dev", upstreamHeaders{})
+	checker.check()
+	_, ok := checker.status()
+	assert.True(t, ok)
+	assert.Equal(t, "sdk-dev", authorization)
+}
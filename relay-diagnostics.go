@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+const (
+	defaultDiagnosticIntervalSecs = 900
+	// LaunchDarkly's SDKs send diagnostic events no more often than this, and neither does the relay
+	minDiagnosticIntervalSecs = 60
+)
+
+// Returns true if the relay should send diagnostic events of its own to LaunchDarkly
+func relayDiagnosticsEnabled(c Config) bool {
+	return c.Events.SendEvents && !c.Events.DisableDiagnostics && c.Events.DiagnosticIntervalSecs > 0
+}
+
+// diagnosticId identifies the relay and environment that a diagnostic event describes, as an SDK's does
+type diagnosticId struct {
+	DiagnosticId string `json:"diagnosticId"`
+	SdkKeySuffix string `json:"sdkKeySuffix"`
+}
+
+// diagnosticInitEvent is sent for each environment when the relay starts serving it, and describes the relay
+// and how it is configured
+type diagnosticInitEvent struct {
+	Kind          string             `json:"kind"`
+	Id            diagnosticId       `json:"id"`
+	CreationDate  int64              `json:"creationDate"`
+	Sdk           diagnosticSdk      `json:"sdk"`
+	Configuration diagnosticConfig   `json:"configuration"`
+	Platform      diagnosticPlatform `json:"platform"`
+}
+
+type diagnosticSdk struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type diagnosticPlatform struct {
+	Name      string `json:"name"`
+	GoVersion string `json:"goVersion"`
+	OsName    string `json:"osName"`
+	OsArch    string `json:"osArch"`
+}
+
+// diagnosticConfig summarizes the relay's configuration. It holds only settings and whether features are
+// in use, never keys, passwords, host names or URLs.
+type diagnosticConfig struct {
+	CustomBaseUri           bool   `json:"customBaseURI"`
+	CustomStreamUri         bool   `json:"customStreamURI"`
+	CustomEventsUri         bool   `json:"customEventsURI"`
+	UsingParentRelay        bool   `json:"usingParentRelay"`
+	FeatureStore            string `json:"featureStore"`
+	EnvironmentCount        int    `json:"environmentCount"`
+	HeartbeatIntervalSecs   int    `json:"heartbeatIntervalSecs"`
+	PingIntervalSecs        int    `json:"pingIntervalSecs"`
+	BackgroundInit          bool   `json:"backgroundInit"`
+	InitTimeoutSecs         int    `json:"initTimeoutSecs"`
+	CoalesceWindowMs        int    `json:"coalesceWindowMs"`
+	EventsCapacity          int    `json:"eventsCapacity"`
+	EventsFlushIntervalSecs int    `json:"eventsFlushIntervalSecs"`
+	SamplingInterval        int32  `json:"samplingInterval"`
+	InlineUsersInEvents     bool   `json:"inlineUsersInEvents"`
+	TLS                     bool   `json:"tls"`
+	LeaderElection          bool   `json:"leaderElection"`
+	Archive                 bool   `json:"archive"`
+	UsageTracking           bool   `json:"usageTracking"`
+	EvalCache               bool   `json:"evalCache"`
+	StoreFallback           bool   `json:"storeFallback"`
+}
+
+// diagnosticPeriodicEvent is sent for each environment at every interval, and describes what happened since
+// the last one
+type diagnosticPeriodicEvent struct {
+	Kind             string          `json:"kind"`
+	Id               diagnosticId    `json:"id"`
+	CreationDate     int64           `json:"creationDate"`
+	DataSinceDate    int64           `json:"dataSinceDate"`
+	UptimeSecs       float64         `json:"uptimeSecs"`
+	EnvironmentCount int             `json:"environmentCount"`
+	ConnectionStatus string          `json:"connectionStatus"`
+	Connections      connectionStats `json:"connections"`
+}
+
+func newDiagnosticConfig(c Config, environmentCount int) diagnosticConfig {
+	featureStore := "memory"
+	switch {
+	case c.Main.Store != "":
+		featureStore = "custom"
+	case redisConfigured(c):
+		featureStore = "redis"
+	case c.Postgres.Url != "":
+		featureStore = "postgres"
+	case len(c.Memcached.Server) > 0:
+		featureStore = "memcached"
+	}
+	return diagnosticConfig{
+		CustomBaseUri:           c.Main.BaseUri != defaultBaseUri,
+		CustomStreamUri:         c.Main.StreamUri != defaultStreamUri,
+		CustomEventsUri:         c.Events.EventsUri != defaultEventsUri,
+		UsingParentRelay:        c.Main.ParentRelayUri != "",
+		FeatureStore:            featureStore,
+		EnvironmentCount:        environmentCount,
+		HeartbeatIntervalSecs:   c.Main.HeartbeatIntervalSecs,
+		PingIntervalSecs:        c.Main.PingIntervalSecs,
+		BackgroundInit:          c.Main.BackgroundInit,
+		InitTimeoutSecs:         c.Main.InitTimeoutSecs,
+		CoalesceWindowMs:        c.Main.CoalesceWindowMs,
+		EventsCapacity:          c.Events.Capacity,
+		EventsFlushIntervalSecs: c.Events.FlushIntervalSecs,
+		SamplingInterval:        c.Events.SamplingInterval,
+		InlineUsersInEvents:     c.Events.InlineUsers,
+		TLS:                     tlsEnabled(c),
+		LeaderElection:          leaderElectionEnabled(c),
+		Archive:                 c.Archive.Url != "",
+		UsageTracking:           c.Usage.Enabled,
+		EvalCache:               c.Main.EvalCacheTtlMs > 0,
+		StoreFallback:           persistentStoreConfigured(c) && c.Main.StoreFallbackSecs > 0,
+	}
+}
+
+// relayDiagnostics sends the relay's own diagnostic events to LaunchDarkly, for each environment whose
+// events are sent there, so that LaunchDarkly can see how the relay is doing when helping with a problem.
+// Each environment's events are sent with its SDK key, as an SDK's would be.
+type relayDiagnostics struct {
+	relay  *relay
+	client *http.Client
+	// When each environment's last event was sent, by name; an environment that isn't here hasn't been
+	// sent its init event yet
+	lastSent map[string]time.Time
+}
+
+func newRelayDiagnostics(r *relay) *relayDiagnostics {
+	return &relayDiagnostics{relay: r, client: diagnosticEventClient, lastSent: make(map[string]time.Time)}
+}
+
+// Sends diagnostic events straight away and then at each interval
+func (d *relayDiagnostics) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.send()
+		<-ticker.C
+	}
+}
+
+// Sends an init event for each environment that hasn't had one, including environments added since the
+// relay started, and a periodic event for each of the others
+func (d *relayDiagnostics) send() {
+	envs := d.relay.allEnvironments()
+	present := make(map[string]bool, len(envs))
+	for _, clientCtx := range envs {
+		present[clientCtx.name] = true
+		if handler, ok := clientCtx.getHandlers().eventsHandler.(*eventRelayHandler); !ok || handler.sinksOnly {
+			continue
+		}
+		now := time.Now()
+		id := diagnosticId{DiagnosticId: relayId, SdkKeySuffix: diagnosticKeySuffix(clientCtx.sdkKey)}
+		var event interface{}
+		if since, ok := d.lastSent[clientCtx.name]; ok {
+			event = diagnosticPeriodicEvent{
+				Kind:             "diagnostic",
+				Id:               id,
+				CreationDate:     toUnixMillis(now),
+				DataSinceDate:    toUnixMillis(since),
+				UptimeSecs:       time.Since(startTime).Seconds(),
+				EnvironmentCount: len(envs),
+				ConnectionStatus: clientCtx.connectionStatus(),
+				Connections:      clientCtx.getMetrics().getConnectionStats(),
+			}
+		} else {
+			event = diagnosticInitEvent{
+				Kind:          "diagnostic-init",
+				Id:            id,
+				CreationDate:  toUnixMillis(now),
+				Sdk:           diagnosticSdk{Name: "ld-relay", Version: Version},
+				Configuration: newDiagnosticConfig(d.relay.config, len(envs)),
+				Platform:      diagnosticPlatform{Name: "Go", GoVersion: runtime.Version(), OsName: runtime.GOOS, OsArch: runtime.GOARCH},
+			}
+		}
+		if err := d.post(clientCtx, event); err != nil {
+			Warning.Printf("Unable to send diagnostics for environment %s: %s", clientCtx.name, err)
+			continue
+		}
+		d.lastSent[clientCtx.name] = now
+	}
+	for name := range d.lastSent {
+		if !present[name] {
+			delete(d.lastSent, name)
+		}
+	}
+}
+
+func (d *relayDiagnostics) post(clientCtx *clientContextImpl, event interface{}) error {
+	body, _ := json.Marshal(event)
+	uri := d.uri()
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", clientCtx.sdkKey)
+	req.Header.Set("User-Agent", "LDRelay/"+Version)
+	clientCtx.upstreamHeaders.apply(req)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return checkStatusCode(resp.StatusCode, uri)
+}
+
+// Returns where the relay's diagnostic events are sent, which is where server-side SDKs send theirs
+func (d *relayDiagnostics) uri() string {
+	return diagnosticEventsUri(d.relay.config.Events.EventsUri, "/diagnostic")
+}
+
+// Returns the end of an SDK key, which is how LaunchDarkly's SDKs identify the key in diagnostic events
+func diagnosticKeySuffix(sdkKey string) string {
+	if len(sdkKey) > 6 {
+		return sdkKey[len(sdkKey)-6:]
+	}
+	return sdkKey
+}
+
+func toUnixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayDiagnosticsAreSentForEachEnvironment(t *testing.T) {
+	server, received := startFakeEventsServer()
+	defer server.Close()
+
+	sdkKey := "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+	config := Config{Environment: map[string]*EnvConfig{
+		"env1": {SdkKey: sdkKey},
+		// Events for this environment only go to its sinks, so LaunchDarkly doesn't hear from it
+		"env2": {SdkKey: "sdk-other", EventSinksOnly: true},
+	}}
+	config.Events.SendEvents = true
+	// Shaped like the default eventsUri, under which LaunchDarkly doesn't accept diagnostic events
+	config.Events.EventsUri = server.URL + "/api/events"
+	relay := makeTestRelay(config)
+	defer relay.findEnvironment("env1").close()
+	defer relay.findEnvironment("env2").close()
+	for deadline := time.Now().Add(time.Second); !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	diagnostics := newRelayDiagnostics(relay)
+	diagnostics.send()
+	posts := received()
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, "/diagnostic", posts[0].path)
+		assert.Equal(t, sdkKey, posts[0].headers.Get("Authorization"))
+		assert.NotContains(t, posts[0].body, sdkKey)
+		var event diagnosticInitEvent
+		json.Unmarshal([]byte(posts[0].body), &event)
+		assert.Equal(t, "diagnostic-init", event.Kind)
+		assert.Equal(t, diagnosticId{DiagnosticId: relayId, SdkKeySuffix: "7e42d0"}, event.Id)
+		assert.Equal(t, Version, event.Sdk.Version)
+		assert.Equal(t, "memory", event.Configuration.FeatureStore)
+		assert.Equal(t, 2, event.Configuration.EnvironmentCount)
+	}
+
+	diagnostics.send()
+	posts = received()
+	if assert.Len(t, posts, 1) {
+		var event diagnosticPeriodicEvent
+		json.Unmarshal([]byte(posts[0].body), &event)
+		assert.Equal(t, "diagnostic", event.Kind)
+		assert.Equal(t, "connected", event.ConnectionStatus)
+		assert.Equal(t, 2, event.EnvironmentCount)
+		assert.True(t, event.DataSinceDate <= event.CreationDate)
+	}
+}
+
+func TestRelayDiagnosticsGoToTheEventsHost(t *testing.T) {
+	var config Config
+	config.Events.EventsUri = defaultEventsUri
+	diagnostics := newRelayDiagnostics(&relay{config: config})
+	assert.Equal(t, "https://events.launchdarkly.com/diagnostic", diagnostics.uri())
+}
+
+func TestDiagnosticConfigLeavesOutSecrets(t *testing.T) {
+	var config Config
+	config.Main.BaseUri = defaultBaseUri
+	config.Main.StreamUri = "https://relay.internal:8030"
+	config.Events.EventsUri = defaultEventsUri
+	config.Redis.Host, config.Redis.Port = "redis.internal", 6379
+	config.Admin.Password = "hunter2"
+	data, _ := json.Marshal(newDiagnosticConfig(config, 3))
+	assert.NotContains(t, string(data), "internal")
+	assert.NotContains(t, string(data), "hunter2")
+
+	var summary diagnosticConfig
+	json.Unmarshal(data, &summary)
+	assert.Equal(t, "redis", summary.FeatureStore)
+	assert.True(t, summary.CustomStreamUri)
+	assert.False(t, summary.CustomBaseUri)
+	assert.Equal(t, 3, summary.EnvironmentCount)
+}
+
+func TestRelayDiagnosticsCanBeDisabled(t *testing.T) {
+	var config Config
+	config.Events.SendEvents = true
+	config.Events.DiagnosticIntervalSecs = defaultDiagnosticIntervalSecs
+	assert.True(t, relayDiagnosticsEnabled(config))
+
+	config.Events.DisableDiagnostics = true
+	assert.False(t, relayDiagnosticsEnabled(config))
+
+	config.Events.DisableDiagnostics = false
+	config.Events.SendEvents = false
+	assert.False(t, relayDiagnosticsEnabled(config))
+}
+
+func TestDiagnosticIntervalIsValidated(t *testing.T) {
+	file := writeTestConfig(t, "[events]\ndiagnosticIntervalSecs = 10\n")
+	defer os.Remove(file)
+	_, err := loadConfig(file)
+	assert.EqualError(t, err, "diagnosticIntervalSecs must be at least 60")
+
+	file2 := writeTestConfig(t, "[events]\ndiagnosticIntervalSecs = 10\ndisableDiagnostics = true\n")
+	defer os.Remove(file2)
+	_, err = loadConfig(file2)
+	assert.NoError(t, err)
+}
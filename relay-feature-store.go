@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"net/http"
+	"sync"
 	"time"
 
 	es "github.com/launchdarkly/eventsource"
@@ -20,6 +22,9 @@ type SSERelayFeatureStore struct {
 	flagsPublisher ESPublisher
 	pingPublisher  ESPublisher
 	apiKey         string
+	changes        *flagChangeLog
+	closer         chan struct{}
+	closeOnce      sync.Once
 }
 
 type allRepository struct {
@@ -32,6 +37,11 @@ type pingRepository struct {
 	relayStore *SSERelayFeatureStore
 }
 
+// Clients that open a ping stream with a ping query parameter are served from their own channel, which also
+// receives the environment's periodic pings. A browser's EventSource hides SSE comments, so the JS SDK can't
+// see heartbeats, but it can see pings.
+const pingingChannelSuffix = "\x00ping"
+
 func NewSSERelayFeatureStore(apiKey string, allPublisher ESPublisher, flagsPublisher ESPublisher, pingPublisher ESPublisher, baseFeatureStore ld.FeatureStore, heartbeatInterval int) *SSERelayFeatureStore {
 	relayStore := &SSERelayFeatureStore{
 		store:          baseFeatureStore,
@@ -39,18 +49,26 @@ func NewSSERelayFeatureStore(apiKey string, allPublisher ESPublisher, flagsPubli
 		allPublisher:   allPublisher,
 		flagsPublisher: flagsPublisher,
 		pingPublisher:  pingPublisher,
+		changes:        newFlagChangeLog(),
+		closer:         make(chan struct{}),
 	}
 
 	allPublisher.Register(apiKey, allRepository{relayStore})
 	flagsPublisher.Register(apiKey, flagsRepository{relayStore})
 	pingPublisher.Register(apiKey, pingRepository{relayStore})
+	pingPublisher.Register(apiKey+pingingChannelSuffix, pingRepository{relayStore})
 
 	if heartbeatInterval > 0 {
 		go func() {
 			t := time.NewTicker(time.Duration(heartbeatInterval) * time.Second)
+			defer t.Stop()
 			for {
 				relayStore.heartbeat()
-				<-t.C
+				select {
+				case <-t.C:
+				case <-relayStore.closer:
+					return
+				}
 			}
 		}()
 	}
@@ -58,14 +76,104 @@ func NewSSERelayFeatureStore(apiKey string, allPublisher ESPublisher, flagsPubli
 	return relayStore
 }
 
+// Stops sending heartbeats and disconnects the environment's stream clients, once the environment has been
+// removed. The environment's channels are given an empty repository, so that the publishers no longer hold
+// on to its data, and any updates its coalescing publishers are holding back are dropped.
+func (relay *SSERelayFeatureStore) Close() {
+	relay.closeOnce.Do(func() {
+		close(relay.closer)
+		relay.allPublisher.Register(relay.apiKey, emptyRepository{})
+		relay.flagsPublisher.Register(relay.apiKey, emptyRepository{})
+		for _, channel := range relay.pingKeys() {
+			relay.pingPublisher.Register(channel, emptyRepository{})
+		}
+		for _, publisher := range []ESPublisher{relay.allPublisher, relay.flagsPublisher, relay.pingPublisher} {
+			if coalescing, ok := publisher.(*coalescingPublisher); ok {
+				coalescing.Close()
+			}
+		}
+	})
+}
+
+// Wraps one of the environment's stream handlers so that its clients are disconnected when the store is
+// closed, as well as when they go away themselves
+func (relay *SSERelayFeatureStore) disconnectOnClose(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var gone <-chan bool
+		if notifier, ok := w.(http.CloseNotifier); ok {
+			gone = notifier.CloseNotify()
+		}
+		closed := make(chan bool, 1)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-gone:
+			case <-relay.closer:
+			case <-done:
+				return
+			}
+			closed <- true
+		}()
+		handler.ServeHTTP(closingStreamWriter{ResponseWriter: w, closed: closed}, req)
+	})
+}
+
+// closingStreamWriter tells the stream handler that its client has gone when it should be disconnected
+type closingStreamWriter struct {
+	http.ResponseWriter
+	closed chan bool
+}
+
+func (w closingStreamWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w closingStreamWriter) CloseNotify() <-chan bool {
+	return w.closed
+}
+
+// emptyRepository has nothing to replay, and is registered for the channels of a removed environment
+type emptyRepository struct{}
+
+func (emptyRepository) Replay(channel, id string) chan es.Event {
+	out := make(chan es.Event)
+	close(out)
+	return out
+}
+
 func (relay *SSERelayFeatureStore) keys() []string {
 	return []string{relay.apiKey}
 }
 
+// The channels of the ping stream, for clients that did and didn't ask for periodic pings
+func (relay *SSERelayFeatureStore) pingKeys() []string {
+	return []string{relay.apiKey, relay.apiKey + pingingChannelSuffix}
+}
+
 func (relay *SSERelayFeatureStore) heartbeat() {
 	relay.allPublisher.PublishComment(relay.keys(), "")
 	relay.flagsPublisher.PublishComment(relay.keys(), "")
-	relay.pingPublisher.PublishComment(relay.keys(), "")
+	relay.pingPublisher.PublishComment(relay.pingKeys(), "")
+}
+
+// Sends a ping at the interval to ping stream clients that asked for periodic pings, until the store is
+// closed. Each ping makes the client fetch its flags again.
+func (relay *SSERelayFeatureStore) sendPings(interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				relay.pingPublisher.Publish([]string{relay.apiKey + pingingChannelSuffix}, makePingEvent())
+			case <-relay.closer:
+				return
+			}
+		}
+	}()
 }
 
 func (relay *SSERelayFeatureStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
@@ -83,26 +191,51 @@ func (relay *SSERelayFeatureStore) Init(allData map[ld.VersionedDataKind]map[str
 		return err
 	}
 
-	relay.allPublisher.Publish(relay.keys(), makePutEvent(allData[ld.Features], allData[ld.Segments]))
-	relay.flagsPublisher.Publish(relay.keys(), makeFlagsPutEvent(allData[ld.Features]))
-	relay.pingPublisher.Publish(relay.keys(), makePingEvent())
+	relay.changes.add(flagChange{Time: time.Now(), Kind: "all"})
+	relay.publishAll(overriddenData(relay.store, allData))
+	return nil
+}
 
+// Sends stream clients all the flags and segments again, for changes that their versions don't show, such as
+// a flag override being removed
+func (relay *SSERelayFeatureStore) republish() error {
+	flags, err := relay.store.All(ld.Features)
+	if err != nil {
+		return err
+	}
+	segments, err := relay.store.All(ld.Segments)
+	if err != nil {
+		return err
+	}
+	relay.publishAll(map[ld.VersionedDataKind]map[string]ld.VersionedData{ld.Features: flags, ld.Segments: segments})
 	return nil
 }
 
+func (relay *SSERelayFeatureStore) publishAll(allData map[ld.VersionedDataKind]map[string]ld.VersionedData) {
+	relay.allPublisher.Publish(relay.keys(), makePutEvent(allData[ld.Features], allData[ld.Segments]))
+	relay.flagsPublisher.Publish(relay.keys(), makeFlagsPutEvent(allData[ld.Features]))
+	relay.pingPublisher.Publish(relay.pingKeys(), makePingEvent())
+}
+
 func (relay *SSERelayFeatureStore) Delete(kind ld.VersionedDataKind, key string, version int) error {
 	err := relay.store.Delete(kind, key, version)
 	if err != nil {
 		return err
 	}
 
+	relay.publishDelete(kind, key, version)
+	return nil
+}
+
+// Tells stream clients that an item has been deleted
+func (relay *SSERelayFeatureStore) publishDelete(kind ld.VersionedDataKind, key string, version int) {
+	relay.changes.add(flagChange{Time: time.Now(), Kind: dataKindApiName[kind], Key: key, Version: version, Deleted: true})
+
 	relay.allPublisher.Publish(relay.keys(), makeDeleteEvent(kind, key, version))
 	if kind == ld.Features {
 		relay.flagsPublisher.Publish(relay.keys(), makeFlagsDeleteEvent(key, version))
 	}
-	relay.pingPublisher.Publish(relay.keys(), makePingEvent())
-
-	return nil
+	relay.pingPublisher.Publish(relay.pingKeys(), makePingEvent())
 }
 
 func (relay *SSERelayFeatureStore) Upsert(kind ld.VersionedDataKind, item ld.VersionedData) error {
@@ -119,16 +252,22 @@ func (relay *SSERelayFeatureStore) Upsert(kind ld.VersionedDataKind, item ld.Ver
 	}
 
 	if newItem != nil {
-		relay.allPublisher.Publish(relay.keys(), makeUpsertEvent(kind, newItem))
-		if kind == ld.Features {
-			relay.flagsPublisher.Publish(relay.keys(), makeFlagsUpsertEvent(newItem))
-		}
-		relay.pingPublisher.Publish(relay.keys(), makePingEvent())
+		relay.publishUpsert(kind, newItem)
 	}
 
 	return nil
 }
 
+// Tells stream clients about a new or updated item
+func (relay *SSERelayFeatureStore) publishUpsert(kind ld.VersionedDataKind, item ld.VersionedData) {
+	relay.changes.add(flagChange{Time: time.Now(), Kind: dataKindApiName[kind], Key: item.GetKey(), Version: item.GetVersion()})
+	relay.allPublisher.Publish(relay.keys(), makeUpsertEvent(kind, item))
+	if kind == ld.Features {
+		relay.flagsPublisher.Publish(relay.keys(), makeFlagsUpsertEvent(item))
+	}
+	relay.pingPublisher.Publish(relay.pingKeys(), makePingEvent())
+}
+
 func (relay *SSERelayFeatureStore) Initialized() bool {
 	return relay.store.Initialized()
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -129,3 +135,30 @@ func TestRelayFeatureStore(t *testing.T) {
 		assert.EqualValues(t, []es.Event(nil), pingPublisher.events)
 	})
 }
+
+func TestPeriodicPingsGoOnlyToClientsThatAskForThem(t *testing.T) {
+	pingPublisher := es.NewServer()
+	defer pingPublisher.Close()
+	store := NewSSERelayFeatureStore("api-key", &testPublisher{}, &testPublisher{}, pingPublisher, ld.NewInMemoryFeatureStore(nil), 0)
+	store.sendPings(50 * time.Millisecond)
+	defer store.Close()
+
+	countPings := func(channel string) int {
+		server := httptest.NewServer(replayOnConnect(pingPublisher.Handler(channel)))
+		defer server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return strings.Count(string(body), "event: ping")
+	}
+
+	// Both are sent a ping when they connect
+	assert.Equal(t, 1, countPings("api-key"))
+	assert.True(t, countPings("api-key"+pingingChannelSuffix) > 2)
+}
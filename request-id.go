@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// The header that carries a request's ID, in requests to the relay, its responses, and the requests it makes
+// to LaunchDarkly on a client's behalf
+const requestIdHeader = "X-Request-Id"
+
+// IDs given by clients are used if they are reasonably short and can't break up a log line
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:+=/-]{1,128}$`)
+
+type requestIdContextKey struct{}
+
+// Gives every request an ID, so that it can be followed from the client's logs through the relay's logs to
+// LaunchDarkly. A client may choose the ID by sending its own X-Request-Id header; otherwise one is
+// generated. The ID is returned in the X-Request-Id header and in error responses.
+func assignRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIdHeader)
+		if !validRequestId.MatchString(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, id)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIdContextKey{}, id)))
+	})
+}
+
+func newRequestId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Returns the ID of the request, if it has one
+func requestId(req *http.Request) string {
+	id, _ := req.Context().Value(requestIdContextKey{}).(string)
+	return id
+}
+
+// Returns a suffix that identifies the request in log messages about it
+func forRequest(req *http.Request) string {
+	if id := requestId(req); id != "" {
+		return " (request " + id + ")"
+	}
+	return ""
+}
+
+// Passes the request's ID on to a request the relay makes on its behalf
+func forwardRequestId(from *http.Request, to *http.Request) {
+	if id := requestId(from); id != "" {
+		to.Header.Set(requestIdHeader, id)
+	}
+}
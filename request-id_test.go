@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIds(t *testing.T) {
+	var seen string
+	handler := assignRequestId(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = requestId(req)
+	}))
+
+	specs := []struct {
+		name     string
+		incoming string
+		honored  bool
+	}{
+		{"generated when missing", "", false},
+		{"honored when valid", "a1b2-c3d4.e5:f6/g7+h8=", true},
+		{"replaced when it has spaces", "not an id", false},
+		{"replaced when too long", strings.Repeat("x", 129), false},
+	}
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if s.incoming != "" {
+				req.Header.Set(requestIdHeader, s.incoming)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.NotEmpty(t, seen)
+			assert.Equal(t, seen, w.Header().Get(requestIdHeader))
+			if s.honored {
+				assert.Equal(t, s.incoming, seen)
+			} else {
+				assert.NotEqual(t, s.incoming, seen)
+				assert.Len(t, seen, 16)
+			}
+		})
+	}
+}
+
+func TestRequestIdIsForwarded(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIdHeader, "abc")
+	assignRequestId(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, " (request abc)", forRequest(req))
+		upstream, _ := http.NewRequest("GET", "http://localhost", nil)
+		forwardRequestId(req, upstream)
+		assert.Equal(t, "abc", upstream.Header.Get(requestIdHeader))
+	})).ServeHTTP(httptest.NewRecorder(), req)
+
+	// Requests that didn't come through the middleware have no ID to pass on
+	req = httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, "", forRequest(req))
+	upstream, _ := http.NewRequest("GET", "http://localhost", nil)
+	forwardRequestId(req, upstream)
+	assert.Equal(t, "", upstream.Header.Get(requestIdHeader))
+}
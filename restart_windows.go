@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// Windows has no equivalent of exec, so restarting is left to the service manager
+func restartProcess() error {
+	return errors.New("restarting the relay is not supported on Windows; restart the service instead")
+}
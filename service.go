@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	// The name the relay is installed under as a Windows service, which is also the source of its Event Log entries
+	windowsServiceName        = "ld-relay"
+	windowsServiceDisplayName = "LaunchDarkly Relay"
+	windowsServiceDescription = "Relays feature flag updates and events between LaunchDarkly and SDKs"
+)
+
+// The actions accepted by --service
+var serviceActions = []string{"install", "uninstall", "start", "stop"}
+
+// Returns where a service finds its configuration file. A service starts in the system directory rather than
+// the one it was installed from, so relative paths are taken to be relative to the relay's executable.
+func serviceConfigPath(configFile string, exe string) string {
+	if filepath.IsAbs(configFile) {
+		return configFile
+	}
+	return filepath.Join(filepath.Dir(exe), configFile)
+}
+
+// Returns the command line the service manager starts the relay with
+func serviceCommandLine(exe string, configFile string) string {
+	return fmt.Sprintf(`"%s" --config "%s"`, exe, configFile)
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "strings"
+
+// Services are only managed by the relay on Windows; elsewhere, use the init system's own tools
+func runServiceCommand(action string, configFile string) int {
+	Error.Printf("--service %s is only supported on Windows (actions are %s)", action, strings.Join(serviceActions, ", "))
+	return 2
+}
+
+func resolveConfigPath(configFile string) string {
+	return configFile
+}
+
+func logErrorsToEventLog() {}
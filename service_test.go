@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceConfigPathIsRelativeToExecutable(t *testing.T) {
+	assert.Equal(t, "/opt/ld-relay/ld-relay.conf", serviceConfigPath("ld-relay.conf", "/opt/ld-relay/ld-relay"))
+	assert.Equal(t, "/opt/ld-relay/conf/relay.conf", serviceConfigPath("conf/relay.conf", "/opt/ld-relay/ld-relay"))
+	assert.Equal(t, "/etc/ld-relay.conf", serviceConfigPath("/etc/ld-relay.conf", "/opt/ld-relay/ld-relay"))
+}
+
+func TestServiceCommandLineQuotesPaths(t *testing.T) {
+	assert.Equal(t, `"C:\Program Files\ld-relay.exe" --config "C:\Program Files\ld-relay.conf"`,
+		serviceCommandLine(`C:\Program Files\ld-relay.exe`, `C:\Program Files\ld-relay.conf`))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+)
+
+const (
+	// How long to wait for the service to stop before giving up
+	serviceStopTimeout = 30 * time.Second
+	// The standard right to delete an object, which the windows package doesn't define
+	accessDelete = 0x10000
+)
+
+// The Event Log source is registered under this key, using EventCreate's messages so that entries are shown
+// as they were written
+const eventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\` + windowsServiceName
+
+var (
+	advapi32           = windows.NewLazySystemDLL("advapi32.dll")
+	procRegCreateKeyEx = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueEx  = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKey   = advapi32.NewProc("RegDeleteKeyW")
+)
+
+// Installs, uninstalls, starts or stops the relay's Windows service, and returns the process exit code
+func runServiceCommand(action string, configFile string) int {
+	var err error
+	switch action {
+	case "install":
+		err = installService(configFile)
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = withService(windows.SERVICE_START, func(s windows.Handle) error {
+			return windows.StartService(s, 0, nil)
+		})
+	case "stop":
+		err = withService(windows.SERVICE_STOP|windows.SERVICE_QUERY_STATUS, stopService)
+	default:
+		Error.Printf("Unknown service action %q; expected one of %s", action, strings.Join(serviceActions, ", "))
+		return 2
+	}
+	if err != nil {
+		Error.Printf("Unable to %s the %s service: %s", action, windowsServiceName, err)
+		return 1
+	}
+	Info.Printf("The %s service was %s", windowsServiceName, map[string]string{
+		"install": "installed", "uninstall": "uninstalled", "start": "started", "stop": "stopped"}[action])
+	return 0
+}
+
+func installService(configFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if configFile, err = filepath.Abs(configFile); err != nil {
+		return err
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		return fmt.Errorf("configuration file %s can't be read: %s", configFile, err)
+	}
+	manager, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_ALL_ACCESS)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseServiceHandle(manager)
+	s, err := windows.CreateService(manager, utf16(windowsServiceName), utf16(windowsServiceDisplayName),
+		windows.SERVICE_ALL_ACCESS, windows.SERVICE_WIN32_OWN_PROCESS, windows.SERVICE_AUTO_START,
+		windows.SERVICE_ERROR_NORMAL, utf16(serviceCommandLine(exe, configFile)), nil, nil, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseServiceHandle(s)
+	description := windows.SERVICE_DESCRIPTION{Description: utf16(windowsServiceDescription)}
+	windows.ChangeServiceConfig2(s, windows.SERVICE_CONFIG_DESCRIPTION, (*byte)(unsafe.Pointer(&description)))
+	if err := installEventSource(); err != nil {
+		windows.DeleteService(s)
+		return fmt.Errorf("unable to register with the Event Log: %s", err)
+	}
+	return nil
+}
+
+func uninstallService() error {
+	if err := withService(accessDelete, windows.DeleteService); err != nil {
+		return err
+	}
+	key := utf16(eventLogKey)
+	procRegDeleteKey.Call(uintptr(windows.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(key)))
+	return nil
+}
+
+// Asks the service to stop and waits until it has
+func stopService(s windows.Handle) error {
+	var status windows.SERVICE_STATUS
+	if err := windows.ControlService(s, windows.SERVICE_CONTROL_STOP, &status); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.CurrentState != windows.SERVICE_STOPPED {
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for the service to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if err := windows.QueryServiceStatus(s, &status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Opens the relay's service with the given access and passes it to fn
+func withService(access uint32, fn func(windows.Handle) error) error {
+	manager, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseServiceHandle(manager)
+	s, err := windows.OpenService(manager, utf16(windowsServiceName), access)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseServiceHandle(s)
+	return fn(s)
+}
+
+func installEventSource() error {
+	var key windows.Handle
+	if ret, _, _ := procRegCreateKeyEx.Call(uintptr(windows.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(utf16(eventLogKey))),
+		0, 0, 0, windows.KEY_WRITE, 0, uintptr(unsafe.Pointer(&key)), 0); ret != 0 {
+		return syscall.Errno(ret)
+	}
+	defer windows.RegCloseKey(key)
+	messageFile, _ := windows.UTF16FromString(`%SystemRoot%\System32\EventCreate.exe`)
+	if err := setRegistryValue(key, "EventMessageFile", windows.REG_EXPAND_SZ,
+		(*byte)(unsafe.Pointer(&messageFile[0])), len(messageFile)*2); err != nil {
+		return err
+	}
+	types := uint32(windows.EVENTLOG_ERROR_TYPE | windows.EVENTLOG_WARNING_TYPE | windows.EVENTLOG_INFORMATION_TYPE)
+	return setRegistryValue(key, "TypesSupported", windows.REG_DWORD, (*byte)(unsafe.Pointer(&types)), 4)
+}
+
+func setRegistryValue(key windows.Handle, name string, valueType uint32, data *byte, size int) error {
+	if ret, _, _ := procRegSetValueEx.Call(uintptr(key), uintptr(unsafe.Pointer(utf16(name))), 0, uintptr(valueType),
+		uintptr(unsafe.Pointer(data)), uintptr(size)); ret != 0 {
+		return syscall.Errno(ret)
+	}
+	return nil
+}
+
+func utf16(s string) *uint16 {
+	p, _ := windows.UTF16PtrFromString(s)
+	return p
+}
+
+// Returns true if the relay was started by the service manager
+func runningAsService() bool {
+	interactive, err := svc.IsAnInteractiveSession()
+	return err == nil && !interactive
+}
+
+// Relative configuration paths are resolved against the relay's executable when it runs as a service
+func resolveConfigPath(configFile string) string {
+	if !runningAsService() {
+		return configFile
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return configFile
+	}
+	return serviceConfigPath(configFile, exe)
+}
+
+// A service's output goes nowhere, so when running as one, errors are also written to the Windows Event Log
+func logErrorsToEventLog() {
+	if !runningAsService() {
+		return
+	}
+	handle, err := windows.RegisterEventSource(nil, utf16(windowsServiceName))
+	if err != nil {
+		Error.Printf("Unable to write to the Event Log: %s", err)
+		return
+	}
+	Error.SetOutput(io.MultiWriter(os.Stderr, eventLogWriter{handle: handle, eventType: windows.EVENTLOG_ERROR_TYPE}))
+}
+
+// eventLogWriter writes each log line as an Event Log entry
+type eventLogWriter struct {
+	handle    windows.Handle
+	eventType uint16
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	message := utf16(strings.TrimRight(string(p), "\r\n"))
+	// EventCreate's message 1 is just the string it is given
+	if err := windows.ReportEvent(w.handle, w.eventType, 0, 1, 0, 1, 0, &message, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// Snapshots larger than this are refused by the import endpoint, rather than being read into memory
+const maxSnapshotBodyBytes = 32 << 20
+
+// storeSnapshot is an archive of an environment's flags and segments. The "flags" and "segments" properties
+// have the same form as in a flag data file, so a snapshot can also be used as one.
+type storeSnapshot struct {
+	Environment  string                     `json:"environment,omitempty"`
+	ExportedAt   *time.Time                 `json:"exportedAt,omitempty"`
+	RelayVersion string                     `json:"relayVersion,omitempty"`
+	Flags        map[string]*ld.FeatureFlag `json:"flags"`
+	Segments     map[string]*ld.Segment     `json:"segments"`
+}
+
+// Takes a snapshot of everything in a feature store
+func exportSnapshot(store ld.FeatureStore, envName string) (*storeSnapshot, error) {
+	now := time.Now().UTC()
+	snapshot := &storeSnapshot{
+		Environment:  envName,
+		ExportedAt:   &now,
+		RelayVersion: Version,
+		Flags:        make(map[string]*ld.FeatureFlag),
+		Segments:     make(map[string]*ld.Segment),
+	}
+	flags, err := store.All(ld.Features)
+	if err != nil {
+		return nil, err
+	}
+	for key, item := range flags {
+		if flag, ok := item.(*ld.FeatureFlag); ok {
+			snapshot.Flags[key] = flag
+		}
+	}
+	segments, err := store.All(ld.Segments)
+	if err != nil {
+		return nil, err
+	}
+	for key, item := range segments {
+		if segment, ok := item.(*ld.Segment); ok {
+			snapshot.Segments[key] = segment
+		}
+	}
+	return snapshot, nil
+}
+
+// Reads a snapshot, checking that each item is stored under its own key
+func readSnapshot(r io.Reader) (*storeSnapshot, error) {
+	var snapshot storeSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("snapshot is not valid JSON: %s", err)
+	}
+	for key, flag := range snapshot.Flags {
+		if flag == nil {
+			return nil, fmt.Errorf("flag %q is null", key)
+		}
+		if flag.Key == "" {
+			flag.Key = key
+		} else if flag.Key != key {
+			return nil, fmt.Errorf("flag %q is stored under the key %q", flag.Key, key)
+		}
+	}
+	for key, segment := range snapshot.Segments {
+		if segment == nil {
+			return nil, fmt.Errorf("segment %q is null", key)
+		}
+		if segment.Key == "" {
+			segment.Key = key
+		} else if segment.Key != key {
+			return nil, fmt.Errorf("segment %q is stored under the key %q", segment.Key, key)
+		}
+	}
+	return &snapshot, nil
+}
+
+// Returns the snapshot's contents in the form taken by FeatureStore.Init
+func (s *storeSnapshot) allData() map[ld.VersionedDataKind]map[string]ld.VersionedData {
+	flags := make(map[string]ld.VersionedData)
+	for key, flag := range s.Flags {
+		flags[key] = flag
+	}
+	segments := make(map[string]ld.VersionedData)
+	for key, segment := range s.Segments {
+		segments[key] = segment
+	}
+	return map[ld.VersionedDataKind]map[string]ld.VersionedData{ld.Features: flags, ld.Segments: segments}
+}
+
+// Returns the named environment's feature store contents as a downloadable snapshot
+func (r *relay) exportEnvironment(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	clientCtx := r.findEnvironment(name)
+	if clientCtx == nil {
+		writeErrorf(w, req, http.StatusNotFound, "No environment named %q", name)
+		return
+	}
+	store := clientCtx.getStore()
+	if overriding, ok := store.(overridingFeatureStore); ok {
+		// Overrides are temporary and don't belong in a snapshot
+		store = overriding.FeatureStore
+	}
+	snapshot, err := exportSnapshot(store, name)
+	if err != nil {
+		writeErrorf(w, req, errorStatus(err), "Unable to read the feature store: %s", err)
+		return
+	}
+	data, _ := json.MarshalIndent(snapshot, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+	w.Write(data)
+}
+
+// Replaces the named environment's flags and segments with those in the snapshot in the request body.
+// Streaming clients receive the new data straight away. If the environment is connected to LaunchDarkly, the
+// data will be replaced again the next time LaunchDarkly sends a full update. Like every admin change, an
+// import from another site is refused by adminAuthMiddleware before it gets here.
+func (r *relay) importEnvironment(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	clientCtx := r.findEnvironment(name)
+	if clientCtx == nil {
+		writeErrorf(w, req, http.StatusNotFound, "No environment named %q", name)
+		return
+	}
+	snapshot, err := readSnapshot(http.MaxBytesReader(w, req.Body, maxSnapshotBodyBytes))
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var store ld.FeatureStore = clientCtx.getStore()
+	if clientCtx.relayStore != nil {
+		// Go through the relay store so that streaming clients are told about the new data
+		store = clientCtx.relayStore
+	}
+	if err := store.Init(snapshot.allData()); err != nil {
+		writeErrorf(w, req, http.StatusInternalServerError, "Unable to write the feature store: %s", err)
+		return
+	}
+	Info.Printf("Imported %d flags and %d segments into environment %s", len(snapshot.Flags), len(snapshot.Segments), name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeExport writes an environment's data in the persistent store to a snapshot file, or to standard output
+func storeExport(c Config, args []string) int {
+	flags := flag.NewFlagSet("store export", flag.ContinueOnError)
+	output := flags.String("o", "", "file to write the snapshot to, instead of standard output")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: store export [-o file] <environment>")
+		return 2
+	}
+	envName := flags.Arg(0)
+	store, ok := persistentStoreForCommand(c, envName)
+	if !ok {
+		return 1
+	}
+
+	snapshot, err := exportSnapshot(store, envName)
+	if err != nil {
+		Error.Printf("Unable to read the feature store: %s", err)
+		return 1
+	}
+	data, _ := json.MarshalIndent(snapshot, "", "  ")
+	data = append(data, '\n')
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := ioutil.WriteFile(*output, data, 0644); err != nil {
+		Error.Printf("Unable to write %s: %s", *output, err)
+		return 1
+	}
+	Info.Printf("Exported %d flags and %d segments to %s", len(snapshot.Flags), len(snapshot.Segments), *output)
+	return 0
+}
+
+// storeImport replaces an environment's data in the persistent store with the contents of a snapshot file
+func storeImport(c Config, args []string) int {
+	flags := flag.NewFlagSet("store import", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: store import <environment> <file>")
+		return 2
+	}
+	envName, fileName := flags.Arg(0), flags.Arg(1)
+	f, err := os.Open(fileName)
+	if err != nil {
+		Error.Printf("Unable to open %s: %s", fileName, err)
+		return 1
+	}
+	defer f.Close()
+	snapshot, err := readSnapshot(f)
+	if err != nil {
+		Error.Printf("Unable to read %s: %s", fileName, err)
+		return 1
+	}
+	store, ok := persistentStoreForCommand(c, envName)
+	if !ok {
+		return 1
+	}
+
+	if err := store.Init(snapshot.allData()); err != nil {
+		Error.Printf("Unable to write the feature store: %s", err)
+		return 1
+	}
+	Info.Printf("Imported %d flags and %d segments into environment %s", len(snapshot.Flags), len(snapshot.Segments), envName)
+	return 0
+}
+
+func persistentStoreForCommand(c Config, envName string) (ld.FeatureStore, bool) {
+	if !persistentStoreConfigured(c) {
+		Error.Println("No persistent feature store is configured")
+		return nil, false
+	}
+	envConfig := c.Environment[envName]
+	if envConfig == nil {
+		Error.Printf("No environment named %q", envName)
+		return nil, false
+	}
+	store, err := newBaseFeatureStore(c, *envConfig)
+	if err != nil {
+		Error.Printf("Unable to open the feature store: %s", err)
+		return nil, false
+	}
+	return store, true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+var snapshotTestStore = ld.NewInMemoryFeatureStore(nullLogger)
+
+func init() {
+	RegisterFeatureStore("snapshot-test-store", func(options map[string]string, prefix string, logger ld.Logger) (ld.FeatureStore, error) {
+		return snapshotTestStore, nil
+	})
+}
+
+const testSnapshot = `{
+	"flags": {"flag1": {"key": "flag1", "version": 2, "on": true, "variations": [true, false]}, "flag2": {"version": 1}},
+	"segments": {"segment1": {"key": "segment1", "version": 3, "included": ["user1"]}}
+}`
+
+func makeSnapshotRequest(handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, "http://localhost"+path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("admin", "secret")
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestEnvironmentCanBeImportedAndExported(t *testing.T) {
+	handler := makeAdminTestRelay(false).getHandler()
+
+	w := makeSnapshotRequest(handler, "POST", "/internal/import/env1", testSnapshot)
+	assert.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	w = makeSnapshotRequest(handler, "GET", "/internal/export/env1", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, `attachment; filename="env1.json"`, w.Header().Get("Content-Disposition"))
+
+	var snapshot storeSnapshot
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshot)) {
+		assert.Equal(t, "env1", snapshot.Environment)
+		assert.Equal(t, Version, snapshot.RelayVersion)
+		assert.NotNil(t, snapshot.ExportedAt)
+		if assert.Len(t, snapshot.Flags, 2) {
+			assert.True(t, snapshot.Flags["flag1"].On)
+			assert.Equal(t, 2, snapshot.Flags["flag1"].Version)
+			assert.Equal(t, "flag2", snapshot.Flags["flag2"].Key)
+		}
+		if assert.Len(t, snapshot.Segments, 1) {
+			assert.Equal(t, []string{"user1"}, snapshot.Segments["segment1"].Included)
+		}
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	handler := makeAdminTestRelay(false).getHandler()
+
+	specs := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{"export unknown environment", "GET", "/internal/export/env2", "", http.StatusNotFound},
+		{"import unknown environment", "POST", "/internal/import/env2", testSnapshot, http.StatusNotFound},
+		{"import invalid JSON", "POST", "/internal/import/env1", "{", http.StatusBadRequest},
+		{"import mismatched key", "POST", "/internal/import/env1", `{"flags": {"flag1": {"key": "flag2"}}}`, http.StatusBadRequest},
+		{"import null flag", "POST", "/internal/import/env1", `{"flags": {"flag1": null}}`, http.StatusBadRequest},
+		{"import too large", "POST", "/internal/import/env1", `{"flags": {}` + strings.Repeat(" ", maxSnapshotBodyBytes) + `}`, http.StatusBadRequest},
+	}
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			w := makeSnapshotRequest(handler, s.method, s.path, s.body)
+			assert.Equal(t, s.expectedStatus, w.Result().StatusCode)
+		})
+	}
+}
+
+func TestStoreImportAndExportCommands(t *testing.T) {
+	var c Config
+	c.Main.Store = "snapshot-test-store"
+	c.Environment = map[string]*EnvConfig{"env1": {SdkKey: "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"}}
+
+	input, _ := ioutil.TempFile("", "ld-relay-snapshot")
+	input.WriteString(testSnapshot)
+	input.Close()
+	defer os.Remove(input.Name())
+	output := input.Name() + ".out"
+	defer os.Remove(output)
+
+	assert.Equal(t, 0, runCommand(c, []string{"store", "import", "env1", input.Name()}))
+	flag, _ := snapshotTestStore.Get(ld.Features, "flag1")
+	assert.NotNil(t, flag)
+
+	assert.Equal(t, 0, runCommand(c, []string{"store", "export", "-o", output, "env1"}))
+	data, _ := ioutil.ReadFile(output)
+	snapshot, err := readSnapshot(bytes.NewReader(data))
+	if assert.NoError(t, err) {
+		assert.Len(t, snapshot.Flags, 2)
+		assert.Len(t, snapshot.Segments, 1)
+	}
+
+	assert.Equal(t, 1, runCommand(c, []string{"store", "export", "env2"}))
+	assert.Equal(t, 2, runCommand(c, []string{"store", "import", "env1"}))
+	assert.Equal(t, 1, runCommand(Config{Environment: c.Environment}, []string{"store", "export", "env1"}))
+}
+
+func TestImportRejectsCrossSiteRequests(t *testing.T) {
+	handler := makeAdminTestRelay(false).getHandler()
+
+	specs := []struct {
+		header         map[string]string
+		expectedStatus int
+	}{
+		{map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{map[string]string{"Content-Type": "application/json", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+	}
+	for _, s := range specs {
+		req, _ := http.NewRequest("POST", "http://localhost/internal/import/env1", strings.NewReader(testSnapshot))
+		for name, value := range s.header {
+			req.Header.Set(name, value)
+		}
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, s.expectedStatus, w.Code)
+	}
+
+	w := makeSnapshotRequest(handler, "GET", "/internal/export/env1", "")
+	assert.NotContains(t, w.Body.String(), "flag1")
+}
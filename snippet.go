@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"text/template"
+
+	"github.com/gorilla/mux"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// The bootstrap snippet records the flags for the page's user, and starts the JavaScript SDK with them if it
+// has already been loaded, so that the page can be rendered with the right variations straight away instead
+// of showing the defaults until the SDK has fetched its flags. The values are JSON, which the template
+// inserts unchanged; json.Marshal escapes '<', '>' and '&', so the snippet can be inlined in a <script>
+// element.
+var snippetTemplate = template.Must(template.New("snippet").Parse(`(function() {
+  var envId = {{.EnvId}};
+  var user = {{.User}};
+  var flags = {{.Flags}};
+  window.ldBootstrap = window.ldBootstrap || {};
+  window.ldBootstrap[envId] = { user: user, flags: flags };
+  if (window.LDClient && typeof window.LDClient.initialize === "function" && !window.ldclient) {
+    window.ldclient = window.LDClient.initialize(envId, user, { bootstrap: flags });
+  }
+})();
+`))
+
+// snippetFlagState is the metadata the JavaScript SDK expects for each flag in bootstrap data, so that it
+// can send analytics events for flags evaluated before it has connected
+type snippetFlagState struct {
+	Variation            *int    `json:"variation,omitempty"`
+	Version              int     `json:"version"`
+	TrackEvents          bool    `json:"trackEvents"`
+	DebugEventsUntilDate *uint64 `json:"debugEventsUntilDate,omitempty"`
+}
+
+// Returns the bootstrap snippet for the user given in the user query parameter or header
+func getSnippet(w http.ResponseWriter, req *http.Request) {
+	user, err := userFromGetRequest(req)
+	if err == nil && user.Key == nil {
+		err = errors.New("User must have a 'key' attribute")
+	}
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	recordEvaluationUser(req, user)
+
+	clientCtx := getClientContext(req)
+	store := clientCtx.getStore()
+	if !clientCtx.getClient().Initialized() && !store.Initialized() {
+		writeError(w, req, http.StatusServiceUnavailable, "Service not initialized")
+		return
+	}
+	items, err := store.All(ld.Features)
+	if err == nil {
+		var segments map[string]ld.VersionedData
+		if segments, err = store.All(ld.Segments); err == nil {
+			etag := evalETag(user, false, items, segments)
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", evalCacheControl)
+			if etagMatches(req, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	if err != nil {
+		writeErrorf(w, req, errorStatus(err), "Error fetching flags from feature store: %s", err)
+		return
+	}
+
+	flags := make(map[string]interface{}, len(items)+2)
+	states := make(map[string]snippetFlagState, len(items))
+	for _, item := range items {
+		if flag, ok := item.(*ld.FeatureFlag); ok {
+			value, variation, _ := flag.Evaluate(*user, store)
+			flags[flag.Key] = value
+			states[flag.Key] = snippetFlagState{
+				Variation:            variation,
+				Version:              flag.Version,
+				TrackEvents:          flag.TrackEvents,
+				DebugEventsUntilDate: flag.DebugEventsUntilDate,
+			}
+		}
+	}
+	flags["$flagsState"] = states
+	flags["$valid"] = true
+
+	envIdJson, _ := json.Marshal(mux.Vars(req)["envId"])
+	userJson, _ := json.Marshal(user)
+	flagsJson, _ := json.Marshal(flags)
+	var snippet bytes.Buffer
+	snippetTemplate.Execute(&snippet, struct{ EnvId, User, Flags string }{string(envIdJson), string(userJson), string(flagsJson)})
+
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Write(snippet.Bytes())
+}
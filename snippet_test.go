@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+var snippetFlagsPattern = regexp.MustCompile(`(?m)^  var flags = (.*);$`)
+
+func TestSnippetEmbedsFlagsForUser(t *testing.T) {
+	req := buildRequest("GET", map[string]string{"envId": "env-id"}, nil, "", makeTestContextWithData())
+	req.URL.RawQuery = "user=" + user()
+	w := httptest.NewRecorder()
+	getSnippet(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, `var envId = "env-id";`)
+	assert.Contains(t, body, `var user = {"key":"test"};`)
+	assert.Contains(t, body, `window.LDClient.initialize(envId, user, { bootstrap: flags })`)
+
+	match := snippetFlagsPattern.FindStringSubmatch(body)
+	if assert.NotNil(t, match) {
+		var flags map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(match[1]), &flags))
+		assert.Equal(t, 3.0, flags["another-flag-key"])
+		assert.Equal(t, true, flags["some-flag-key"])
+		assert.Equal(t, true, flags["$valid"])
+		states := flags["$flagsState"].(map[string]interface{})
+		assert.Equal(t, map[string]interface{}{"variation": 0.0, "version": 1.0, "trackEvents": false}, states["another-flag-key"])
+	}
+
+	// The same user and flags give the same snippet, so it needn't be sent again
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	getSnippet(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
+
+func TestSnippetCanBeInlinedInScriptElement(t *testing.T) {
+	zero := 0
+	clientCtx := makeTestContextWithData()
+	clientCtx.store.Upsert(ld.Features, &ld.FeatureFlag{Key: "html-flag", OffVariation: &zero, Variations: []interface{}{"</script><script>alert(1)</script>"}, Version: 1})
+	req := buildRequest("GET", map[string]string{"envId": "env-id"}, nil, "", clientCtx)
+	req.URL.RawQuery = "user=" + user()
+	w := httptest.NewRecorder()
+	getSnippet(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "</script>")
+	assert.Contains(t, w.Body.String(), `\u003c/script\u003e`)
+}
+
+func TestSnippetRequiresUser(t *testing.T) {
+	req := buildRequest("GET", map[string]string{"envId": "env-id"}, nil, "", makeTestContextWithData())
+	w := httptest.NewRecorder()
+	getSnippet(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSnippetRequiresData(t *testing.T) {
+	clientCtx := &clientContextImpl{client: FakeLDClient{false}, store: ld.NewInMemoryFeatureStore(nullLogger), logger: nullLogger}
+	req := buildRequest("GET", map[string]string{"envId": "env-id"}, nil, "", clientCtx)
+	req.URL.RawQuery = "user=" + user()
+	w := httptest.NewRecorder()
+	getSnippet(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
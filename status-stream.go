@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	r "github.com/garyburd/redigo/redis"
+	es "github.com/launchdarkly/eventsource"
+)
+
+const (
+	statusStreamChannel       = "status"
+	statusStreamCheckInterval = time.Second
+)
+
+// envStatus is a snapshot of the aspects of an environment that operators want to be told about as soon as
+// they change
+type envStatus struct {
+	Environment string    `json:"environment"`
+	Connection  string    `json:"connection"`
+	Store       string    `json:"store"`
+	EventQueue  string    `json:"eventQueue"`
+	Time        time.Time `json:"time"`
+}
+
+func (s envStatus) sameAs(other envStatus) bool {
+	return s.Connection == other.Connection && s.Store == other.Store && s.EventQueue == other.EventQueue
+}
+
+func (s envStatus) Id() string {
+	return ""
+}
+
+func (s envStatus) Event() string {
+	return "status"
+}
+
+func (s envStatus) Data() string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func (s envStatus) Comment() string {
+	return ""
+}
+
+// statusStream watches every environment and publishes an event on /internal/status/stream whenever one of
+// them changes status. Each new subscriber is first sent the current status of every environment. Checking
+// an environment's status pings its store, so environments are only watched while someone is subscribed.
+type statusStream struct {
+	relay     *relay
+	publisher *es.Server
+	interval  time.Duration
+	// Held for each check, so that two checks can't publish the same change and stop can't close the
+	// publisher while a check is publishing
+	checkLock sync.Mutex
+	mu        sync.Mutex
+	last      map[string]envStatus
+	// The number of clients subscribed, and a channel that stops the watching once the last one has gone
+	subscribers  int
+	stopWatching chan struct{}
+	stopped      bool
+}
+
+func newStatusStream(relay *relay, interval time.Duration) *statusStream {
+	publisher := es.NewServer()
+	publisher.Gzip = false
+	publisher.ReplayAll = true
+	s := &statusStream{
+		relay:     relay,
+		publisher: publisher,
+		interval:  interval,
+		last:      make(map[string]envStatus),
+	}
+	publisher.Register(statusStreamChannel, s)
+	return s
+}
+
+func (s *statusStream) handler() http.Handler {
+	streamHandler := s.publisher.Handler(statusStreamChannel)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !s.subscribe() {
+			writeError(w, req, http.StatusServiceUnavailable, "The relay is shutting down")
+			return
+		}
+		defer s.unsubscribe()
+		streamHandler.ServeHTTP(w, req)
+	})
+}
+
+// Starts watching the environments when the first client subscribes. Their status is checked straight away,
+// so that the new subscriber isn't sent what was seen before the last one went away. Returns false if the
+// stream has been stopped.
+func (s *statusStream) subscribe() bool {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return false
+	}
+	s.subscribers++
+	first := s.subscribers == 1
+	if first {
+		s.stopWatching = make(chan struct{})
+		go s.watch(s.stopWatching)
+	}
+	s.mu.Unlock()
+	if first {
+		s.check()
+	}
+	return true
+}
+
+func (s *statusStream) unsubscribe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers--
+	if s.subscribers == 0 && s.stopWatching != nil {
+		close(s.stopWatching)
+		s.stopWatching = nil
+	}
+}
+
+func (s *statusStream) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+// Stops watching the environments and disconnects every subscriber
+func (s *statusStream) stop() {
+	s.checkLock.Lock()
+	defer s.checkLock.Unlock()
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	if s.stopWatching != nil {
+		close(s.stopWatching)
+		s.stopWatching = nil
+	}
+	s.mu.Unlock()
+	s.publisher.Close()
+}
+
+func (s *statusStream) watching() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopWatching != nil
+}
+
+// Publishes an event for each environment whose status differs from the last time we looked
+func (s *statusStream) check() {
+	s.checkLock.Lock()
+	defer s.checkLock.Unlock()
+	s.mu.Lock()
+	stopped := s.stopped
+	s.mu.Unlock()
+	if stopped {
+		return
+	}
+	for _, clientCtx := range s.relay.allEnvironments() {
+		status := getEnvStatus(clientCtx)
+		s.mu.Lock()
+		previous, seen := s.last[clientCtx.name]
+		if !seen || !status.sameAs(previous) {
+			s.last[clientCtx.name] = status
+		}
+		s.mu.Unlock()
+		if seen && !status.sameAs(previous) {
+			s.publisher.Publish([]string{statusStreamChannel}, status)
+		}
+	}
+}
+
+func (s *statusStream) Replay(channel, id string) (out chan es.Event) {
+	s.mu.Lock()
+	var statuses []envStatus
+	for _, clientCtx := range s.relay.allEnvironments() {
+		if status, ok := s.last[clientCtx.name]; ok {
+			statuses = append(statuses, status)
+		}
+	}
+	s.mu.Unlock()
+
+	out = make(chan es.Event)
+	go func() {
+		defer close(out)
+		for _, status := range statuses {
+			out <- status
+		}
+	}()
+	return
+}
+
+func getEnvStatus(clientCtx *clientContextImpl) envStatus {
+	status := envStatus{
+		Environment: clientCtx.name,
+		Connection:  clientCtx.connectionStatus(),
+		Store:       "available",
+		EventQueue:  "normal",
+		Time:        time.Now(),
+	}
+	if clientCtx.storeCheck != nil {
+		if err := clientCtx.storeCheck(); err != nil {
+			status.Store = "unavailable"
+		}
+	}
+	if eventsHandler, ok := clientCtx.getHandlers().eventsHandler.(*eventRelayHandler); ok && eventsHandler.queueSaturated() {
+		status.EventQueue = "saturated"
+	}
+	return status
+}
+
+// Returns a function that reports whether Redis can currently be reached
+func newRedisStoreCheck(host string, port int) func() error {
+	pool := &r.Pool{
+		MaxIdle:     1,
+		IdleTimeout: time.Minute,
+		Dial: func() (r.Conn, error) {
+			return r.Dial("tcp", fmt.Sprintf("%s:%d", host, port), r.DialConnectTimeout(time.Second))
+		},
+	}
+	return func() error {
+		conn := pool.Get()
+		defer conn.Close()
+		_, err := conn.Do("PING")
+		return err
+	}
+}
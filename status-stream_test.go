@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readStatusEvent(t *testing.T, reader *bufio.Reader) envStatus {
+	var status envStatus
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return status
+		}
+		if strings.HasPrefix(line, "data:") {
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &status))
+			return status
+		}
+	}
+}
+
+func TestStatusStreamPublishesTransitions(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	clientCtx := relay.findEnvironment("env1")
+	clientCtx.setClient(FakeLDClient{true})
+
+	stream := newStatusStream(relay, time.Hour)
+	server := httptest.NewServer(stream.handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	initial := readStatusEvent(t, reader)
+	assert.Equal(t, "env1", initial.Environment)
+	assert.Equal(t, "connected", initial.Connection)
+	assert.Equal(t, "available", initial.Store)
+	assert.Equal(t, "normal", initial.EventQueue)
+
+	clientCtx.setClient(FakeLDClient{false})
+	stream.check()
+	disconnected := readStatusEvent(t, reader)
+	assert.Equal(t, "disconnected", disconnected.Connection)
+
+	clientCtx.storeCheck = func() error { return errors.New("connection refused") }
+	stream.check()
+	storeDown := readStatusEvent(t, reader)
+	assert.Equal(t, "disconnected", storeDown.Connection)
+	assert.Equal(t, "unavailable", storeDown.Store)
+}
+
+func TestStatusStreamOnlyWatchesWhileSubscribed(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	stream := relay.statusStream
+	server := httptest.NewServer(stream.handler())
+	defer server.Close()
+	assert.False(t, stream.watching())
+
+	resp, err := http.Get(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	readStatusEvent(t, bufio.NewReader(resp.Body))
+	assert.True(t, stream.watching())
+
+	resp.Body.Close()
+	for deadline := time.Now().Add(time.Second); stream.watching() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, stream.watching())
+
+	stream.stop()
+	resp, err = http.Get(server.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestStatusStreamRequiresAdminCredentials(t *testing.T) {
+	handler := makeAdminTestRelay(false).getHandler()
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost/internal/status/stream", nil)
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
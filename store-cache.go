@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const (
+	// Items are cached as they are read, and updated in the cache as they are written
+	cacheModeWriteThrough = "writeThrough"
+	// Each kind of data is read and cached as a whole, and single items are answered from it. Writes clear
+	// the cached kind, and reads that find it missing at the same time share one read of the store.
+	cacheModeReadCombined = "readCombined"
+
+	defaultCacheRefreshSecs = 30
+)
+
+var allDataKinds = []ld.VersionedDataKind{ld.Features, ld.Segments}
+
+// Returns true if the environment has cache settings of its own, which replace the cache of the persistent
+// store
+func envCacheConfigured(envConfig EnvConfig) bool {
+	return envConfig.LocalTtl != nil || envConfig.CacheMode != "" || envConfig.CacheRefreshSecs != nil
+}
+
+func validateEnvCache(c Config, envConfig EnvConfig) error {
+	if !envCacheConfigured(envConfig) {
+		return nil
+	}
+	if !persistentStoreConfigured(c) {
+		return errors.New("localTtl, cacheMode and cacheRefreshSecs only apply to a persistent store")
+	}
+	if envConfig.LocalTtl != nil && *envConfig.LocalTtl < -1 {
+		return errors.New("localTtl must be -1 (never expire), 0 (no cache) or a number of milliseconds")
+	}
+	if envConfig.CacheMode != "" && envConfig.CacheMode != cacheModeWriteThrough && envConfig.CacheMode != cacheModeReadCombined {
+		return errors.New(`cacheMode must be "writeThrough" or "readCombined"`)
+	}
+	if envConfig.CacheRefreshSecs != nil && *envConfig.CacheRefreshSecs <= 0 {
+		return errors.New("cacheRefreshSecs must be greater than 0")
+	}
+	return nil
+}
+
+// Returns the localTtl of the configured persistent store, which an environment's cache uses unless it has a
+// localTtl of its own. A custom store has no localTtl, and caches as it sees fit, so environments using one
+// aren't cached unless they set a localTtl.
+func storeLocalTtlMs(c Config) int {
+	switch {
+	case c.Main.Store != "":
+		return 0
+	case redisConfigured(c):
+		return *c.Redis.LocalTtl
+	case c.Postgres.Url != "":
+		return *c.Postgres.LocalTtl
+	case len(c.Memcached.Server) > 0:
+		return *c.Memcached.LocalTtl
+	}
+	return 0
+}
+
+// Returns the cache to put in front of an environment's persistent store, if it has cache settings of its own,
+// or nil if it doesn't or its localTtl is 0
+func newEnvCache(c Config, envConfig EnvConfig, store ld.FeatureStore) *localCacheStore {
+	if !persistentStoreConfigured(c) || !envCacheConfigured(envConfig) {
+		return nil
+	}
+	ttl, refreshSecs := storeLocalTtlMs(c), defaultCacheRefreshSecs
+	if envConfig.LocalTtl != nil {
+		ttl = *envConfig.LocalTtl
+	}
+	if envConfig.CacheRefreshSecs != nil {
+		refreshSecs = *envConfig.CacheRefreshSecs
+	}
+	if ttl == 0 {
+		return nil
+	}
+	return newLocalCacheStore(store, ttl, envConfig.CacheMode, time.Duration(refreshSecs)*time.Second)
+}
+
+// localCacheStore keeps an environment's flags and segments in memory in front of its persistent store, with
+// the environment's own TTL and cache mode. With a TTL of -1 nothing expires, and instead the whole cache is
+// reloaded from the store in the background at each refresh interval, so reads never wait for the store;
+// changes made to the store by anything other than this relay are seen after up to one interval.
+type localCacheStore struct {
+	ld.FeatureStore
+	// Items expire this long after they are cached; 0 means never
+	ttl     time.Duration
+	mode    string
+	mu      sync.Mutex
+	kinds   map[ld.VersionedDataKind]*cachedKind
+	closer  chan struct{}
+	closeMu sync.Once
+}
+
+type cachedKind struct {
+	// Set when every item of the kind is cached
+	all   map[string]ld.VersionedData
+	allAt time.Time
+	// Items cached individually, in writeThrough mode
+	items map[string]cachedItem
+	// Closed when a combined read in progress finishes
+	loading chan struct{}
+	// Counts the writes, so that a read that started before a write doesn't cache what it read
+	writes int
+}
+
+type cachedItem struct {
+	// nil if there is no such item
+	item ld.VersionedData
+	at   time.Time
+}
+
+func newLocalCacheStore(store ld.FeatureStore, ttlMs int, mode string, refresh time.Duration) *localCacheStore {
+	if mode == "" {
+		mode = cacheModeWriteThrough
+	}
+	s := &localCacheStore{
+		FeatureStore: store,
+		ttl:          time.Duration(ttlMs) * time.Millisecond,
+		mode:         mode,
+		kinds:        make(map[ld.VersionedDataKind]*cachedKind),
+		closer:       make(chan struct{}),
+	}
+	if ttlMs < 0 {
+		s.ttl = 0
+		go s.refreshEvery(refresh)
+	}
+	return s
+}
+
+// Stops refreshing the cache
+func (s *localCacheStore) close() {
+	s.closeMu.Do(func() { close(s.closer) })
+}
+
+func (s *localCacheStore) fresh(at time.Time) bool {
+	return !at.IsZero() && (s.ttl == 0 || time.Since(at) < s.ttl)
+}
+
+// Returns the cache for the kind; the caller must hold the lock
+func (s *localCacheStore) kind(kind ld.VersionedDataKind) *cachedKind {
+	k := s.kinds[kind]
+	if k == nil {
+		k = &cachedKind{items: make(map[string]cachedItem)}
+		s.kinds[kind] = k
+	}
+	return k
+}
+
+func (s *localCacheStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	if s.mode == cacheModeReadCombined {
+		items, err := s.All(kind)
+		if err != nil {
+			return nil, err
+		}
+		return items[key], nil
+	}
+
+	s.mu.Lock()
+	k := s.kind(kind)
+	if s.fresh(k.allAt) {
+		item := k.all[key]
+		s.mu.Unlock()
+		return item, nil
+	}
+	if cached, ok := k.items[key]; ok && s.fresh(cached.at) {
+		s.mu.Unlock()
+		return cached.item, nil
+	}
+	writes := k.writes
+	s.mu.Unlock()
+
+	item, err := s.FeatureStore.Get(kind, key)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if k.writes == writes && s.kinds[kind] == k {
+		k.items[key] = cachedItem{item: item, at: time.Now()}
+	}
+	s.mu.Unlock()
+	return item, nil
+}
+
+func (s *localCacheStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	for {
+		s.mu.Lock()
+		k := s.kind(kind)
+		if s.fresh(k.allAt) {
+			items := k.all
+			s.mu.Unlock()
+			return items, nil
+		}
+		if k.loading == nil || s.mode != cacheModeReadCombined {
+			break
+		}
+		// Wait for the read in progress, and use what it cached
+		loading := k.loading
+		s.mu.Unlock()
+		<-loading
+	}
+	k := s.kinds[kind]
+	loading := make(chan struct{})
+	k.loading = loading
+	writes := k.writes
+	s.mu.Unlock()
+
+	items, err := s.FeatureStore.All(kind)
+
+	s.mu.Lock()
+	if err == nil && k.writes == writes && s.kinds[kind] == k {
+		k.all, k.allAt = items, time.Now()
+	}
+	if k.loading == loading {
+		k.loading = nil
+	}
+	s.mu.Unlock()
+	close(loading)
+	return items, err
+}
+
+func (s *localCacheStore) Init(allData map[ld.VersionedDataKind]map[string]ld.VersionedData) error {
+	if err := s.FeatureStore.Init(allData); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.kinds = make(map[ld.VersionedDataKind]*cachedKind)
+	for kind, items := range allData {
+		live := make(map[string]ld.VersionedData, len(items))
+		for key, item := range items {
+			if !item.IsDeleted() {
+				live[key] = item
+			}
+		}
+		k := s.kind(kind)
+		k.all, k.allAt = live, now
+	}
+	return nil
+}
+
+func (s *localCacheStore) Upsert(kind ld.VersionedDataKind, item ld.VersionedData) error {
+	if err := s.FeatureStore.Upsert(kind, item); err != nil {
+		return err
+	}
+	s.written(kind, item.GetKey(), item)
+	return nil
+}
+
+func (s *localCacheStore) Delete(kind ld.VersionedDataKind, key string, version int) error {
+	if err := s.FeatureStore.Delete(kind, key, version); err != nil {
+		return err
+	}
+	s.written(kind, key, nil)
+	return nil
+}
+
+// Updates the cache after an item was written to the store. The store may have kept a newer version than
+// the one written, so only the written item itself is cached, and only if it is newer than the cached one.
+func (s *localCacheStore) written(kind ld.VersionedDataKind, key string, item ld.VersionedData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.kind(kind)
+	k.writes++
+	// The cached maps may have been handed to callers, so they are never changed in place
+	k.all, k.allAt = nil, time.Time{}
+	if s.mode == cacheModeReadCombined {
+		return
+	}
+	if item == nil || item.IsDeleted() {
+		delete(k.items, key)
+		return
+	}
+	if cached, ok := k.items[key]; ok && cached.item != nil && cached.item.GetVersion() >= item.GetVersion() {
+		return
+	}
+	k.items[key] = cachedItem{item: item, at: time.Now()}
+}
+
+// Reloads every kind of data from the store at each interval, until closed. Data that can't be read stays
+// cached as it was.
+func (s *localCacheStore) refreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closer:
+			return
+		case <-ticker.C:
+		}
+		for _, kind := range allDataKinds {
+			s.mu.Lock()
+			k := s.kind(kind)
+			writes := k.writes
+			s.mu.Unlock()
+			items, err := s.FeatureStore.All(kind)
+			s.mu.Lock()
+			if err == nil && k.writes == writes && s.kinds[kind] == k {
+				k.all, k.allAt = items, time.Now()
+				k.items = make(map[string]cachedItem)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
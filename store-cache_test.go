@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// countingFeatureStore counts the reads that reach a store, and can make them slow
+type countingFeatureStore struct {
+	ld.FeatureStore
+	gets  int32
+	alls  int32
+	delay time.Duration
+}
+
+func (s *countingFeatureStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.FeatureStore.Get(kind, key)
+}
+
+func (s *countingFeatureStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	atomic.AddInt32(&s.alls, 1)
+	time.Sleep(s.delay)
+	return s.FeatureStore.All(kind)
+}
+
+func TestWriteThroughCacheServesReadsAndWritesFromMemory(t *testing.T) {
+	store := &countingFeatureStore{FeatureStore: makeStoreWithData(true)}
+	cache := newLocalCacheStore(store, 100, cacheModeWriteThrough, 0)
+
+	for i := 0; i < 3; i++ {
+		flag, err := cache.Get(ld.Features, "some-flag-key")
+		if assert.NoError(t, err) && assert.NotNil(t, flag) {
+			assert.Equal(t, 2, flag.GetVersion())
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.gets))
+
+	cache.Upsert(ld.Features, &ld.FeatureFlag{Key: "some-flag-key", Version: 5})
+	flag, _ := cache.Get(ld.Features, "some-flag-key")
+	assert.Equal(t, 5, flag.GetVersion())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.gets))
+
+	cache.Delete(ld.Features, "some-flag-key", 6)
+	flag, _ = cache.Get(ld.Features, "some-flag-key")
+	assert.Nil(t, flag)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&store.gets))
+
+	time.Sleep(150 * time.Millisecond)
+	cache.Get(ld.Features, "some-flag-key")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&store.gets))
+}
+
+func TestReadCombinedCacheSharesOneRead(t *testing.T) {
+	store := &countingFeatureStore{FeatureStore: makeStoreWithData(true), delay: 50 * time.Millisecond}
+	cache := newLocalCacheStore(store, 60000, cacheModeReadCombined, 0)
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"some-flag-key", "another-flag-key", "off-variation-key", "missing-key"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			flag, err := cache.Get(ld.Features, key)
+			assert.NoError(t, err)
+			assert.Equal(t, key != "missing-key", flag != nil, key)
+		}(key)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.alls))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&store.gets))
+
+	cache.Upsert(ld.Features, &ld.FeatureFlag{Key: "new-flag", Version: 1})
+	flags, _ := cache.All(ld.Features)
+	assert.Len(t, flags, 4)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&store.alls))
+}
+
+func TestNeverExpiringCacheIsRefreshedInTheBackground(t *testing.T) {
+	store := &countingFeatureStore{FeatureStore: makeStoreWithData(true)}
+	cache := newLocalCacheStore(store, -1, cacheModeWriteThrough, 50*time.Millisecond)
+	defer cache.close()
+
+	flags, _ := cache.All(ld.Features)
+	assert.Len(t, flags, 3)
+
+	// Written by another relay
+	store.FeatureStore.Upsert(ld.Features, &ld.FeatureFlag{Key: "new-flag", Version: 1})
+	flags, _ = cache.All(ld.Features)
+	assert.Len(t, flags, 3)
+
+	time.Sleep(150 * time.Millisecond)
+	flags, _ = cache.All(ld.Features)
+	assert.Len(t, flags, 4)
+	flag, _ := cache.Get(ld.Features, "new-flag")
+	assert.NotNil(t, flag)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&store.gets))
+}
+
+func TestValidateEnvCache(t *testing.T) {
+	var memory Config
+	var redis Config
+	redis.Redis.Host = "localhost"
+	redis.Redis.Port = 6379
+
+	ttl, badTtl, refresh := -1, -2, 0
+	assert.NoError(t, validateEnvCache(memory, EnvConfig{}))
+	assert.Error(t, validateEnvCache(memory, EnvConfig{LocalTtl: &ttl}))
+	assert.NoError(t, validateEnvCache(redis, EnvConfig{LocalTtl: &ttl, CacheMode: cacheModeReadCombined}))
+	assert.Error(t, validateEnvCache(redis, EnvConfig{LocalTtl: &badTtl}))
+	assert.Error(t, validateEnvCache(redis, EnvConfig{CacheMode: "writeBack"}))
+	assert.Error(t, validateEnvCache(redis, EnvConfig{CacheRefreshSecs: &refresh}))
+}
+
+func TestEnvCacheIsOffWithATtlOfZero(t *testing.T) {
+	zero, ttl := 0, 100
+	var c Config
+	c.Redis.Host, c.Redis.Port, c.Redis.LocalTtl = "localhost", 6379, &ttl
+	store := makeStoreWithData(true)
+
+	assert.Nil(t, newEnvCache(c, EnvConfig{}, store))
+	assert.Nil(t, newEnvCache(c, EnvConfig{LocalTtl: &zero}, store))
+	cache := newEnvCache(c, EnvConfig{CacheMode: cacheModeReadCombined}, store)
+	if assert.NotNil(t, cache) {
+		assert.Equal(t, 100*time.Millisecond, cache.ttl)
+		cache.close()
+	}
+
+	// The store's localTtl applies when the environment doesn't set one
+	c.Redis.LocalTtl = &zero
+	assert.Nil(t, newEnvCache(c, EnvConfig{CacheMode: cacheModeReadCombined}, store))
+
+	// A custom store has no localTtl
+	var custom Config
+	custom.Main.Store = "test-store"
+	assert.Nil(t, newEnvCache(custom, EnvConfig{CacheMode: cacheModeWriteThrough}, store))
+	cache = newEnvCache(custom, EnvConfig{LocalTtl: &ttl}, store)
+	if assert.NotNil(t, cache) {
+		cache.close()
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	r "github.com/garyburd/redigo/redis"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const defaultRedisPrefix = "launchdarkly"
+
+// storeClean deletes feature store data in Redis under prefixes that are not used by any configured
+// environment. Data like this is left behind when an environment is removed from the configuration, and SDKs
+// still pointed at the old prefix would otherwise keep reading it. Since Redis may be shared with other relays
+// or applications whose prefixes the configuration doesn't know about, only the prefixes given as arguments
+// are deleted. Without any, the prefixes that look unused are listed so that they can be checked first.
+func storeClean(c Config, args []string) int {
+	flags := flag.NewFlagSet("store clean", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list the keys that would be deleted without deleting them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if c.Postgres.Url != "" || len(c.Memcached.Server) > 0 || c.Main.Store != "" {
+		Error.Println("store clean only supports Redis feature stores")
+		return 1
+	}
+	if !redisConfigured(c) {
+		Error.Println("No Redis feature store is configured; nothing to clean")
+		return 1
+	}
+	configured := configuredPrefixes(c)
+	for _, prefix := range flags.Args() {
+		if configured[prefix] {
+			Error.Printf("Prefix %s is used by an environment in the configuration and can't be cleaned", prefix)
+			return 1
+		}
+	}
+
+	conn, err := r.Dial("tcp", fmt.Sprintf("%s:%d", c.Redis.Host, c.Redis.Port))
+	if err != nil {
+		Error.Printf("Unable to connect to Redis at %s:%d: %s", c.Redis.Host, c.Redis.Port, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if flags.NArg() == 0 {
+		keys, err := scanStoreKeys(conn)
+		if err != nil {
+			Error.Printf("Unable to list Redis keys: %s", err)
+			return 1
+		}
+		unused := unusedStorePrefixes(keys, configured)
+		if len(unused) == 0 {
+			Info.Println("No unused feature store prefixes found")
+			return 0
+		}
+		fmt.Println("Feature store data was found under these prefixes, which no environment in the configuration uses:")
+		for _, prefix := range unused {
+			fmt.Printf("  %s\n", prefix)
+		}
+		fmt.Println("Check that nothing else uses them, then give the ones to delete, e.g. \"store clean " + unused[0] + "\"")
+		return 0
+	}
+
+	for _, key := range storeKeysForPrefixes(flags.Args()) {
+		if *dryRun {
+			if exists, err := r.Bool(conn.Do("EXISTS", key)); err != nil {
+				Error.Printf("Unable to check %s: %s", key, err)
+				return 1
+			} else if exists {
+				fmt.Printf("would delete %s\n", key)
+			}
+			continue
+		}
+		deleted, err := r.Int(conn.Do("DEL", key))
+		if err != nil {
+			Error.Printf("Unable to delete %s: %s", key, err)
+			return 1
+		}
+		if deleted > 0 {
+			fmt.Printf("deleted %s\n", key)
+		}
+	}
+	return 0
+}
+
+func configuredPrefixes(c Config) map[string]bool {
+	prefixes := make(map[string]bool)
+	for _, envConfig := range c.Environment {
+		prefix := envConfig.Prefix
+		if prefix == "" {
+			prefix = defaultRedisPrefix
+		}
+		prefixes[prefix] = true
+	}
+	return prefixes
+}
+
+// Returns every key that looks like it belongs to a Redis feature store, i.e. "<prefix>:features" or
+// "<prefix>:segments"
+func scanStoreKeys(conn r.Conn) ([]string, error) {
+	var keys []string
+	for _, kind := range ld.VersionedDataKinds {
+		cursor := 0
+		for {
+			values, err := r.Values(conn.Do("SCAN", cursor, "MATCH", "*:"+kind.GetNamespace()))
+			if err != nil {
+				return nil, err
+			}
+			if len(values) != 2 {
+				return nil, fmt.Errorf("unexpected SCAN reply: %v", values)
+			}
+			cursor, err = r.Int(values[0], nil)
+			if err != nil {
+				return nil, err
+			}
+			batch, err := r.Strings(values[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, batch...)
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Returns the prefixes of the feature store keys that aren't used by any configured environment
+func unusedStorePrefixes(keys []string, prefixes map[string]bool) []string {
+	seen := make(map[string]bool)
+	var unused []string
+	for _, key := range keys {
+		for _, kind := range ld.VersionedDataKinds {
+			suffix := ":" + kind.GetNamespace()
+			prefix := strings.TrimSuffix(key, suffix)
+			if strings.HasSuffix(key, suffix) && !prefixes[prefix] && !seen[prefix] {
+				seen[prefix] = true
+				unused = append(unused, prefix)
+			}
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// Returns the keys a Redis feature store with each of the prefixes would use
+func storeKeysForPrefixes(prefixes []string) []string {
+	var keys []string
+	for _, prefix := range prefixes {
+		for _, kind := range ld.VersionedDataKinds {
+			keys = append(keys, prefix+":"+kind.GetNamespace())
+		}
+	}
+	return keys
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnusedStorePrefixes(t *testing.T) {
+	c := Config{Environment: map[string]*EnvConfig{
+		"prod":    {Prefix: "prod"},
+		"default": {},
+	}}
+	keys := []string{
+		"prod:features", "prod:segments",
+		"launchdarkly:features",
+		"old-test:segments", "old-test:features",
+		"unrelated-key",
+	}
+	assert.Equal(t, []string{"old-test"}, unusedStorePrefixes(keys, configuredPrefixes(c)))
+}
+
+func TestOnlyGivenPrefixesAreCleaned(t *testing.T) {
+	assert.Equal(t, []string{"old-test:features", "old-test:segments"}, storeKeysForPrefixes([]string{"old-test"}))
+}
+
+func TestStoreCleanRefusesConfiguredPrefixesAndOtherStores(t *testing.T) {
+	c := Config{Environment: map[string]*EnvConfig{"prod": {Prefix: "prod"}}}
+	c.Redis.Host, c.Redis.Port = "localhost", 6379
+	assert.Equal(t, 1, storeClean(c, []string{"prod"}))
+
+	c = Config{Environment: map[string]*EnvConfig{"prod": {Prefix: "prod"}}}
+	c.Postgres.Url = "postgres://localhost/ldrelay"
+	assert.Equal(t, 1, storeClean(c, []string{"old-test"}))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// lastKnownGoodStore remembers the flags and segments last read from or written to a persistent store, and
+// serves them if reads from the store start failing, so that a short store outage doesn't leave SDKs with
+// default values. Data older than maxAge is never served; once it is that old, reads fail as they would have
+// without the fallback.
+type lastKnownGoodStore struct {
+	ld.FeatureStore
+	maxAge  time.Duration
+	envName string
+	mu      sync.Mutex
+	data    map[ld.VersionedDataKind]map[string]ld.VersionedData
+	// When each kind of data was last known to match the store
+	confirmedAt map[ld.VersionedDataKind]time.Time
+	// Set while reads are being answered from the remembered data
+	fallingBackSince time.Time
+}
+
+func newLastKnownGoodStore(store ld.FeatureStore, maxAge time.Duration, envName string) *lastKnownGoodStore {
+	return &lastKnownGoodStore{
+		FeatureStore: store,
+		maxAge:       maxAge,
+		envName:      envName,
+		data:         make(map[ld.VersionedDataKind]map[string]ld.VersionedData),
+		confirmedAt:  make(map[ld.VersionedDataKind]time.Time),
+	}
+}
+
+func (s *lastKnownGoodStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	item, err := s.FeatureStore.Get(kind, key)
+	if err == nil {
+		s.recovered()
+		return item, nil
+	}
+	items, ok := s.fallback(kind, err)
+	if !ok {
+		return nil, err
+	}
+	if item = items[key]; item != nil && item.IsDeleted() {
+		item = nil
+	}
+	return item, nil
+}
+
+func (s *lastKnownGoodStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	items, err := s.FeatureStore.All(kind)
+	if err == nil {
+		s.recovered()
+		s.remember(kind, items)
+		return items, nil
+	}
+	if items, ok := s.fallback(kind, err); ok {
+		return items, nil
+	}
+	return nil, err
+}
+
+func (s *lastKnownGoodStore) Init(allData map[ld.VersionedDataKind]map[string]ld.VersionedData) error {
+	if err := s.FeatureStore.Init(allData); err != nil {
+		return err
+	}
+	for kind, items := range allData {
+		s.remember(kind, items)
+	}
+	return nil
+}
+
+func (s *lastKnownGoodStore) Upsert(kind ld.VersionedDataKind, item ld.VersionedData) error {
+	if err := s.FeatureStore.Upsert(kind, item); err != nil {
+		return err
+	}
+	s.update(kind, item.GetKey(), item, item.GetVersion())
+	return nil
+}
+
+func (s *lastKnownGoodStore) Delete(kind ld.VersionedDataKind, key string, version int) error {
+	if err := s.FeatureStore.Delete(kind, key, version); err != nil {
+		return err
+	}
+	s.update(kind, key, nil, version)
+	return nil
+}
+
+// Reports the store as initialized while remembered data is being served, since the store itself may not
+// be able to say
+func (s *lastKnownGoodStore) Initialized() bool {
+	return s.servingFallback() || s.FeatureStore.Initialized()
+}
+
+// Returns true if reads are currently being answered from remembered data
+func (s *lastKnownGoodStore) servingFallback() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.fallingBackSince.IsZero()
+}
+
+func (s *lastKnownGoodStore) remember(kind ld.VersionedDataKind, items map[string]ld.VersionedData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[kind] = items
+	s.confirmedAt[kind] = time.Now()
+}
+
+// Applies a change that was written to the store successfully. The remembered map may have been handed to
+// callers, so it is copied rather than changed.
+func (s *lastKnownGoodStore) update(kind ld.VersionedDataKind, key string, item ld.VersionedData, version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.data[kind]
+	if items == nil {
+		return
+	}
+	if existing := items[key]; existing != nil && existing.GetVersion() >= version {
+		return
+	}
+	updated := make(map[string]ld.VersionedData, len(items)+1)
+	for k, v := range items {
+		updated[k] = v
+	}
+	if item == nil || item.IsDeleted() {
+		delete(updated, key)
+	} else {
+		updated[key] = item
+	}
+	s.data[kind] = updated
+}
+
+// Returns the remembered data to serve in place of a failed read, if it isn't too old
+func (s *lastKnownGoodStore) fallback(kind ld.VersionedDataKind, err error) (map[string]ld.VersionedData, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.data[kind]
+	age := time.Since(s.confirmedAt[kind])
+	if items == nil || age > s.maxAge {
+		return nil, false
+	}
+	if s.fallingBackSince.IsZero() {
+		s.fallingBackSince = time.Now()
+		Warning.Printf("Unable to read the feature store for environment %s (%s); serving data from %s ago until it recovers",
+			s.envName, err, age.Round(time.Second))
+	}
+	return items, true
+}
+
+func (s *lastKnownGoodStore) recovered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.fallingBackSince.IsZero() {
+		Info.Printf("The feature store for environment %s has recovered after %s", s.envName, time.Since(s.fallingBackSince).Round(time.Second))
+		s.fallingBackSince = time.Time{}
+	}
+}
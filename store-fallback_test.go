@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// failingFeatureStore fails every read while failing is set
+type failingFeatureStore struct {
+	ld.FeatureStore
+	failing *bool
+}
+
+var errStoreDown = errors.New("store is down")
+
+func (s failingFeatureStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	if *s.failing {
+		return nil, errStoreDown
+	}
+	return s.FeatureStore.Get(kind, key)
+}
+
+func (s failingFeatureStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	if *s.failing {
+		return nil, errStoreDown
+	}
+	return s.FeatureStore.All(kind)
+}
+
+func TestLastKnownGoodDataIsServedWhileTheStoreFails(t *testing.T) {
+	failing := false
+	store := newLastKnownGoodStore(failingFeatureStore{FeatureStore: makeStoreWithData(true), failing: &failing}, time.Minute, "env")
+
+	_, err := store.All(ld.Features)
+	assert.NoError(t, err)
+	store.Upsert(ld.Features, &ld.FeatureFlag{Key: "new-flag", Version: 1})
+	store.Delete(ld.Features, "off-variation-key", 4)
+
+	failing = true
+	flags, err := store.All(ld.Features)
+	if assert.NoError(t, err) {
+		assert.Len(t, flags, 3)
+		assert.NotNil(t, flags["new-flag"])
+		assert.Nil(t, flags["off-variation-key"])
+	}
+	flag, err := store.Get(ld.Features, "some-flag-key")
+	if assert.NoError(t, err) && assert.NotNil(t, flag) {
+		assert.Equal(t, 2, flag.GetVersion())
+	}
+	assert.True(t, store.servingFallback())
+	assert.True(t, store.Initialized())
+
+	// Segments were never read, so there is nothing to fall back on
+	_, err = store.All(ld.Segments)
+	assert.Equal(t, errStoreDown, err)
+
+	failing = false
+	store.Get(ld.Features, "some-flag-key")
+	assert.False(t, store.servingFallback())
+}
+
+func TestLastKnownGoodDataIsNotServedOnceTooOld(t *testing.T) {
+	failing := false
+	store := newLastKnownGoodStore(failingFeatureStore{FeatureStore: makeStoreWithData(true), failing: &failing}, time.Minute, "env")
+	store.All(ld.Features)
+	store.confirmedAt[ld.Features] = time.Now().Add(-2 * time.Minute)
+
+	failing = true
+	_, err := store.All(ld.Features)
+	assert.Equal(t, errStoreDown, err)
+	assert.False(t, store.servingFallback())
+}
+
+func TestEnvironmentIsDegradedWhileServingLastKnownGoodData(t *testing.T) {
+	failing := false
+	store := newLastKnownGoodStore(failingFeatureStore{FeatureStore: makeStoreWithData(true), failing: &failing}, time.Minute, "env")
+	clientCtx := &clientContextImpl{client: FakeLDClient{true}, store: store, fallback: store}
+	store.All(ld.Features)
+	assert.Equal(t, "connected", clientCtx.connectionStatus())
+
+	failing = true
+	store.All(ld.Features)
+	assert.Equal(t, "degraded", clientCtx.connectionStatus())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+// FeatureStoreFactory creates the feature store for one environment. Options are the values given for the
+// store in its [store "<name>"] section, and prefix is the environment's prefix, which the store should use
+// to keep each environment's data apart.
+type FeatureStoreFactory func(options map[string]string, prefix string, logger ld.Logger) (ld.FeatureStore, error)
+
+// StoreConfig holds the options for a custom store. Each option is given as "name=value":
+//
+//	[store "etcd"]
+//	    option = "endpoints=http://etcd-1:2379,http://etcd-2:2379"
+//	    option = "timeout=5s"
+type StoreConfig struct {
+	Option []string
+}
+
+// The names of the stores that are configured with their own sections, which custom stores may not use
+var builtInStoreNames = []string{"redis", "postgres", "memcached", "memory"}
+
+var (
+	featureStoreFactoriesLock sync.RWMutex
+	featureStoreFactories     = make(map[string]FeatureStoreFactory)
+)
+
+// RegisterFeatureStore makes a custom feature store available to the relay under the given name, which can
+// then be chosen with "store = <name>" in the [main] section. It is meant to be called from an init function
+// in a file added to the relay's source, and panics if the name is already in use.
+func RegisterFeatureStore(name string, factory FeatureStoreFactory) {
+	if factory == nil {
+		panic("RegisterFeatureStore: factory is nil")
+	}
+	featureStoreFactoriesLock.Lock()
+	defer featureStoreFactoriesLock.Unlock()
+	for _, builtIn := range builtInStoreNames {
+		if strings.EqualFold(name, builtIn) {
+			panic("RegisterFeatureStore: " + name + " is a built-in store")
+		}
+	}
+	if _, exists := featureStoreFactories[name]; exists {
+		panic("RegisterFeatureStore: store " + name + " is already registered")
+	}
+	featureStoreFactories[name] = factory
+}
+
+func getFeatureStoreFactory(name string) FeatureStoreFactory {
+	featureStoreFactoriesLock.RLock()
+	defer featureStoreFactoriesLock.RUnlock()
+	return featureStoreFactories[name]
+}
+
+func registeredFeatureStores() []string {
+	featureStoreFactoriesLock.RLock()
+	defer featureStoreFactoriesLock.RUnlock()
+	names := make([]string, 0, len(featureStoreFactories))
+	for name := range featureStoreFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Checks that the store named in the [main] section has been registered and that its options are well formed
+func validateCustomStore(c Config) error {
+	if getFeatureStoreFactory(c.Main.Store) == nil {
+		registered := registeredFeatureStores()
+		if len(registered) == 0 {
+			return fmt.Errorf("unknown store %q; no custom stores have been registered", c.Main.Store)
+		}
+		return fmt.Errorf("unknown store %q; registered stores are: %s", c.Main.Store, strings.Join(registered, ", "))
+	}
+	_, err := customStoreOptions(c)
+	return err
+}
+
+// Returns the options given for the store named in the [main] section
+func customStoreOptions(c Config) (map[string]string, error) {
+	options := make(map[string]string)
+	storeConfig := c.Store[c.Main.Store]
+	if storeConfig == nil {
+		return options, nil
+	}
+	for _, option := range storeConfig.Option {
+		parts := strings.SplitN(option, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("store option %q must be of the form name=value", option)
+		}
+		if _, exists := options[name]; exists {
+			return nil, fmt.Errorf("store option %q is given more than once", name)
+		}
+		options[name] = strings.TrimSpace(parts[1])
+	}
+	return options, nil
+}
+
+func newCustomFeatureStore(c Config, envConfig EnvConfig) (ld.FeatureStore, error) {
+	factory := getFeatureStoreFactory(c.Main.Store)
+	if factory == nil {
+		return nil, fmt.Errorf("unknown store %q", c.Main.Store)
+	}
+	options, err := customStoreOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	store, err := factory(options, envConfig.Prefix, Info)
+	if err == nil && store == nil {
+		err = fmt.Errorf("store %q did not create a feature store", c.Main.Store)
+	}
+	return store, err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+type recordingStoreFactory struct {
+	options map[string]string
+	prefix  string
+}
+
+func (f *recordingStoreFactory) create(options map[string]string, prefix string, logger ld.Logger) (ld.FeatureStore, error) {
+	f.options = options
+	f.prefix = prefix
+	return ld.NewInMemoryFeatureStore(logger), nil
+}
+
+var testStoreFactory = &recordingStoreFactory{}
+
+func init() {
+	RegisterFeatureStore("test-store", testStoreFactory.create)
+	RegisterFeatureStore("failing-store", func(options map[string]string, prefix string, logger ld.Logger) (ld.FeatureStore, error) {
+		return nil, errors.New("unavailable")
+	})
+}
+
+func TestCustomStoreIsCreatedWithItsOptions(t *testing.T) {
+	configFile := writeTestConfig(t, `
+[main]
+	store = "test-store"
+[store "test-store"]
+	option = "endpoints=http://etcd-1:2379,http://etcd-2:2379"
+	option = "timeout = 5s"
+	option = "empty="
+`)
+	defer os.Remove(configFile)
+
+	c, err := loadConfig(configFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, persistentStoreConfigured(c))
+	store, err := newBaseFeatureStore(c, EnvConfig{Prefix: "ld:test"})
+	assert.NoError(t, err)
+	assert.IsType(t, &ld.InMemoryFeatureStore{}, store)
+	assert.Equal(t, map[string]string{"endpoints": "http://etcd-1:2379,http://etcd-2:2379", "timeout": "5s", "empty": ""}, testStoreFactory.options)
+	assert.Equal(t, "ld:test", testStoreFactory.prefix)
+}
+
+func TestCustomStoreErrorIsReturned(t *testing.T) {
+	var c Config
+	c.Main.Store = "failing-store"
+	store, err := newBaseFeatureStore(c, EnvConfig{})
+	assert.Nil(t, store)
+	assert.EqualError(t, err, "unable to create the failing-store store: unavailable")
+
+	c.Environment = map[string]*EnvConfig{"env1": {SdkKey: "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"}}
+	relay, err := newRelay(c, func(sdkKey string, config ld.Config) (ldClientContext, error) {
+		t.Error("no environment should be started")
+		return FakeLDClient{true}, nil
+	})
+	assert.Nil(t, relay)
+	assert.EqualError(t, err, "environment env1: unable to create the failing-store store: unavailable")
+}
+
+func TestCustomStoreConfigIsValidated(t *testing.T) {
+	specs := []struct {
+		name          string
+		config        string
+		expectedError string
+	}{
+		{"unregistered store", `[main]
+	store = "etcd"`, `unknown store "etcd"; registered stores are: failing-store, snapshot-test-store, test-store`},
+		{"malformed option", `[main]
+	store = "test-store"
+[store "test-store"]
+	option = "timeout"`, `store option "timeout" must be of the form name=value`},
+		{"repeated option", `[main]
+	store = "test-store"
+[store "test-store"]
+	option = "timeout=1s"
+	option = "timeout=2s"`, `store option "timeout" is given more than once`},
+		{"combined with Redis", `[main]
+	store = "test-store"
+[redis]
+	host = "localhost"
+	port = 6379`, "a custom store may not be combined with Redis, Postgres or Memcached"},
+	}
+	for _, s := range specs {
+		t.Run(s.name, func(t *testing.T) {
+			configFile := writeTestConfig(t, s.config)
+			defer os.Remove(configFile)
+			_, err := loadConfig(configFile)
+			assert.EqualError(t, err, s.expectedError)
+		})
+	}
+}
+
+func TestStoreNamesCannotBeReused(t *testing.T) {
+	factory := func(options map[string]string, prefix string, logger ld.Logger) (ld.FeatureStore, error) {
+		return nil, nil
+	}
+	assert.Panics(t, func() { RegisterFeatureStore("test-store", factory) })
+	assert.Panics(t, func() { RegisterFeatureStore("Redis", factory) })
+	assert.Panics(t, func() { RegisterFeatureStore("other-store", nil) })
+}
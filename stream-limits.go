@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// How long clients turned away by a connection limit are asked to wait before trying again
+const streamRetryAfterSecs = 30
+
+// streamLimiter caps the number of stream connections open at once, both across the relay and for each
+// environment, so that a surge of clients in one environment can't use up the file descriptors that every
+// other environment needs. A limit of 0 means no limit.
+type streamLimiter struct {
+	maxTotal  int
+	maxPerEnv int
+	mu        sync.Mutex
+	total     int
+	perEnv    map[*envMetrics]int
+}
+
+func newStreamLimiter(maxTotal int, maxPerEnv int) *streamLimiter {
+	return &streamLimiter{maxTotal: maxTotal, maxPerEnv: maxPerEnv, perEnv: make(map[*envMetrics]int)}
+}
+
+// Reserves a connection for an environment, returning false if either limit has been reached. Environments
+// are told apart by their metrics, which server-side, mobile and client-side streams share.
+func (l *streamLimiter) acquire(env *envMetrics) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return false
+	}
+	if l.maxPerEnv > 0 && l.perEnv[env] >= l.maxPerEnv {
+		return false
+	}
+	l.total++
+	l.perEnv[env]++
+	return true
+}
+
+func (l *streamLimiter) release(env *envMetrics) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perEnv[env] <= 1 {
+		delete(l.perEnv, env)
+	} else {
+		l.perEnv[env]--
+	}
+}
+
+// Returns the number of stream connections open across the relay
+func (l *streamLimiter) connections() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// Wraps a stream handler so that connections over the limit receive a 503 with a Retry-After header. It must
+// come after the middleware that selects the environment. CORS preflight requests don't open a stream, so
+// they are neither counted nor turned away.
+func (l *streamLimiter) middleware(next http.Handler) http.Handler {
+	if l.maxTotal <= 0 && l.maxPerEnv <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "OPTIONS" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		env := getClientContext(req).getMetrics()
+		if !l.acquire(env) {
+			w.Header().Set("Retry-After", strconv.Itoa(streamRetryAfterSecs))
+			writeError(w, req, http.StatusServiceUnavailable, "Too many stream connections; try again later")
+			return
+		}
+		defer l.release(env)
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamLimiter(t *testing.T) {
+	env1, env2 := &clientContextImpl{name: "env1"}, &clientContextImpl{name: "env2"}
+	limiter := newStreamLimiter(3, 2)
+
+	release := make(chan struct{})
+	opened := make(chan struct{})
+	handler := limiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		opened <- struct{}{}
+		<-release
+	}))
+	connect := func(env *clientContextImpl) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/all", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "context", env))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	open := func(env *clientContextImpl) {
+		go connect(env)
+		<-opened
+	}
+
+	open(env1)
+	open(env1)
+	w := connect(env1)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Equal(t, "30", w.Result().Header.Get("Retry-After"))
+
+	open(env2)
+	assert.Equal(t, http.StatusServiceUnavailable, connect(env2).Result().StatusCode)
+
+	// Closing a stream makes room for another
+	release <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for limiter.connections() == 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	open(env2)
+	close(release)
+}
+
+func TestStreamLimiterIgnoresPreflightRequests(t *testing.T) {
+	env := &clientContextImpl{name: "env1"}
+	limiter := newStreamLimiter(1, 1)
+	assert.True(t, limiter.acquire(env.getMetrics()))
+
+	var served bool
+	handler := limiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		served = true
+		assert.Equal(t, 1, limiter.connections())
+	}))
+	req, _ := http.NewRequest("OPTIONS", "http://localhost/ping/env-id", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "context", env))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.True(t, served)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, 1, limiter.connections())
+}
+
+func TestStreamLimiterIsPassThroughWithoutLimits(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	handler := newStreamLimiter(0, 0).middleware(next)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/all", nil)
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	es "github.com/launchdarkly/eventsource"
+)
+
+// How many events a stream client may fall behind by before it is disconnected
+const defaultStreamBufferSize = 128
+
+// The Last-Event-ID given to stream requests that don't have one, so that they are sent a replay
+const replayEventId = "replay"
+
+// streamReplays sends newly connected stream clients the full set of flags and segments, which is built
+// from the store for each client as it connects and not held once it has been sent. Events published to
+// clients are serialized once, however many clients they go to. One streamReplays serves all of an
+// environment's streams.
+type streamReplays struct {
+	generated int64
+	waiting   int64
+	sending   int64
+	// Limits how many replays are built and sent at once across the relay, if a limit is configured; nil
+	// otherwise
+	slots chan struct{}
+}
+
+// replayStats describes the replays of an environment's streams, and the memory held for them
+type replayStats struct {
+	// Replays built from the store
+	Generated int64 `json:"generated"`
+	// Replays waiting for one of the relay's replay slots
+	Waiting int64 `json:"waiting"`
+	// The size of the replayed events that have been built but not yet passed on to their clients
+	SendingBytes int64 `json:"sendingBytes"`
+}
+
+// replayPublisher wraps an ESPublisher for one stream of an environment
+type replayPublisher struct {
+	publisher ESPublisher
+	replays   *streamReplays
+}
+
+type replayRepository struct {
+	repo    es.Repository
+	replays *streamReplays
+}
+
+// encodedEvent is an event that has already been serialized
+type encodedEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+func (e encodedEvent) Id() string {
+	return e.id
+}
+
+func (e encodedEvent) Event() string {
+	return e.event
+}
+
+func (e encodedEvent) Data() string {
+	return e.data
+}
+
+func encodeEvent(event es.Event) encodedEvent {
+	if encoded, ok := event.(encodedEvent); ok {
+		return encoded
+	}
+	return encodedEvent{id: event.Id(), event: event.Event(), data: event.Data()}
+}
+
+func newStreamReplays(slots chan struct{}) *streamReplays {
+	return &streamReplays{slots: slots}
+}
+
+// Returns a publisher for one of the environment's streams whose repositories are replayed through r
+func (r *streamReplays) wrap(publisher ESPublisher) *replayPublisher {
+	return &replayPublisher{publisher: publisher, replays: r}
+}
+
+func (r *streamReplays) stats() replayStats {
+	return replayStats{
+		Generated:    atomic.LoadInt64(&r.generated),
+		Waiting:      atomic.LoadInt64(&r.waiting),
+		SendingBytes: atomic.LoadInt64(&r.sending),
+	}
+}
+
+func (p *replayPublisher) Publish(channels []string, event es.Event) {
+	p.publisher.Publish(channels, encodeEvent(event))
+}
+
+func (p *replayPublisher) PublishComment(channels []string, text string) {
+	p.publisher.PublishComment(channels, text)
+}
+
+func (p *replayPublisher) Register(channel string, repo es.Repository) {
+	p.publisher.Register(channel, replayRepository{repo: repo, replays: p.replays})
+}
+
+func (r replayRepository) Replay(channel, id string) chan es.Event {
+	out := make(chan es.Event)
+	go func() {
+		defer close(out)
+		if r.replays.slots != nil {
+			atomic.AddInt64(&r.replays.waiting, 1)
+			r.replays.slots <- struct{}{}
+			atomic.AddInt64(&r.replays.waiting, -1)
+			defer func() { <-r.replays.slots }()
+		}
+		atomic.AddInt64(&r.replays.generated, 1)
+		for event := range r.repo.Replay(channel, id) {
+			encoded := encodeEvent(event)
+			size := int64(len(encoded.data))
+			atomic.AddInt64(&r.replays.sending, size)
+			out <- encoded
+			atomic.AddInt64(&r.replays.sending, -size)
+		}
+	}()
+	return out
+}
+
+// Returns a handler for a stream that has its repository replayed to each client when it connects. The
+// eventsource server only replays to clients that give a Last-Event-ID, since it would otherwise replay
+// to every client of every channel, so the request is given one if it has none.
+func replayOnConnect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Last-Event-ID") == "" {
+			req.Header.Set("Last-Event-ID", replayEventId)
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
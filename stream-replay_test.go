@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	es "github.com/launchdarkly/eventsource"
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+type countingRepository struct {
+	replays chan struct{}
+}
+
+func (r countingRepository) Replay(channel, id string) chan es.Event {
+	r.replays <- struct{}{}
+	out := make(chan es.Event, 1)
+	out <- makeFlagsPutEvent(map[string]ld.VersionedData{"flag1": &ld.FeatureFlag{Key: "flag1", Version: 1}})
+	close(out)
+	return out
+}
+
+func readReplay(repo es.Repository) []es.Event {
+	var events []es.Event
+	for event := range repo.Replay("channel", "") {
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestReplaysAreBuiltForEachClient(t *testing.T) {
+	replays := newStreamReplays(nil)
+	publisher := &testPublisher{}
+	wrapped := replays.wrap(publisher)
+	counting := countingRepository{replays: make(chan struct{}, 10)}
+	repo := replayRepository{repo: counting, replays: replays}
+
+	first := readReplay(repo)
+	second := readReplay(repo)
+	assert.Len(t, counting.replays, 2)
+	if assert.Len(t, first, 1) {
+		assert.Equal(t, first, second)
+		assert.Equal(t, "put", first[0].Event())
+	}
+	// Nothing is held once the replays have been sent
+	assert.Equal(t, replayStats{Generated: 2}, replays.stats())
+
+	upsert := makeFlagsUpsertEvent(&ld.FeatureFlag{Key: "flag1", Version: 2})
+	wrapped.Publish([]string{"channel"}, upsert)
+	assert.Equal(t, []es.Event{encodedEvent{event: "patch", data: upsert.Data()}}, publisher.events)
+}
+
+func TestReplaysWaitForASlot(t *testing.T) {
+	slots := make(chan struct{}, 1)
+	replays := newStreamReplays(slots)
+	repo := replayRepository{repo: pingRepository{}, replays: replays}
+	slots <- struct{}{}
+	out := repo.Replay("channel", "")
+
+	deadline := time.Now().Add(time.Second)
+	for replays.stats().Waiting == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(1), replays.stats().Waiting)
+
+	<-slots
+	event := <-out
+	assert.Equal(t, "ping", event.Event())
+	assert.Equal(t, int64(0), replays.stats().Waiting)
+}
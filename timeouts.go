@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const (
+	defaultReadHeaderTimeoutSecs = 10
+	defaultRequestTimeoutSecs    = 30
+	defaultIdleTimeoutSecs       = 120
+	defaultStoreTimeoutMs        = 5000
+	defaultGoalsTimeoutSecs      = 10
+	// At most this many reads of a store may be running at once, including reads that have been given up on
+	maxStoreReadsInFlight = 100
+)
+
+var errStoreTimeout = errors.New("the feature store did not respond in time")
+
+// Creates the server for the relay's main listener. The server's own write timeout would cut off stream
+// connections, so it isn't used; requestTimeout bounds every other request instead. For the same reason
+// only the time taken to read request headers is limited, since a read deadline on the connection would
+// also end streams when it passed.
+func newHttpServer(c Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(c.Main.ReadHeaderTimeoutSecs) * time.Second,
+		IdleTimeout:       time.Duration(c.Main.IdleTimeoutSecs) * time.Second,
+	}
+}
+
+// streamHandler marks a handler as serving a long-lived stream, which requestTimeout leaves alone
+type streamHandler struct {
+	http.Handler
+}
+
+// Returns middleware that answers a request with a 504 if its handler hasn't finished within the timeout,
+// so that a slow store or upstream service can't tie up connections indefinitely. The handler's response is
+// held back until it finishes, and discarded if it finishes too late. Stream routes are not affected.
+func requestTimeout(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if route := mux.CurrentRoute(req); route != nil {
+				if _, isStream := route.GetHandler().(streamHandler); isStream {
+					next.ServeHTTP(w, req)
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(req.Context(), timeout)
+			defer cancel()
+			tw := &timeoutWriter{header: make(http.Header)}
+			done := make(chan struct{})
+			panicked := make(chan handlerPanic, 1)
+			go func() {
+				defer func() {
+					if err := recover(); err != nil {
+						tw.mu.Lock()
+						defer tw.mu.Unlock()
+						if tw.timedOut {
+							logLatePanic(req, handlerPanic{err, debug.Stack()})
+							return
+						}
+						panicked <- handlerPanic{err, debug.Stack()}
+						return
+					}
+					close(done)
+				}()
+				next.ServeHTTP(tw, req.WithContext(ctx))
+			}()
+
+			select {
+			case p := <-panicked:
+				// Let the recovery middleware deal with it, as if the handler had run on this goroutine
+				panic(p.value)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				for name, values := range tw.header {
+					w.Header()[name] = values
+				}
+				if tw.status == 0 {
+					tw.status = http.StatusOK
+				}
+				w.WriteHeader(tw.status)
+				w.Write(tw.body.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				select {
+				case p := <-panicked:
+					// The handler panicked just as the request timed out
+					logLatePanic(req, p)
+				default:
+				}
+				writeError(w, req, http.StatusGatewayTimeout, "The request timed out")
+			}
+		})
+	}
+}
+
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// Logs and reports a panic in a handler that requestTimeout had already given up on, which can't be passed on
+// to the recovery middleware since the response has been written
+func logLatePanic(req *http.Request, p handlerPanic) {
+	Error.Printf("Unexpected panic serving %s %s for %s%s after it timed out: %v\n%s", req.Method, req.URL.Path, clientIp(req), forRequest(req), p.value, p.stack)
+	reportPanic(p.value, map[string]string{"method": req.Method, "path": req.URL.Path, "requestId": requestId(req)})
+}
+
+// timeoutWriter holds a handler's response until requestTimeout knows whether it finished in time
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(data []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.body.Write(data)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut && tw.status == 0 {
+		tw.status = status
+	}
+}
+
+// timeoutFeatureStore gives up on reads that take longer than the timeout, returning errStoreTimeout, so
+// that requests fail quickly while a persistent store is unresponsive. The read carries on in the
+// background and its result is dropped. Only so many reads may be running at once, so that a store that
+// has stopped responding can't build up goroutines without limit; once that many are stuck, further reads
+// fail when the timeout passes without starting. Writes come from LaunchDarkly rather than from clients,
+// and are left to finish.
+type timeoutFeatureStore struct {
+	ld.FeatureStore
+	timeout time.Duration
+	// Holds a token for each read that is running
+	reads chan struct{}
+}
+
+func newTimeoutFeatureStore(store ld.FeatureStore, timeout time.Duration, maxReads int) timeoutFeatureStore {
+	return timeoutFeatureStore{FeatureStore: store, timeout: timeout, reads: make(chan struct{}, maxReads)}
+}
+
+type storeReadResult struct {
+	item  ld.VersionedData
+	items map[string]ld.VersionedData
+	err   error
+}
+
+func (s timeoutFeatureStore) read(fn func() storeReadResult) storeReadResult {
+	deadline := time.NewTimer(s.timeout)
+	defer deadline.Stop()
+	select {
+	case s.reads <- struct{}{}:
+	case <-deadline.C:
+		return storeReadResult{err: errStoreTimeout}
+	}
+	// Buffered, so that a read that finishes after we've given up on it doesn't block
+	results := make(chan storeReadResult, 1)
+	go func() {
+		defer func() { <-s.reads }()
+		results <- fn()
+	}()
+	select {
+	case result := <-results:
+		return result
+	case <-deadline.C:
+		return storeReadResult{err: errStoreTimeout}
+	}
+}
+
+func (s timeoutFeatureStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	result := s.read(func() storeReadResult {
+		item, err := s.FeatureStore.Get(kind, key)
+		return storeReadResult{item: item, err: err}
+	})
+	return result.item, result.err
+}
+
+func (s timeoutFeatureStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	result := s.read(func() storeReadResult {
+		items, err := s.FeatureStore.All(kind)
+		return storeReadResult{items: items, err: err}
+	})
+	return result.items, result.err
+}
+
+// Returns the status for a response to a request that failed because of err: 504 if a store or upstream
+// service didn't respond in time, and 500 otherwise
+func errorStatus(err error) int {
+	if err == errStoreTimeout {
+		return http.StatusGatewayTimeout
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
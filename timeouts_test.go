@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func makeTimeoutTestRouter(timeout time.Duration, handler http.HandlerFunc) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(requestTimeout(timeout))
+	router.HandleFunc("/request", handler)
+	router.Handle("/stream", streamHandler{handler})
+	return router
+}
+
+func TestRequestTimeoutPassesOnResponseOfFastHandler(t *testing.T) {
+	router := makeTimeoutTestRouter(time.Second, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("done"))
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/request", nil))
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "yes", w.Header().Get("X-Test"))
+	assert.Equal(t, "done", w.Body.String())
+}
+
+func TestRequestTimeoutRespondsWith504ForSlowHandler(t *testing.T) {
+	router := makeTimeoutTestRouter(10*time.Millisecond, func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		w.Write([]byte("too late"))
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/request", nil))
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.NotContains(t, w.Body.String(), "too late")
+}
+
+func TestRequestTimeoutDoesNotLimitStreams(t *testing.T) {
+	router := makeTimeoutTestRouter(10*time.Millisecond, func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		_, isRecorder := w.(*httptest.ResponseRecorder)
+		assert.True(t, isRecorder, "stream should write directly to the response")
+		w.Write([]byte("event"))
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/stream", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "event", w.Body.String())
+}
+
+func TestRequestTimeoutRepanicsOnRequestGoroutine(t *testing.T) {
+	router := makeTimeoutTestRouter(time.Second, func(w http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	})
+	assert.PanicsWithValue(t, "boom", func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/request", nil))
+	})
+}
+
+func TestRequestTimeoutSurvivesPanicAfterTimingOut(t *testing.T) {
+	finished := make(chan struct{})
+	router := makeTimeoutTestRouter(10*time.Millisecond, func(w http.ResponseWriter, req *http.Request) {
+		defer close(finished)
+		<-req.Context().Done()
+		panic("late boom")
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/request", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	<-finished
+}
+
+type slowFeatureStore struct {
+	ld.FeatureStore
+	delay time.Duration
+}
+
+func (s slowFeatureStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	time.Sleep(s.delay)
+	return s.FeatureStore.Get(kind, key)
+}
+
+func (s slowFeatureStore) All(kind ld.VersionedDataKind) (map[string]ld.VersionedData, error) {
+	time.Sleep(s.delay)
+	return s.FeatureStore.All(kind)
+}
+
+func TestTimeoutFeatureStoreGivesUpOnSlowReads(t *testing.T) {
+	base := ld.NewInMemoryFeatureStore(nil)
+	base.Upsert(ld.Features, &ld.FeatureFlag{Key: "flag", Version: 1})
+
+	fast := newTimeoutFeatureStore(slowFeatureStore{base, 0}, time.Second, maxStoreReadsInFlight)
+	item, err := fast.Get(ld.Features, "flag")
+	assert.NoError(t, err)
+	assert.Equal(t, "flag", item.GetKey())
+	items, err := fast.All(ld.Features)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+
+	slow := newTimeoutFeatureStore(slowFeatureStore{base, 100 * time.Millisecond}, 10*time.Millisecond, maxStoreReadsInFlight)
+	_, err = slow.Get(ld.Features, "flag")
+	assert.Equal(t, errStoreTimeout, err)
+	_, err = slow.All(ld.Features)
+	assert.Equal(t, errStoreTimeout, err)
+}
+
+// blockedFeatureStore counts reads, which never finish until it is released
+type blockedFeatureStore struct {
+	ld.FeatureStore
+	reads   *int32
+	release chan struct{}
+}
+
+func (s blockedFeatureStore) Get(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	atomic.AddInt32(s.reads, 1)
+	<-s.release
+	return nil, nil
+}
+
+func TestTimeoutFeatureStoreLimitsReadsInFlight(t *testing.T) {
+	var reads int32
+	blocked := blockedFeatureStore{reads: &reads, release: make(chan struct{})}
+	store := newTimeoutFeatureStore(blocked, 10*time.Millisecond, 2)
+	for i := 0; i < 5; i++ {
+		_, err := store.Get(ld.Features, "flag")
+		assert.Equal(t, errStoreTimeout, err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&reads))
+
+	// Once the stuck reads finish, there is room for more
+	close(blocked.release)
+	deadline := time.Now().Add(time.Second)
+	for len(store.reads) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	_, err := store.Get(ld.Features, "flag")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&reads))
+}
+
+type fakeNetError struct{ timeout bool }
+
+func (e fakeNetError) Error() string   { return "network error" }
+func (e fakeNetError) Timeout() bool   { return e.timeout }
+func (e fakeNetError) Temporary() bool { return false }
+
+var _ net.Error = fakeNetError{}
+
+func TestErrorStatus(t *testing.T) {
+	assert.Equal(t, http.StatusGatewayTimeout, errorStatus(errStoreTimeout))
+	assert.Equal(t, http.StatusGatewayTimeout, errorStatus(fakeNetError{timeout: true}))
+	assert.Equal(t, http.StatusInternalServerError, errorStatus(fakeNetError{timeout: false}))
+	assert.Equal(t, http.StatusInternalServerError, errorStatus(errors.New("failed")))
+}
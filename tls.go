@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+func tlsEnabled(c Config) bool {
+	return c.TLS.CertFile != "" || acmeEnabled(c)
+}
+
+// Builds the TLS configuration for the relay's listener. If a client CA bundle is configured, every
+// client must present a certificate signed by one of those CAs.
+func makeTLSConfig(c Config) (*tls.Config, error) {
+	if acmeManager != nil {
+		return makeAcmeTLSConfig(acmeManager), nil
+	}
+	if c.TLS.KeyFile == "" {
+		return nil, errors.New("keyFile must be specified along with certFile")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.TLS.ClientCaFile != "" {
+		caData, err := ioutil.ReadFile(c.TLS.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no certificates found in " + c.TLS.ClientCaFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// Returns true if the request may use an environment restricted to clients whose certificates have one of
+// the given subject alternative names. Environments with no restriction can be used by anyone.
+func clientCertAllowed(req *http.Request, allowedSans []string) bool {
+	if len(allowedSans) == 0 {
+		return true
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	cert := req.TLS.PeerCertificates[0]
+	sans := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		for _, allowed := range allowedSans {
+			if san == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func makeTestCert(t *testing.T, template *x509.Certificate, issuer *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ld-relay-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ca := makeTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := makeTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "relay"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	makeClientCert := func(san string) tls.Certificate {
+		return makeTestCert(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: san},
+			DNSNames:    []string{san},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca).tlsCertificate()
+	}
+
+	var config Config
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	config.TLS.CertFile, config.TLS.KeyFile = server.writeFiles(t, dir, "server")
+	config.TLS.ClientCaFile = caFile
+	sdkKey := "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+	allowed := []string{"billing.internal"}
+	config.Environment = map[string]*EnvConfig{"test": {SdkKey: sdkKey, AllowedClientSan: &allowed}}
+
+	tlsConfig, err := makeTLSConfig(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	relay := makeTestRelay(config)
+	httpServer := httptest.NewUnstartedServer(relay.getHandler())
+	httpServer.TLS = tlsConfig
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(clientCerts []tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: clientCerts}}}
+		req, _ := http.NewRequest("REPORT", httpServer.URL+"/sdk/eval/user", strings.NewReader(`{"key":"me"}`))
+		req.Header.Set("Authorization", sdkKey)
+		req.Header.Set("Content-Type", "application/json")
+		return client.Do(req)
+	}
+
+	t.Run("no client certificate", func(t *testing.T) {
+		_, err := get(nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("allowed certificate", func(t *testing.T) {
+		resp, err := get([]tls.Certificate{makeClientCert("billing.internal")})
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("certificate not allowed for environment", func(t *testing.T) {
+		resp, err := get([]tls.Certificate{makeClientCert("search.internal")})
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var validHeaderName = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// Headers the relay sets itself, which would break requests to LaunchDarkly if they were replaced
+var reservedUpstreamHeaders = map[string]bool{
+	"Authorization":  true,
+	"Content-Type":   true,
+	"Content-Length": true,
+	"Host":           true,
+	"User-Agent":     true,
+}
+
+// upstreamHeaders are added to every request the relay makes to LaunchDarkly, or to a parent relay, for an
+// environment: its stream and polling requests, goals and events. They are made up of the [upstream] settings
+// and the environment's own, so that requests can pass through a gateway that wants a token or an identifier.
+type upstreamHeaders struct {
+	header http.Header
+	// Appended to the User-Agent of each request
+	userAgentSuffix string
+}
+
+// Parses headers given as "Name: value"
+func parseUpstreamHeaders(entries []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !validHeaderName.MatchString(name) {
+			return nil, fmt.Errorf("invalid header %q; expected \"Name: value\"", entry)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if reservedUpstreamHeaders[name] {
+			return nil, fmt.Errorf("the %s header is set by the relay and can't be replaced", name)
+		}
+		value := strings.TrimSpace(parts[1])
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("the value of header %s may not contain line breaks", name)
+		}
+		header.Add(name, value)
+	}
+	return header, nil
+}
+
+func validateUserAgentSuffix(suffix string) error {
+	if strings.ContainsAny(suffix, "\r\n") {
+		return errors.New("userAgentSuffix may not contain line breaks")
+	}
+	return nil
+}
+
+func validateEnvUpstreamHeaders(envConfig EnvConfig) error {
+	if envConfig.UpstreamHeader != nil {
+		if _, err := parseUpstreamHeaders(*envConfig.UpstreamHeader); err != nil {
+			return err
+		}
+	}
+	return validateUserAgentSuffix(envConfig.UserAgentSuffix)
+}
+
+// Returns the headers for an environment's upstream requests. An environment's header replaces an [upstream]
+// header of the same name, and its userAgentSuffix replaces the one in [upstream]. The headers must already
+// have been validated.
+func newUpstreamHeaders(c Config, envConfig EnvConfig) upstreamHeaders {
+	header, _ := parseUpstreamHeaders(c.Upstream.Header)
+	if envConfig.UpstreamHeader != nil {
+		envHeader, _ := parseUpstreamHeaders(*envConfig.UpstreamHeader)
+		for name, values := range envHeader {
+			header[name] = values
+		}
+	}
+	h := upstreamHeaders{header: header, userAgentSuffix: c.Upstream.UserAgentSuffix}
+	if envConfig.UserAgentSuffix != "" {
+		h.userAgentSuffix = envConfig.UserAgentSuffix
+	}
+	return h
+}
+
+func (h upstreamHeaders) empty() bool {
+	return len(h.header) == 0 && h.userAgentSuffix == ""
+}
+
+// Adds the headers to a request, after anything else has set its User-Agent
+func (h upstreamHeaders) apply(req *http.Request) {
+	for name, values := range h.header {
+		req.Header[name] = values
+	}
+	if h.userAgentSuffix != "" {
+		req.Header.Set("User-Agent", strings.TrimSpace(req.Header.Get("User-Agent")+" "+h.userAgentSuffix))
+	}
+}
+
+// Returns a client like upstreamClient's that adds the headers to each request
+func (h upstreamHeaders) client(timeout time.Duration) *http.Client {
+	client := upstreamClient(timeout)
+	if !h.empty() {
+		client.Transport = headerTransport{base: client.Transport, headers: h}
+	}
+	return client
+}
+
+// headerTransport adds headers to each request, including those made by the LaunchDarkly SDK's event
+// processor, which the relay doesn't build itself
+type headerTransport struct {
+	base    http.RoundTripper
+	headers upstreamHeaders
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper may not change the request it was given
+	withHeaders := new(http.Request)
+	*withHeaders = *req
+	withHeaders.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		withHeaders.Header[name] = values
+	}
+	t.headers.apply(withHeaders)
+	return t.base.RoundTrip(withHeaders)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpstreamHeaders(t *testing.T) {
+	header, err := parseUpstreamHeaders([]string{"x-gateway-token: abc:123", "X-Team:payments"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "abc:123", header.Get("X-Gateway-Token"))
+		assert.Equal(t, "payments", header.Get("X-Team"))
+	}
+	for _, invalid := range []string{"no-colon", ": value", "bad name: value", "Authorization: sdk-key", "user-agent: me"} {
+		_, err := parseUpstreamHeaders([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestEnvironmentUpstreamHeadersReplaceGlobalOnes(t *testing.T) {
+	var c Config
+	c.Upstream.Header = []string{"X-Gateway-Token: global", "X-Region: eu"}
+	c.Upstream.UserAgentSuffix = "global-suffix"
+	assert.Equal(t, upstreamHeaders{
+		header:          http.Header{"X-Gateway-Token": {"global"}, "X-Region": {"eu"}},
+		userAgentSuffix: "global-suffix",
+	}, newUpstreamHeaders(c, EnvConfig{}))
+
+	envHeader := []string{"X-Gateway-Token: env"}
+	h := newUpstreamHeaders(c, EnvConfig{UpstreamHeader: &envHeader, UserAgentSuffix: "env-suffix"})
+	assert.Equal(t, "env", h.header.Get("X-Gateway-Token"))
+	assert.Equal(t, "eu", h.header.Get("X-Region"))
+	assert.Equal(t, "env-suffix", h.userAgentSuffix)
+
+	assert.True(t, newUpstreamHeaders(Config{}, EnvConfig{}).empty())
+}
+
+func TestUpstreamHeadersAreAddedToRequests(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req.Header
+	}))
+	defer server.Close()
+
+	h := upstreamHeaders{header: http.Header{"X-Gateway-Token": {"abc"}}, userAgentSuffix: "acme-egress/1.0"}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("User-Agent", "LDRelay/"+Version)
+	resp, err := h.client(0).Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, "abc", received.Get("X-Gateway-Token"))
+		assert.Equal(t, "LDRelay/"+Version+" acme-egress/1.0", received.Get("User-Agent"))
+	}
+	// The caller's request is left as it was
+	assert.Equal(t, "", req.Header.Get("X-Gateway-Token"))
+	assert.Equal(t, "LDRelay/"+Version, req.Header.Get("User-Agent"))
+}
+
+func TestUpstreamHeadersAreAddedToEvents(t *testing.T) {
+	server, received := startFakeEventsServer()
+	defer server.Close()
+
+	var config Config
+	config.Events.EventsUri = server.URL
+	config.Events.SendEvents = true
+	config.Events.Capacity = defaultEventCapacity
+	config.Events.FlushIntervalSecs = 60
+	h := upstreamHeaders{header: http.Header{"X-Gateway-Token": {"abc"}}, userAgentSuffix: "acme-egress/1.0"}
+	relay := newEventVerbatimRelay("sdk-key", config, h)
+	relay.enqueue([]json.RawMessage{json.RawMessage(`{"kind":"identify"}`)}, 3)
+	relay.flush()
+	close(relay.closer)
+
+	if posts := received(); assert.Len(t, posts, 1) {
+		assert.Equal(t, "sdk-key", posts[0].headers.Get("Authorization"))
+		assert.Equal(t, "abc", posts[0].headers.Get("X-Gateway-Token"))
+		assert.Equal(t, "LDRelay/"+Version+" acme-egress/1.0", posts[0].headers.Get("User-Agent"))
+	}
+}
+
+func TestLoadConfigRejectsInvalidUpstreamHeaders(t *testing.T) {
+	configFile := writeTestConfig(t, `
+[upstream]
+	header = "Authorization: sdk-other"
+`)
+	defer os.Remove(configFile)
+	_, err := loadConfig(configFile)
+	assert.EqualError(t, err, "invalid upstream header: the Authorization header is set by the relay and can't be replaced")
+
+	envConfigFile := writeTestConfig(t, `
+[environment "env1"]
+	sdkKey = "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0"
+	upstreamHeader = "no colon"
+`)
+	defer os.Remove(envConfigFile)
+	_, err = loadConfig(envConfigFile)
+	assert.EqualError(t, err, `invalid upstream headers for environment "env1": invalid header "no colon"; expected "Name: value"`)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultUpstreamDialTimeoutMs        = 5000
+	defaultUpstreamTlsTimeoutMs         = 10000
+	defaultUpstreamResponseTimeoutMs    = 30000
+	defaultUpstreamKeepAliveSecs        = 30
+	defaultUpstreamIdleConnTimeoutSecs  = 90
+	defaultUpstreamMaxIdleConnsPerHost  = 20
+	defaultUpstreamMaxIdleConnsPerRelay = 200
+)
+
+// The transport shared by every client that talks to LaunchDarkly or a parent relay, so that connections are
+// pooled and kept alive between requests rather than opened for each one. It is configured from the
+// [upstream] section when the relay starts, before any requests are made.
+var upstreamTransport = newUpstreamTransport()
+
+func newUpstreamTransport() *http.Transport {
+	t := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	configureUpstreamTransport(t, defaultUpstreamConfig())
+	return t
+}
+
+// upstreamConfig tunes the connections the relay makes to LaunchDarkly. Timeouts of 0 mean no timeout.
+type upstreamConfig struct {
+	DialTimeoutMs       int
+	TlsTimeoutMs        int
+	ResponseTimeoutMs   int
+	KeepAliveSecs       int
+	IdleConnTimeoutSecs int
+	MaxIdleConnsPerHost int
+	// Added to every upstream request; see upstreamHeaders
+	Header          []string
+	UserAgentSuffix string
+}
+
+func defaultUpstreamConfig() upstreamConfig {
+	return upstreamConfig{
+		DialTimeoutMs:       defaultUpstreamDialTimeoutMs,
+		TlsTimeoutMs:        defaultUpstreamTlsTimeoutMs,
+		ResponseTimeoutMs:   defaultUpstreamResponseTimeoutMs,
+		KeepAliveSecs:       defaultUpstreamKeepAliveSecs,
+		IdleConnTimeoutSecs: defaultUpstreamIdleConnTimeoutSecs,
+		MaxIdleConnsPerHost: defaultUpstreamMaxIdleConnsPerHost,
+	}
+}
+
+// Applies the configuration to a transport. The response timeout only covers waiting for response headers,
+// so it doesn't cut off streams.
+func configureUpstreamTransport(t *http.Transport, c upstreamConfig) {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(c.DialTimeoutMs) * time.Millisecond,
+		KeepAlive: time.Duration(c.KeepAliveSecs) * time.Second,
+	}
+	t.DialContext = dialer.DialContext
+	t.TLSHandshakeTimeout = time.Duration(c.TlsTimeoutMs) * time.Millisecond
+	t.ResponseHeaderTimeout = time.Duration(c.ResponseTimeoutMs) * time.Millisecond
+	t.IdleConnTimeout = time.Duration(c.IdleConnTimeoutSecs) * time.Second
+	t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	t.MaxIdleConns = defaultUpstreamMaxIdleConnsPerRelay
+	if t.MaxIdleConns < c.MaxIdleConnsPerHost {
+		t.MaxIdleConns = c.MaxIdleConnsPerHost
+	}
+}
+
+// Returns a client for requests to LaunchDarkly or a parent relay that go through the shared transport.
+// Requests give up after the timeout, if it is not 0.
+func upstreamClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: upstreamTransport, Timeout: timeout}
+}
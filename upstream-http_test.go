@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamTransportIsConfigured(t *testing.T) {
+	transport := newUpstreamTransport()
+	assert.Equal(t, defaultUpstreamMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+
+	c := defaultUpstreamConfig()
+	c.TlsTimeoutMs = 2000
+	c.ResponseTimeoutMs = 0
+	c.MaxIdleConnsPerHost = 500
+	configureUpstreamTransport(transport, c)
+	assert.Equal(t, 2*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, time.Duration(0), transport.ResponseHeaderTimeout)
+	assert.Equal(t, 500, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 500, transport.MaxIdleConns)
+}
+
+func TestUpstreamClientsReuseConnections(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	var connections int32
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := upstreamClient(time.Second).Get(server.URL)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	es "github.com/launchdarkly/eventsource"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const (
+	defaultReconnectInitialDelayMs = 1000
+	defaultReconnectMaxDelayMs     = 30000
+	defaultReconnectJitterPercent  = 50
+	// LaunchDarkly sends a heartbeat every three minutes, so a stream that has been silent for longer than
+	// this has stalled
+	defaultStreamStaleSecs = 300
+	// A connection that stays up this long is taken to be healthy, and the next reconnect starts again from
+	// the initial delay
+	reconnectResetInterval = time.Minute
+	upstreamRequestTimeout = 10 * time.Second
+)
+
+// reconnectBackoff describes how long to wait before each attempt to reconnect to the upstream stream. The
+// delay doubles with each failed attempt, up to the maximum, and a random part of it, given by the jitter
+// percentage, is taken off so that many relays don't all reconnect at once.
+type reconnectBackoff struct {
+	initial   time.Duration
+	max       time.Duration
+	jitterPct int
+}
+
+// Reads the backoff from the configuration, using the defaults for any delays that aren't set
+func newReconnectBackoff(c Config) reconnectBackoff {
+	b := reconnectBackoff{
+		initial:   time.Duration(c.Main.ReconnectInitialDelayMs) * time.Millisecond,
+		max:       time.Duration(c.Main.ReconnectMaxDelayMs) * time.Millisecond,
+		jitterPct: c.Main.ReconnectJitterPercent,
+	}
+	if b.initial <= 0 {
+		b.initial = defaultReconnectInitialDelayMs * time.Millisecond
+	}
+	if b.max < b.initial {
+		b.max = b.initial
+		if b.max < defaultReconnectMaxDelayMs*time.Millisecond {
+			b.max = defaultReconnectMaxDelayMs * time.Millisecond
+		}
+	}
+	return b
+}
+
+func validateReconnectBackoff(c Config) error {
+	if c.Main.ReconnectInitialDelayMs <= 0 {
+		return errors.New("reconnectInitialDelayMs must be greater than 0")
+	}
+	if c.Main.ReconnectMaxDelayMs < c.Main.ReconnectInitialDelayMs {
+		return errors.New("reconnectMaxDelayMs may not be less than reconnectInitialDelayMs")
+	}
+	if c.Main.ReconnectJitterPercent < 0 || c.Main.ReconnectJitterPercent > 100 {
+		return errors.New("reconnectJitterPercent must be between 0 and 100")
+	}
+	if c.Main.StreamStaleSecs < 0 {
+		return errors.New("streamStaleSecs may not be negative")
+	}
+	return nil
+}
+
+// Returns the delay before the given reconnect attempt, counting from 0
+func (b reconnectBackoff) delay(attempt int) time.Duration {
+	delay := b.initial
+	for i := 0; i < attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	if b.jitterPct > 0 {
+		delay -= time.Duration(rand.Int63n(int64(delay)*int64(b.jitterPct)/100 + 1))
+	}
+	return delay
+}
+
+type upstreamStatusError struct {
+	code int
+}
+
+func (e upstreamStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from stream", e.code)
+}
+
+// Returned when the stream was closed because it went stale, which has already been logged
+var errUpstreamStreamStale = errors.New("stream was closed after receiving nothing")
+
+// upstreamStream takes the place of the LaunchDarkly client's own stream processor, so that the relay can
+// control how it reconnects and can tell when the stream has gone quiet. An upstream connection can stall
+// without being closed, for instance behind a proxy that drops it silently, and the client would go on
+// reporting that it is connected. Any data received, including heartbeats, shows that the stream is alive.
+type upstreamStream struct {
+	sdkKey     string
+	config     ld.Config
+	backoff    reconnectBackoff
+	staleAfter time.Duration
+	client     *http.Client
+	// Used for fetching single items, which are given up on if they take too long
+	itemClient *http.Client
+	mu         sync.Mutex
+	// Set once the first full set of data has been received
+	initialized  bool
+	lastActivity time.Time
+	stalled      bool
+	// Set if LaunchDarkly has refused the SDK key, in which case the stream isn't retried
+	failed    error
+	body      io.Closer
+	halt      chan struct{}
+	closeOnce sync.Once
+}
+
+func newUpstreamStream(sdkKey string, config ld.Config, backoff reconnectBackoff, staleAfter time.Duration, headers upstreamHeaders) *upstreamStream {
+	return &upstreamStream{
+		sdkKey:     sdkKey,
+		config:     config,
+		backoff:    backoff,
+		staleAfter: staleAfter,
+		client:     headers.client(0),
+		itemClient: headers.client(upstreamRequestTimeout),
+		halt:       make(chan struct{}),
+	}
+}
+
+func (s *upstreamStream) Initialized() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.initialized
+}
+
+// Returns the error that stopped the stream for good, if it has been stopped
+func (s *upstreamStream) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed
+}
+
+func (s *upstreamStream) Start(closeWhenReady chan<- struct{}) {
+	s.config.Logger.Printf("Starting LaunchDarkly streaming connection")
+	go s.run(closeWhenReady)
+	if s.staleAfter > 0 {
+		go s.watch()
+	}
+}
+
+func (s *upstreamStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.config.Logger.Printf("Closing event stream.")
+		close(s.halt)
+		s.mu.Lock()
+		if s.body != nil {
+			s.body.Close()
+		}
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+func (s *upstreamStream) halted() bool {
+	select {
+	case <-s.halt:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reports whether the stream has received nothing for longer than the stale window. A stream is never
+// stale before it has received its first data, since until then the environment reports that it is
+// initializing.
+func (s *upstreamStream) stale() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.staleLocked()
+}
+
+func (s *upstreamStream) staleLocked() bool {
+	return s.staleAfter > 0 && s.initialized && time.Since(s.lastActivity) > s.staleAfter
+}
+
+func (s *upstreamStream) touch() {
+	s.mu.Lock()
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
+}
+
+// Logs when the stream goes stale and when it recovers. A stale connection is closed, so that a new one is
+// made; a connection that has stalled may never be closed otherwise.
+func (s *upstreamStream) watch() {
+	interval := s.staleAfter / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.halt:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			stale, wasStalled := s.staleLocked(), s.stalled
+			s.stalled = stale
+			if stale && !wasStalled && s.body != nil {
+				s.body.Close()
+				s.body = nil
+			}
+			s.mu.Unlock()
+			if stale && !wasStalled {
+				// Logged as an error so that it is also reported to Sentry, if that is configured
+				s.config.Logger.Printf("ERROR: Nothing received from the LaunchDarkly stream in %s; reconnecting", s.staleAfter)
+			} else if !stale && wasStalled {
+				s.config.Logger.Printf("LaunchDarkly stream is receiving data again")
+			}
+		}
+	}
+}
+
+func (s *upstreamStream) run(closeWhenReady chan<- struct{}) {
+	attempt := 0
+	for {
+		connectedAt := time.Now()
+		err := s.connectAndRead(closeWhenReady)
+		if s.halted() {
+			return
+		}
+		if se, ok := err.(upstreamStatusError); ok && (se.code == http.StatusUnauthorized || se.code == http.StatusForbidden) {
+			s.config.Logger.Printf("ERROR: Received %d error, no further streaming connection will be made since SDK key is invalid", se.code)
+			s.mu.Lock()
+			s.failed = err
+			initialized := s.initialized
+			s.mu.Unlock()
+			if !initialized {
+				// The client stops waiting for the stream straight away, rather than at the end of its timeout
+				close(closeWhenReady)
+			}
+			return
+		}
+		if err != nil && err != io.EOF && err != errUpstreamStreamStale {
+			s.config.Logger.Printf("ERROR: Error encountered processing stream: %+v", err)
+		}
+		if time.Since(connectedAt) >= reconnectResetInterval {
+			attempt = 0
+		}
+		delay := s.backoff.delay(attempt)
+		attempt++
+		s.config.Logger.Printf("Reconnecting to stream in %0.3f secs", delay.Seconds())
+		select {
+		case <-s.halt:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Connects to the stream and applies its events to the feature store until the connection ends
+func (s *upstreamStream) connectAndRead(closeWhenReady chan<- struct{}) error {
+	req, _ := http.NewRequest("GET", strings.TrimRight(s.config.StreamUri, "/")+"/all", nil)
+	req.Header.Set("Authorization", s.sdkKey)
+	req.Header.Set("User-Agent", s.config.UserAgent)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	s.config.Logger.Printf("Connecting to LaunchDarkly stream using URL: %s", req.URL.String())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return upstreamStatusError{resp.StatusCode}
+	}
+
+	s.mu.Lock()
+	s.body = resp.Body
+	halted := s.halted()
+	s.mu.Unlock()
+	if halted {
+		return nil
+	}
+	s.touch()
+
+	dec := es.NewDecoder(activityReader{resp.Body, s.touch})
+	for {
+		event, err := dec.Decode()
+		if err != nil {
+			s.mu.Lock()
+			closedAsStale := s.body == nil
+			s.mu.Unlock()
+			if closedAsStale {
+				return errUpstreamStreamStale
+			}
+			return err
+		}
+		if err := s.handleEvent(event, closeWhenReady); err != nil {
+			return err
+		}
+	}
+}
+
+// Applies an event to the feature store. Events that can't be parsed are logged and skipped, but an error is
+// returned if the store can't be written, so that the stream is reconnected and LaunchDarkly sends all of the
+// data again.
+func (s *upstreamStream) handleEvent(event es.Event, closeWhenReady chan<- struct{}) error {
+	store, logger := s.config.FeatureStore, s.config.Logger
+	switch event.Event() {
+	case "put":
+		var put struct {
+			Data struct {
+				Flags    map[string]*ld.FeatureFlag `json:"flags"`
+				Segments map[string]*ld.Segment     `json:"segments"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(event.Data()), &put); err != nil {
+			logger.Printf("ERROR: Unexpected error unmarshalling PUT json: %+v", err)
+			return nil
+		}
+		if err := store.Init(ld.MakeAllVersionedDataMap(put.Data.Flags, put.Data.Segments)); err != nil {
+			return fmt.Errorf("unable to initialize the feature store: %s", err)
+		}
+		s.mu.Lock()
+		first := !s.initialized
+		s.initialized = true
+		s.mu.Unlock()
+		if first {
+			logger.Printf("Started LaunchDarkly streaming client")
+			close(closeWhenReady)
+		}
+	case "patch":
+		var patch struct {
+			Path string          `json:"path"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(event.Data()), &patch); err != nil {
+			logger.Printf("ERROR: Unexpected error unmarshalling PATCH json: %+v", err)
+			return nil
+		}
+		kind, _, ok := parseDataPath(patch.Path)
+		if !ok {
+			logger.Printf("ERROR: Unknown data path: %s. Ignoring patch.", patch.Path)
+			return nil
+		}
+		item, err := unmarshalItem(kind, patch.Data)
+		if err != nil {
+			logger.Printf("ERROR: Unexpected error unmarshalling %s json: %+v", kind.GetNamespace(), err)
+			return nil
+		}
+		if err := store.Upsert(kind, item); err != nil {
+			return fmt.Errorf("unable to update %s in the feature store: %s", kind.GetNamespace(), err)
+		}
+	case "delete":
+		var data struct {
+			Path    string `json:"path"`
+			Version int    `json:"version"`
+		}
+		if err := json.Unmarshal([]byte(event.Data()), &data); err != nil {
+			logger.Printf("ERROR: Unexpected error unmarshalling DELETE json: %+v", err)
+			return nil
+		}
+		kind, key, ok := parseDataPath(data.Path)
+		if !ok {
+			logger.Printf("ERROR: Unknown data path: %s. Ignoring delete.", data.Path)
+			return nil
+		}
+		if err := store.Delete(kind, key, data.Version); err != nil {
+			return fmt.Errorf("unable to delete from %s in the feature store: %s", kind.GetNamespace(), err)
+		}
+	case "indirect/patch":
+		kind, key, ok := parseDataPath(event.Data())
+		if !ok {
+			logger.Printf("ERROR: Unknown data path: %s. Ignoring patch.", event.Data())
+			return nil
+		}
+		item, err := s.requestItem(kind, key)
+		if err != nil {
+			logger.Printf("ERROR: Unexpected error requesting %s: %+v", kind.GetNamespace(), err)
+			return nil
+		}
+		if err := store.Upsert(kind, item); err != nil {
+			return fmt.Errorf("unable to update %s in the feature store: %s", kind.GetNamespace(), err)
+		}
+	default:
+		logger.Printf("Unexpected event found in stream: %s", event.Event())
+	}
+	return nil
+}
+
+// Fetches a single flag or segment that the stream only told us has changed
+func (s *upstreamStream) requestItem(kind ld.VersionedDataKind, key string) (ld.VersionedData, error) {
+	path := ld.LatestFlagsPath
+	if kind == ld.Segments {
+		path = ld.LatestSegmentsPath
+	}
+	req, _ := http.NewRequest("GET", strings.TrimRight(s.config.BaseUri, "/")+path+"/"+key, nil)
+	req.Header.Set("Authorization", s.sdkKey)
+	req.Header.Set("User-Agent", s.config.UserAgent)
+	resp, err := s.itemClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalItem(kind, body)
+}
+
+// Splits a stream path such as "/flags/my-flag" into the kind of data and its key
+func parseDataPath(path string) (ld.VersionedDataKind, string, bool) {
+	switch {
+	case strings.HasPrefix(path, "/flags/"):
+		return ld.Features, strings.TrimPrefix(path, "/flags/"), true
+	case strings.HasPrefix(path, "/segments/"):
+		return ld.Segments, strings.TrimPrefix(path, "/segments/"), true
+	default:
+		return nil, "", false
+	}
+}
+
+func unmarshalItem(kind ld.VersionedDataKind, data []byte) (ld.VersionedData, error) {
+	if kind == ld.Segments {
+		var segment ld.Segment
+		err := json.Unmarshal(data, &segment)
+		return &segment, err
+	}
+	var flag ld.FeatureFlag
+	err := json.Unmarshal(data, &flag)
+	return &flag, err
+}
+
+// activityReader calls touch whenever data is read, so that heartbeats, which the decoder skips, still show
+// that the stream is alive
+type activityReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
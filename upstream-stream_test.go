@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestReconnectBackoffDelay(t *testing.T) {
+	b := reconnectBackoff{initial: time.Second, max: 5 * time.Second}
+	assert.Equal(t, time.Second, b.delay(0))
+	assert.Equal(t, 2*time.Second, b.delay(1))
+	assert.Equal(t, 4*time.Second, b.delay(2))
+	assert.Equal(t, 5*time.Second, b.delay(3))
+	assert.Equal(t, 5*time.Second, b.delay(100))
+
+	b.jitterPct = 50
+	for i := 0; i < 100; i++ {
+		delay := b.delay(1)
+		assert.True(t, delay >= time.Second && delay <= 2*time.Second, "delay %s out of range", delay)
+	}
+}
+
+func TestReconnectBackoffDefaults(t *testing.T) {
+	var c Config
+	b := newReconnectBackoff(c)
+	assert.Equal(t, defaultReconnectInitialDelayMs*time.Millisecond, b.initial)
+	assert.Equal(t, defaultReconnectMaxDelayMs*time.Millisecond, b.max)
+}
+
+func makeTestUpstreamStream(uri string, store ld.FeatureStore, staleAfter time.Duration) *upstreamStream {
+	config := ld.DefaultConfig
+	config.StreamUri = uri
+	config.BaseUri = uri
+	config.FeatureStore = store
+	config.Logger = nullLogger
+	backoff := reconnectBackoff{initial: 10 * time.Millisecond, max: 10 * time.Millisecond}
+	return newUpstreamStream("sdk-key", config, backoff, staleAfter, upstreamHeaders{})
+}
+
+func waitForReady(t *testing.T, ready chan struct{}) bool {
+	select {
+	case <-ready:
+		return true
+	case <-time.After(time.Second):
+		assert.Fail(t, "stream did not initialize")
+		return false
+	}
+}
+
+func TestUpstreamStreamAppliesEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/all":
+			assert.Equal(t, "sdk-key", req.Header.Get("Authorization"))
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: put\ndata: {\"path\":\"/\",\"data\":{\"flags\":{\"flag1\":{\"key\":\"flag1\",\"version\":1},\"flag2\":{\"key\":\"flag2\",\"version\":1}},\"segments\":{}}}\n\n")
+			fmt.Fprint(w, "event: patch\ndata: {\"path\":\"/flags/flag1\",\"data\":{\"key\":\"flag1\",\"version\":2}}\n\n")
+			fmt.Fprint(w, "event: delete\ndata: {\"path\":\"/flags/flag2\",\"version\":2}\n\n")
+			fmt.Fprint(w, "event: indirect/patch\ndata: /segments/segment1\n\n")
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+		case "/sdk/latest-segments/segment1":
+			fmt.Fprint(w, `{"key":"segment1","version":3}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	store := ld.NewInMemoryFeatureStore(nullLogger)
+	stream := makeTestUpstreamStream(server.URL, store, 0)
+	ready := make(chan struct{})
+	stream.Start(ready)
+	defer stream.Close()
+	if !waitForReady(t, ready) {
+		return
+	}
+	assert.True(t, stream.Initialized())
+
+	deadline := time.Now().Add(time.Second)
+	var segment ld.VersionedData
+	for segment == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		segment, _ = store.Get(ld.Segments, "segment1")
+	}
+	if assert.NotNil(t, segment) {
+		assert.Equal(t, 3, segment.GetVersion())
+	}
+	flag1, _ := store.Get(ld.Features, "flag1")
+	if assert.NotNil(t, flag1) {
+		assert.Equal(t, 2, flag1.GetVersion())
+	}
+	flag2, _ := store.Get(ld.Features, "flag2")
+	assert.Nil(t, flag2)
+}
+
+func TestUpstreamStreamReconnects(t *testing.T) {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		fmt.Fprint(w, "event: put\ndata: {\"path\":\"/\",\"data\":{\"flags\":{},\"segments\":{}}}\n\n")
+	}))
+	defer server.Close()
+
+	stream := makeTestUpstreamStream(server.URL, ld.NewInMemoryFeatureStore(nullLogger), 0)
+	stream.Start(make(chan struct{}))
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&connections) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stream.Close()
+	assert.True(t, atomic.LoadInt32(&connections) >= 3)
+}
+
+func TestUpstreamStreamStopsOnUnauthorized(t *testing.T) {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	stream := makeTestUpstreamStream(server.URL, ld.NewInMemoryFeatureStore(nullLogger), 0)
+	ready := make(chan struct{})
+	stream.Start(ready)
+	defer stream.Close()
+	// The client is told to stop waiting straight away
+	waitForReady(t, ready)
+	assert.False(t, stream.Initialized())
+	assert.Equal(t, upstreamStatusError{http.StatusUnauthorized}, stream.failure())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
+
+// initFailingFeatureStore fails the given number of calls to Init before it starts to succeed
+type initFailingFeatureStore struct {
+	ld.FeatureStore
+	failures int32
+}
+
+func (s *initFailingFeatureStore) Init(allData map[ld.VersionedDataKind]map[string]ld.VersionedData) error {
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return errors.New("store is down")
+	}
+	return s.FeatureStore.Init(allData)
+}
+
+func TestUpstreamStreamReconnectsWhenTheStoreCantBeWritten(t *testing.T) {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		fmt.Fprint(w, "event: put\ndata: {\"path\":\"/\",\"data\":{\"flags\":{},\"segments\":{}}}\n\n")
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+
+	store := &initFailingFeatureStore{FeatureStore: ld.NewInMemoryFeatureStore(nullLogger), failures: 1}
+	stream := makeTestUpstreamStream(server.URL, store, 0)
+	ready := make(chan struct{})
+	stream.Start(ready)
+	defer stream.Close()
+	if waitForReady(t, ready) {
+		assert.True(t, store.Initialized())
+		assert.Equal(t, int32(2), atomic.LoadInt32(&connections))
+	}
+}
+
+func TestStaleUpstreamStreamIsReconnected(t *testing.T) {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		fmt.Fprint(w, "event: put\ndata: {\"path\":\"/\",\"data\":{\"flags\":{},\"segments\":{}}}\n\n")
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+
+	stream := makeTestUpstreamStream(server.URL, ld.NewInMemoryFeatureStore(nullLogger), 100*time.Millisecond)
+	stream.Start(make(chan struct{}))
+	defer stream.Close()
+	// Staleness is checked once a second at most
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt32(&connections) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&connections))
+}
+
+func TestStalledUpstreamStreamDegradesEnvironment(t *testing.T) {
+	heartbeat := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "event: put\ndata: {\"path\":\"/\",\"data\":{\"flags\":{},\"segments\":{}}}\n\n")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-heartbeat:
+				fmt.Fprint(w, ":\n")
+				w.(http.Flusher).Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	stream := makeTestUpstreamStream(server.URL, ld.NewInMemoryFeatureStore(nullLogger), 100*time.Millisecond)
+	ready := make(chan struct{})
+	stream.Start(ready)
+	defer stream.Close()
+	if !waitForReady(t, ready) {
+		return
+	}
+	clientCtx := &clientContextImpl{client: FakeLDClient{true}, upstream: stream}
+	assert.Equal(t, "connected", clientCtx.connectionStatus())
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, "degraded", clientCtx.connectionStatus())
+
+	// A heartbeat shows that the stream is alive again
+	heartbeat <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for clientCtx.connectionStatus() != "connected" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "connected", clientCtx.connectionStatus())
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"time"
+
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+const (
+	defaultUsageReportIntervalSecs = 3600
+	usageReportTimeout             = 10 * time.Second
+	// The most distinct users counted for an environment in a month, so that a flood of one-off user keys
+	// can't use up memory. This comes to a few tens of megabytes per environment at most.
+	maxTrackedUsers  = 1000000
+	usageMonthFormat = "2006-01"
+)
+
+// Tracks monthly active users, requests and stream connections for each environment, if usage tracking is
+// enabled; nil otherwise
+var usageReporter *usageReport
+
+// usageReport posts every environment's usage to a URL at an interval, if a URL is configured
+type usageReport struct {
+	reportUrl string
+	interval  time.Duration
+	client    *http.Client
+}
+
+// monthUsage describes how an environment was used in a calendar month, in UTC. Users are counted by the
+// keys given to the evaluation endpoints and in analytics events, and are only held as a hash of their key.
+type monthUsage struct {
+	month    string
+	users    map[uint64]struct{}
+	capped   bool
+	requests map[string]int64
+	peak     int
+}
+
+// usageSummary is an environment's usage as shown on /status and sent to the report URL
+type usageSummary struct {
+	Month              string `json:"month"`
+	MonthlyActiveUsers int    `json:"monthlyActiveUsers"`
+	// True if more users were seen than could be counted
+	UsersCapped bool `json:"usersCapped,omitempty"`
+	// Authorized requests by the kind of credential they were made with: sdk, mobile or clientSide
+	Requests      map[string]int64 `json:"requests"`
+	ActiveStreams int              `json:"activeStreams"`
+	PeakStreams   int              `json:"peakStreams"`
+	// The previous month's usage, once a new month has begun
+	PreviousMonth *usageSummary `json:"previousMonth,omitempty"`
+}
+
+type usageReportBody struct {
+	RelayId      string                  `json:"relayId"`
+	RelayVersion string                  `json:"relayVersion"`
+	Time         time.Time               `json:"time"`
+	Environments map[string]usageSummary `json:"environments"`
+}
+
+func newUsageReport(reportUrl string, interval time.Duration) *usageReport {
+	return &usageReport{reportUrl: reportUrl, interval: interval, client: &http.Client{Timeout: usageReportTimeout}}
+}
+
+func newMonthUsage(month string) *monthUsage {
+	return &monthUsage{month: month, users: make(map[uint64]struct{}), requests: make(map[string]int64)}
+}
+
+// Returns the usage for the current month, starting a new month if need be. The caller must hold the lock.
+func (m *envMetrics) currentUsageLocked() *monthUsage {
+	month := time.Now().UTC().Format(usageMonthFormat)
+	if m.usage == nil {
+		m.usage = newMonthUsage(month)
+	} else if m.usage.month != month {
+		m.previousUsage = m.usage
+		m.usage = newMonthUsage(month)
+		// Streams that were open as the month began count towards its peak
+		m.usage.peak = m.activeStreams
+	}
+	return m.usage
+}
+
+// Counts a user towards the environment's monthly active users. Does nothing unless usage tracking is
+// enabled.
+func (m *envMetrics) userSeen(key string) {
+	if usageReporter == nil {
+		return
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	hash := h.Sum64()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := m.currentUsageLocked()
+	if _, seen := usage.users[hash]; seen {
+		return
+	}
+	if len(usage.users) >= maxTrackedUsers {
+		usage.capped = true
+		return
+	}
+	usage.users[hash] = struct{}{}
+}
+
+// Counts a request authorized with a credential of the given kind. Does nothing unless usage tracking is
+// enabled.
+func (m *envMetrics) requestAuthorized(credentialKind string) {
+	if usageReporter == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.currentUsageLocked().requests[credentialKind]++
+}
+
+// Notes the number of open streams, for the month's peak. The caller must hold the lock.
+func (m *envMetrics) streamsChangedLocked() {
+	if usageReporter == nil {
+		return
+	}
+	if usage := m.currentUsageLocked(); m.activeStreams > usage.peak {
+		usage.peak = m.activeStreams
+	}
+}
+
+func (m *envMetrics) usageSummary() usageSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	summary := m.currentUsageLocked().summary()
+	summary.ActiveStreams = m.activeStreams
+	if m.previousUsage != nil {
+		previous := m.previousUsage.summary()
+		summary.PreviousMonth = &previous
+	}
+	return summary
+}
+
+func (u *monthUsage) summary() usageSummary {
+	requests := make(map[string]int64, len(u.requests))
+	for kind, count := range u.requests {
+		requests[kind] = count
+	}
+	return usageSummary{
+		Month:              u.month,
+		MonthlyActiveUsers: len(u.users),
+		UsersCapped:        u.capped,
+		Requests:           requests,
+		PeakStreams:        u.peak,
+	}
+}
+
+// Counts the user of an evaluation request towards its environment's monthly active users, by the real key, as
+// users in events are counted before they are scrubbed
+func recordEvaluationUser(req *http.Request, user *ld.User) {
+	if usageReporter != nil && user != nil && user.Key != nil {
+		getClientContext(req).getMetrics().userSeen(*user.Key)
+	}
+}
+
+// Counts the users in analytics events towards the environment's monthly active users
+func recordEventUsers(metrics *envMetrics, evts []json.RawMessage) {
+	if usageReporter == nil || metrics == nil {
+		return
+	}
+	for _, evt := range evts {
+		var fields struct {
+			User *struct {
+				Key *string `json:"key"`
+			} `json:"user"`
+			UserKey *string `json:"userKey"`
+		}
+		if err := json.Unmarshal(evt, &fields); err != nil {
+			continue
+		}
+		if fields.User != nil && fields.User.Key != nil {
+			metrics.userSeen(*fields.User.Key)
+		} else if fields.UserKey != nil {
+			metrics.userSeen(*fields.UserKey)
+		}
+	}
+}
+
+// Posts the usage of every environment to the report URL at the configured interval
+func (u *usageReport) run(r *relay) {
+	t := time.NewTicker(u.interval)
+	defer t.Stop()
+	for range t.C {
+		if err := u.send(r); err != nil {
+			Warning.Printf("Unable to report usage: %s", err)
+		}
+	}
+}
+
+func (u *usageReport) send(r *relay) error {
+	body := usageReportBody{
+		RelayId:      relayId,
+		RelayVersion: Version,
+		Time:         time.Now().UTC(),
+		Environments: make(map[string]usageSummary),
+	}
+	for _, clientCtx := range r.allEnvironments() {
+		body.Environments[clientCtx.name] = clientCtx.getMetrics().usageSummary()
+	}
+	data, _ := json.Marshal(body)
+	resp, err := u.client.Post(u.reportUrl, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("report URL responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
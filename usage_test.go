@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageIsOnlyTrackedWhenEnabled(t *testing.T) {
+	var metrics envMetrics
+	metrics.userSeen("user1")
+	metrics.requestAuthorized("sdk")
+	assert.Nil(t, metrics.usage)
+}
+
+func TestUsageCountsDistinctUsersRequestsAndPeakStreams(t *testing.T) {
+	usageReporter = newUsageReport("", time.Hour)
+	defer func() { usageReporter = nil }()
+
+	var metrics envMetrics
+	metrics.userSeen("user1")
+	metrics.userSeen("user2")
+	metrics.userSeen("user1")
+	recordEventUsers(&metrics, []json.RawMessage{
+		json.RawMessage(`{"kind":"feature","user":{"key":"user3"}}`),
+		json.RawMessage(`{"kind":"custom","userKey":"user2"}`),
+		json.RawMessage(`not an event`),
+	})
+	metrics.requestAuthorized("sdk")
+	metrics.requestAuthorized("sdk")
+	metrics.requestAuthorized("mobile")
+	metrics.streamOpened("a")
+	metrics.streamOpened("b")
+	metrics.streamClosed("a")
+
+	summary := metrics.usageSummary()
+	assert.Equal(t, time.Now().UTC().Format(usageMonthFormat), summary.Month)
+	assert.Equal(t, 3, summary.MonthlyActiveUsers)
+	assert.Equal(t, map[string]int64{"sdk": 2, "mobile": 1}, summary.Requests)
+	assert.Equal(t, 1, summary.ActiveStreams)
+	assert.Equal(t, 2, summary.PeakStreams)
+	assert.Nil(t, summary.PreviousMonth)
+
+	// A new month starts counting again, and keeps the last month's usage
+	metrics.usage.month = "2000-01"
+	metrics.userSeen("user1")
+	summary = metrics.usageSummary()
+	assert.Equal(t, 1, summary.MonthlyActiveUsers)
+	assert.Equal(t, 1, summary.PeakStreams)
+	if assert.NotNil(t, summary.PreviousMonth) {
+		assert.Equal(t, "2000-01", summary.PreviousMonth.Month)
+		assert.Equal(t, 3, summary.PreviousMonth.MonthlyActiveUsers)
+	}
+}
+
+func TestUsageIsReported(t *testing.T) {
+	received := make(chan usageReportBody, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body usageReportBody
+		data, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(data, &body)
+		received <- body
+	}))
+	defer server.Close()
+	usageReporter = newUsageReport(server.URL, time.Hour)
+	defer func() { usageReporter = nil }()
+
+	relay := makeAdminTestRelay(false)
+	relay.findEnvironment("env1").metrics.userSeen("user1")
+	assert.NoError(t, usageReporter.send(relay))
+	body := <-received
+	assert.Equal(t, Version, body.RelayVersion)
+	assert.Equal(t, 1, body.Environments["env1"].MonthlyActiveUsers)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	es "github.com/launchdarkly/eventsource"
+)
+
+const (
+	// Stream heartbeats are SSE comments, which have no WebSocket equivalent, so WebSocket clients are sent
+	// pings instead
+	webSocketPingInterval = 30 * time.Second
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+var webSocketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// Client-side streams are meant to be reached from any origin, just as the SSE streams allow any origin
+	// with CORS, and server-side streams are authorized by key rather than by cookie
+	CheckOrigin: func(req *http.Request) bool { return true },
+}
+
+// webSocketMessage is the form of each message sent to a WebSocket client. The event is "put", "patch",
+// "delete" or "ping", as on the SSE stream, and the data is the same JSON that the SSE event carries.
+type webSocketMessage struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Serves a stream to a WebSocket client, for networks and proxies that buffer or cut off long-lived SSE
+// responses. The SSE handler writes its events into a pipe, and each event is passed on to the client as a
+// WebSocket text message, so both transports always carry the same events.
+func serveWebSocketStream(handler http.Handler, w http.ResponseWriter, req *http.Request) {
+	conn, err := webSocketUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader has already responded with an error
+		return
+	}
+	defer conn.Close()
+
+	pr, pw := io.Pipe()
+	sw := &webSocketStreamWriter{header: make(http.Header), out: pw, closed: make(chan bool)}
+
+	// Nothing is expected from the client, but reading is how a disconnection is noticed and how control
+	// frames get answered
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(sw.closed)
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forwardWebSocketEvents(conn, es.NewDecoder(pr))
+		// Stop the SSE handler if the client couldn't be written to
+		pr.Close()
+		conn.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(webSocketPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteTimeout))
+			}
+		}
+	}()
+
+	handler.ServeHTTP(sw, req)
+	pw.Close()
+	<-done
+}
+
+func forwardWebSocketEvents(conn *websocket.Conn, dec *es.Decoder) {
+	for {
+		event, err := dec.Decode()
+		if err != nil {
+			return
+		}
+		message := webSocketMessage{Event: event.Event()}
+		if data := strings.TrimSpace(event.Data()); data != "" && json.Valid([]byte(data)) {
+			message.Data = json.RawMessage(data)
+		}
+		encoded, _ := json.Marshal(message)
+		conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+		if err := conn.WriteMessage(websocket.TextMessage, encoded); err != nil {
+			return
+		}
+	}
+}
+
+// webSocketStreamWriter stands in for the response to the SSE handler, which writes its events to a pipe
+// and is told that the client has gone when the WebSocket connection closes
+type webSocketStreamWriter struct {
+	header http.Header
+	out    io.Writer
+	closed chan bool
+}
+
+func (w *webSocketStreamWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *webSocketStreamWriter) Write(data []byte) (int, error) {
+	return w.out.Write(data)
+}
+
+func (w *webSocketStreamWriter) WriteHeader(statusCode int) {}
+
+func (w *webSocketStreamWriter) Flush() {}
+
+func (w *webSocketStreamWriter) CloseNotify() <-chan bool {
+	return w.closed
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	ld "gopkg.in/launchdarkly/go-client.v4"
+)
+
+func TestWebSocketStreamCarriesFlagEvents(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	deadline := time.Now().Add(time.Second)
+	for !relay.sdkClientMux.allInitialized() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	server := httptest.NewServer(relay.getHandler())
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "sdk-98e2b0b4-2688-4a59-9810-1e0e3d7e42d0")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/flags", header)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var put webSocketMessage
+	if assert.NoError(t, conn.ReadJSON(&put)) {
+		assert.Equal(t, "put", put.Event)
+		assert.JSONEq(t, `{}`, string(put.Data))
+	}
+
+	relay.findEnvironment("env1").relayStore.Upsert(ld.Features, &ld.FeatureFlag{Key: "my-flag", Version: 1})
+	var patch webSocketMessage
+	if assert.NoError(t, conn.ReadJSON(&patch)) {
+		assert.Equal(t, "patch", patch.Event)
+		var data struct {
+			Path string `json:"path"`
+		}
+		assert.NoError(t, json.Unmarshal(patch.Data, &data))
+		assert.Equal(t, "/my-flag", data.Path)
+	}
+}
+
+func TestWebSocketStreamRequiresKey(t *testing.T) {
+	relay := makeAdminTestRelay(false)
+	server := httptest.NewServer(relay.getHandler())
+	defer server.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/flags", nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+}